@@ -3,9 +3,10 @@ module flint-vault
 go 1.24.3
 
 require (
+	github.com/klauspost/compress v1.18.0
 	github.com/urfave/cli/v3 v3.3.8
 	golang.org/x/crypto v0.31.0
 	golang.org/x/term v0.27.0
 )
 
-require golang.org/x/sys v0.28.0 // indirect
+require golang.org/x/sys v0.28.0
@@ -3,10 +3,16 @@
 //
 // Available commands:
 //   - create: Create new encrypted vault
+//   - keygen: Generate an X25519 identity for public-key recipients
 //   - add: Add files or directories to vault (with high-performance batch processing)
-//   - list: Show vault contents
+//   - list: Show vault contents and their logical vs. deduplicated size
 //   - extract: Extract files from vault (with parallel processing)
 //   - remove: Remove files or directories from vault
+//   - compact: Reclaim space held by removed and superseded entries
+//   - migrate: Rewrite a vault in a newer format version, verifying every file
+//   - recover: Finish or discard writes interrupted by a crash
+//   - passwd: Change vault password without rewriting file data
+//   - keyslot: Add, remove or list key slots (several passwords, keyfiles or recipients per vault)
 //   - info: Show vault file information without password
 //
 // All commands use optimized batch processing and provide comprehensive error handling.
@@ -14,9 +20,13 @@ package commands
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"flint-vault/pkg/lib/vault"
 
@@ -33,17 +43,29 @@ import (
 // Command structure:
 //   - Each command has its own set of flags for configuration
 //   - Password input is secured by default (hidden from terminal)
+//   - Vaults are locked while in use; --lock-timeout waits for other processes
+//   - Ctrl-C during add, extract and compact undoes the write in progress
 //   - All commands provide comprehensive help text
 //   - Error messages are user-friendly and descriptive
 func Run() {
 	app := &cli.Command{
 		Name:  "flint-vault",
 		Usage: "Military-grade encrypted file storage with AES-256",
+		Flags: []cli.Flag{
+			&cli.DurationFlag{
+				Name:  "lock-timeout",
+				Usage: "How long to wait for a vault locked by another process (e.g. 30s); fails at once by default",
+				Action: func(ctx context.Context, cmd *cli.Command, timeout time.Duration) error {
+					vault.LockTimeout = timeout
+					return nil
+				},
+			},
+		},
 		Commands: []*cli.Command{
 			{
 				Name:  "create",
 				Usage: "Create new encrypted vault",
-				Flags: []cli.Flag{
+				Flags: append([]cli.Flag{
 					&cli.StringFlag{
 						Name:     "file",
 						Aliases:  []string{"f"},
@@ -56,14 +78,43 @@ func Run() {
 						Usage:    "Encryption password (NOT RECOMMENDED, better to enter interactively)",
 						Required: false,
 					},
-				},
+					&cli.StringFlag{
+						Name:     "keyfile",
+						Aliases:  []string{"k"},
+						Usage:    "Keyfile that unlocks the vault (any file kept unchanged, e.g. on removable media)",
+						Required: false,
+					},
+					&cli.BoolFlag{
+						Name:  "with-password",
+						Usage: "Also prompt for a password to combine with the keyfile",
+					},
+					&cli.StringSliceFlag{
+						Name:    "recipient",
+						Aliases: []string{"r"},
+						Usage:   "Public key (flint1...) of a recipient whose identity opens the vault (repeatable)",
+					},
+				}, kdfFlags()...),
 				Action: func(ctx context.Context, cmd *cli.Command) error {
 					file := cmd.String("file")
-					password := cmd.String("password")
 
-					if password == "" {
-						var err error
-						password, err = vault.ReadPasswordSecurely("Enter password for new vault: ")
+					kdfParams, err := kdfParamsFromFlags(cmd)
+					if err != nil {
+						return err
+					}
+
+					var recipients []vault.Recipient
+					for _, encoded := range cmd.StringSlice("recipient") {
+						recipient, err := vault.ParseRecipient(encoded)
+						if err != nil {
+							return err
+						}
+						recipients = append(recipients, recipient)
+					}
+
+					// A vault for recipients only needs no password
+					var keySource vault.KeySource
+					if len(recipients) == 0 || cmd.IsSet("password") || cmd.IsSet("keyfile") || cmd.Bool("with-password") {
+						keySource, err = keySourceFromFlags(cmd, "Enter password for new vault: ")
 						if err != nil {
 							return err
 						}
@@ -71,18 +122,65 @@ func Run() {
 
 					fmt.Printf("Creating encrypted vault: %s\n", file)
 
-					if err := vault.CreateVault(file, password); err != nil {
+					if err := vault.CreateVaultWithRecipients(file, keySource, kdfParams, recipients); err != nil {
 						return fmt.Errorf("vault creation error: %w", err)
 					}
 
 					fmt.Println("✅ Vault successfully created!")
 					fmt.Println("🔐 Using AES-256-GCM encryption")
-					fmt.Println("🧂 Applied cryptographically secure salt")
-					fmt.Println("🔑 Key derived using PBKDF2 (100,000 iterations)")
+					if keySource != nil {
+						fmt.Println("🧂 Applied cryptographically secure salt")
+						fmt.Printf("🔑 Key derived from %s using %s\n", keySource.Description(), describeKDF(kdfParams))
+					}
+					for _, recipient := range recipients {
+						fmt.Printf("👤 Recipient: %s\n", recipient)
+					}
 
 					return nil
 				},
 			},
+			{
+				Name:  "keygen",
+				Usage: "Generate an X25519 identity for use with 'create --recipient' and '--identity'",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "output",
+						Aliases:  []string{"o"},
+						Usage:    "Write the identity to this file instead of standard output",
+						Required: false,
+					},
+				},
+				Action: func(ctx context.Context, cmd *cli.Command) error {
+					output := cmd.String("output")
+
+					identity, err := vault.GenerateIdentity()
+					if err != nil {
+						return err
+					}
+					content := formatIdentityFile(identity, time.Now())
+
+					if output == "" {
+						fmt.Print(content)
+						return nil
+					}
+
+					file, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+					if err != nil {
+						return fmt.Errorf("identity file creation error: %w", err)
+					}
+					if _, err := file.WriteString(content); err != nil {
+						file.Close()
+						return fmt.Errorf("identity file write error: %w", err)
+					}
+					if err := file.Close(); err != nil {
+						return fmt.Errorf("identity file write error: %w", err)
+					}
+
+					fmt.Printf("✅ Identity written to %s (keep it secret)\n", output)
+					fmt.Printf("👤 Public key: %s\n", identity.Recipient())
+					return nil
+				},
+			},
 			{
 				Name:  "add",
 				Usage: "Add files or directories to vault with high-performance batch processing",
@@ -99,12 +197,50 @@ func Run() {
 						Usage:    "Vault password (NOT RECOMMENDED, better to enter interactively)",
 						Required: false,
 					},
+					&cli.StringFlag{
+						Name:     "keyfile",
+						Aliases:  []string{"k"},
+						Usage:    "Keyfile that unlocks the vault (any file kept unchanged, e.g. on removable media)",
+						Required: false,
+					},
+					&cli.BoolFlag{
+						Name:  "with-password",
+						Usage: "Also prompt for a password to combine with the keyfile",
+					},
+					&cli.StringFlag{
+						Name:     "identity",
+						Aliases:  []string{"i"},
+						Usage:    "Identity file (private key from 'keygen') that unlocks the vault",
+						Required: false,
+					},
 					&cli.StringFlag{
 						Name:     "source",
 						Aliases:  []string{"s"},
 						Usage:    "Path to file or directory to add",
 						Required: true,
 					},
+					&cli.BoolFlag{
+						Name:  "append-only",
+						Usage: "Add without a password using the vault's public key (e.g. from CI); only key holders can extract",
+					},
+					&cli.BoolFlag{
+						Name:  "follow-symlinks",
+						Usage: "Store the files and directories symlinks point to",
+					},
+					&cli.BoolFlag{
+						Name:  "preserve-symlinks",
+						Usage: "Store symlinks as links with their target (default)",
+					},
+					&cli.StringFlag{
+						Name:    "compression",
+						Aliases: []string{"c"},
+						Usage:   "Compression: gzip[:1-9], zstd[:1-22], none, or auto[:level] to store incompressible files raw",
+						Value:   "gzip",
+					},
+					&cli.BoolFlag{
+						Name:  "snapshot-check",
+						Usage: "Compare each file's size and modification time before and after reading it, and fail files that keep changing",
+					},
 					&cli.IntFlag{
 						Name:    "workers",
 						Aliases: []string{"w"},
@@ -119,30 +255,61 @@ func Run() {
 				},
 				Action: func(ctx context.Context, cmd *cli.Command) error {
 					vaultPath := cmd.String("vault")
-					password := cmd.String("password")
 					sourcePath := cmd.String("source")
 					workers := cmd.Int("workers")
 					showProgress := cmd.Bool("progress")
 
-					if password == "" {
-						var err error
-						password, err = vault.ReadPasswordSecurely("Enter vault password: ")
-						if err != nil {
-							return err
-						}
-					}
-
 					// Check that source exists
 					info, err := os.Stat(sourcePath)
 					if err != nil {
 						return fmt.Errorf("source not found: %s", sourcePath)
 					}
 
+					if cmd.Bool("follow-symlinks") && cmd.Bool("preserve-symlinks") {
+						return fmt.Errorf("--follow-symlinks and --preserve-symlinks cannot be combined")
+					}
+					addOptions := vault.AddOptions{Symlinks: vault.SymlinkPreserve}
+					if cmd.Bool("follow-symlinks") {
+						addOptions.Symlinks = vault.SymlinkFollow
+					}
+					addOptions.Compression, err = vault.ParseCompression(cmd.String("compression"))
+					if err != nil {
+						return err
+					}
+					addOptions.SnapshotCheck = cmd.Bool("snapshot-check")
+
+					if cmd.Bool("append-only") {
+						ctx, stop := interruptible(ctx)
+						defer stop()
+						addOptions.Context = ctx
+
+						fmt.Printf("Appending '%s' to vault without a password...\n", sourcePath)
+						if err := vault.AppendToVaultWithOptions(vaultPath, sourcePath, addOptions); err != nil {
+							return fmt.Errorf("append error: %w", err)
+						}
+						fmt.Printf("✅ Successfully appended to vault! Contents become visible when the vault is opened with a key\n")
+						return nil
+					}
+
+					keySource, err := keySourceFromFlags(cmd, "Enter vault password: ")
+					if err != nil {
+						return err
+					}
+
+					// Interrupting undoes the write in progress instead of killing it
+					ctx, stop := interruptible(ctx)
+					defer stop()
+					addOptions.Context = ctx
+
 					// Configure parallel processing
 					config := vault.DefaultParallelConfig()
 					if workers > 0 {
 						config.MaxConcurrency = workers
 					}
+					config.Context = ctx
+					config.Symlinks = addOptions.Symlinks
+					config.Compression = addOptions.Compression
+					config.SnapshotCheck = addOptions.SnapshotCheck
 
 					var progressChan chan string
 					if showProgress {
@@ -162,7 +329,7 @@ func Run() {
 						var stats *vault.ParallelStats
 						var err error
 
-						stats, err = vault.AddDirectoryToVaultParallel(vaultPath, password, sourcePath, config)
+						stats, err = vault.AddDirectoryToVaultParallel(vaultPath, keySource, sourcePath, config)
 
 						if showProgress {
 							close(progressChan)
@@ -175,7 +342,7 @@ func Run() {
 						vault.PrintParallelStats(stats)
 					} else {
 						fmt.Printf("Adding file '%s' to vault...\n", sourcePath)
-						if err := vault.AddFileToVault(vaultPath, password, sourcePath); err != nil {
+						if err := vault.AddFileToVaultWithOptions(vaultPath, keySource, sourcePath, addOptions); err != nil {
 							return fmt.Errorf("file add error: %w", err)
 						}
 						fmt.Printf("✅ File successfully added to vault!\n")
@@ -200,20 +367,51 @@ func Run() {
 						Usage:    "Vault password (NOT RECOMMENDED, better to enter interactively)",
 						Required: false,
 					},
+					&cli.StringFlag{
+						Name:     "keyfile",
+						Aliases:  []string{"k"},
+						Usage:    "Keyfile that unlocks the vault (any file kept unchanged, e.g. on removable media)",
+						Required: false,
+					},
+					&cli.BoolFlag{
+						Name:  "with-password",
+						Usage: "Also prompt for a password to combine with the keyfile",
+					},
+					&cli.StringFlag{
+						Name:     "identity",
+						Aliases:  []string{"i"},
+						Usage:    "Identity file (private key from 'keygen') that unlocks the vault",
+						Required: false,
+					},
+					&cli.StringFlag{
+						Name:  "prefix",
+						Usage: "Only list paths starting with this prefix (v5 vaults read only the directory pages holding them)",
+					},
 				},
 				Action: func(ctx context.Context, cmd *cli.Command) error {
 					vaultPath := cmd.String("vault")
-					password := cmd.String("password")
 
-					if password == "" {
-						var err error
-						password, err = vault.ReadPasswordSecurely("Enter vault password: ")
-						if err != nil {
-							return err
-						}
+					keySource, err := keySourceFromFlags(cmd, "Enter vault password: ")
+					if err != nil {
+						return err
 					}
 
-					entries, err := vault.ListVault(vaultPath, password)
+					v, err := vault.OpenVault(vaultPath, keySource)
+					if err != nil {
+						return fmt.Errorf("vault read error: %w", err)
+					}
+					defer v.Close()
+
+					var entries []vault.FileEntry
+					if cmd.IsSet("prefix") {
+						entries, err = v.ListPrefix(cmd.String("prefix"))
+					} else {
+						entries, err = v.List()
+					}
+					if err != nil {
+						return fmt.Errorf("vault read error: %w", err)
+					}
+					conflicts, err := v.InboxConflicts()
 					if err != nil {
 						return fmt.Errorf("vault read error: %w", err)
 					}
@@ -232,14 +430,30 @@ func Run() {
 							icon = "📁"
 						}
 
+						name := entry.Path
+						if entry.IsSymlink {
+							icon = "🔗"
+							name += " -> " + entry.LinkTarget
+						}
+
 						size := formatSize(entry.Size)
 						fmt.Printf("  %s %s  %s  %s\n",
 							icon,
-							entry.Path,
+							name,
 							size,
 							entry.ModTime.Format("2006-01-02 15:04"))
 					}
 
+					if len(conflicts) > 0 {
+						fmt.Printf("\n⚠️  %d files appended without a key would have replaced stored files and were renamed:\n", len(conflicts))
+						for _, conflict := range conflicts {
+							fmt.Printf("  %s -> %s\n", conflict.Path, conflict.StoredAs)
+						}
+					}
+
+					fmt.Println()
+					printStorageUsage(vault.ComputeStorageUsage(entries))
+
 					return nil
 				},
 			},
@@ -259,6 +473,22 @@ func Run() {
 						Usage:    "Vault password (NOT RECOMMENDED, better to enter interactively)",
 						Required: false,
 					},
+					&cli.StringFlag{
+						Name:     "keyfile",
+						Aliases:  []string{"k"},
+						Usage:    "Keyfile that unlocks the vault (any file kept unchanged, e.g. on removable media)",
+						Required: false,
+					},
+					&cli.BoolFlag{
+						Name:  "with-password",
+						Usage: "Also prompt for a password to combine with the keyfile",
+					},
+					&cli.StringFlag{
+						Name:     "identity",
+						Aliases:  []string{"i"},
+						Usage:    "Identity file (private key from 'keygen') that unlocks the vault",
+						Required: false,
+					},
 					&cli.StringFlag{
 						Name:     "output",
 						Aliases:  []string{"o"},
@@ -270,6 +500,10 @@ func Run() {
 						Aliases: []string{"f"},
 						Usage:   "Specific files to extract (if not specified, extracts all)",
 					},
+					&cli.BoolFlag{
+						Name:  "allow-unsafe-paths",
+						Usage: "Extract entries with absolute or '..' paths as stored (DANGEROUS, trusted vaults only)",
+					},
 					&cli.IntFlag{
 						Name:    "workers",
 						Aliases: []string{"w"},
@@ -284,25 +518,32 @@ func Run() {
 				},
 				Action: func(ctx context.Context, cmd *cli.Command) error {
 					vaultPath := cmd.String("vault")
-					password := cmd.String("password")
 					outputDir := cmd.String("output")
 					specificFiles := cmd.StringSlice("files")
 					workers := cmd.Int("workers")
 					showProgress := cmd.Bool("progress")
+					allowUnsafePaths := cmd.Bool("allow-unsafe-paths")
 
-					if password == "" {
-						var err error
-						password, err = vault.ReadPasswordSecurely("Enter vault password: ")
-						if err != nil {
-							return err
-						}
+					keySource, err := keySourceFromFlags(cmd, "Enter vault password: ")
+					if err != nil {
+						return err
 					}
 
+					if allowUnsafePaths {
+						fmt.Println("⚠️  Unsafe paths allowed: entries may be written outside the output directory")
+					}
+
+					// Interrupting removes the file being written instead of leaving it partial
+					ctx, stop := interruptible(ctx)
+					defer stop()
+
 					// Configure parallel processing
 					config := vault.DefaultParallelConfig()
 					if workers > 0 {
 						config.MaxConcurrency = workers
 					}
+					config.Context = ctx
+					config.AllowUnsafePaths = allowUnsafePaths
 
 					var progressChan chan string
 					if showProgress {
@@ -319,7 +560,7 @@ func Run() {
 					if len(specificFiles) > 0 {
 						// Extract specific files in parallel
 						fmt.Printf("Extracting %d specific files (workers: %d)...\n", len(specificFiles), config.MaxConcurrency)
-						stats, err := vault.ExtractMultipleFilesFromVaultParallel(vaultPath, password, outputDir, specificFiles, config)
+						stats, err := vault.ExtractMultipleFilesFromVaultParallel(vaultPath, keySource, outputDir, specificFiles, config)
 
 						if showProgress {
 							close(progressChan)
@@ -333,7 +574,8 @@ func Run() {
 					} else {
 						// Extract all files using optimized streaming
 						fmt.Printf("Extracting all files to: %s\n", outputDir)
-						if err := vault.ExtractFromVault(vaultPath, password, outputDir); err != nil {
+						opts := vault.ExtractOptions{AllowUnsafePaths: allowUnsafePaths, Context: ctx}
+						if err := vault.ExtractFromVaultWithOptions(vaultPath, keySource, outputDir, opts); err != nil {
 							return fmt.Errorf("extraction error: %w", err)
 						}
 						fmt.Printf("✅ All files successfully extracted!\n")
@@ -358,6 +600,22 @@ func Run() {
 						Usage:    "Vault password (NOT RECOMMENDED, better to enter interactively)",
 						Required: false,
 					},
+					&cli.StringFlag{
+						Name:     "keyfile",
+						Aliases:  []string{"k"},
+						Usage:    "Keyfile that unlocks the vault (any file kept unchanged, e.g. on removable media)",
+						Required: false,
+					},
+					&cli.BoolFlag{
+						Name:  "with-password",
+						Usage: "Also prompt for a password to combine with the keyfile",
+					},
+					&cli.StringFlag{
+						Name:     "identity",
+						Aliases:  []string{"i"},
+						Usage:    "Identity file (private key from 'keygen') that unlocks the vault",
+						Required: false,
+					},
 					&cli.StringFlag{
 						Name:     "target",
 						Aliases:  []string{"t"},
@@ -367,20 +625,16 @@ func Run() {
 				},
 				Action: func(ctx context.Context, cmd *cli.Command) error {
 					vaultPath := cmd.String("vault")
-					password := cmd.String("password")
 					targetPath := cmd.String("target")
 
-					if password == "" {
-						var err error
-						password, err = vault.ReadPasswordSecurely("Enter vault password: ")
-						if err != nil {
-							return err
-						}
+					keySource, err := keySourceFromFlags(cmd, "Enter vault password: ")
+					if err != nil {
+						return err
 					}
 
 					fmt.Printf("Removing '%s' from vault...\n", targetPath)
 
-					if err := vault.RemoveFromVault(vaultPath, password, []string{targetPath}); err != nil {
+					if err := vault.RemoveFromVault(vaultPath, keySource, []string{targetPath}); err != nil {
 						return fmt.Errorf("removal error: %w", err)
 					}
 
@@ -388,6 +642,531 @@ func Run() {
 					return nil
 				},
 			},
+			{
+				Name:  "compact",
+				Usage: "Rewrite the vault with only live data, reclaiming space from removed and replaced files",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "vault",
+						Aliases:  []string{"v"},
+						Usage:    "Path to vault file",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:     "password",
+						Aliases:  []string{"p"},
+						Usage:    "Vault password (NOT RECOMMENDED, better to enter interactively)",
+						Required: false,
+					},
+					&cli.StringFlag{
+						Name:     "keyfile",
+						Aliases:  []string{"k"},
+						Usage:    "Keyfile that unlocks the vault (any file kept unchanged, e.g. on removable media)",
+						Required: false,
+					},
+					&cli.BoolFlag{
+						Name:  "with-password",
+						Usage: "Also prompt for a password to combine with the keyfile",
+					},
+					&cli.StringFlag{
+						Name:     "identity",
+						Aliases:  []string{"i"},
+						Usage:    "Identity file (private key from 'keygen') that unlocks the vault",
+						Required: false,
+					},
+					&cli.BoolFlag{
+						Name:  "dry-run",
+						Usage: "Only show how much space would be reclaimed",
+					},
+					&cli.BoolFlag{
+						Name:  "upgrade",
+						Usage: "Also rewrite a v3 or v4 vault in the current format version",
+					},
+				},
+				Action: func(ctx context.Context, cmd *cli.Command) error {
+					vaultPath := cmd.String("vault")
+					dryRun := cmd.Bool("dry-run")
+					upgrade := cmd.Bool("upgrade")
+
+					keySource, err := keySourceFromFlags(cmd, "Enter vault password: ")
+					if err != nil {
+						return err
+					}
+
+					if !dryRun {
+						fmt.Printf("Compacting vault '%s'...\n", vaultPath)
+					}
+
+					// Interrupting discards the rewrite and keeps the vault as it was
+					ctx, stop := interruptible(ctx)
+					defer stop()
+
+					stats, err := vault.CompactVault(vaultPath, keySource, vault.CompactOptions{DryRun: dryRun, Upgrade: upgrade, Context: ctx})
+					if err != nil {
+						return fmt.Errorf("compaction error: %w", err)
+					}
+
+					fmt.Printf("📦 Vault: %s\n", vaultPath)
+					fmt.Printf("📏 Size: %s\n", formatSize(stats.OriginalSize))
+					fmt.Printf("📄 Live data: %s in %d entries\n", formatSize(stats.LiveDataSize), stats.LiveEntries)
+
+					if dryRun {
+						fmt.Printf("♻️  Reclaimable: %s (compacted size %s)\n", formatSize(stats.ReclaimedBytes()), formatSize(stats.CompactedSize))
+						return nil
+					}
+
+					fmt.Printf("✅ Vault compacted! Reclaimed %s (now %s)\n", formatSize(stats.ReclaimedBytes()), formatSize(stats.CompactedSize))
+					return nil
+				},
+			},
+			{
+				Name:  "migrate",
+				Usage: "Rewrite the vault in a newer format version, verifying every file on the way",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "vault",
+						Aliases:  []string{"v"},
+						Usage:    "Path to vault file",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:     "password",
+						Aliases:  []string{"p"},
+						Usage:    "Vault password (NOT RECOMMENDED, better to enter interactively)",
+						Required: false,
+					},
+					&cli.StringFlag{
+						Name:     "keyfile",
+						Aliases:  []string{"k"},
+						Usage:    "Keyfile that unlocks the vault (any file kept unchanged, e.g. on removable media)",
+						Required: false,
+					},
+					&cli.BoolFlag{
+						Name:  "with-password",
+						Usage: "Also prompt for a password to combine with the keyfile",
+					},
+					&cli.StringFlag{
+						Name:     "identity",
+						Aliases:  []string{"i"},
+						Usage:    "Identity file (private key from 'keygen') that unlocks the vault",
+						Required: false,
+					},
+					&cli.IntFlag{
+						Name:  "to",
+						Usage: "Target format version (default: the current version)",
+					},
+					&cli.BoolFlag{
+						Name:  "check",
+						Usage: "Only report what the migration would change",
+					},
+				},
+				Action: func(ctx context.Context, cmd *cli.Command) error {
+					vaultPath := cmd.String("vault")
+					check := cmd.Bool("check")
+					target := cmd.Int("to")
+					if target < 0 {
+						return fmt.Errorf("invalid target version: %d", target)
+					}
+
+					keySource, err := keySourceFromFlags(cmd, "Enter vault password: ")
+					if err != nil {
+						return err
+					}
+
+					if !check {
+						fmt.Printf("Migrating vault '%s'...\n", vaultPath)
+					}
+
+					// Interrupting discards the rewrite and keeps the vault as it was
+					ctx, stop := interruptible(ctx)
+					defer stop()
+
+					report, err := vault.MigrateVault(vaultPath, keySource, uint32(target), vault.MigrateOptions{Check: check, Context: ctx})
+					if err != nil {
+						return fmt.Errorf("migration error: %w", err)
+					}
+
+					fmt.Printf("📦 Vault: %s\n", vaultPath)
+					fmt.Printf("🔢 Format Version: %d -> %d\n", report.FromVersion, report.ToVersion)
+					fmt.Printf("📄 Entries: %d (%d files to verify)\n", report.Entries, report.Files)
+
+					if len(report.Changes) == 0 {
+						fmt.Printf("✅ Vault is already in format version %d\n", report.ToVersion)
+						return nil
+					}
+					fmt.Println("🔄 Changes:")
+					for _, change := range report.Changes {
+						fmt.Printf("  - %s\n", change)
+					}
+
+					if check {
+						return nil
+					}
+
+					fmt.Printf("✅ Vault migrated! All %d files verified (%s, was %s)\n", report.Files, formatSize(report.MigratedSize), formatSize(report.OriginalSize))
+					return nil
+				},
+			},
+			{
+				Name:  "recover",
+				Usage: "Repair a vault after a crash: finish or discard interrupted writes",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "vault",
+						Aliases:  []string{"v"},
+						Usage:    "Path to vault file",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:     "password",
+						Aliases:  []string{"p"},
+						Usage:    "Vault password (NOT RECOMMENDED, better to enter interactively)",
+						Required: false,
+					},
+					&cli.StringFlag{
+						Name:     "keyfile",
+						Aliases:  []string{"k"},
+						Usage:    "Keyfile that unlocks the vault (any file kept unchanged, e.g. on removable media)",
+						Required: false,
+					},
+					&cli.BoolFlag{
+						Name:  "with-password",
+						Usage: "Also prompt for a password to combine with the keyfile",
+					},
+					&cli.StringFlag{
+						Name:     "identity",
+						Aliases:  []string{"i"},
+						Usage:    "Identity file (private key from 'keygen') that unlocks the vault",
+						Required: false,
+					},
+					&cli.BoolFlag{
+						Name:  "dry-run",
+						Usage: "Only show what would be repaired",
+					},
+				},
+				Action: func(ctx context.Context, cmd *cli.Command) error {
+					vaultPath := cmd.String("vault")
+					dryRun := cmd.Bool("dry-run")
+
+					keySource, err := keySourceFromFlags(cmd, "Enter vault password: ")
+					if err != nil {
+						return err
+					}
+
+					report, err := vault.RecoverVault(vaultPath, keySource, vault.RecoverOptions{DryRun: dryRun})
+					if err != nil {
+						return fmt.Errorf("recovery error: %w", err)
+					}
+
+					fmt.Printf("📦 Vault: %s\n", vaultPath)
+					if report.Clean() {
+						fmt.Printf("✅ No interrupted writes found\n")
+						return nil
+					}
+
+					completed, removed, restored := "Completed", "Removed", "Restored"
+					if dryRun {
+						completed, removed, restored = "Would complete", "Would remove", "Would restore"
+					}
+					if report.RestoredHeader {
+						fmt.Printf("🔑 %s header torn by an interrupted password or key slot change\n", restored)
+					}
+					if report.CompletedTempFile != "" {
+						fmt.Printf("🔁 %s interrupted rewrite: %s\n", completed, report.CompletedTempFile)
+					}
+					for _, tempPath := range report.DiscardedTempFiles {
+						fmt.Printf("🗑️  %s partial rewrite: %s\n", removed, tempPath)
+					}
+					if report.TruncatedBytes > 0 {
+						fmt.Printf("✂️  %s %s of partially appended data\n", removed, formatSize(report.TruncatedBytes))
+					}
+
+					if !dryRun {
+						fmt.Printf("✅ Vault recovered!\n")
+					}
+					return nil
+				},
+			},
+			{
+				Name:  "passwd",
+				Usage: "Change vault password (rewrites only the header, not file data)",
+				Flags: append([]cli.Flag{
+					&cli.StringFlag{
+						Name:     "vault",
+						Aliases:  []string{"v"},
+						Usage:    "Path to vault file",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:     "password",
+						Aliases:  []string{"p"},
+						Usage:    "Current vault password (NOT RECOMMENDED, better to enter interactively)",
+						Required: false,
+					},
+					&cli.StringFlag{
+						Name:     "keyfile",
+						Aliases:  []string{"k"},
+						Usage:    "Keyfile that unlocks the vault (any file kept unchanged, e.g. on removable media)",
+						Required: false,
+					},
+					&cli.BoolFlag{
+						Name:  "with-password",
+						Usage: "Also prompt for a password to combine with the keyfile",
+					},
+					&cli.StringFlag{
+						Name:     "identity",
+						Aliases:  []string{"i"},
+						Usage:    "Identity file (private key from 'keygen') that unlocks the vault",
+						Required: false,
+					},
+					&cli.StringFlag{
+						Name:     "new-password",
+						Aliases:  []string{"n"},
+						Usage:    "New vault password (NOT RECOMMENDED, better to enter interactively)",
+						Required: false,
+					},
+					&cli.StringFlag{
+						Name:     "new-keyfile",
+						Aliases:  []string{"K"},
+						Usage:    "New keyfile (replaces the password, or combined with it when --new-with-password is set)",
+						Required: false,
+					},
+					&cli.BoolFlag{
+						Name:  "new-with-password",
+						Usage: "Also prompt for a new password to combine with the new keyfile",
+					},
+				}, kdfFlags()...),
+				Action: func(ctx context.Context, cmd *cli.Command) error {
+					vaultPath := cmd.String("vault")
+
+					// Keep the current KDF parameters unless any KDF flag is given
+					var kdfParams *vault.KDFParams
+					for _, name := range []string{"kdf", "kdf-iterations", "kdf-memory", "kdf-time", "kdf-parallelism"} {
+						if cmd.IsSet(name) {
+							params, err := kdfParamsFromFlags(cmd)
+							if err != nil {
+								return err
+							}
+							kdfParams = &params
+							break
+						}
+					}
+
+					oldKey, err := keySourceFromFlags(cmd, "Enter current vault password: ")
+					if err != nil {
+						return err
+					}
+
+					newKey, err := readKeySource(cmd.String("new-password"), cmd.String("new-keyfile"),
+						cmd.Bool("new-with-password"), "Enter new vault password: ", true)
+					if err != nil {
+						return err
+					}
+
+					fmt.Printf("Changing password of vault: %s\n", vaultPath)
+
+					if err := vault.ChangeVaultPasswordWithKDF(vaultPath, oldKey, newKey, kdfParams); err != nil {
+						return fmt.Errorf("password change error: %w", err)
+					}
+
+					fmt.Printf("✅ Vault password successfully changed! Now unlocked by %s\n", newKey.Description())
+					if kdfParams != nil {
+						fmt.Printf("🔑 Key derived using %s\n", describeKDF(*kdfParams))
+					}
+
+					return nil
+				},
+			},
+			{
+				Name:  "keyslot",
+				Usage: "Manage key slots (several passwords, keyfiles or recipients opening the same vault)",
+				Commands: []*cli.Command{
+					{
+						Name:  "add",
+						Usage: "Add a key slot for another password, keyfile or recipient",
+						Flags: append([]cli.Flag{
+							&cli.StringFlag{
+								Name:     "vault",
+								Aliases:  []string{"v"},
+								Usage:    "Path to vault file",
+								Required: true,
+							},
+							&cli.StringFlag{
+								Name:     "password",
+								Aliases:  []string{"p"},
+								Usage:    "Vault password (NOT RECOMMENDED, better to enter interactively)",
+								Required: false,
+							},
+							&cli.StringFlag{
+								Name:     "keyfile",
+								Aliases:  []string{"k"},
+								Usage:    "Keyfile that unlocks the vault (any file kept unchanged, e.g. on removable media)",
+								Required: false,
+							},
+							&cli.BoolFlag{
+								Name:  "with-password",
+								Usage: "Also prompt for a password to combine with the keyfile",
+							},
+							&cli.StringFlag{
+								Name:     "identity",
+								Aliases:  []string{"i"},
+								Usage:    "Identity file (private key from 'keygen') that unlocks the vault",
+								Required: false,
+							},
+							&cli.StringFlag{
+								Name:     "new-password",
+								Aliases:  []string{"n"},
+								Usage:    "Password for the new slot (NOT RECOMMENDED, better to enter interactively)",
+								Required: false,
+							},
+							&cli.StringFlag{
+								Name:     "new-keyfile",
+								Aliases:  []string{"K"},
+								Usage:    "Keyfile for the new slot (combined with a password when --new-with-password is set)",
+								Required: false,
+							},
+							&cli.BoolFlag{
+								Name:  "new-with-password",
+								Usage: "Also prompt for a password to combine with the new keyfile",
+							},
+							&cli.StringFlag{
+								Name:     "recipient",
+								Aliases:  []string{"r"},
+								Usage:    "Public key (flint1...) for the new slot instead of a password or keyfile",
+								Required: false,
+							},
+						}, kdfFlags()...),
+						Action: func(ctx context.Context, cmd *cli.Command) error {
+							vaultPath := cmd.String("vault")
+
+							kdfParams, err := kdfParamsFromFlags(cmd)
+							if err != nil {
+								return err
+							}
+
+							keySource, err := keySourceFromFlags(cmd, "Enter existing vault password: ")
+							if err != nil {
+								return err
+							}
+
+							if cmd.IsSet("recipient") {
+								recipient, err := vault.ParseRecipient(cmd.String("recipient"))
+								if err != nil {
+									return err
+								}
+
+								slot, err := vault.AddRecipientSlot(vaultPath, keySource, recipient)
+								if err != nil {
+									return fmt.Errorf("key slot add error: %w", err)
+								}
+
+								fmt.Printf("✅ Key slot %d added (recipient %s)\n", slot, recipient)
+								return nil
+							}
+
+							newKey, err := readKeySource(cmd.String("new-password"), cmd.String("new-keyfile"),
+								cmd.Bool("new-with-password"), "Enter password for the new key slot: ", true)
+							if err != nil {
+								return err
+							}
+
+							slot, err := vault.AddKeySlot(vaultPath, keySource, newKey, kdfParams)
+							if err != nil {
+								return fmt.Errorf("key slot add error: %w", err)
+							}
+
+							fmt.Printf("✅ Key slot %d added (%s, %s)\n", slot, newKey.Description(), describeKDF(kdfParams))
+							return nil
+						},
+					},
+					{
+						Name:  "remove",
+						Usage: "Remove a key slot",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:     "vault",
+								Aliases:  []string{"v"},
+								Usage:    "Path to vault file",
+								Required: true,
+							},
+							&cli.StringFlag{
+								Name:     "password",
+								Aliases:  []string{"p"},
+								Usage:    "Vault password (NOT RECOMMENDED, better to enter interactively)",
+								Required: false,
+							},
+							&cli.StringFlag{
+								Name:     "keyfile",
+								Aliases:  []string{"k"},
+								Usage:    "Keyfile that unlocks the vault (any file kept unchanged, e.g. on removable media)",
+								Required: false,
+							},
+							&cli.BoolFlag{
+								Name:  "with-password",
+								Usage: "Also prompt for a password to combine with the keyfile",
+							},
+							&cli.StringFlag{
+								Name:     "identity",
+								Aliases:  []string{"i"},
+								Usage:    "Identity file (private key from 'keygen') that unlocks the vault",
+								Required: false,
+							},
+							&cli.IntFlag{
+								Name:     "slot",
+								Aliases:  []string{"s"},
+								Usage:    "Index of the key slot to remove (see 'keyslot list')",
+								Required: true,
+							},
+						},
+						Action: func(ctx context.Context, cmd *cli.Command) error {
+							vaultPath := cmd.String("vault")
+							slot := cmd.Int("slot")
+
+							keySource, err := keySourceFromFlags(cmd, "Enter vault password: ")
+							if err != nil {
+								return err
+							}
+
+							if err := vault.RemoveKeySlot(vaultPath, keySource, slot); err != nil {
+								return fmt.Errorf("key slot removal error: %w", err)
+							}
+
+							fmt.Printf("✅ Key slot %d removed\n", slot)
+							return nil
+						},
+					},
+					{
+						Name:  "list",
+						Usage: "List key slots (no password required)",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:     "vault",
+								Aliases:  []string{"v"},
+								Usage:    "Path to vault file",
+								Required: true,
+							},
+						},
+						Action: func(ctx context.Context, cmd *cli.Command) error {
+							vaultPath := cmd.String("vault")
+
+							slots, err := vault.ListKeySlots(vaultPath)
+							if err != nil {
+								return fmt.Errorf("key slot list error: %w", err)
+							}
+
+							fmt.Printf("🔑 Key slots of %s (%d of %d in use):\n\n", vaultPath, len(slots), vault.MaxKeySlots)
+							for _, slot := range slots {
+								if slot.Kind == vault.KeySlotRecipient {
+									fmt.Printf("  [%d] %-22s %s\n", slot.Index, slot.KindName(), slot.Recipient)
+									continue
+								}
+								fmt.Printf("  [%d] %-22s %s\n", slot.Index, slot.KindName(), describeKDF(slot.KDF))
+							}
+							return nil
+						},
+					},
+				},
+			},
 			{
 				Name:  "info",
 				Usage: "Show vault file information without requiring password",
@@ -398,6 +1177,32 @@ func Run() {
 						Usage:    "Path to file to check",
 						Required: true,
 					},
+					&cli.BoolFlag{
+						Name:  "usage",
+						Usage: "Also show the logical and deduplicated size of the contents (requires the vault key)",
+					},
+					&cli.StringFlag{
+						Name:     "password",
+						Aliases:  []string{"p"},
+						Usage:    "Vault password for --usage (NOT RECOMMENDED, better to enter interactively)",
+						Required: false,
+					},
+					&cli.StringFlag{
+						Name:     "keyfile",
+						Aliases:  []string{"k"},
+						Usage:    "Keyfile that unlocks the vault for --usage",
+						Required: false,
+					},
+					&cli.BoolFlag{
+						Name:  "with-password",
+						Usage: "Also prompt for a password to combine with the keyfile",
+					},
+					&cli.StringFlag{
+						Name:     "identity",
+						Aliases:  []string{"i"},
+						Usage:    "Identity file (private key from 'keygen') that unlocks the vault for --usage",
+						Required: false,
+					},
 				},
 				Action: func(ctx context.Context, cmd *cli.Command) error {
 					filePath := cmd.String("file")
@@ -415,7 +1220,19 @@ func Run() {
 					if info.IsFlintVault {
 						fmt.Printf("✅ File Type: Flint Vault encrypted storage\n")
 						fmt.Printf("🔢 Format Version: %d\n", info.Version)
-						fmt.Printf("🔐 PBKDF2 Iterations: %s\n", formatNumber(int64(info.Iterations)))
+						fmt.Printf("🔐 Key Derivation: %s\n", describeKDF(info.KDF))
+						fmt.Printf("🔑 Key Slots: %d of %d in use\n", len(info.KeySlots), vault.MaxKeySlots)
+						if info.PayloadsEncrypted {
+							fmt.Printf("🔒 File Payloads: encrypted (AES-256-GCM chunks)\n")
+						} else {
+							fmt.Printf("⚠️  File Payloads: unencrypted payloads (legacy format, only the directory is encrypted)\n")
+						}
+						if info.ChunkedPayloads {
+							fmt.Printf("🧩 File Storage: deduplicated content-defined chunks\n")
+						}
+						if info.PagedDirectory {
+							fmt.Printf("📑 Directory: sorted pages, read on demand\n")
+						}
 
 						if err := vault.ValidateVaultFile(filePath); err != nil {
 							fmt.Printf("⚠️  Validation: Failed - %v\n", err)
@@ -423,6 +1240,19 @@ func Run() {
 							fmt.Printf("✅ Validation: Passed\n")
 						}
 
+						if cmd.Bool("usage") {
+							keySource, err := keySourceFromFlags(cmd, "Enter vault password: ")
+							if err != nil {
+								return err
+							}
+							usage, err := vault.GetStorageUsage(filePath, keySource)
+							if err != nil {
+								return fmt.Errorf("vault read error: %w", err)
+							}
+							fmt.Println()
+							printStorageUsage(*usage)
+						}
+
 						fmt.Printf("\n💡 This file can be opened with 'flint-vault list' command\n")
 					} else {
 						fmt.Printf("❌ File Type: Not a Flint Vault file\n")
@@ -436,10 +1266,159 @@ func Run() {
 	}
 
 	if err := app.Run(context.Background(), os.Args); err != nil {
+		if errors.Is(err, vault.ErrInterruptedWrite) {
+			log.Printf("💡 A write to the vault was interrupted; run 'flint-vault recover' to repair it")
+		}
+		if errors.Is(err, context.Canceled) {
+			log.Printf("💡 Interrupted; the write in progress was undone")
+		}
 		log.Fatal(err)
 	}
 }
 
+// interruptible returns a context that SIGINT and SIGTERM cancel, so long operations
+// stop cleanly and undo their write in progress instead of being killed in the middle
+// of it. It is set up after any password prompt, which Ctrl-C still aborts.
+func interruptible(ctx context.Context) (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+}
+
+// keySourceFromFlags builds the key source from the password, keyfile and identity flags
+func keySourceFromFlags(cmd *cli.Command, prompt string) (vault.KeySource, error) {
+	if identity := cmd.String("identity"); identity != "" {
+		if cmd.String("password") != "" || cmd.String("keyfile") != "" || cmd.Bool("with-password") {
+			return nil, fmt.Errorf("--identity cannot be combined with --password, --keyfile or --with-password")
+		}
+		return vault.IdentityFile(identity), nil
+	}
+	return readKeySource(cmd.String("password"), cmd.String("keyfile"), cmd.Bool("with-password"), prompt, false)
+}
+
+// printStorageUsage prints the logical size of the files next to the space they take
+func printStorageUsage(usage vault.StorageUsage) {
+	fmt.Printf("📏 Logical Size: %s in %d files\n", formatSize(usage.LogicalSize), usage.Files)
+	fmt.Printf("💾 Stored Size: %s", formatSize(usage.StoredSize))
+	if usage.Chunks > 0 {
+		fmt.Printf(" (%d distinct chunks of %d)", usage.Chunks, usage.ChunkRefs)
+	}
+	fmt.Println()
+	if usage.SavedBytes() > 0 {
+		fmt.Printf("📉 Saved: %s by deduplication and compression (%.2fx)\n", formatSize(usage.SavedBytes()), usage.DedupRatio())
+	}
+}
+
+// formatIdentityFile returns the contents of an identity file: comments with the
+// creation time and public key, followed by the secret key
+func formatIdentityFile(identity *vault.Identity, created time.Time) string {
+	return fmt.Sprintf("# created: %s\n# public key: %s\n%s\n",
+		created.Format(time.RFC3339), identity.Recipient(), identity)
+}
+
+// readKeySource selects a password, keyfile or combined key source.
+// A keyfile alone unlocks the vault unless a password is given or requested with
+// withPassword; the password is prompted for when needed and not given.
+func readKeySource(password, keyfile string, withPassword bool, prompt string, confirm bool) (vault.KeySource, error) {
+	if keyfile != "" && password == "" && !withPassword {
+		return vault.Keyfile(keyfile), nil
+	}
+
+	if password == "" {
+		var err error
+		password, err = vault.ReadPasswordSecurely(prompt)
+		if err != nil {
+			return nil, err
+		}
+
+		if confirm {
+			confirmation, err := vault.ReadPasswordSecurely("Confirm password: ")
+			if err != nil {
+				return nil, err
+			}
+			if confirmation != password {
+				return nil, fmt.Errorf("passwords do not match")
+			}
+		}
+	}
+
+	if keyfile != "" {
+		return vault.PasswordAndKeyfile(password, keyfile), nil
+	}
+	return vault.Password(password), nil
+}
+
+// kdfFlags returns the key derivation flags shared by the create, passwd and keyslot add commands
+func kdfFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:  "kdf",
+			Usage: "Key derivation function: pbkdf2 or argon2id",
+			Value: "pbkdf2",
+		},
+		&cli.IntFlag{
+			Name:  "kdf-iterations",
+			Usage: "PBKDF2 iteration count",
+			Value: vault.PBKDF2Iters,
+		},
+		&cli.IntFlag{
+			Name:  "kdf-memory",
+			Usage: "Argon2id memory cost in MiB",
+			Value: vault.Argon2DefaultMemory / 1024,
+		},
+		&cli.IntFlag{
+			Name:  "kdf-time",
+			Usage: "Argon2id time cost (number of passes)",
+			Value: vault.Argon2DefaultTime,
+		},
+		&cli.IntFlag{
+			Name:  "kdf-parallelism",
+			Usage: "Argon2id parallelism (number of lanes)",
+			Value: vault.Argon2DefaultParallelism,
+		},
+	}
+}
+
+// kdfParamsFromFlags builds key derivation parameters from the KDF flags
+func kdfParamsFromFlags(cmd *cli.Command) (vault.KDFParams, error) {
+	algorithm, err := vault.ParseKDFName(cmd.String("kdf"))
+	if err != nil {
+		return vault.KDFParams{}, err
+	}
+
+	if algorithm != vault.KDFArgon2id {
+		iterations := cmd.Int("kdf-iterations")
+		if iterations <= 0 {
+			return vault.KDFParams{}, fmt.Errorf("invalid PBKDF2 iteration count: %d", iterations)
+		}
+		params := vault.KDFParams{Algorithm: vault.KDFPBKDF2, Iterations: uint32(iterations)}
+		if err := params.Validate(); err != nil {
+			return vault.KDFParams{}, err
+		}
+		return params, nil
+	}
+
+	memory := cmd.Int("kdf-memory")
+	time := cmd.Int("kdf-time")
+	parallelism := cmd.Int("kdf-parallelism")
+	if memory <= 0 || time <= 0 || parallelism <= 0 || parallelism > 255 {
+		return vault.KDFParams{}, fmt.Errorf("invalid Argon2id parameters: memory, time and parallelism (1-255) must be positive")
+	}
+
+	params := vault.Argon2idKDFParams(uint32(memory)*1024, uint32(time), uint8(parallelism))
+	if err := params.Validate(); err != nil {
+		return vault.KDFParams{}, err
+	}
+	return params, nil
+}
+
+// describeKDF formats key derivation parameters for display
+func describeKDF(params vault.KDFParams) string {
+	if params.Algorithm == vault.KDFArgon2id {
+		return fmt.Sprintf("Argon2id (memory %s, time %d, parallelism %d)",
+			formatSize(int64(params.Memory)*1024), params.Time, params.Parallelism)
+	}
+	return fmt.Sprintf("PBKDF2-SHA256 (%s iterations)", formatNumber(int64(params.Iterations)))
+}
+
 // formatSize formats file size in human-readable form
 func formatSize(size int64) string {
 	const unit = 1024
@@ -1,6 +1,12 @@
 package commands
 
-import "testing"
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"flint-vault/pkg/lib/vault"
+)
 
 // TestFormatSize tests the formatSize helper function
 func TestFormatSize(t *testing.T) {
@@ -69,3 +75,65 @@ func TestFormatFileSize(t *testing.T) {
 		}
 	}
 }
+
+// TestDescribeKDF tests the describeKDF helper function
+func TestDescribeKDF(t *testing.T) {
+	tests := []struct {
+		params   vault.KDFParams
+		expected string
+	}{
+		{vault.DefaultKDFParams(), "PBKDF2-SHA256 (100,000 iterations)"},
+		{vault.Argon2idKDFParams(64*1024, 3, 4), "Argon2id (memory 64.0 MB, time 3, parallelism 4)"},
+	}
+
+	for _, test := range tests {
+		result := describeKDF(test.params)
+		if result != test.expected {
+			t.Fatalf("describeKDF(%+v) = %s, expected %s", test.params, result, test.expected)
+		}
+	}
+}
+
+// TestReadKeySource tests key source selection from password and keyfile flags
+func TestReadKeySource(t *testing.T) {
+	tests := []struct {
+		password string
+		keyfile  string
+		expected string
+	}{
+		{"secret", "", "password"},
+		{"", "vault.key", "keyfile"},
+		{"secret", "vault.key", "password and keyfile"},
+	}
+
+	for _, test := range tests {
+		source, err := readKeySource(test.password, test.keyfile, false, "", false)
+		if err != nil {
+			t.Fatalf("readKeySource(%q, %q) failed: %v", test.password, test.keyfile, err)
+		}
+		if source.Description() != test.expected {
+			t.Fatalf("readKeySource(%q, %q) = %s, expected %s", test.password, test.keyfile, source.Description(), test.expected)
+		}
+	}
+}
+
+// TestFormatIdentityFile tests that identity files can be parsed back
+func TestFormatIdentityFile(t *testing.T) {
+	identity, err := vault.GenerateIdentity()
+	if err != nil {
+		t.Fatalf("GenerateIdentity failed: %v", err)
+	}
+
+	content := formatIdentityFile(identity, time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC))
+	if !strings.HasPrefix(content, "# created: 2024-01-02T03:04:05Z\n# public key: "+identity.Recipient().String()+"\n") {
+		t.Fatalf("Unexpected identity file header:\n%s", content)
+	}
+
+	parsed, err := vault.ParseIdentity(content)
+	if err != nil {
+		t.Fatalf("ParseIdentity failed: %v", err)
+	}
+	if parsed.String() != identity.String() {
+		t.Fatal("Identity file round trip mismatch")
+	}
+}
@@ -0,0 +1,395 @@
+package vault
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"slices"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// ========================
+// CONTENT-DEFINED CHUNKING
+// ========================
+//
+// Starting with format version 4 file data is split into variable-sized chunks at
+// content-defined boundaries (FastCDC with normalized chunking), so an insertion
+// only changes the chunks around it. Each chunk is identified by a keyed hash of
+// its plaintext and stored once, however many files or versions contain it; a
+// file entry lists the chunks that make up its data. The boundary function and
+// the chunk IDs are both keyed with the vault key, so neither the chunk sizes nor
+// the IDs in the directory reveal anything about the content to someone without it.
+// Every stored chunk is compressed and sealed like a v3 payload with its own salt.
+
+const (
+	// ChunkedVersion is the first vault format version that stores files as deduplicated chunks
+	ChunkedVersion = 4
+
+	// Chunk size bounds; boundaries are normally found around the average size
+	ChunkMinSize = 64 * 1024
+	ChunkAvgSize = 256 * 1024
+	ChunkMaxSize = 1024 * 1024
+
+	// chunkMaskSmall is used below the average size and makes a cut less likely,
+	// chunkMaskLarge is used above it and makes a cut more likely
+	chunkMaskSmall = uint64(1<<20-1) << (64 - 20)
+	chunkMaskLarge = uint64(1<<16-1) << (64 - 16)
+
+	// HKDF info strings for the chunking keys
+	chunkGearInfo = "flint-vault chunk gear v4"
+	chunkIDInfo   = "flint-vault chunk id v4"
+)
+
+// ChunkID identifies a chunk by the keyed hash of its plaintext
+type ChunkID [32]byte
+
+// MarshalText encodes the ID as base64 in the directory
+func (id ChunkID) MarshalText() ([]byte, error) {
+	return []byte(base64.RawStdEncoding.EncodeToString(id[:])), nil
+}
+
+// UnmarshalText decodes a base64 ID
+func (id *ChunkID) UnmarshalText(text []byte) error {
+	decoded, err := base64.RawStdEncoding.DecodeString(string(text))
+	if err != nil || len(decoded) != len(id) {
+		return fmt.Errorf("invalid chunk ID %q", text)
+	}
+	copy(id[:], decoded)
+	return nil
+}
+
+// ChunkRef locates a stored chunk of a file
+type ChunkRef struct {
+	ID         ChunkID `json:"id"`     // Keyed hash of the chunk plaintext
+	Salt       []byte  `json:"salt"`   // Salt of the chunk payload key
+	Offset     int64   `json:"offset"` // Offset of the stored chunk in the data area
+	Size       int64   `json:"size"`   // Plaintext size of the chunk
+	StoredSize int64   `json:"stored"` // Size of the stored chunk (compressed and encrypted)
+
+	Compression string `json:"compression,omitempty"` // Compression algorithm of the chunk (empty for gzip)
+}
+
+// StorageUsage compares the size of the files in a vault with the space their data takes
+type StorageUsage struct {
+	Files       int   // Number of file entries
+	LogicalSize int64 // Total size of the files
+	StoredSize  int64 // Space taken by their payloads, counting every shared chunk once
+	Chunks      int   // Number of distinct chunks
+	ChunkRefs   int   // Number of chunk references from all files
+}
+
+// SavedBytes returns how much smaller the stored data is than the files it holds
+func (u StorageUsage) SavedBytes() int64 {
+	return u.LogicalSize - u.StoredSize
+}
+
+// DedupRatio returns the logical size per stored byte (0 for a vault without data)
+func (u StorageUsage) DedupRatio() float64 {
+	if u.StoredSize == 0 {
+		return 0
+	}
+	return float64(u.LogicalSize) / float64(u.StoredSize)
+}
+
+// ComputeStorageUsage sums up the logical and stored size of directory entries
+func ComputeStorageUsage(entries []FileEntry) StorageUsage {
+	var usage StorageUsage
+	seen := make(map[ChunkID]bool)
+	for _, entry := range entries {
+		if !entry.isFile() {
+			continue
+		}
+		usage.Files++
+		usage.LogicalSize += entry.Size
+		if entry.hasPayload() {
+			usage.StoredSize += entry.CompressedSize
+			continue
+		}
+		for _, ref := range entry.Chunks {
+			usage.ChunkRefs++
+			if seen[ref.ID] {
+				continue
+			}
+			seen[ref.ID] = true
+			usage.Chunks++
+			usage.StoredSize += ref.StoredSize
+		}
+	}
+	return usage
+}
+
+// GetStorageUsage opens the vault and reports its logical and deduplicated size
+func GetStorageUsage(vaultPath string, keySource KeySource) (*StorageUsage, error) {
+	v, err := OpenVault(vaultPath, keySource)
+	if err != nil {
+		return nil, err
+	}
+	defer v.Close()
+
+	return v.StorageUsage()
+}
+
+// StorageUsage reports the logical size of the files in the vault and the space their
+// stored data takes
+func (v *Vault) StorageUsage() (*StorageUsage, error) {
+	entries, err := v.List()
+	if err != nil {
+		return nil, err
+	}
+	usage := ComputeStorageUsage(entries)
+	return &usage, nil
+}
+
+// deriveChunkKey derives one of the chunking keys from the vault key
+func deriveChunkKey(vaultKey []byte, info string, size int) ([]byte, error) {
+	key := make([]byte, size)
+	reader := hkdf.New(sha256.New, vaultKey, nil, []byte(info))
+	if _, err := io.ReadFull(reader, key); err != nil {
+		return nil, fmt.Errorf("chunk key derivation error: %w", err)
+	}
+	return key, nil
+}
+
+// chunker splits a stream at content-defined boundaries
+type chunker struct {
+	r     io.Reader
+	gear  *[256]uint64
+	buf   []byte
+	start int
+	end   int
+	eof   bool
+}
+
+// newChunker returns a chunker for r using the given gear table
+func newChunker(r io.Reader, gear *[256]uint64) *chunker {
+	return &chunker{r: r, gear: gear, buf: make([]byte, ChunkMaxSize)}
+}
+
+// reset starts chunking another stream, reusing the buffer
+func (c *chunker) reset(r io.Reader) {
+	c.r = r
+	c.start = 0
+	c.end = 0
+	c.eof = false
+}
+
+// next returns the next chunk, which stays valid until the following call, or io.EOF
+func (c *chunker) next() ([]byte, error) {
+	// Keep at least a maximum-sized chunk buffered, so every cut sees the same data
+	if c.end-c.start < ChunkMaxSize && !c.eof {
+		c.end = copy(c.buf, c.buf[c.start:c.end])
+		c.start = 0
+		n, err := io.ReadFull(c.r, c.buf[c.end:])
+		c.end += n
+		switch err {
+		case nil:
+		case io.EOF, io.ErrUnexpectedEOF:
+			c.eof = true
+		default:
+			return nil, fmt.Errorf("source read error: %w", err)
+		}
+	}
+
+	if c.start == c.end {
+		return nil, io.EOF
+	}
+	n := c.cut(c.buf[c.start:c.end])
+	chunk := c.buf[c.start : c.start+n]
+	c.start += n
+	return chunk, nil
+}
+
+// cut returns the length of the first chunk of data
+func (c *chunker) cut(data []byte) int {
+	n := len(data)
+	if n <= ChunkMinSize {
+		return n
+	}
+	if n > ChunkMaxSize {
+		n = ChunkMaxSize
+	}
+	normal := min(ChunkAvgSize, n)
+
+	var fingerprint uint64
+	i := ChunkMinSize
+	for ; i < normal; i++ {
+		fingerprint = fingerprint<<1 + c.gear[data[i]]
+		if fingerprint&chunkMaskSmall == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fingerprint = fingerprint<<1 + c.gear[data[i]]
+		if fingerprint&chunkMaskLarge == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// chunkKeys holds the keys content-defined chunking derives from the vault key
+type chunkKeys struct {
+	gear  [256]uint64
+	idKey []byte
+}
+
+// newChunkKeys derives the gear table and the chunk ID key
+func newChunkKeys(key []byte) (*chunkKeys, error) {
+	gearBytes, err := deriveChunkKey(key, chunkGearInfo, 256*8)
+	if err != nil {
+		return nil, err
+	}
+	defer clearKey(gearBytes)
+
+	idKey, err := deriveChunkKey(key, chunkIDInfo, KeyLength)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := &chunkKeys{idKey: idKey}
+	for i := range keys.gear {
+		keys.gear[i] = binary.LittleEndian.Uint64(gearBytes[i*8:])
+	}
+	return keys, nil
+}
+
+// newIDHash returns a hash for chunk IDs; each goroutine needs its own
+func (k *chunkKeys) newIDHash() hash.Hash {
+	return hmac.New(sha256.New, k.idKey)
+}
+
+// clear wipes the chunking keys
+func (k *chunkKeys) clear() {
+	clearKey(k.idKey)
+	k.gear = [256]uint64{}
+}
+
+// chunkID computes the keyed ID of a chunk
+func chunkID(idHash hash.Hash, data []byte) ChunkID {
+	var id ChunkID
+	idHash.Reset()
+	idHash.Write(data)
+	idHash.Sum(id[:0])
+	return id
+}
+
+// knownChunks indexes the chunks the entries refer to
+func knownChunks(entries []FileEntry) map[ChunkID]ChunkRef {
+	known := make(map[ChunkID]ChunkRef)
+	for _, entry := range entries {
+		for _, ref := range entry.Chunks {
+			known[ref.ID] = ref
+		}
+	}
+	return known
+}
+
+// chunkReader reads the data of a chunked file entry from the vault, chunk by chunk
+type chunkReader struct {
+	file      *os.File
+	dataStart int64
+	key       []byte
+	refs      []ChunkRef
+	current   io.Reader
+	closer    io.Closer
+}
+
+// newChunkReader returns a reader for the chunks of an entry
+func newChunkReader(file *os.File, dataStart int64, key []byte, refs []ChunkRef) *chunkReader {
+	return &chunkReader{file: file, dataStart: dataStart, key: key, refs: refs}
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if len(r.refs) == 0 {
+				return 0, io.EOF
+			}
+			if err := r.openChunk(r.refs[0]); err != nil {
+				return 0, err
+			}
+			r.refs = r.refs[1:]
+		}
+
+		n, err := r.current.Read(p)
+		if err == io.EOF {
+			r.closeChunk()
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+// openChunk starts reading a stored chunk
+func (r *chunkReader) openChunk(ref ChunkRef) error {
+	if len(ref.Salt) != SaltLength || ref.Offset < 0 || ref.StoredSize < 0 {
+		return fmt.Errorf("invalid chunk reference at offset %d", ref.Offset)
+	}
+	var salt [32]byte
+	copy(salt[:], ref.Salt)
+
+	section := io.NewSectionReader(r.file, r.dataStart+ref.Offset, ref.StoredSize)
+	payload, err := newPayloadReader(section, ref.StoredSize, r.key, salt)
+	if err != nil {
+		return fmt.Errorf("chunk decryption setup error: %w", err)
+	}
+	decompressor, err := newDecompressor(payload, ref.Compression)
+	if err != nil {
+		return fmt.Errorf("chunk decompression setup error: %w", err)
+	}
+
+	r.current = io.LimitReader(decompressor, ref.Size)
+	r.closer = decompressor
+	return nil
+}
+
+// closeChunk finishes the current chunk
+func (r *chunkReader) closeChunk() {
+	if r.closer != nil {
+		r.closer.Close()
+	}
+	r.current = nil
+	r.closer = nil
+}
+
+// Close releases the chunk being read
+func (r *chunkReader) Close() error {
+	r.closeChunk()
+	return nil
+}
+
+// layoutChunks assigns offsets after offset to the distinct chunks of the entries, in
+// directory order, and returns the extents to copy them from
+func layoutChunks(entries []FileEntry, offset int64) []storedExtent {
+	var extents []storedExtent
+	offsets := make(map[ChunkID]int64)
+	for i := range entries {
+		if len(entries[i].Chunks) == 0 {
+			continue
+		}
+
+		// The chunk list may be shared with a copy of the directory
+		entries[i].Chunks = slices.Clone(entries[i].Chunks)
+		for j := range entries[i].Chunks {
+			ref := &entries[i].Chunks[j]
+			if newOffset, ok := offsets[ref.ID]; ok {
+				ref.Offset = newOffset
+				continue
+			}
+			extents = append(extents, storedExtent{path: entries[i].Path, offset: ref.Offset, size: ref.StoredSize})
+			offsets[ref.ID] = offset
+			ref.Offset = offset
+			offset += ref.StoredSize
+		}
+	}
+	return extents
+}
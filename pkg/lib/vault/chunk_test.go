@@ -0,0 +1,188 @@
+package vault
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testChunks разбивает данные на чанки с ключом vault key
+func testChunks(t *testing.T, key, data []byte) [][]byte {
+	t.Helper()
+
+	keys, err := newChunkKeys(key)
+	if err != nil {
+		t.Fatalf("newChunkKeys failed: %v", err)
+	}
+
+	var chunks [][]byte
+	c := newChunker(bytes.NewReader(data), &keys.gear)
+	for {
+		chunk, err := c.next()
+		if err == io.EOF {
+			return chunks
+		}
+		if err != nil {
+			t.Fatalf("chunker failed: %v", err)
+		}
+		chunks = append(chunks, append([]byte(nil), chunk...))
+	}
+}
+
+// TestChunker тестирует границы чанков, их детерминированность и устойчивость к вставкам
+func TestChunker(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, KeyLength)
+	data := make([]byte, 8*1024*1024)
+	rand.Read(data)
+
+	chunks := testChunks(t, key, data)
+	if !bytes.Equal(bytes.Join(chunks, nil), data) {
+		t.Fatal("Chunks do not add up to the data")
+	}
+	for i, chunk := range chunks {
+		if len(chunk) > ChunkMaxSize || (len(chunk) < ChunkMinSize && i != len(chunks)-1) {
+			t.Errorf("Chunk %d has %d bytes, outside the bounds", i, len(chunk))
+		}
+	}
+	if average := len(data) / len(chunks); average < ChunkAvgSize/2 || average > ChunkAvgSize*2 {
+		t.Errorf("Average chunk size %d, expected about %d", average, ChunkAvgSize)
+	}
+
+	// Вставка в середину меняет только соседние чанки
+	edited := append(append(append([]byte(nil), data[:3*1024*1024]...), []byte("inserted")...), data[3*1024*1024:]...)
+	known := make(map[string]bool)
+	for _, chunk := range chunks {
+		known[string(chunk)] = true
+	}
+	editedChunks := testChunks(t, key, edited)
+	changed := 0
+	for _, chunk := range editedChunks {
+		if !known[string(chunk)] {
+			changed++
+		}
+	}
+	if changed == 0 || changed > 2 {
+		t.Errorf("An insertion changed %d of %d chunks", changed, len(editedChunks))
+	}
+
+	// Границы зависят от ключа
+	other := testChunks(t, bytes.Repeat([]byte{8}, KeyLength), data)
+	if len(other) > 1 && len(other[0]) == len(chunks[0]) && len(other[1]) == len(chunks[1]) {
+		t.Error("Chunk boundaries do not depend on the vault key")
+	}
+}
+
+// TestChunkIDText тестирует кодирование идентификатора чанка в директории
+func TestChunkIDText(t *testing.T) {
+	ref := ChunkRef{Size: 42}
+	rand.Read(ref.ID[:])
+
+	encoded, err := json.Marshal(ref)
+	if err != nil {
+		t.Fatalf("json.Marshal failed: %v", err)
+	}
+	var decoded ChunkRef
+	if err := json.Unmarshal(encoded, &decoded); err != nil || decoded.ID != ref.ID {
+		t.Errorf("Chunk ID did not survive encoding: %s (%v)", encoded, err)
+	}
+
+	if err := json.Unmarshal([]byte(`{"id":"c2hvcnQ"}`), &decoded); err == nil {
+		t.Error("Expected error for a short chunk ID")
+	}
+}
+
+// TestDeduplicatedStorage тестирует хранение одинаковых данных один раз
+func TestDeduplicatedStorage(t *testing.T) {
+	tmpDir := setupCoreTest(t)
+	defer cleanupCoreTest(t, tmpDir)
+
+	vaultPath := filepath.Join(tmpDir, "dedup.vault")
+	if err := CreateVaultWithKDF(vaultPath, Password(testPassword), testArgon2Params); err != nil {
+		t.Fatalf("CreateVaultWithKDF failed: %v", err)
+	}
+	if info, err := GetVaultInfo(vaultPath); err != nil || info.Version != CurrentVaultVersion || !info.ChunkedPayloads {
+		t.Fatalf("New vault does not store chunks: %+v (%v)", info, err)
+	}
+
+	// Несжимаемые данные, чтобы размер vault отражал число сохранённых чанков
+	data := make([]byte, 2*1024*1024)
+	rand.Read(data)
+	original := filepath.Join(tmpDir, "original.bin")
+	if err := os.WriteFile(original, data, 0644); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	if err := AddFileToVault(vaultPath, Password(testPassword), original); err != nil {
+		t.Fatalf("AddFileToVault failed: %v", err)
+	}
+
+	// Копия под другим именем не занимает места под данные
+	before := vaultFileSize(t, vaultPath)
+	copyDir := filepath.Join(tmpDir, "copies")
+	os.MkdirAll(copyDir, 0755)
+	if err := os.WriteFile(filepath.Join(copyDir, "copy.bin"), data, 0644); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	if err := AddDirectoryToVault(vaultPath, Password(testPassword), copyDir); err != nil {
+		t.Fatalf("AddDirectoryToVault failed: %v", err)
+	}
+	if growth := vaultFileSize(t, vaultPath) - before; growth >= ChunkMinSize {
+		t.Errorf("Adding an identical file grew the vault by %d bytes", growth)
+	}
+
+	// Изменённая версия сохраняет только изменившиеся чанки
+	before = vaultFileSize(t, vaultPath)
+	edited := append([]byte("prepended"), data...)
+	if err := os.WriteFile(original, edited, 0644); err != nil {
+		t.Fatalf("Failed to update file: %v", err)
+	}
+	if err := AddFileToVault(vaultPath, Password(testPassword), original); err != nil {
+		t.Fatalf("AddFileToVault (edited) failed: %v", err)
+	}
+	if growth := vaultFileSize(t, vaultPath) - before; growth >= int64(len(data))/2 {
+		t.Errorf("Adding an edited file grew the vault by %d bytes", growth)
+	}
+
+	empty := createTestFile(t, tmpDir, "empty.txt", "")
+	if err := AddFileToVault(vaultPath, Password(testPassword), empty); err != nil {
+		t.Fatalf("AddFileToVault (empty) failed: %v", err)
+	}
+
+	entries, err := ListVault(vaultPath, Password(testPassword))
+	if err != nil {
+		t.Fatalf("ListVault failed: %v", err)
+	}
+	usage := ComputeStorageUsage(entries)
+	if usage.Files != 3 || usage.LogicalSize != int64(len(data)+len(edited)) {
+		t.Errorf("Unexpected logical usage: %+v", usage)
+	}
+	if usage.StoredSize >= int64(len(data))*3/2 || usage.Chunks >= usage.ChunkRefs {
+		t.Errorf("Shared chunks are counted more than once: %+v", usage)
+	}
+	if reported, err := GetStorageUsage(vaultPath, Password(testPassword)); err != nil || *reported != usage {
+		t.Errorf("GetStorageUsage returned %+v (%v), expected %+v", reported, err, usage)
+	}
+
+	// Сжатие переносит каждый чанк один раз и сохраняет содержимое
+	stats, err := CompactVault(vaultPath, Password(testPassword), CompactOptions{})
+	if err != nil {
+		t.Fatalf("CompactVault failed: %v", err)
+	}
+	if stats.LiveDataSize != usage.StoredSize {
+		t.Errorf("Compaction kept %d bytes of data, expected %d", stats.LiveDataSize, usage.StoredSize)
+	}
+
+	outputDir := filepath.Join(tmpDir, "output")
+	if err := ExtractFromVault(vaultPath, Password(testPassword), outputDir); err != nil {
+		t.Fatalf("ExtractFromVault failed: %v", err)
+	}
+	for name, content := range map[string][]byte{"original.bin": edited, "copies/copy.bin": data, "empty.txt": nil} {
+		extracted, err := os.ReadFile(filepath.Join(outputDir, filepath.FromSlash(name)))
+		if err != nil || !bytes.Equal(extracted, content) {
+			t.Errorf("Content mismatch for %s (%v)", name, err)
+		}
+	}
+}
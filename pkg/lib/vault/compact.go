@@ -0,0 +1,108 @@
+package vault
+
+import (
+	"context"
+	"fmt"
+)
+
+// ========================
+// COMPACTION
+// ========================
+//
+// Appends leave superseded payloads, earlier directories and folded public-key
+// segments in the file. Compaction rewrites the vault with only the live payloads
+// and a single directory after the header, using the same temp-file-and-rename
+// approach as any rewrite, so an interrupted compaction leaves the vault unchanged.
+//
+// With Upgrade the rewrite also moves a v3+ vault to the current format version. The
+// payloads are copied as they are; the key slots keep the master key wrapped under
+// the version they were written with.
+
+// CompactOptions controls a compaction
+type CompactOptions struct {
+	// DryRun only reports how much space compaction would reclaim
+	DryRun bool
+
+	// Upgrade rewrites the vault in the current format version (v3+ vaults only)
+	Upgrade bool
+
+	// Context cancels the compaction; the vault is left unchanged
+	Context context.Context
+}
+
+// CompactStats reports the space taken by live and dead data
+type CompactStats struct {
+	OriginalSize  int64 // Vault file size before compaction
+	CompactedSize int64 // Vault file size after compaction (expected size for a dry run)
+	LiveDataSize  int64 // Size of the stored payloads and chunks still referenced by the directory
+	LiveEntries   int   // Number of entries in the directory
+}
+
+// ReclaimedBytes returns the space freed (or, for a dry run, held) by dead data
+func (s *CompactStats) ReclaimedBytes() int64 {
+	return s.OriginalSize - s.CompactedSize
+}
+
+// CompactVault rewrites the vault with only the payloads the directory still refers to,
+// reclaiming the space of removed and superseded entries
+func CompactVault(vaultPath string, keySource KeySource, opts CompactOptions) (*CompactStats, error) {
+	if keySource == nil {
+		return nil, fmt.Errorf("key source cannot be nil")
+	}
+
+	v, err := OpenVault(vaultPath, keySource)
+	if err != nil {
+		return nil, err
+	}
+	defer v.Close()
+
+	return v.Compact(opts)
+}
+
+// Compact rewrites the vault with only the payloads the directory still refers to
+func (v *Vault) Compact(opts CompactOptions) (*CompactStats, error) {
+	// Lock the vault against other goroutines and processes
+	unlock, err := v.lock(true)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	vaultDir := *v.dir
+	if opts.Upgrade && v.header.Version < CurrentVaultVersion {
+		if v.header.Version < MasterKeyVersion {
+			return nil, fmt.Errorf("vault version %d cannot be upgraded by compaction, migrate it instead", v.header.Version)
+		}
+		vaultDir.Version = CurrentVaultVersion
+	}
+
+	stats := &CompactStats{
+		OriginalSize: v.stamp.Size(),
+		LiveDataSize: ComputeStorageUsage(v.dir.Entries).StoredSize,
+		LiveEntries:  len(v.dir.Entries),
+	}
+
+	if opts.DryRun {
+		// Lay out and seal a copy of the directory to learn its size; nothing is written
+		compacted := vaultDir.clone()
+		layoutPayloads(compacted.Entries, nil)
+
+		sizedHeader := *v.header
+		if compacted.Version > sizedHeader.Version {
+			sizedHeader.upgrade(compacted.Version)
+		}
+		if _, err := sealVaultDirectory(v.key, &sizedHeader, *compacted); err != nil {
+			return nil, err
+		}
+		stats.CompactedSize = sizedHeader.encodedSize() + int64(sizedHeader.DirectorySize) + stats.LiveDataSize
+		return stats, nil
+	}
+
+	err = updateVaultDirectoryStreamingOptimized(orBackground(opts.Context), v.path, v.key, vaultDir)
+	if err := v.written(err); err != nil {
+		return nil, fmt.Errorf("vault rewrite error: %w", err)
+	}
+	stats.CompactedSize = v.stamp.Size()
+
+	return stats, nil
+}
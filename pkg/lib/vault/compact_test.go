@@ -0,0 +1,107 @@
+package vault
+
+import (
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestCompactVault тестирует освобождение места от удалённых и заменённых файлов
+func TestCompactVault(t *testing.T) {
+	tmpDir := setupCoreTest(t)
+	defer cleanupCoreTest(t, tmpDir)
+
+	vaultPath := filepath.Join(tmpDir, "compact.vault")
+	if err := CreateVaultWithKDF(vaultPath, Password(testPassword), testArgon2Params); err != nil {
+		t.Fatalf("CreateVaultWithKDF failed: %v", err)
+	}
+
+	// Несжимаемые данные, чтобы мёртвые payload были заметны по размеру
+	data := make([]byte, 256*1024)
+	rand.Read(data)
+	dataPath := filepath.Join(tmpDir, "data.bin")
+	if err := os.WriteFile(dataPath, data, 0644); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	keep := createTestFile(t, tmpDir, "keep.txt", testContent)
+	removed := createTestFile(t, tmpDir, "removed.txt", "removed later")
+	for _, path := range []string{dataPath, keep, removed} {
+		if err := AddFileToVault(vaultPath, Password(testPassword), path); err != nil {
+			t.Fatalf("AddFileToVault failed: %v", err)
+		}
+	}
+
+	// Новое содержимое вытесняет все чанки прежней версии
+	rand.Read(data)
+	if err := os.WriteFile(dataPath, data, 0644); err != nil {
+		t.Fatalf("Failed to update file: %v", err)
+	}
+	if err := AddFileToVault(vaultPath, Password(testPassword), dataPath); err != nil {
+		t.Fatalf("AddFileToVault failed: %v", err)
+	}
+	if err := RemoveFromVault(vaultPath, Password(testPassword), []string{"removed.txt"}); err != nil {
+		t.Fatalf("RemoveFromVault failed: %v", err)
+	}
+	appended := createTestFile(t, tmpDir, "appended.txt", "appended without key")
+	if err := AppendToVault(vaultPath, appended); err != nil {
+		t.Fatalf("AppendToVault failed: %v", err)
+	}
+
+	// Пробный запуск ничего не меняет
+	sizeBefore := vaultFileSize(t, vaultPath)
+	dryRun, err := CompactVault(vaultPath, Password(testPassword), CompactOptions{DryRun: true})
+	if err != nil {
+		t.Fatalf("CompactVault (dry run) failed: %v", err)
+	}
+	if vaultFileSize(t, vaultPath) != sizeBefore || dryRun.OriginalSize != sizeBefore {
+		t.Fatal("Dry run must not change the vault")
+	}
+	if dryRun.LiveEntries != 3 || dryRun.ReclaimedBytes() < int64(len(data)) {
+		t.Errorf("Unexpected dry run stats: %+v, reclaimable %d", dryRun, dryRun.ReclaimedBytes())
+	}
+
+	stats, err := CompactVault(vaultPath, Password(testPassword), CompactOptions{})
+	if err != nil {
+		t.Fatalf("CompactVault failed: %v", err)
+	}
+	if stats.CompactedSize != vaultFileSize(t, vaultPath) || stats.CompactedSize != dryRun.CompactedSize {
+		t.Errorf("Compacted size %d, dry run expected %d, file has %d", stats.CompactedSize, dryRun.CompactedSize, vaultFileSize(t, vaultPath))
+	}
+	if stats.ReclaimedBytes() != dryRun.ReclaimedBytes() {
+		t.Errorf("Reclaimed %d bytes, dry run reported %d", stats.ReclaimedBytes(), dryRun.ReclaimedBytes())
+	}
+
+	// Компактный vault состоит из заголовка, директории и живых данных
+	header := readTestHeader(t, vaultPath)
+	if stats.CompactedSize != header.encodedSize()+int64(header.DirectorySize)+stats.LiveDataSize {
+		t.Error("Compacted vault still holds dead data")
+	}
+
+	outputDir := filepath.Join(tmpDir, "output")
+	if err := ExtractFromVault(vaultPath, Password(testPassword), outputDir); err != nil {
+		t.Fatalf("ExtractFromVault failed: %v", err)
+	}
+	for name, content := range map[string]string{"data.bin": string(data), "keep.txt": testContent, "appended.txt": "appended without key"} {
+		extracted, err := os.ReadFile(filepath.Join(outputDir, name))
+		if err != nil || string(extracted) != content {
+			t.Errorf("Content mismatch for %s", name)
+		}
+	}
+
+	// Повторное сжатие ничего не освобождает, а запись после него снова дописывается
+	again, err := CompactVault(vaultPath, Password(testPassword), CompactOptions{DryRun: true})
+	if err != nil || again.ReclaimedBytes() != 0 {
+		t.Errorf("Expected nothing to reclaim after compaction, got %v (%v)", again, err)
+	}
+	if err := AddFileToVault(vaultPath, Password(testPassword), keep); err != nil {
+		t.Fatalf("AddFileToVault after compaction failed: %v", err)
+	}
+	if entries, err := ListVault(vaultPath, Password(testPassword)); err != nil || len(entries) != 3 {
+		t.Errorf("ListVault after compaction failed: %v", err)
+	}
+
+	if _, err := CompactVault(vaultPath, Password("WrongPassword1!"), CompactOptions{}); err == nil {
+		t.Error("Expected error for wrong password")
+	}
+}
@@ -0,0 +1,191 @@
+package vault
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// ========================
+// COMPRESSION ALGORITHMS
+// ========================
+//
+// Every payload and chunk records the algorithm it was compressed with, so extraction
+// dispatches on the entry instead of assuming gzip; entries written before the field
+// existed have none recorded and are gzip. The level only matters when compressing and
+// is not stored. In auto mode the start of each file is compressed as a sample, and
+// files that barely shrink (JPEGs, videos, archives) are stored raw instead of spending
+// CPU time on them.
+
+const (
+	// Compression algorithms
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+	CompressionNone = "none"
+
+	// CompressionAuto stores incompressible files raw and compresses the rest with zstd
+	CompressionAuto = "auto"
+
+	// compressionSampleSize is how much of a file auto mode compresses to decide
+	compressionSampleSize = 64 * 1024
+
+	// autoCompressionThreshold is the fraction of its size the sample must shrink
+	// below for the file to be compressed
+	autoCompressionThreshold = 0.9
+)
+
+// Compression selects how file data is compressed when it is added
+type Compression struct {
+	Algorithm string // CompressionGzip (default when empty), CompressionZstd, CompressionNone or CompressionAuto
+	Level     int    // Level of the algorithm (gzip 1-9, zstd 1-22); 0 selects its default
+}
+
+// ParseCompression parses a compression setting such as "zstd:9", "gzip", "none" or "auto"
+func ParseCompression(spec string) (Compression, error) {
+	name, levelText, hasLevel := strings.Cut(strings.ToLower(strings.TrimSpace(spec)), ":")
+	compression := Compression{Algorithm: name}
+
+	if hasLevel {
+		level, err := strconv.Atoi(levelText)
+		if err != nil {
+			return Compression{}, fmt.Errorf("invalid compression level %q", levelText)
+		}
+		compression.Level = level
+	}
+
+	if err := compression.validate(); err != nil {
+		return Compression{}, err
+	}
+	return compression, nil
+}
+
+// String formats the setting the way ParseCompression accepts it
+func (c Compression) String() string {
+	algorithm := c.algorithm()
+	if c.Level == 0 {
+		return algorithm
+	}
+	return fmt.Sprintf("%s:%d", algorithm, c.Level)
+}
+
+// algorithm returns the algorithm name, defaulting to gzip
+func (c Compression) algorithm() string {
+	if c.Algorithm == "" {
+		return CompressionGzip
+	}
+	return c.Algorithm
+}
+
+// validate checks the algorithm and its level
+func (c Compression) validate() error {
+	switch c.algorithm() {
+	case CompressionGzip:
+		if c.Level < 0 || c.Level > gzip.BestCompression {
+			return fmt.Errorf("gzip compression level must be 0 (default) or 1-%d", gzip.BestCompression)
+		}
+	case CompressionZstd, CompressionAuto:
+		if c.Level < 0 || c.Level > 22 {
+			return fmt.Errorf("%s compression level must be 0 (default) or 1-22", c.algorithm())
+		}
+	case CompressionNone:
+		if c.Level != 0 {
+			return fmt.Errorf("no level can be given without compression")
+		}
+	default:
+		return fmt.Errorf("unknown compression algorithm %q (supported: gzip, zstd, none, auto)", c.Algorithm)
+	}
+	return nil
+}
+
+// resolve returns the setting to compress a file with and the reader to read the
+// file from. In auto mode it compresses a sample from the start of the file and
+// selects no compression if it barely shrinks; the returned reader replays the sample
+// before the rest of the file, so the file is still read only once.
+func (c Compression) resolve(source io.Reader) (Compression, io.Reader, error) {
+	if err := c.validate(); err != nil {
+		return Compression{}, nil, err
+	}
+	if c.algorithm() != CompressionAuto {
+		return Compression{Algorithm: c.algorithm(), Level: c.Level}, source, nil
+	}
+
+	sample := make([]byte, compressionSampleSize)
+	n, err := io.ReadFull(source, sample)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return Compression{}, nil, fmt.Errorf("compression sample read error: %w", err)
+	}
+	source = io.MultiReader(bytes.NewReader(sample[:n]), source)
+
+	compressed := Compression{Algorithm: CompressionZstd, Level: c.Level}
+	var sampleSize int64
+	writer, err := newCompressor(&countingWriter{count: &sampleSize}, compressed)
+	if err != nil {
+		return Compression{}, nil, err
+	}
+	writer.Write(sample[:n])
+	if err := writer.Close(); err != nil {
+		return Compression{}, nil, fmt.Errorf("compression finalization error: %w", err)
+	}
+
+	if n == 0 || float64(sampleSize) >= autoCompressionThreshold*float64(n) {
+		return Compression{Algorithm: CompressionNone}, source, nil
+	}
+	return compressed, source, nil
+}
+
+// nopWriteCloser passes writes through for uncompressed data
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// newCompressor returns a writer that compresses into w; Close must be called to
+// flush the compressed stream
+func newCompressor(w io.Writer, c Compression) (io.WriteCloser, error) {
+	switch c.algorithm() {
+	case CompressionGzip:
+		level := c.Level
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		return gzip.NewWriterLevel(w, level)
+	case CompressionZstd:
+		level := zstd.SpeedDefault
+		if c.Level != 0 {
+			level = zstd.EncoderLevelFromZstd(c.Level)
+		}
+		// One goroutine keeps the output identical for the same input and setting
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(level), zstd.WithEncoderConcurrency(1))
+	case CompressionNone:
+		return nopWriteCloser{w}, nil
+	default:
+		return nil, fmt.Errorf("cannot compress with %q", c.Algorithm)
+	}
+}
+
+// newDecompressor returns a reader for data compressed with the given algorithm
+// (empty for entries written before the algorithm was recorded, which are gzip)
+func newDecompressor(r io.Reader, algorithm string) (io.ReadCloser, error) {
+	switch algorithm {
+	case "", CompressionGzip:
+		return decompressDataStreaming(r)
+	case CompressionZstd:
+		decoder, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	case CompressionNone:
+		return io.NopCloser(r), nil
+	default:
+		return nil, fmt.Errorf("unknown compression algorithm %q", algorithm)
+	}
+}
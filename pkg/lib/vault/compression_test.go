@@ -0,0 +1,187 @@
+package vault
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestParseCompression тестирует разбор настройки сжатия
+func TestParseCompression(t *testing.T) {
+	valid := map[string]Compression{
+		"gzip":    {Algorithm: CompressionGzip},
+		"gzip:9":  {Algorithm: CompressionGzip, Level: 9},
+		"zstd:19": {Algorithm: CompressionZstd, Level: 19},
+		"ZSTD":    {Algorithm: CompressionZstd},
+		"none":    {Algorithm: CompressionNone},
+		"auto:3":  {Algorithm: CompressionAuto, Level: 3},
+	}
+	for spec, expected := range valid {
+		compression, err := ParseCompression(spec)
+		if err != nil || compression != expected {
+			t.Errorf("ParseCompression(%q) = %+v, %v; expected %+v", spec, compression, err, expected)
+		}
+		if reparsed, err := ParseCompression(compression.String()); err != nil || reparsed != compression {
+			t.Errorf("%q does not survive formatting as %q", spec, compression.String())
+		}
+	}
+
+	for _, spec := range []string{"brotli", "gzip:10", "zstd:23", "zstd:fast", "none:1"} {
+		if _, err := ParseCompression(spec); err == nil {
+			t.Errorf("Expected error for %q", spec)
+		}
+	}
+}
+
+// countingReader считает байты, прочитанные из источника, чтобы проверить, сколько раз читается файл
+type countingReader struct {
+	reader io.Reader
+	count  int
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.count += n
+	return n, err
+}
+
+// TestResolveAutoCompression тестирует, что выборка auto не читает файл повторно
+func TestResolveAutoCompression(t *testing.T) {
+	text := []byte(strings.Repeat("compressible line of text\n", 20000))
+	random := make([]byte, 200*1024)
+	rand.Read(random)
+
+	for name, data := range map[string][]byte{"text": text, "random": random, "short": text[:100], "empty": nil} {
+		source := &countingReader{reader: bytes.NewReader(data)}
+		_, reader, err := Compression{Algorithm: CompressionAuto}.resolve(source)
+		if err != nil {
+			t.Fatalf("%s: resolve failed: %v", name, err)
+		}
+		replayed, err := io.ReadAll(reader)
+		if err != nil {
+			t.Fatalf("%s: read failed: %v", name, err)
+		}
+		if !bytes.Equal(replayed, data) {
+			t.Errorf("%s: data read after the sample does not match the file", name)
+		}
+		if source.count != len(data) {
+			t.Errorf("%s: %d bytes read from a file of %d", name, source.count, len(data))
+		}
+	}
+}
+
+// TestCompressionAlgorithms тестирует запись и извлечение с каждым алгоритмом во всех форматах vault
+func TestCompressionAlgorithms(t *testing.T) {
+	tmpDir := setupCoreTest(t)
+	defer cleanupCoreTest(t, tmpDir)
+
+	text := strings.Repeat("compressible line of text\n", 20000)
+	random := make([]byte, 200*1024)
+	rand.Read(random)
+	textPath := createTestFile(t, tmpDir, "text.txt", text)
+	randomPath := filepath.Join(tmpDir, "random.bin")
+	if err := os.WriteFile(randomPath, random, 0644); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+
+	for _, version := range []uint32{2, PayloadEncryptionVersion, CurrentVaultVersion} {
+		for _, spec := range []string{"gzip:1", "zstd", "zstd:19", "none", "auto"} {
+			t.Run(fmt.Sprintf("v%d/%s", version, spec), func(t *testing.T) {
+				compression, err := ParseCompression(spec)
+				if err != nil {
+					t.Fatalf("ParseCompression failed: %v", err)
+				}
+
+				vaultPath := filepath.Join(tmpDir, fmt.Sprintf("v%d-%s.vault", version, strings.ReplaceAll(spec, ":", "-")))
+				vaultDir := VaultDirectory{Version: version, Entries: []FileEntry{}, CreatedAt: time.Now()}
+				params := testArgon2Params
+				if version < MasterKeyVersion {
+					params = DefaultKDFParams() // Legacy vaults only support PBKDF2
+				}
+				if err := saveVaultDirectory(vaultPath, Password(testPassword), vaultDir, params, nil); err != nil {
+					t.Fatalf("saveVaultDirectory failed: %v", err)
+				}
+
+				opts := AddOptions{Compression: compression}
+				if err := AddFileToVaultWithOptions(vaultPath, Password(testPassword), textPath, opts); err != nil {
+					t.Fatalf("AddFileToVaultWithOptions failed: %v", err)
+				}
+				config := DefaultParallelConfig()
+				config.Compression = compression
+				if _, err := AddMultipleFilesToVaultParallel(vaultPath, Password(testPassword), []string{randomPath}, config); err != nil {
+					t.Fatalf("AddMultipleFilesToVaultParallel failed: %v", err)
+				}
+
+				// Для auto несжимаемый файл хранится без сжатия, остальные сжимаются zstd
+				expected := map[string]string{"text.txt": compression.Algorithm, "random.bin": compression.Algorithm}
+				if compression.Algorithm == CompressionAuto {
+					expected = map[string]string{"text.txt": CompressionZstd, "random.bin": CompressionNone}
+				}
+
+				entries, err := ListVault(vaultPath, Password(testPassword))
+				if err != nil {
+					t.Fatalf("ListVault failed: %v", err)
+				}
+				for _, entry := range entries {
+					algorithm := entry.Compression
+					if len(entry.Chunks) > 0 {
+						algorithm = entry.Chunks[0].Compression
+					}
+					if algorithm != expected[entry.Path] {
+						t.Errorf("%s is stored with %q, expected %q", entry.Path, algorithm, expected[entry.Path])
+					}
+				}
+
+				outputDir := filepath.Join(tmpDir, "output-"+filepath.Base(vaultPath))
+				if err := ExtractFromVault(vaultPath, Password(testPassword), outputDir); err != nil {
+					t.Fatalf("ExtractFromVault failed: %v", err)
+				}
+				if extracted, err := os.ReadFile(filepath.Join(outputDir, "text.txt")); err != nil || string(extracted) != text {
+					t.Errorf("Content mismatch for text.txt (%v)", err)
+				}
+				if extracted, err := os.ReadFile(filepath.Join(outputDir, "random.bin")); err != nil || !bytes.Equal(extracted, random) {
+					t.Errorf("Content mismatch for random.bin (%v)", err)
+				}
+			})
+		}
+	}
+}
+
+// TestAppendWithCompression тестирует выбор сжатия при добавлении без пароля
+func TestAppendWithCompression(t *testing.T) {
+	tmpDir := setupCoreTest(t)
+	defer cleanupCoreTest(t, tmpDir)
+
+	vaultPath := filepath.Join(tmpDir, "append.vault")
+	if err := CreateVaultWithKDF(vaultPath, Password(testPassword), testArgon2Params); err != nil {
+		t.Fatalf("CreateVaultWithKDF failed: %v", err)
+	}
+
+	source := createTestFile(t, tmpDir, "report.txt", strings.Repeat(testContent, 1000))
+	if err := AppendToVaultWithOptions(vaultPath, source, AddOptions{Compression: Compression{Algorithm: CompressionZstd, Level: 3}}); err != nil {
+		t.Fatalf("AppendToVaultWithOptions failed: %v", err)
+	}
+
+	entries, err := ListVault(vaultPath, Password(testPassword))
+	if err != nil || len(entries) != 1 || entries[0].Compression != CompressionZstd {
+		t.Fatalf("Unexpected entries after append: %+v (%v)", entries, err)
+	}
+
+	outputDir := filepath.Join(tmpDir, "output")
+	if err := ExtractFromVault(vaultPath, Password(testPassword), outputDir); err != nil {
+		t.Fatalf("ExtractFromVault failed: %v", err)
+	}
+	if extracted, err := os.ReadFile(filepath.Join(outputDir, "report.txt")); err != nil || string(extracted) != strings.Repeat(testContent, 1000) {
+		t.Errorf("Content mismatch after append (%v)", err)
+	}
+
+	if err := AppendToVaultWithOptions(vaultPath, source, AddOptions{Compression: Compression{Algorithm: "lz4"}}); err == nil {
+		t.Error("Expected error for an unknown algorithm")
+	}
+}
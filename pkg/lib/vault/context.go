@@ -0,0 +1,101 @@
+package vault
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+// ========================
+// CANCELLATION
+// ========================
+//
+// Long-running operations take a context through their options (AddOptions,
+// ExtractOptions, CompactOptions) or ParallelConfig. It is checked between files and
+// on every read of file data, so a cancelled operation stops within one buffer. The
+// write in progress is undone: appends cut the file back, rewrites remove their
+// temporary file and staging removes its spool files, so nothing of a cancelled batch
+// reaches the vault; a parallel add commits the directories and links of a tree with
+// its files. Writes committed before (the earlier entries of AddDirectoryToVault, which
+// commits entry by entry) remain. Once the new directory is being committed the write
+// is no longer interrupted.
+//
+// ParallelConfig.Timeout bounds how long a single file may go without progress
+// rather than its total duration, so large files are not cut off while they move.
+
+// ErrTimeout is returned for a file that made no progress within ParallelConfig.Timeout
+var ErrTimeout = errors.New("operation made no progress within the timeout")
+
+// orBackground returns ctx, or the background context for options that set none
+func orBackground(ctx context.Context) context.Context {
+	if ctx == nil {
+		return context.Background()
+	}
+	return ctx
+}
+
+// contextError returns the reason the context was cancelled, or nil
+func contextError(ctx context.Context) error {
+	if ctx.Err() == nil {
+		return nil
+	}
+	return context.Cause(ctx)
+}
+
+// idleContext is cancelled with ErrTimeout when no progress is reported for the timeout
+type idleContext struct {
+	context.Context
+	cancel  context.CancelCauseFunc
+	timer   *time.Timer
+	timeout time.Duration
+}
+
+// withIdleTimeout derives a context for one file; a zero timeout never expires.
+// stop must be called when the file is done.
+func withIdleTimeout(parent context.Context, timeout time.Duration) *idleContext {
+	ctx, cancel := context.WithCancelCause(parent)
+	idle := &idleContext{Context: ctx, cancel: cancel, timeout: timeout}
+	if timeout > 0 {
+		idle.timer = time.AfterFunc(timeout, func() { cancel(ErrTimeout) })
+	}
+	return idle
+}
+
+// touch reports progress, restarting the timeout
+func (c *idleContext) touch() {
+	if c.timer != nil {
+		c.timer.Reset(c.timeout)
+	}
+}
+
+// stop releases the timer
+func (c *idleContext) stop() {
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	c.cancel(nil)
+}
+
+// contextReader fails reads once its context is cancelled and reports the progress
+// of reads to an idle timeout
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+// newContextReader wraps r so reading it stops when ctx is cancelled
+func newContextReader(ctx context.Context, r io.Reader) io.Reader {
+	return &contextReader{ctx: ctx, r: r}
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := contextError(c.ctx); err != nil {
+		return 0, err
+	}
+	n, err := c.r.Read(p)
+	if idle, ok := c.ctx.(*idleContext); ok && n > 0 {
+		idle.touch()
+	}
+	return n, err
+}
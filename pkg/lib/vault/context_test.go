@@ -0,0 +1,177 @@
+package vault
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// assertVaultUnchanged проверяет, что файл vault не изменился и временные файлы удалены
+func assertVaultUnchanged(t *testing.T, vaultPath string, before []byte) {
+	t.Helper()
+
+	after, err := os.ReadFile(vaultPath)
+	if err != nil {
+		t.Fatalf("Failed to read vault: %v", err)
+	}
+	if !bytes.Equal(after, before) {
+		t.Error("Cancelled operation changed the vault file")
+	}
+	if leftovers, _ := filepath.Glob(vaultPath + ".*.tmp"); len(leftovers) > 0 {
+		t.Errorf("Cancelled operation left temporary files: %v", leftovers)
+	}
+}
+
+// TestCancelledAdd тестирует отмену добавления до и во время чтения файлов
+func TestCancelledAdd(t *testing.T) {
+	tmpDir := setupCoreTest(t)
+	defer cleanupCoreTest(t, tmpDir)
+
+	sourceDir := filepath.Join(tmpDir, "source")
+	os.MkdirAll(sourceDir, 0755)
+	var files []string
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		files = append(files, createTestFile(t, sourceDir, name, strings.Repeat(name, 100000)))
+	}
+
+	for _, version := range []uint32{2, CurrentVaultVersion} {
+		vaultPath := filepath.Join(tmpDir, "cancel.vault")
+		os.Remove(vaultPath)
+		params := testArgon2Params
+		if version < MasterKeyVersion {
+			params = DefaultKDFParams() // Legacy vaults only support PBKDF2
+		}
+		vaultDir := VaultDirectory{Version: version, Entries: []FileEntry{}, CreatedAt: time.Now()}
+		if err := saveVaultDirectory(vaultPath, Password(testPassword), vaultDir, params, nil); err != nil {
+			t.Fatalf("saveVaultDirectory failed: %v", err)
+		}
+		before, _ := os.ReadFile(vaultPath)
+
+		// Отменённый заранее контекст не читает ни одного файла
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		config := DefaultParallelConfig()
+		config.Context = ctx
+		if _, err := AddMultipleFilesToVaultParallel(vaultPath, Password(testPassword), files, config); !errors.Is(err, context.Canceled) {
+			t.Errorf("v%d: expected context.Canceled, got %v", version, err)
+		}
+		if err := AddFileToVaultWithOptions(vaultPath, Password(testPassword), files[0], AddOptions{Context: ctx}); !errors.Is(err, context.Canceled) {
+			t.Errorf("v%d: expected context.Canceled for a single file, got %v", version, err)
+		}
+		assertVaultUnchanged(t, vaultPath, before)
+
+		// Отмена после начала чтения первого файла
+		ctx, cancel = context.WithCancel(context.Background())
+		progress := make(chan string)
+		go func() {
+			<-progress
+			cancel()
+			for range progress {
+			}
+		}()
+		config = DefaultParallelConfig()
+		config.Context = ctx
+		config.MaxConcurrency = 1
+		config.ProgressChan = progress
+		if _, err := AddMultipleFilesToVaultParallel(vaultPath, Password(testPassword), files, config); !errors.Is(err, context.Canceled) {
+			t.Errorf("v%d: expected context.Canceled after the first file, got %v", version, err)
+		}
+		close(progress)
+		assertVaultUnchanged(t, vaultPath, before)
+	}
+}
+
+// TestCancelledExtractAndCompact тестирует отмену извлечения и сжатия vault
+func TestCancelledExtractAndCompact(t *testing.T) {
+	tmpDir := setupCoreTest(t)
+	defer cleanupCoreTest(t, tmpDir)
+
+	vaultPath := filepath.Join(tmpDir, "cancel.vault")
+	if err := CreateVaultWithKDF(vaultPath, Password(testPassword), testArgon2Params); err != nil {
+		t.Fatalf("CreateVaultWithKDF failed: %v", err)
+	}
+	source := createTestFile(t, tmpDir, "data.txt", strings.Repeat(testContent, 10000))
+	for i := 0; i < 2; i++ {
+		if err := AddFileToVault(vaultPath, Password(testPassword), source); err != nil {
+			t.Fatalf("AddFileToVault failed: %v", err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	outputDir := filepath.Join(tmpDir, "output")
+	if err := ExtractFromVaultWithOptions(vaultPath, Password(testPassword), outputDir, ExtractOptions{Context: ctx}); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled for extraction, got %v", err)
+	}
+	config := DefaultParallelConfig()
+	config.Context = ctx
+	if _, err := ExtractMultipleFilesFromVaultParallel(vaultPath, Password(testPassword), outputDir, []string{"data.txt"}, config); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled for parallel extraction, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(outputDir, "data.txt")); !os.IsNotExist(err) {
+		t.Error("Cancelled extraction left an output file")
+	}
+
+	// Прерванная запись файла удаляет неполный файл
+	v, err := OpenVault(vaultPath, Password(testPassword))
+	if err != nil {
+		t.Fatalf("OpenVault failed: %v", err)
+	}
+	defer v.Close()
+	entries, err := v.List()
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	os.MkdirAll(outputDir, 0755)
+	partial := filepath.Join(outputDir, "partial.txt")
+	if err := v.extractEntry(ctx, entries[0], partial); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled for an entry, got %v", err)
+	}
+	if _, err := os.Stat(partial); !os.IsNotExist(err) {
+		t.Error("Cancelled entry left an output file")
+	}
+
+	before, _ := os.ReadFile(vaultPath)
+	if _, err := CompactVault(vaultPath, Password(testPassword), CompactOptions{Context: ctx}); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled for compaction, got %v", err)
+	}
+	assertVaultUnchanged(t, vaultPath, before)
+}
+
+// TestIdleTimeout тестирует тайм-аут операции без прогресса
+func TestIdleTimeout(t *testing.T) {
+	// Регулярное чтение продлевает тайм-аут
+	ctx := withIdleTimeout(context.Background(), 100*time.Millisecond)
+	reader := newContextReader(ctx, strings.NewReader(strings.Repeat("x", 10)))
+	buffer := make([]byte, 1)
+	for i := 0; i < 10; i++ {
+		time.Sleep(30 * time.Millisecond)
+		if _, err := reader.Read(buffer); err != nil {
+			t.Fatalf("Read %d failed while making progress: %v", i, err)
+		}
+	}
+	ctx.stop()
+
+	// Простой дольше тайм-аута прерывает чтение
+	ctx = withIdleTimeout(context.Background(), 20*time.Millisecond)
+	defer ctx.stop()
+	reader = newContextReader(ctx, strings.NewReader("data"))
+	time.Sleep(100 * time.Millisecond)
+	if _, err := reader.Read(buffer); !errors.Is(err, ErrTimeout) {
+		t.Errorf("Expected ErrTimeout, got %v", err)
+	}
+
+	// Нулевой тайм-аут не ограничивает время
+	ctx = withIdleTimeout(context.Background(), 0)
+	defer ctx.stop()
+	time.Sleep(10 * time.Millisecond)
+	if err := contextError(ctx); err != nil {
+		t.Errorf("Zero timeout expired: %v", err)
+	}
+}
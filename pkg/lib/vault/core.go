@@ -11,19 +11,18 @@ import (
 	"crypto/cipher"
 	"crypto/rand"
 	"crypto/sha256"
-	"encoding/binary"
-	"encoding/json"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"runtime"
+	"slices"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
 
-	"golang.org/x/crypto/pbkdf2"
 	"golang.org/x/term"
 )
 
@@ -38,49 +37,70 @@ const (
 	PBKDF2Iters = 100000 // PBKDF2 iterations (recommended minimum)
 
 	// Current vault format version
-	CurrentVaultVersion = 2
+	CurrentVaultVersion = 5
 
 	// Buffer size for streaming operations (1MB)
 	StreamBufferSize = 1024 * 1024
+
+	// Staged data a batch add keeps in memory before spooling it (64MB)
+	DefaultMemoryBudget = 64 * 1024 * 1024
 )
 
 // FileEntry represents a file or directory entry in vault with optimizations
 type FileEntry struct {
-	Path           string    `json:"path"`            // Path to file/directory
-	Name           string    `json:"name"`            // Name of file/directory
-	IsDir          bool      `json:"is_dir"`          // Whether it's a directory
-	Size           int64     `json:"size"`            // Original file size (0 for directories)
-	CompressedSize int64     `json:"compressed_size"` // Size after compression
-	Mode           uint32    `json:"mode"`            // Access permissions
-	ModTime        time.Time `json:"mod_time"`        // Last modification time
-	Offset         int64     `json:"offset"`          // Offset in vault file where data starts
-	SHA256Hash     [32]byte  `json:"sha256_hash"`     // SHA-256 hash for integrity verification
+	Path           string     `json:"path"`                  // Path to file/directory
+	Name           string     `json:"name"`                  // Name of file/directory
+	IsDir          bool       `json:"is_dir"`                // Whether it's a directory
+	Size           int64      `json:"size"`                  // Original file size (0 for directories)
+	CompressedSize int64      `json:"compressed_size"`       // Size of stored payload (compressed, and encrypted since v3)
+	Mode           uint32     `json:"mode"`                  // Access permissions
+	ModTime        time.Time  `json:"mod_time"`              // Last modification time
+	Offset         int64      `json:"offset"`                // Offset in vault file where data starts
+	SHA256Hash     [32]byte   `json:"sha256_hash"`           // SHA-256 hash for integrity verification
+	PayloadSalt    [32]byte   `json:"payload_salt"`          // Salt for per-file payload key derivation (v3+)
+	PayloadKey     []byte     `json:"payload_key,omitempty"` // Key of an appended segment the payload was sealed with (instead of the vault key)
+	IsSymlink      bool       `json:"is_symlink,omitempty"`  // Whether it's a symbolic link (no payload)
+	LinkTarget     string     `json:"link_target,omitempty"` // Target of a symbolic link, slash-separated
+	Chunks         []ChunkRef `json:"chunks,omitempty"`      // Deduplicated chunks of the file data, in order (v4+)
+	Compression    string     `json:"compression,omitempty"` // Compression algorithm of the payload (empty for gzip)
 }
 
 // VaultDirectory contains only metadata - NO file contents in memory
 type VaultDirectory struct {
-	Version   uint32      `json:"version"`    // Vault format version
-	Entries   []FileEntry `json:"entries"`    // File/directory metadata only
-	CreatedAt time.Time   `json:"created_at"` // Vault creation time
-	Comment   string      `json:"comment"`    // Vault comment
+	Version   uint32      `json:"version"`             // Vault format version
+	Entries   []FileEntry `json:"entries"`             // File/directory metadata only
+	CreatedAt time.Time   `json:"created_at"`          // Vault creation time
+	Comment   string      `json:"comment"`             // Vault comment
+	InboxKey  []byte      `json:"inbox_key,omitempty"` // X25519 private key that opens appended segments (v3+)
+
+	index          map[string]int  // Positions of the entries by path; see entryIndex
+	inboxConflicts []InboxConflict // Appended entries renamed when merged; see resolveInboxConflicts
 }
 
-// VaultHeader contains vault metadata
+// VaultHeader contains vault metadata.
+// Since v3 the whole header is bound to the encrypted directory as associated data.
 type VaultHeader struct {
-	Magic         [8]byte  // "FLINT001"
-	Version       uint32   // Format version
-	Iterations    uint32   // PBKDF2 iteration count
-	Salt          [32]byte // Salt for key derivation
-	Nonce         [12]byte // Nonce for AES-GCM
-	DirectorySize uint64   // Size of encrypted directory data
+	Magic         [8]byte              // "FLINT001"
+	Version       uint32               // Format version
+	Nonce         [12]byte             // Nonce for AES-GCM
+	DirectorySize uint64               // Size of encrypted directory data
+	InboxKey      [32]byte             // X25519 public key for appends without a password (v3+)
+	KeySlots      [MaxKeySlots]KeySlot // Master key wrapped per password/keyfile (legacy: slot 0 holds the KDF parameters)
+	Checksum      [16]byte             // Truncated SHA-256 and master key HMAC of the preceding fields (v3+)
 }
 
 // ParallelConfig configures parallel processing parameters
 type ParallelConfig struct {
 	MaxConcurrency int             // Maximum number of concurrent workers
-	Timeout        time.Duration   // Timeout for individual operations
+	Timeout        time.Duration   // Longest time a single file may go without progress (zero for no limit)
 	ProgressChan   chan string     // Progress reporting channel (optional)
-	Context        context.Context // Context for cancellation
+	Context        context.Context // Context for cancellation (nil for none)
+	MemoryBudget   int64           // Compressed data held in memory for the vault writer; the rest is spooled to disk
+
+	AllowUnsafePaths bool        // Extract entries with absolute or escaping paths unchecked (see ExtractOptions)
+	Symlinks         SymlinkMode // How symbolic links inside added directories are stored
+	Compression      Compression // How added files are compressed (gzip by default)
+	SnapshotCheck    bool        // Fail files that change while they are read (see AddOptions)
 }
 
 // ParallelStats tracks parallel operation statistics
@@ -92,15 +112,23 @@ type ParallelStats struct {
 	Duration        time.Duration // Total processing duration
 	Errors          []error       // Collection of errors encountered
 	ErrorsMutex     sync.Mutex    // Mutex for thread-safe error collection
+
+	// Phases of an add. Compression and writing overlap, so they add up to more than
+	// Duration when the writer keeps up with the workers.
+	ScanDuration     time.Duration // Walking the source directory
+	CompressDuration time.Duration // Reading, compressing and encrypting files, until the last worker finished
+	WriteDuration    time.Duration // Writing compressed data into the vault (excluding waits for workers)
+	CommitDuration   time.Duration // Committing the new directory
 }
 
-// FileMetadata represents pre-calculated file metadata for batch operations
+// FileMetadata describes a file staged for a batch add
 type FileMetadata struct {
 	FilePath       string
 	StorePath      string
 	FileInfo       os.FileInfo
 	Hash           [32]byte
 	CompressedSize int64
+	Compression    Compression // Setting the file is compressed with (resolved for auto mode)
 	Error          error
 }
 
@@ -110,41 +138,66 @@ func DefaultParallelConfig() *ParallelConfig {
 		MaxConcurrency: runtime.NumCPU() * 2, // 2x CPU cores for I/O bound operations
 		Timeout:        5 * time.Minute,
 		Context:        context.Background(),
+		MemoryBudget:   DefaultMemoryBudget,
 	}
 }
 
-// Global vault access synchronization
-var vaultMutexes = make(map[string]*sync.Mutex)
-var vaultMutexesLock sync.Mutex
+// ========================
+// VAULT CREATION
+// ========================
 
-// getVaultMutex returns a mutex for a specific vault file
-func getVaultMutex(vaultPath string) *sync.Mutex {
-	vaultMutexesLock.Lock()
-	defer vaultMutexesLock.Unlock()
+// CreateVault creates a new optimized vault file using the default key derivation (PBKDF2)
+func CreateVault(path string, keySource KeySource) error {
+	return CreateVaultWithKDF(path, keySource, DefaultKDFParams())
+}
 
-	if mutex, exists := vaultMutexes[vaultPath]; exists {
-		return mutex
+// CreateVaultWithKDF creates a new vault whose key is derived with the given KDF parameters
+func CreateVaultWithKDF(path string, keySource KeySource, params KDFParams) error {
+	if keySource == nil {
+		return fmt.Errorf("key source cannot be nil")
 	}
-
-	mutex := &sync.Mutex{}
-	vaultMutexes[vaultPath] = mutex
-	return mutex
+	return CreateVaultWithRecipients(path, keySource, params, nil)
 }
 
-// ========================
-// VAULT CREATION
-// ========================
+// CreateVaultWithRecipients creates a new vault that can be opened by keySource and by the
+// identity of each recipient. keySource may be nil when there is at least one recipient.
+func CreateVaultWithRecipients(path string, keySource KeySource, params KDFParams, recipients []Recipient) error {
+	if keySource == nil && len(recipients) == 0 {
+		return fmt.Errorf("key source cannot be nil")
+	}
 
-// CreateVault creates a new optimized vault file
-func CreateVault(path string, password string) error {
-	if len(password) == 0 {
-		return fmt.Errorf("password cannot be empty")
+	if keySource != nil {
+		// Reject an empty password or unreadable keyfile before creating anything
+		secret, err := keySource.Secret()
+		if err != nil {
+			return err
+		}
+		clearKey(secret)
 	}
 
 	if path == "" {
 		return fmt.Errorf("file path cannot be empty")
 	}
 
+	if err := params.Validate(); err != nil {
+		return fmt.Errorf("invalid key derivation parameters: %w", err)
+	}
+
+	slots := len(recipients)
+	if keySource != nil {
+		slots++
+	}
+	if slots > MaxKeySlots {
+		return fmt.Errorf("too many recipients: a vault has %d key slots", MaxKeySlots)
+	}
+
+	// Lock the path, so two creations in this process cannot race
+	unlock, err := lockVault(path, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
 	// Check that file doesn't exist
 	if _, err := os.Stat(path); err == nil {
 		return fmt.Errorf("vault file already exists: %s", path)
@@ -158,7 +211,7 @@ func CreateVault(path string, password string) error {
 		Comment:   "Encrypted Flint Vault Storage (Optimized)",
 	}
 
-	return saveVaultDirectory(path, password, vaultDir)
+	return saveVaultDirectory(path, keySource, vaultDir, params, recipients)
 }
 
 // ========================
@@ -188,12 +241,36 @@ func ReadPasswordSecurely(prompt string) (string, error) {
 // ========================
 
 // AddFileToVault adds a file to vault with streaming and integrity checking
-func AddFileToVault(vaultPath, password, filePath string) error {
-	return addFileToVaultWithBasePath(vaultPath, password, filePath, "")
+func AddFileToVault(vaultPath string, keySource KeySource, filePath string) error {
+	return AddFileToVaultWithOptions(vaultPath, keySource, filePath, AddOptions{})
+}
+
+// AddFileToVaultWithOptions adds a file to vault, compressing it as the options select
+func AddFileToVaultWithOptions(vaultPath string, keySource KeySource, filePath string, opts AddOptions) error {
+	v, err := OpenVault(vaultPath, keySource)
+	if err != nil {
+		return err
+	}
+	defer v.Close()
+
+	return v.AddFile(filePath, opts)
+}
+
+// AddFile adds a file (or a directory with its contents) to the vault
+func (v *Vault) AddFile(filePath string, opts AddOptions) error {
+	// Lock the vault against other goroutines and processes
+	unlock, err := v.lock(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return v.addFile(filePath, "", opts)
 }
 
-// addFileToVaultWithBasePath adds a file to vault with optional base path for relative path calculation
-func addFileToVaultWithBasePath(vaultPath, password, filePath, basePath string) error {
+// addFile adds a file with optional base path for relative path calculation; the
+// caller holds the exclusive vault lock
+func (v *Vault) addFile(filePath, basePath string, opts AddOptions) error {
 	// Check if file is a directory
 	fileInfo, err := os.Stat(filePath)
 	if err != nil {
@@ -201,89 +278,107 @@ func addFileToVaultWithBasePath(vaultPath, password, filePath, basePath string)
 	}
 
 	if fileInfo.IsDir() {
-		return AddDirectoryToVault(vaultPath, password, filePath)
+		return v.addDirectory(filePath, opts)
 	}
 
-	// Load existing vault directory
-	vaultDir, err := loadVaultDirectory(vaultPath, password)
+	batch, err := newStagingBatch(v.path, v.header, v.key, v.dir, opts)
 	if err != nil {
-		return fmt.Errorf("vault directory load error: %w", err)
+		return err
 	}
+	defer batch.close()
 
-	// First pass: calculate metadata (hash and compressed size) using streaming
-	fileHash, compressedSize, err := calculateFileMetadata(filePath)
-	if err != nil {
-		return fmt.Errorf("metadata calculation error: %w", err)
+	// Read the file once, then write it and the directory to the vault
+	files := batch.stageFiles([]string{filePath}, basePath, 1, nil)
+	if err := v.written(batch.commit(v.dir, files)); err != nil {
+		return err
 	}
+	return files[0].Error
+}
 
-	// Calculate the correct path to store in vault
-	var storePath string
-	if basePath == "" {
-		// Single file addition - store only filename
-		storePath = fileInfo.Name()
-	} else {
-		// File from directory - calculate relative path starting from directory name
-		relativePath, err := filepath.Rel(basePath, filePath)
-		if err != nil {
-			// Fallback to original path if relative calculation fails
-			storePath = filepath.Clean(filePath)
-		} else {
-			// Add directory name to the beginning of relative path
-			dirName := filepath.Base(basePath)
-			storePath = filepath.Join(dirName, relativePath)
-		}
-	}
+// AddDirectoryToVault adds a directory and all its contents to the vault,
+// storing symbolic links inside it as links
+func AddDirectoryToVault(vaultPath string, keySource KeySource, dirPath string) error {
+	return AddDirectoryToVaultWithOptions(vaultPath, keySource, dirPath, AddOptions{})
+}
 
-	// Create file entry with metadata (we'll calculate offset later)
-	entry := FileEntry{
-		Path:           storePath,
-		Name:           fileInfo.Name(),
-		IsDir:          false,
-		Size:           fileInfo.Size(),
-		CompressedSize: compressedSize,
-		Mode:           uint32(fileInfo.Mode()),
-		ModTime:        fileInfo.ModTime(),
-		Offset:         0, // Will be set in addFileToVaultStreaming
-		SHA256Hash:     fileHash,
-	}
-
-	// Update vault directory
-	found := false
-	for i, existingEntry := range vaultDir.Entries {
-		if existingEntry.Path == entry.Path {
-			vaultDir.Entries[i] = entry // Update existing
-			found = true
-			break
-		}
+// AddDirectoryToVaultWithOptions adds a directory and all its contents to the vault
+func AddDirectoryToVaultWithOptions(vaultPath string, keySource KeySource, dirPath string, opts AddOptions) error {
+	v, err := OpenVault(vaultPath, keySource)
+	if err != nil {
+		return err
 	}
+	defer v.Close()
 
-	if !found {
-		vaultDir.Entries = append(vaultDir.Entries, entry) // Add new
+	return v.AddDirectory(dirPath, opts)
+}
+
+// AddDirectory adds a directory and all its contents to the vault entry by entry
+func (v *Vault) AddDirectory(dirPath string, opts AddOptions) error {
+	// Lock the vault against other goroutines and processes
+	unlock, err := v.lock(true)
+	if err != nil {
+		return err
 	}
+	defer unlock()
 
-	// Second pass: stream compressed data directly to vault file
-	return addFileToVaultStreaming(vaultPath, password, *vaultDir, filePath)
+	return v.addDirectory(dirPath, opts)
 }
 
-// AddDirectoryToVault adds a directory and all its contents to the vault
-func AddDirectoryToVault(vaultPath, password, dirPath string) error {
-	return filepath.Walk(dirPath, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
+// addDirectory adds a directory entry by entry; the caller holds the exclusive vault lock
+func (v *Vault) addDirectory(dirPath string, opts AddOptions) error {
+	ctx := orBackground(opts.Context)
+	return walkSourceTree(dirPath, opts.Symlinks, func(path string, info os.FileInfo, linkTarget string) error {
+		if err := contextError(ctx); err != nil {
 			return err
 		}
 
+		if isSymlink(info) {
+			return v.addSymlinkEntry(path, info, linkTarget, dirPath)
+		}
+
 		if info.IsDir() {
-			return addDirectoryEntry(vaultPath, password, path, info, dirPath)
+			return v.addDirectoryEntry(path, info, dirPath)
 		}
 
 		// Use the internal function with basePath for proper relative path calculation
-		return addFileToVaultWithBasePath(vaultPath, password, path, dirPath)
+		return v.addFile(path, dirPath, opts)
 	})
 }
 
 // ExtractFromVault extracts all files from vault to specified directory
-func ExtractFromVault(vaultPath, password, outputDir string) error {
-	vaultDir, err := loadVaultDirectory(vaultPath, password)
+func ExtractFromVault(vaultPath string, keySource KeySource, outputDir string) error {
+	return ExtractFromVaultWithOptions(vaultPath, keySource, outputDir, ExtractOptions{})
+}
+
+// ExtractFromVaultWithOptions extracts all files from vault to specified directory.
+// Unless opts.AllowUnsafePaths is set, nothing is extracted if any entry path is unsafe.
+func ExtractFromVaultWithOptions(vaultPath string, keySource KeySource, outputDir string, opts ExtractOptions) error {
+	v, err := OpenVault(vaultPath, keySource)
+	if err != nil {
+		return err
+	}
+	defer v.Close()
+
+	return v.Extract(outputDir, opts)
+}
+
+// Extract extracts all files from the vault to the specified directory.
+// Unless opts.AllowUnsafePaths is set, nothing is extracted if any entry path is unsafe.
+func (v *Vault) Extract(outputDir string, opts ExtractOptions) error {
+	// Lock the vault against writers in other goroutines and processes
+	unlock, err := v.lock(false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return v.extractEntries(outputDir, v.dir.Entries, opts)
+}
+
+// extractEntries extracts the given entries one after another; the caller holds the
+// vault lock
+func (v *Vault) extractEntries(outputDir string, entries []FileEntry, opts ExtractOptions) error {
+	outputPaths, err := resolveExtractPaths(outputDir, entries, opts.AllowUnsafePaths)
 	if err != nil {
 		return err
 	}
@@ -292,65 +387,141 @@ func ExtractFromVault(vaultPath, password, outputDir string) error {
 		return fmt.Errorf("output directory creation error: %w", err)
 	}
 
-	for _, entry := range vaultDir.Entries {
-		if entry.IsDir {
-			dirPath := filepath.Join(outputDir, entry.Path)
-			if err := os.MkdirAll(dirPath, os.FileMode(entry.Mode)); err != nil {
-				return fmt.Errorf("directory creation error: %w", err)
-			}
-		} else {
-			if err := extractFileEntry(vaultPath, password, entry, outputDir); err != nil {
-				return fmt.Errorf("file extraction error for %s: %w", entry.Path, err)
-			}
+	// Links are created last, so no entry is written through a link
+	ctx := orBackground(opts.Context)
+	for i, entry := range entries {
+		if entry.IsSymlink {
+			continue
+		}
+		if err := v.extractEntry(ctx, entry, outputPaths[i]); err != nil {
+			return fmt.Errorf("file extraction error for %s: %w", entry.Path, err)
 		}
 	}
 
-	return nil
+	return extractSymlinks(entries, outputPaths)
 }
 
 // GetFromVault extracts specific files from vault
-func GetFromVault(vaultPath, password, outputDir string, targetPaths []string) error {
-	vaultDir, err := loadVaultDirectory(vaultPath, password)
+func GetFromVault(vaultPath string, keySource KeySource, outputDir string, targetPaths []string) error {
+	return GetFromVaultWithOptions(vaultPath, keySource, outputDir, targetPaths, ExtractOptions{})
+}
+
+// GetFromVaultWithOptions extracts specific files from vault.
+// Unless opts.AllowUnsafePaths is set, nothing is extracted if any selected entry path is unsafe.
+func GetFromVaultWithOptions(vaultPath string, keySource KeySource, outputDir string, targetPaths []string, opts ExtractOptions) error {
+	v, err := OpenVault(vaultPath, keySource)
 	if err != nil {
 		return err
 	}
+	defer v.Close()
 
-	if err := os.MkdirAll(outputDir, 0755); err != nil {
-		return fmt.Errorf("output directory creation error: %w", err)
+	return v.Get(outputDir, targetPaths, opts)
+}
+
+// Get extracts specific files from the vault.
+// Unless opts.AllowUnsafePaths is set, nothing is extracted if any selected entry path is unsafe.
+func (v *Vault) Get(outputDir string, targetPaths []string, opts ExtractOptions) error {
+	// Lock the vault against writers in other goroutines and processes
+	unlock, err := v.lockLookup()
+	if err != nil {
+		return err
 	}
+	defer unlock()
 
-	// Create a map for fast lookup
-	targetMap := make(map[string]bool)
-	for _, path := range targetPaths {
-		targetMap[filepath.Clean(path)] = true
+	entries, err := v.selectEntries(targetPaths)
+	if err != nil {
+		return err
 	}
+	return v.extractEntries(outputDir, entries, opts)
+}
 
-	for _, entry := range vaultDir.Entries {
-		if targetMap[entry.Path] {
-			if entry.IsDir {
-				dirPath := filepath.Join(outputDir, entry.Path)
-				if err := os.MkdirAll(dirPath, os.FileMode(entry.Mode)); err != nil {
-					return fmt.Errorf("directory creation error: %w", err)
-				}
-			} else {
-				if err := extractFileEntry(vaultPath, password, entry, outputDir); err != nil {
-					return fmt.Errorf("file extraction error for %s: %w", entry.Path, err)
-				}
-			}
+// selectEntries returns the entries with the given paths, in directory order. Of a
+// paged directory that was not loaded only the pages holding them are read, and they
+// come in path order.
+func (v *Vault) selectEntries(targetPaths []string) ([]FileEntry, error) {
+	vaultDir, root := v.current()
+	if vaultDir == nil {
+		paths := make([]string, len(targetPaths))
+		for i, path := range targetPaths {
+			paths[i] = cleanEntryPath(path)
 		}
+		return root.find(paths)
 	}
 
-	return nil
+	index := vaultDir.entryIndex()
+	selected := make(map[int]bool, len(targetPaths))
+	var positions []int
+	for _, path := range targetPaths {
+		if i, ok := index[cleanEntryPath(path)]; ok && !selected[i] {
+			selected[i] = true
+			positions = append(positions, i)
+		}
+	}
+	slices.Sort(positions)
+
+	entries := make([]FileEntry, 0, len(positions))
+	for _, i := range positions {
+		entries = append(entries, vaultDir.Entries[i])
+	}
+	return entries, nil
 }
 
 // ListVault returns list of files in the vault
-func ListVault(vaultPath, password string) ([]FileEntry, error) {
-	vaultDir, err := loadVaultDirectory(vaultPath, password)
+func ListVault(vaultPath string, keySource KeySource) ([]FileEntry, error) {
+	v, err := OpenVault(vaultPath, keySource)
+	if err != nil {
+		return nil, err
+	}
+	defer v.Close()
+
+	return v.List()
+}
+
+// List returns the entries of the vault. The slice is the caller's to keep.
+func (v *Vault) List() ([]FileEntry, error) {
+	// Lock the vault against writers in other goroutines and processes
+	unlock, err := v.lock(false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	return append([]FileEntry(nil), v.dir.Entries...), nil
+}
+
+// ListVaultPrefix returns the files in the vault whose path starts with prefix
+func ListVaultPrefix(vaultPath string, keySource KeySource, prefix string) ([]FileEntry, error) {
+	v, err := OpenVault(vaultPath, keySource)
+	if err != nil {
+		return nil, err
+	}
+	defer v.Close()
+
+	return v.ListPrefix(prefix)
+}
+
+// ListPrefix returns the entries of the vault whose path starts with prefix. Of a paged
+// directory only the pages that can hold them are read, and they come in path order.
+func (v *Vault) ListPrefix(prefix string) ([]FileEntry, error) {
+	// Lock the vault against writers in other goroutines and processes
+	unlock, err := v.lockLookup()
 	if err != nil {
 		return nil, err
 	}
+	defer unlock()
 
-	return vaultDir.Entries, nil
+	vaultDir, root := v.current()
+	if vaultDir == nil {
+		return root.listPrefix(prefix)
+	}
+
+	var entries []FileEntry
+	for _, entry := range vaultDir.Entries {
+		if strings.HasPrefix(entry.Path, prefix) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
 }
 
 // ========================
@@ -358,39 +529,74 @@ func ListVault(vaultPath, password string) ([]FileEntry, error) {
 // ========================
 
 // AddMultipleFilesToVaultParallel adds multiple files to vault in parallel
-func AddMultipleFilesToVaultParallel(vaultPath, password string, filePaths []string, config *ParallelConfig) (*ParallelStats, error) {
-	return addMultipleFilesToVaultParallelWithBasePath(vaultPath, password, filePaths, "", config)
+func AddMultipleFilesToVaultParallel(vaultPath string, keySource KeySource, filePaths []string, config *ParallelConfig) (*ParallelStats, error) {
+	v, err := OpenVault(vaultPath, keySource)
+	if err != nil {
+		return nil, fmt.Errorf("vault directory load error: %w", err)
+	}
+	defer v.Close()
+
+	return v.AddFilesParallel(filePaths, config)
 }
 
-// addMultipleFilesToVaultParallelWithBasePath adds multiple files to vault in parallel with optional base path
-func addMultipleFilesToVaultParallelWithBasePath(vaultPath, password string, filePaths []string, basePath string, config *ParallelConfig) (*ParallelStats, error) {
-	// Always use optimized batch mode for best performance
-	return addMultipleFilesToVaultBatch(vaultPath, password, filePaths, basePath, config)
+// AddFilesParallel adds multiple files to the vault in parallel
+func (v *Vault) AddFilesParallel(filePaths []string, config *ParallelConfig) (*ParallelStats, error) {
+	// Lock the vault against other goroutines and processes
+	unlock, err := v.lock(true)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	return v.addFilesBatch(filePaths, "", nil, config)
 }
 
 // AddDirectoryToVaultParallel adds directory to vault with optimized parallel processing
-func AddDirectoryToVaultParallel(vaultPath, password, dirPath string, config *ParallelConfig) (*ParallelStats, error) {
+func AddDirectoryToVaultParallel(vaultPath string, keySource KeySource, dirPath string, config *ParallelConfig) (*ParallelStats, error) {
+	v, err := OpenVault(vaultPath, keySource)
+	if err != nil {
+		return nil, err
+	}
+	defer v.Close()
+
+	return v.AddDirectoryParallel(dirPath, config)
+}
+
+// AddDirectoryParallel adds a directory to the vault with optimized parallel processing
+func (v *Vault) AddDirectoryParallel(dirPath string, config *ParallelConfig) (*ParallelStats, error) {
 	startTime := time.Now()
 
-	// Collect all files and directories
-	var filePaths []string
-	var allDirs []struct {
-		path string
-		info os.FileInfo
+	// Lock the vault against other goroutines and processes
+	unlock, err := v.lock(true)
+	if err != nil {
+		return nil, err
 	}
+	defer unlock()
 
-	err := filepath.Walk(dirPath, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
+	// Collect all files; directories and links become entries without data
+	var filePaths []string
+	var dirs, links []FileEntry
+
+	ctx := orBackground(config.Context)
+	scanStart := time.Now()
+	err = walkSourceTree(dirPath, config.Symlinks, func(path string, info os.FileInfo, linkTarget string) error {
+		if err := contextError(ctx); err != nil {
 			return err
 		}
 
-		if info.IsDir() {
-			allDirs = append(allDirs, struct {
-				path string
-				info os.FileInfo
-			}{path, info})
-		} else {
+		if !isSymlink(info) && !info.IsDir() {
 			filePaths = append(filePaths, path)
+			return nil
+		}
+
+		storePath, err := storePathFor(dirPath, path)
+		if err != nil {
+			return err
+		}
+		if isSymlink(info) {
+			links = append(links, newSymlinkEntry(storePath, info, linkTarget))
+		} else {
+			dirs = append(dirs, newDirectoryEntry(storePath, info))
 		}
 		return nil
 	})
@@ -398,63 +604,60 @@ func AddDirectoryToVaultParallel(vaultPath, password, dirPath string, config *Pa
 	if err != nil {
 		return nil, fmt.Errorf("directory traversal error: %w", err)
 	}
+	scanDuration := time.Since(scanStart)
 
-	// Add all directories first (they're metadata-only and fast)
+	// Directories and links are committed with the files in a single write
 	if config.ProgressChan != nil {
-		config.ProgressChan <- fmt.Sprintf("Adding %d directories...", len(allDirs))
-	}
-
-	for _, dir := range allDirs {
-		if err := addDirectoryEntry(vaultPath, password, dir.path, dir.info, dirPath); err != nil {
-			return nil, fmt.Errorf("directory add error for %s: %w", dir.path, err)
+		config.ProgressChan <- fmt.Sprintf("Adding %d directories...", len(dirs))
+		if len(filePaths) > 0 {
+			config.ProgressChan <- fmt.Sprintf("Processing %d files in batch mode...", len(filePaths))
 		}
 	}
 
-	// Add all files using optimized batch mode
-	if len(filePaths) == 0 {
-		return &ParallelStats{
-			TotalFiles:      0,
-			SuccessfulFiles: 0,
-			FailedFiles:     0,
-			Duration:        time.Since(startTime),
-		}, nil
+	stats, err := v.addFilesBatch(filePaths, dirPath, append(dirs, links...), config)
+	if stats != nil {
+		// Adjust timing to include the scan
+		stats.Duration = time.Since(startTime)
+		stats.ScanDuration = scanDuration
 	}
+	return stats, err
+}
 
-	if config.ProgressChan != nil {
-		config.ProgressChan <- fmt.Sprintf("Processing %d files in batch mode...", len(filePaths))
+// ExtractMultipleFilesFromVaultParallel extracts multiple files from vault in parallel
+func ExtractMultipleFilesFromVaultParallel(vaultPath string, keySource KeySource, outputDir string, targetPaths []string, config *ParallelConfig) (*ParallelStats, error) {
+	v, err := OpenVault(vaultPath, keySource)
+	if err != nil {
+		return nil, err
 	}
+	defer v.Close()
 
-	fileStats, err := addMultipleFilesToVaultBatch(vaultPath, password, filePaths, dirPath, config)
-	if fileStats != nil {
-		// Adjust timing to include directory operations
-		fileStats.Duration = time.Since(startTime)
-	}
-	return fileStats, err
+	return v.ExtractParallel(outputDir, targetPaths, config)
 }
 
-// ExtractMultipleFilesFromVaultParallel extracts multiple files from vault in parallel
-func ExtractMultipleFilesFromVaultParallel(vaultPath, password, outputDir string, targetPaths []string, config *ParallelConfig) (*ParallelStats, error) {
-	vaultDir, err := loadVaultDirectory(vaultPath, password)
+// ExtractParallel extracts multiple files from the vault in parallel. The workers
+// share the handle's descriptor of the vault file.
+func (v *Vault) ExtractParallel(outputDir string, targetPaths []string, config *ParallelConfig) (*ParallelStats, error) {
+	// Lock the vault against writers in other goroutines and processes
+	unlock, err := v.lockLookup()
 	if err != nil {
 		return nil, err
 	}
+	defer unlock()
 
-	if err := os.MkdirAll(outputDir, 0755); err != nil {
-		return nil, fmt.Errorf("output directory creation error: %w", err)
+	// Filter entries to extract
+	entriesToExtract, err := v.selectEntries(targetPaths)
+	if err != nil {
+		return nil, err
 	}
 
-	// Create a map for fast lookup
-	targetMap := make(map[string]bool)
-	for _, path := range targetPaths {
-		targetMap[filepath.Clean(path)] = true
+	// Refuse the whole extraction before writing anything if a path is unsafe
+	outputPaths, err := resolveExtractPaths(outputDir, entriesToExtract, config.AllowUnsafePaths)
+	if err != nil {
+		return nil, err
 	}
 
-	// Filter entries to extract
-	var entriesToExtract []FileEntry
-	for _, entry := range vaultDir.Entries {
-		if targetMap[entry.Path] {
-			entriesToExtract = append(entriesToExtract, entry)
-		}
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return nil, fmt.Errorf("output directory creation error: %w", err)
 	}
 
 	stats := &ParallelStats{
@@ -462,23 +665,32 @@ func ExtractMultipleFilesFromVaultParallel(vaultPath, password, outputDir string
 	}
 	startTime := time.Now()
 
+	ctx := orBackground(config.Context)
 	semaphore := make(chan struct{}, config.MaxConcurrency)
 	var wg sync.WaitGroup
 
-	for _, entry := range entriesToExtract {
+	for i, entry := range entriesToExtract {
+		if entry.IsSymlink {
+			continue
+		}
 		wg.Add(1)
-		go func(e FileEntry) {
+		go func(e FileEntry, outputPath string) {
 			defer wg.Done()
 			semaphore <- struct{}{}
 			defer func() { <-semaphore }()
 
+			// Entries not started yet are skipped once the extraction is cancelled
+			if ctx.Err() != nil {
+				atomic.AddInt64(&stats.FailedFiles, 1)
+				return
+			}
+
 			if config.ProgressChan != nil {
 				config.ProgressChan <- fmt.Sprintf("Extracting: %s", e.Path)
 			}
 
 			if e.IsDir {
-				dirPath := filepath.Join(outputDir, e.Path)
-				if err := os.MkdirAll(dirPath, os.FileMode(e.Mode)); err != nil {
+				if err := os.MkdirAll(outputPath, os.FileMode(e.Mode)); err != nil {
 					atomic.AddInt64(&stats.FailedFiles, 1)
 					stats.ErrorsMutex.Lock()
 					stats.Errors = append(stats.Errors, fmt.Errorf("failed to create directory %s: %w", e.Path, err))
@@ -487,7 +699,10 @@ func ExtractMultipleFilesFromVaultParallel(vaultPath, password, outputDir string
 					atomic.AddInt64(&stats.SuccessfulFiles, 1)
 				}
 			} else {
-				if err := extractFileEntry(vaultPath, password, e, outputDir); err != nil {
+				fileCtx := withIdleTimeout(ctx, config.Timeout)
+				err := v.extractEntry(fileCtx, e, outputPath)
+				fileCtx.stop()
+				if err != nil {
 					atomic.AddInt64(&stats.FailedFiles, 1)
 					stats.ErrorsMutex.Lock()
 					stats.Errors = append(stats.Errors, fmt.Errorf("failed to extract %s: %w", e.Path, err))
@@ -497,10 +712,28 @@ func ExtractMultipleFilesFromVaultParallel(vaultPath, password, outputDir string
 					atomic.AddInt64(&stats.TotalSize, e.Size)
 				}
 			}
-		}(entry)
+		}(entry, outputPaths[i])
 	}
 
 	wg.Wait()
+
+	if err := contextError(ctx); err != nil {
+		stats.Duration = time.Since(startTime)
+		return stats, fmt.Errorf("extraction cancelled: %w", err)
+	}
+
+	// Links are created last, so no entry is written through a link
+	for i, entry := range entriesToExtract {
+		if !entry.IsSymlink {
+			continue
+		}
+		if err := extractSymlinkEntry(entry, outputPaths[i]); err != nil {
+			atomic.AddInt64(&stats.FailedFiles, 1)
+			stats.Errors = append(stats.Errors, fmt.Errorf("failed to create symlink %s: %w", entry.Path, err))
+		} else {
+			atomic.AddInt64(&stats.SuccessfulFiles, 1)
+		}
+	}
 	stats.Duration = time.Since(startTime)
 
 	if len(stats.Errors) > 0 {
@@ -524,6 +757,12 @@ func PrintParallelStats(stats *ParallelStats) {
 		fmt.Printf("  🚀 Throughput: %.1f MB/s\n", mbps)
 	}
 
+	if stats.CompressDuration > 0 || stats.WriteDuration > 0 {
+		fmt.Printf("  🧭 Phases: scan %v, compress %v, write %v, commit %v\n",
+			stats.ScanDuration.Round(time.Millisecond), stats.CompressDuration.Round(time.Millisecond),
+			stats.WriteDuration.Round(time.Millisecond), stats.CommitDuration.Round(time.Millisecond))
+	}
+
 	if len(stats.Errors) > 0 {
 		fmt.Printf("\n⚠️  Errors encountered:\n")
 		for i, err := range stats.Errors {
@@ -564,33 +803,29 @@ func formatFileSize(size int64) string {
 	}
 }
 
-// addDirectoryEntry adds a directory entry to vault
-func addDirectoryEntry(vaultPath, password, dirPath string, info os.FileInfo, basePath string) error {
-	// Load existing vault directory
-	vaultDir, err := loadVaultDirectory(vaultPath, password)
-	if err != nil {
-		return fmt.Errorf("vault directory load error: %w", err)
+// clearKey overwrites key material in memory
+func clearKey(key []byte) {
+	for i := range key {
+		key[i] = 0
 	}
+}
 
-	// Calculate the correct path to store in vault
-	var storePath string
-	if basePath == dirPath {
-		// Root directory being added - use only its name
-		storePath = info.Name()
-	} else {
-		// Subdirectory - calculate relative path starting from directory name
-		relativePath, err := filepath.Rel(basePath, dirPath)
-		if err != nil {
-			// Fallback to original path if relative calculation fails
-			storePath = filepath.Clean(dirPath)
-		} else {
-			// Add base directory name to the beginning of relative path
-			baseDirName := filepath.Base(basePath)
-			storePath = filepath.Join(baseDirName, relativePath)
-		}
+// addDirectoryEntry adds a directory entry to the vault; the caller holds the exclusive
+// vault lock
+func (v *Vault) addDirectoryEntry(dirPath string, info os.FileInfo, basePath string) error {
+	// Calculate the correct path to store in vault (the root directory is stored by its
+	// name, subdirectories by their relative path starting from the root name)
+	storePath, err := storePathFor(basePath, dirPath)
+	if err != nil {
+		return err
 	}
 
-	entry := FileEntry{
+	return v.putEntry(newDirectoryEntry(storePath, info))
+}
+
+// newDirectoryEntry creates the entry of a directory
+func newDirectoryEntry(storePath string, info os.FileInfo) FileEntry {
+	return FileEntry{
 		Path:           storePath,
 		Name:           info.Name(),
 		IsDir:          true,
@@ -601,62 +836,6 @@ func addDirectoryEntry(vaultPath, password, dirPath string, info os.FileInfo, ba
 		Offset:         0,
 		SHA256Hash:     [32]byte{}, // Empty hash for directories
 	}
-
-	// Update vault directory
-	found := false
-	for i, existingEntry := range vaultDir.Entries {
-		if existingEntry.Path == entry.Path {
-			vaultDir.Entries[i] = entry // Update existing
-			found = true
-			break
-		}
-	}
-
-	if !found {
-		vaultDir.Entries = append(vaultDir.Entries, entry) // Add new
-	}
-
-	return updateVaultDirectory(vaultPath, password, *vaultDir)
-}
-
-// calculateFileMetadata calculates file hash and compressed size using streaming
-func calculateFileMetadata(filePath string) ([32]byte, int64, error) {
-	file, err := os.Open(filePath)
-	if err != nil {
-		return [32]byte{}, 0, fmt.Errorf("file open error: %w", err)
-	}
-	defer file.Close()
-
-	// Create hasher and compression size counter
-	hasher := sha256.New()
-
-	// Use a buffer to count compressed size efficiently
-	var compressedSize int64
-	compressedCounter := &countingWriter{count: &compressedSize}
-
-	// Create gzip writer for size calculation
-	gzipWriter := gzip.NewWriter(compressedCounter)
-	defer gzipWriter.Close()
-
-	// Create multi-writer to simultaneously hash and count compressed size
-	multiWriter := io.MultiWriter(hasher, gzipWriter)
-
-	// Stream through data
-	buffer := make([]byte, StreamBufferSize)
-	if _, err := io.CopyBuffer(multiWriter, file, buffer); err != nil {
-		return [32]byte{}, 0, fmt.Errorf("metadata calculation error: %w", err)
-	}
-
-	// Close gzip writer to get final compressed size
-	if err := gzipWriter.Close(); err != nil {
-		return [32]byte{}, 0, fmt.Errorf("compression finalization error: %w", err)
-	}
-
-	// Get final hash
-	var hash [32]byte
-	copy(hash[:], hasher.Sum(nil))
-
-	return hash, compressedSize, nil
 }
 
 // countingWriter counts bytes written to it
@@ -670,305 +849,421 @@ func (c *countingWriter) Write(p []byte) (int, error) {
 	return n, nil
 }
 
-// addFileToVaultStreaming adds file to vault using true streaming approach
-func addFileToVaultStreaming(vaultPath, password string, vaultDir VaultDirectory, filePath string) error {
-	// Create temporary file for the new vault
-	tempPath := vaultPath + ".tmp"
-	defer os.Remove(tempPath) // Clean up temp file
+// storedExtent is a range of the data area to copy into a rewritten vault
+type storedExtent struct {
+	path   string // Entry the data belongs to, for error messages
+	offset int64  // Previous offset in the data area
+	size   int64
+}
 
-	// Open original vault file for reading
-	originalFile, err := os.Open(vaultPath)
-	if err != nil {
-		return fmt.Errorf("original file open error: %w", err)
+// layoutPayloads assigns contiguous data offsets in write order: retained payloads first
+// (in directory order), then each distinct chunk once, then the payloads for newPaths in
+// the given order. It returns the previous extents of the retained data so it can be
+// copied over.
+func layoutPayloads(entries []FileEntry, newPaths []string) []storedExtent {
+	isNew := make(map[string]bool, len(newPaths))
+	for _, path := range newPaths {
+		isNew[path] = true
+	}
+
+	var retained []storedExtent
+	var offset int64
+	newEntries := make(map[string]int, len(newPaths)) // Position of each new payload
+	for i := range entries {
+		if !entries[i].hasPayload() {
+			continue
+		}
+		if isNew[entries[i].Path] {
+			if _, ok := newEntries[entries[i].Path]; !ok {
+				newEntries[entries[i].Path] = i
+			}
+			continue
+		}
+		retained = append(retained, storedExtent{path: entries[i].Path, offset: entries[i].Offset, size: entries[i].CompressedSize})
+		entries[i].Offset = offset
+		offset += entries[i].CompressedSize
 	}
-	defer originalFile.Close()
 
-	// Read original header
-	var originalHeader VaultHeader
-	if err := binary.Read(originalFile, binary.LittleEndian, &originalHeader); err != nil {
-		return fmt.Errorf("header read error: %w", err)
+	chunks := layoutChunks(entries, offset)
+	retained = append(retained, chunks...)
+	for _, extent := range chunks {
+		offset += extent.size
 	}
 
-	// Calculate file offsets for all entries in the directory
-	var totalDataSize int64 = 0
-	for i := range vaultDir.Entries {
-		if !vaultDir.Entries[i].IsDir {
-			vaultDir.Entries[i].Offset = totalDataSize
-			totalDataSize += vaultDir.Entries[i].CompressedSize
+	for _, path := range newPaths {
+		if i, ok := newEntries[path]; ok {
+			entries[i].Offset = offset
+			offset += entries[i].CompressedSize
 		}
 	}
 
-	// Serialize and compress new directory
-	jsonData, err := json.Marshal(vaultDir)
-	if err != nil {
-		return fmt.Errorf("directory serialization error: %w", err)
-	}
+	return retained
+}
 
-	compressedDir, err := compressData(jsonData)
-	if err != nil {
-		return fmt.Errorf("directory compression error: %w", err)
+// writePayload compresses the source stream into target, encrypting it for v3+ vaults
+func writePayload(target io.Writer, source io.Reader, version uint32, key []byte, entry FileEntry, compression Compression, buffer []byte) error {
+	var sink io.Writer = target
+	var sealer io.WriteCloser
+	if version >= PayloadEncryptionVersion {
+		var err error
+		sealer, err = newPayloadWriter(target, key, entry.PayloadSalt)
+		if err != nil {
+			return err
+		}
+		sink = sealer
 	}
 
-	// Encrypt directory with existing parameters
-	key := pbkdf2.Key([]byte(password), originalHeader.Salt[:], int(originalHeader.Iterations), KeyLength, sha256.New)
-
-	block, err := aes.NewCipher(key)
+	compressor, err := newCompressor(sink, compression)
 	if err != nil {
-		return fmt.Errorf("AES cipher creation error: %w", err)
+		return err
+	}
+	if _, err := io.CopyBuffer(compressor, source, buffer); err != nil {
+		compressor.Close()
+		return fmt.Errorf("file compression streaming error: %w", err)
 	}
 
-	gcm, err := cipher.NewGCM(block)
-	if err != nil {
-		return fmt.Errorf("GCM creation error: %w", err)
+	if err := compressor.Close(); err != nil {
+		return fmt.Errorf("compression finalization error: %w", err)
 	}
 
-	encryptedDir := gcm.Seal(nil, originalHeader.Nonce[:], compressedDir, nil)
+	if sealer != nil {
+		if err := sealer.Close(); err != nil {
+			return fmt.Errorf("payload encryption finalization error: %w", err)
+		}
+	}
 
-	// Create new header with updated directory size
-	newHeader := originalHeader
-	newHeader.DirectorySize = uint64(len(encryptedDir))
+	return nil
+}
 
-	// Create temporary file
-	tempFile, err := os.Create(tempPath)
+// saveVaultDirectory saves initial vault directory to file
+func saveVaultDirectory(path string, keySource KeySource, vaultDir VaultDirectory, params KDFParams, recipients []Recipient) error {
+	header, key, err := newVaultHeader(keySource, &vaultDir, params, recipients)
 	if err != nil {
-		return fmt.Errorf("temp file creation error: %w", err)
+		return err
 	}
-	defer tempFile.Close()
+	defer clearKey(key)
 
-	// Write new header
-	if err := binary.Write(tempFile, binary.LittleEndian, newHeader); err != nil {
+	// Encrypt directory
+	encryptedDir, err := sealVaultDirectory(key, header, vaultDir)
+	if err != nil {
+		return err
+	}
+
+	// Write the vault to a temporary file, so a crash never leaves half a vault
+	file, err := createVaultTempFile(path)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	// Write header
+	if err := writeVaultHeader(file, header); err != nil {
 		return fmt.Errorf("header write error: %w", err)
 	}
 
 	// Write encrypted directory
-	if _, err := tempFile.Write(encryptedDir); err != nil {
+	if _, err := file.Write(encryptedDir); err != nil {
 		return fmt.Errorf("directory write error: %w", err)
 	}
 
-	// Stream existing file data from original vault
-	headerSize := int64(binary.Size(VaultHeader{}))
-	originalDirectorySize := int64(originalHeader.DirectorySize)
-	fileDataOffset := headerSize + originalDirectorySize
+	return replaceVaultFile(file, path)
+}
 
-	if _, err := originalFile.Seek(fileDataOffset, io.SeekStart); err != nil {
-		return fmt.Errorf("original file seek error: %w", err)
+// newVaultHeader creates the header of a new vault in the version of the directory and
+// returns it with the key of the directory and payloads. For v3+ vaults the private
+// inbox key is stored in the directory. The caller must clear the key after use.
+func newVaultHeader(keySource KeySource, vaultDir *VaultDirectory, params KDFParams, recipients []Recipient) (*VaultHeader, []byte, error) {
+	if vaultDir.Version < HeaderAuthVersion && params.Algorithm != KDFPBKDF2 {
+		return nil, nil, fmt.Errorf("vault format version %d only supports PBKDF2", vaultDir.Version)
+	}
+	if vaultDir.Version < MasterKeyVersion && (keySource == nil || len(recipients) > 0) {
+		return nil, nil, fmt.Errorf("vault format version %d only supports a password", vaultDir.Version)
 	}
 
-	buffer := make([]byte, StreamBufferSize)
-	if _, err := io.CopyBuffer(tempFile, originalFile, buffer); err != nil {
-		return fmt.Errorf("existing file data copy error: %w", err)
+	// Create header with fresh cryptographic parameters
+	header := &VaultHeader{Version: vaultDir.Version}
+	copy(header.Magic[:], VaultMagic)
+
+	// Derive key (v3+ vaults encrypt with a random master key wrapped in the key slots)
+	if header.Version < MasterKeyVersion {
+		slot := &header.KeySlots[0]
+		slot.Kind = KeySlotPassword
+		slot.setKDFParams(params)
+		if _, err := rand.Read(slot.Salt[:]); err != nil {
+			return nil, nil, fmt.Errorf("salt generation error: %w", err)
+		}
+
+		legacyKey, err := slot.deriveKey(keySource)
+		if err != nil {
+			return nil, nil, err
+		}
+		return header, legacyKey, nil
 	}
 
-	// Now stream new file data directly from source file with compression
-	sourceFile, err := os.Open(filePath)
+	key, err := newMasterKey()
 	if err != nil {
-		return fmt.Errorf("source file open error: %w", err)
+		return nil, nil, err
 	}
-	defer sourceFile.Close()
 
-	// Create gzip writer to compress directly to vault
-	gzipWriter := gzip.NewWriter(tempFile)
-	if _, err := io.CopyBuffer(gzipWriter, sourceFile, buffer); err != nil {
-		gzipWriter.Close()
-		return fmt.Errorf("file compression streaming error: %w", err)
+	index := 0
+	if keySource != nil {
+		if err := header.wrapMasterKey(index, keySource, params, key); err != nil {
+			clearKey(key)
+			return nil, nil, err
+		}
+		index++
+	}
+	for _, recipient := range recipients {
+		if err := header.wrapMasterKeyForRecipient(index, recipient, key); err != nil {
+			clearKey(key)
+			return nil, nil, err
+		}
+		index++
 	}
 
-	if err := gzipWriter.Close(); err != nil {
-		return fmt.Errorf("compression finalization error: %w", err)
+	inboxKey, err := newInboxKey()
+	if err != nil {
+		clearKey(key)
+		return nil, nil, err
 	}
+	copy(header.InboxKey[:], inboxKey.PublicKey().Bytes())
+	vaultDir.InboxKey = inboxKey.Bytes()
+	return header, key, nil
+}
 
-	if err := tempFile.Sync(); err != nil {
-		return fmt.Errorf("temp file sync error: %w", err)
+// sealVaultDirectory serializes, compresses and encrypts the vault directory.
+// Every call draws a fresh random nonce, which is stored in the header together
+// with the new directory size, so a key+nonce pair is never reused across saves.
+func sealVaultDirectory(key []byte, header *VaultHeader, vaultDir VaultDirectory) ([]byte, error) {
+	// Serialize and compress directory (sealing the pages of a paged one)
+	encoded, err := encodeDirectory(key, header.Version, vaultDir)
+	if err != nil {
+		return nil, err
 	}
 
-	tempFile.Close()
-	originalFile.Close()
+	// Create AES cipher
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("AES cipher creation error: %w", err)
+	}
 
-	// Replace original file with temporary file
-	if err := os.Rename(tempPath, vaultPath); err != nil {
-		return fmt.Errorf("file replacement error: %w", err)
+	// Create GCM for encryption
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("GCM creation error: %w", err)
 	}
 
-	// Clear sensitive data
-	for i := range key {
-		key[i] = 0
+	// Generate a new nonce for this save
+	if _, err := rand.Read(header.Nonce[:]); err != nil {
+		return nil, fmt.Errorf("nonce generation error: %w", err)
 	}
 
-	return nil
+	// Finalize the header before sealing, since it is bound as associated data
+	header.DirectorySize = encoded.sealedSize(gcm.Overhead())
+	header.Checksum = header.computeChecksum(key)
+
+	encryptedDir := encoded.seal(gcm, header.Nonce[:], header.associatedData())
+
+	return encryptedDir, nil
 }
 
-// saveVaultDirectory saves initial vault directory to file
-func saveVaultDirectory(path, password string, vaultDir VaultDirectory) error {
-	// Serialize directory
-	jsonData, err := json.Marshal(vaultDir)
-	if err != nil {
-		return fmt.Errorf("directory serialization error: %w", err)
-	}
+// ========================
+// STORAGE FUNCTIONS (from common.go)
+// ========================
 
-	// Compress directory
-	compressedDir, err := compressData(jsonData)
+// loadVaultDirectory loads only the vault directory (metadata) - memory efficient
+func loadVaultDirectory(path string, keySource KeySource) (*VaultDirectory, error) {
+	vaultDir, _, key, err := openVaultDirectory(path, keySource)
 	if err != nil {
-		return fmt.Errorf("directory compression error: %w", err)
+		return nil, err
 	}
 
-	// Generate cryptographic parameters
-	var salt [SaltLength]byte
-	var nonce [NonceLength]byte
-
-	if _, err := rand.Read(salt[:]); err != nil {
-		return fmt.Errorf("salt generation error: %w", err)
-	}
+	// Clear key from memory
+	clearKey(key)
 
-	if _, err := rand.Read(nonce[:]); err != nil {
-		return fmt.Errorf("nonce generation error: %w", err)
-	}
+	return vaultDir, nil
+}
 
-	// Derive key
-	key := pbkdf2.Key([]byte(password), salt[:], PBKDF2Iters, KeyLength, sha256.New)
+// openVaultDirectory loads the vault directory and also returns the header and derived key,
+// which are needed to decrypt file payloads. The caller must clear the key after use.
+func openVaultDirectory(path string, keySource KeySource) (*VaultDirectory, *VaultHeader, []byte, error) {
+	vaultDir, header, key, _, err := openVaultKeySlot(path, keySource)
+	return vaultDir, header, key, err
+}
 
-	// Create AES cipher
-	block, err := aes.NewCipher(key)
+// openVaultKeySlot works like openVaultDirectory and also reports which key slot was unlocked
+func openVaultKeySlot(path string, keySource KeySource) (*VaultDirectory, *VaultHeader, []byte, int, error) {
+	v, err := openVault(path, keySource)
 	if err != nil {
-		return fmt.Errorf("AES cipher creation error: %w", err)
+		return nil, nil, nil, 0, err
+	}
+	if v.dir == nil {
+		if err := v.loadDirectory(); err != nil {
+			v.Close()
+			return nil, nil, nil, 0, err
+		}
 	}
 
-	// Create GCM for encryption
-	gcm, err := cipher.NewGCM(block)
+	// The key is handed to the caller instead of being cleared
+	key := v.key
+	v.key = nil
+	v.file.Close()
+	return v.dir, v.header, key, v.slot, nil
+}
+
+// readCurrentDirectory reads the directory that is current in the first size bytes of
+// the vault file, with the files appended by public key since merged in
+func readCurrentDirectory(file *os.File, header *VaultHeader, key []byte, size int64) (*VaultDirectory, error) {
+	// The newest directory appended to the log is current; the one after the header
+	// only until the first append
+	commit, err := findLogCommit(file, header, size)
 	if err != nil {
-		return fmt.Errorf("GCM creation error: %w", err)
+		return nil, err
 	}
+	if commit != nil {
+		vaultDir, err := openLogDirectory(file, key, header, commit)
+		if err != nil {
+			return nil, err
+		}
 
-	// Encrypt directory
-	encryptedDir := gcm.Seal(nil, nonce[:], compressedDir, nil)
-
-	// Create header
-	header := VaultHeader{
-		Version:       CurrentVaultVersion,
-		Iterations:    PBKDF2Iters,
-		Salt:          salt,
-		Nonce:         nonce,
-		DirectorySize: uint64(len(encryptedDir)),
+		// Merge files appended with the public inbox key since the last write
+		if err := mergeInboxSegments(file, header, commit.end, size, vaultDir); err != nil {
+			return nil, err
+		}
+		return vaultDir, nil
 	}
-	copy(header.Magic[:], VaultMagic)
 
-	// Create file
-	file, err := os.Create(path)
+	vaultDir, err := openBaseDirectory(file, key, header)
 	if err != nil {
-		return fmt.Errorf("file creation error: %w", err)
+		return nil, err
 	}
-	defer file.Close()
 
-	// Write header
-	if err := binary.Write(file, binary.LittleEndian, header); err != nil {
-		return fmt.Errorf("header write error: %w", err)
+	// Merge files appended with the public inbox key since the last write
+	if err := mergeInboxSegments(file, header, payloadDataEnd(header, vaultDir.Entries), size, vaultDir); err != nil {
+		return nil, err
 	}
+	return vaultDir, nil
+}
 
-	// Write encrypted directory
-	if _, err := file.Write(encryptedDir); err != nil {
-		return fmt.Errorf("directory write error: %w", err)
+// readCurrentPages reads the root of the current paged directory, with the entries
+// appended with the public inbox key since the last write; the pages are read on demand
+func readCurrentPages(file *os.File, header *VaultHeader, key []byte, size int64) (*pagedDirectory, error) {
+	commit, err := findLogCommit(file, header, size)
+	if err != nil {
+		return nil, err
 	}
 
-	// Clear sensitive data
-	for i := range key {
-		key[i] = 0
+	var body []byte
+	var pagesStart, end, inboxStart int64
+	if commit != nil {
+		if body, pagesStart, err = openLogBody(file, key, header, commit); err != nil {
+			return nil, err
+		}
+		end = commit.directoryEnd()
+		inboxStart = commit.end
+	} else {
+		if body, pagesStart, err = openBaseBody(file, key, header); err != nil {
+			return nil, err
+		}
+		end = header.encodedSize() + int64(header.DirectorySize)
 	}
 
-	return nil
-}
-
-// ========================
-// STORAGE FUNCTIONS (from common.go)
-// ========================
-
-// loadVaultDirectory loads only the vault directory (metadata) - memory efficient
-func loadVaultDirectory(path, password string) (*VaultDirectory, error) {
-	// First validate the vault file format
-	if err := ValidateVaultFile(path); err != nil {
+	root, err := decodePagedRoot(file, key, body, pagesStart, end)
+	if err != nil {
 		return nil, err
 	}
+	if commit == nil {
+		inboxStart = end + root.dataEnd
+	}
 
-	// Open vault file
-	file, err := os.Open(path)
+	inbox, err := readInboxEntries(file, header, inboxStart, size, root.meta.InboxKey)
 	if err != nil {
-		return nil, fmt.Errorf("file open error: %w", err)
+		return nil, err
 	}
-	defer file.Close()
-
-	// Read header
-	var header VaultHeader
-	if err := binary.Read(file, binary.LittleEndian, &header); err != nil {
-		return nil, fmt.Errorf("header read error: %w", err)
+	if root.inbox, root.meta.inboxConflicts, err = resolveInboxConflicts(inbox, root.lookup()); err != nil {
+		return nil, err
 	}
+	return root, nil
+}
 
-	// Derive key from password
-	key := pbkdf2.Key([]byte(password), header.Salt[:], int(header.Iterations), KeyLength, sha256.New)
-
-	// Clear password from memory
-	passwordBytes := []byte(password)
-	for i := range passwordBytes {
-		passwordBytes[i] = 0
+// openBaseDirectory reads and decrypts the directory stored after the header
+func openBaseDirectory(file *os.File, key []byte, header *VaultHeader) (*VaultDirectory, error) {
+	body, pagesStart, err := openBaseBody(file, key, header)
+	if err != nil {
+		return nil, err
 	}
+	return decodeDirectory(file, key, header.Version, body, pagesStart, header.encodedSize()+int64(header.DirectorySize))
+}
 
+// openBaseBody reads and decrypts the directory stored after the header (the root of a
+// paged directory) and returns it with the offset of the pages
+func openBaseBody(file *os.File, key []byte, header *VaultHeader) ([]byte, int64, error) {
 	// Create AES cipher
 	block, err := aes.NewCipher(key)
 	if err != nil {
-		return nil, fmt.Errorf("AES cipher creation error: %w", err)
+		return nil, 0, fmt.Errorf("AES cipher creation error: %w", err)
 	}
 
 	// Create GCM for decryption
 	gcm, err := cipher.NewGCM(block)
 	if err != nil {
-		return nil, fmt.Errorf("GCM creation error: %w", err)
+		return nil, 0, fmt.Errorf("GCM creation error: %w", err)
 	}
 
 	// Read encrypted directory data
-	encryptedDir := make([]byte, header.DirectorySize)
-	if _, err := io.ReadFull(file, encryptedDir); err != nil {
-		return nil, fmt.Errorf("encrypted directory read error: %w", err)
-	}
-
-	// Decrypt directory data
-	compressedData, err := gcm.Open(nil, header.Nonce[:], encryptedDir, nil)
+	encryptedDir, pagesStart, err := readSealedDirectory(file, header.Version, header.encodedSize(), header.DirectorySize)
 	if err != nil {
-		return nil, fmt.Errorf("decryption failed: invalid password or corrupted data")
+		return nil, 0, err
 	}
 
-	// Decompress directory data
-	jsonData, err := decompressData(compressedData)
+	// Decrypt directory data, authenticating the header along with it
+	compressedData, err := gcm.Open(nil, header.Nonce[:], encryptedDir, header.associatedData())
 	if err != nil {
-		return nil, fmt.Errorf("directory decompression error: %w", err)
+		if header.Version >= HeaderAuthVersion {
+			return nil, 0, fmt.Errorf("%w: header or directory does not match its authentication tag", ErrHeaderTampered)
+		}
+		return nil, 0, fmt.Errorf("decryption failed: invalid password or corrupted data")
 	}
+	return compressedData, pagesStart, nil
+}
 
-	// Deserialize JSON
-	var vaultDir VaultDirectory
-	if err := json.Unmarshal(jsonData, &vaultDir); err != nil {
-		return nil, fmt.Errorf("directory deserialization error: %w", err)
+// updateVaultDirectory updates the vault directory in the vault file
+func updateVaultDirectory(vaultPath string, keySource KeySource, vaultDir VaultDirectory) error {
+	header, err := readVaultHeaderFile(vaultPath)
+	if err != nil {
+		return err
 	}
 
-	// Clear key from memory
-	for i := range key {
-		key[i] = 0
+	key, err := unlockVaultKey(keySource, header)
+	if err != nil {
+		return err
 	}
+	defer clearKey(key)
 
-	return &vaultDir, nil
+	return writeVaultDirectory(context.Background(), vaultPath, key, vaultDir)
 }
 
-// updateVaultDirectory updates the vault directory in the vault file
-func updateVaultDirectory(vaultPath, password string, vaultDir VaultDirectory) error {
+// writeVaultDirectory writes the directory with the vault key: appended to v3+ vaults,
+// rewriting older ones
+func writeVaultDirectory(ctx context.Context, vaultPath string, key []byte, vaultDir VaultDirectory) error {
+	// v3+ vaults append the new directory instead of rewriting the file
+	usesLog, err := vaultUsesLog(vaultPath)
+	if err != nil {
+		return err
+	}
+	if usesLog {
+		return appendToVaultLog(vaultPath, key, vaultDir)
+	}
+
 	// Use optimized streaming version
-	return updateVaultDirectoryStreamingOptimized(vaultPath, password, vaultDir)
+	return updateVaultDirectoryStreamingOptimized(ctx, vaultPath, key, vaultDir)
 }
 
 // updateVaultDirectoryStreamingOptimized optimized version for memory efficiency
-func updateVaultDirectoryStreamingOptimized(vaultPath, password string, vaultDir VaultDirectory) error {
-	// Recalculate file offsets in new structure
-	var totalDataSize int64 = 0
-	for i := range vaultDir.Entries {
-		if !vaultDir.Entries[i].IsDir {
-			vaultDir.Entries[i].Offset = totalDataSize
-			totalDataSize += vaultDir.Entries[i].CompressedSize
-		}
-	}
+func updateVaultDirectoryStreamingOptimized(ctx context.Context, vaultPath string, key []byte, vaultDir VaultDirectory) error {
+	// Recalculate file offsets in new structure, keeping the old ones for copying
+	retained := layoutPayloads(vaultDir.Entries, nil)
 
 	// Open source file only for reading header
 	sourceFile, err := os.Open(vaultPath)
@@ -978,52 +1273,31 @@ func updateVaultDirectoryStreamingOptimized(vaultPath, password string, vaultDir
 	defer sourceFile.Close()
 
 	// Read only header (not entire file!)
-	var header VaultHeader
-	if err := binary.Read(sourceFile, binary.LittleEndian, &header); err != nil {
-		return fmt.Errorf("header read error: %w", err)
-	}
-
-	// Serialize and compress new directory
-	jsonData, err := json.Marshal(vaultDir)
+	header, err := readVaultHeader(sourceFile)
 	if err != nil {
-		return fmt.Errorf("directory serialization error: %w", err)
-	}
-
-	compressedDir, err := compressData(jsonData)
-	if err != nil {
-		return fmt.Errorf("directory compression error: %w", err)
+		return fmt.Errorf("header read error: %w", err)
 	}
 
-	// Encrypt directory with existing parameters
-	key := pbkdf2.Key([]byte(password), header.Salt[:], int(header.Iterations), KeyLength, sha256.New)
-
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return fmt.Errorf("AES cipher creation error: %w", err)
+	// Encrypt directory with a fresh nonce (the original header is still needed to locate existing file data)
+	originalHeader := *header
+	if vaultDir.Version > header.Version && header.Version >= MasterKeyVersion {
+		header.upgrade(vaultDir.Version) // Rewritten in a newer format, see CompactOptions.Upgrade
 	}
-
-	gcm, err := cipher.NewGCM(block)
+	encryptedDir, err := sealVaultDirectory(key, header, vaultDir)
 	if err != nil {
-		return fmt.Errorf("GCM creation error: %w", err)
+		return err
 	}
 
-	encryptedDir := gcm.Seal(nil, header.Nonce[:], compressedDir, nil)
-
-	// Update header
-	header.DirectorySize = uint64(len(encryptedDir))
-
-	// Create temporary file
-	tempPath := vaultPath + ".tmp"
-	defer os.Remove(tempPath)
-
-	tempFile, err := os.Create(tempPath)
+	// Create a uniquely named temporary file for the new vault
+	tempFile, err := createVaultTempFile(vaultPath)
 	if err != nil {
-		return fmt.Errorf("temp file creation error: %w", err)
+		return err
 	}
+	defer os.Remove(tempFile.Name()) // Clean up temp file
 	defer tempFile.Close()
 
 	// Write new header
-	if err := binary.Write(tempFile, binary.LittleEndian, header); err != nil {
+	if err := writeVaultHeader(tempFile, header); err != nil {
 		return fmt.Errorf("header write error: %w", err)
 	}
 
@@ -1033,55 +1307,35 @@ func updateVaultDirectoryStreamingOptimized(vaultPath, password string, vaultDir
 	}
 
 	// KEY OPTIMIZATION: streaming copy only needed file data
-	if err := copyNeededFileDataStreaming(sourceFile, tempFile, vaultDir.Entries, &header); err != nil {
+	if err := copyNeededFileDataStreaming(ctx, sourceFile, tempFile, retained, &originalHeader); err != nil {
 		return fmt.Errorf("file data streaming error: %w", err)
 	}
 
-	if err := tempFile.Sync(); err != nil {
-		return fmt.Errorf("temp file sync error: %w", err)
-	}
-
-	tempFile.Close()
 	sourceFile.Close()
 
 	// Atomic file replacement
-	if err := os.Rename(tempPath, vaultPath); err != nil {
-		return fmt.Errorf("file replacement error: %w", err)
-	}
-
-	// Clear sensitive data
-	for i := range key {
-		key[i] = 0
-	}
-
-	return nil
+	return replaceVaultFile(tempFile, vaultPath)
 }
 
 // copyNeededFileDataStreaming streams copy only needed file data
-func copyNeededFileDataStreaming(sourceFile, targetFile *os.File, entries []FileEntry, originalHeader *VaultHeader) error {
+func copyNeededFileDataStreaming(ctx context.Context, sourceFile, targetFile *os.File, extents []storedExtent, originalHeader *VaultHeader) error {
 	// Calculate original data offset
-	headerSize := int64(binary.Size(VaultHeader{}))
-	originalDirectorySize := int64(originalHeader.DirectorySize)
-	originalDataOffset := headerSize + originalDirectorySize
+	originalDataOffset := originalHeader.encodedSize() + int64(originalHeader.DirectorySize)
 
-	// Stream copy each needed file
+	// Stream copy each needed payload or chunk
 	buffer := make([]byte, StreamBufferSize)
 
-	for _, entry := range entries {
-		if entry.IsDir {
-			continue // Skip directories
-		}
-
+	for _, extent := range extents {
 		// Seek to file position in source
-		sourceOffset := originalDataOffset + entry.Offset
+		sourceOffset := originalDataOffset + extent.offset
 		if _, err := sourceFile.Seek(sourceOffset, io.SeekStart); err != nil {
-			return fmt.Errorf("source seek error for %s: %w", entry.Path, err)
+			return fmt.Errorf("source seek error for %s: %w", extent.path, err)
 		}
 
 		// Copy compressed file data
-		limitedReader := io.LimitReader(sourceFile, entry.CompressedSize)
+		limitedReader := newContextReader(ctx, io.LimitReader(sourceFile, extent.size))
 		if _, err := io.CopyBuffer(targetFile, limitedReader, buffer); err != nil {
-			return fmt.Errorf("file data copy error for %s: %w", entry.Path, err)
+			return fmt.Errorf("file data copy error for %s: %w", extent.path, err)
 		}
 	}
 
@@ -1195,14 +1449,21 @@ func compareHashesConstantTime(a, b []byte) bool {
 // EXTRACTION FUNCTIONS
 // ========================
 
-// extractFileEntry extracts a single file entry from vault using STREAMING processing
-func extractFileEntry(vaultPath, password string, entry FileEntry, outputDir string) error {
-	outputPath := filepath.Join(outputDir, entry.Path)
+// extractEntry extracts a single file entry from the vault using STREAMING processing.
+// outputPath is the checked destination returned by resolveExtractPath. The payload is
+// read with ReadAt, so entries can be extracted from several goroutines at once.
+func (v *Vault) extractEntry(ctx context.Context, entry FileEntry, outputPath string) (err error) {
+	if err := contextError(ctx); err != nil {
+		return err
+	}
 
 	if entry.IsDir {
 		// Create directory
 		return os.MkdirAll(outputPath, os.FileMode(entry.Mode))
 	}
+	if entry.IsSymlink {
+		return extractSymlinkEntry(entry, outputPath)
+	}
 
 	// Create parent directories
 	parentDir := filepath.Dir(outputPath)
@@ -1210,393 +1471,160 @@ func extractFileEntry(vaultPath, password string, entry FileEntry, outputDir str
 		return fmt.Errorf("parent directory creation error: %w", err)
 	}
 
-	// Open vault file
-	vaultFile, err := os.Open(vaultPath)
+	// Create output file; an incomplete one is removed again
+	outputFile, err := createOutputFile(outputPath)
 	if err != nil {
-		return fmt.Errorf("vault file open error: %w", err)
+		return err
 	}
-	defer vaultFile.Close()
+	defer func() {
+		outputFile.Close()
+		if err != nil {
+			os.Remove(outputPath)
+		}
+	}()
 
-	// Read vault header to calculate file data offset
-	var header VaultHeader
-	if err := binary.Read(vaultFile, binary.LittleEndian, &header); err != nil {
-		return fmt.Errorf("header read error: %w", err)
+	data, err := v.openEntryData(entry)
+	if err != nil {
+		return err
 	}
+	defer data.Close()
 
-	// Calculate absolute offset in vault file
-	headerSize := int64(binary.Size(VaultHeader{}))
-	directorySize := int64(header.DirectorySize)
-	absoluteOffset := headerSize + directorySize + entry.Offset
+	// Streaming copy with integrity check and optimal buffer
+	return streamCopyWithIntegrityCheck(outputFile, newContextReader(ctx, data), entry, getOptimalBufferSizeForFile(entry.Size))
+}
 
-	// Seek to file data
-	if _, err := vaultFile.Seek(absoluteOffset, io.SeekStart); err != nil {
-		return fmt.Errorf("file data seek error: %w", err)
-	}
+// openEntryData returns a reader of the data of a file entry, decrypting and
+// decompressing its payload or chunks while streaming
+func (v *Vault) openEntryData(entry FileEntry) (io.ReadCloser, error) {
+	dataStart := v.header.encodedSize() + int64(v.header.DirectorySize)
 
-	// Create output file
-	outputFile, err := os.Create(outputPath)
-	if err != nil {
-		return fmt.Errorf("output file creation error: %w", err)
+	// Chunked files are read chunk by chunk wherever the chunks are stored
+	if len(entry.Chunks) > 0 {
+		return newChunkReader(v.file, dataStart, v.key, entry.Chunks), nil
 	}
-	defer outputFile.Close()
 
 	// CRITICAL OPTIMIZATION: streaming processing instead of loading to memory
 	// Read compressed data in chunks, not loading all to memory
-	limitedReader := io.LimitReader(vaultFile, entry.CompressedSize)
+	var payload io.Reader = io.NewSectionReader(v.file, dataStart+entry.Offset, entry.CompressedSize)
+
+	// Decrypt and authenticate chunks on the fly for v3+ vaults
+	// (appended payloads are sealed with the key of their segment)
+	if v.header.Version >= PayloadEncryptionVersion {
+		key := v.key
+		if len(entry.PayloadKey) > 0 {
+			key = entry.PayloadKey
+		}
+		var err error
+		payload, err = newPayloadReader(payload, entry.CompressedSize, key, entry.PayloadSalt)
+		if err != nil {
+			return nil, fmt.Errorf("payload decryption setup error: %w", err)
+		}
+	}
 
-	// Create gzip reader for streaming decompression
-	gzipReader, err := decompressDataStreaming(limitedReader)
+	// Decompress with the algorithm the payload was stored with
+	decompressor, err := newDecompressor(payload, entry.Compression)
 	if err != nil {
-		return fmt.Errorf("streaming decompression setup error: %w", err)
+		return nil, fmt.Errorf("streaming decompression setup error: %w", err)
 	}
-	defer gzipReader.Close()
-
-	// Streaming copy with integrity check and optimal buffer
-	bufferSize := getOptimalBufferSizeForFile(entry.Size)
-	return streamCopyWithIntegrityCheck(outputFile, gzipReader, entry, bufferSize)
+	return decompressor, nil
 }
 
 // RemoveFromVault removes files/directories from vault
-func RemoveFromVault(vaultPath, password string, paths []string) error {
+func RemoveFromVault(vaultPath string, keySource KeySource, paths []string) error {
 	// Validate inputs
 	if vaultPath == "" {
 		return fmt.Errorf("vault path cannot be empty")
 	}
-	if password == "" {
-		return fmt.Errorf("password cannot be empty")
+	if keySource == nil {
+		return fmt.Errorf("key source cannot be nil")
 	}
+
+	v, err := OpenVault(vaultPath, keySource)
+	if err != nil {
+		return fmt.Errorf("vault directory load error: %w", err)
+	}
+	defer v.Close()
+
+	return v.Remove(paths)
+}
+
+// Remove removes files/directories from the vault
+func (v *Vault) Remove(paths []string) error {
 	if len(paths) == 0 {
 		return fmt.Errorf("no paths specified for removal")
 	}
 
-	// Synchronize vault access for thread safety
-	vaultMutex := getVaultMutex(vaultPath)
-	vaultMutex.Lock()
-	defer vaultMutex.Unlock()
-
-	// Load vault directory
-	vaultDir, err := loadVaultDirectory(vaultPath, password)
+	// Lock the vault against other goroutines and processes
+	unlock, err := v.lock(true)
 	if err != nil {
-		return fmt.Errorf("vault directory load error: %w", err)
+		return err
 	}
-
-	// Track which entries to keep
-	var entriesToKeep []FileEntry
-	removedPaths := make(map[string]bool)
+	defer unlock()
 
 	// Mark paths for removal (normalize first)
+	removedPaths := make(map[string]bool)
 	for _, path := range paths {
-		cleanPath := filepath.Clean(path)
-		removedPaths[cleanPath] = true
-	}
-
-	// Filter entries to keep
-	for _, entry := range vaultDir.Entries {
-		if !removedPaths[entry.Path] {
-			entriesToKeep = append(entriesToKeep, entry)
-		}
+		removedPaths[cleanEntryPath(path)] = true
 	}
 
 	// Check if any files were actually removed
-	if len(entriesToKeep) == len(vaultDir.Entries) {
+	if v.dir.removeEntries(removedPaths) == 0 {
 		return fmt.Errorf("no matching files found for removal")
 	}
 
-	// Update directory with remaining entries
-	vaultDir.Entries = entriesToKeep
-
-	// Update vault with optimized streaming approach
-	return updateVaultDirectoryStreamingOptimized(vaultPath, password, *vaultDir)
+	// Update vault (appends the directory to v3+ vaults, rewrites older ones)
+	return v.writeDirectory(context.Background())
 }
 
-// addMultipleFilesToVaultBatch adds multiple files to vault in optimized batch mode
-func addMultipleFilesToVaultBatch(vaultPath, password string, filePaths []string, basePath string, config *ParallelConfig) (*ParallelStats, error) {
+// addFilesBatch adds multiple files to the vault in optimized batch mode, together with
+// entries without data (directories, links) that are committed in the same write; the
+// caller holds the exclusive vault lock
+func (v *Vault) addFilesBatch(filePaths []string, basePath string, entries []FileEntry, config *ParallelConfig) (*ParallelStats, error) {
 	stats := &ParallelStats{
 		TotalFiles: int64(len(filePaths)),
 	}
 	startTime := time.Now()
 
-	if len(filePaths) == 0 {
+	if len(filePaths) == 0 && len(entries) == 0 {
 		stats.Duration = time.Since(startTime)
 		return stats, nil
 	}
 
-	// Phase 1: Parallel metadata calculation (no vault modifications)
-	metadataChan := make(chan FileMetadata, len(filePaths))
-	semaphore := make(chan struct{}, config.MaxConcurrency)
-	var wg sync.WaitGroup
-
-	for _, filePath := range filePaths {
-		wg.Add(1)
-		go func(path string) {
-			defer wg.Done()
-			semaphore <- struct{}{}
-			defer func() { <-semaphore }()
-
-			if config.ProgressChan != nil {
-				config.ProgressChan <- fmt.Sprintf("Calculating metadata: %s", path)
-			}
-
-			metadata := FileMetadata{FilePath: path}
-
-			// Get file info
-			fileInfo, err := os.Stat(path)
-			if err != nil {
-				metadata.Error = fmt.Errorf("file info error: %w", err)
-				metadataChan <- metadata
-				return
-			}
-			metadata.FileInfo = fileInfo
-
-			// Calculate store path
-			if basePath == "" {
-				metadata.StorePath = fileInfo.Name()
-			} else {
-				relativePath, err := filepath.Rel(basePath, path)
-				if err != nil {
-					metadata.StorePath = filepath.Clean(path)
-				} else {
-					dirName := filepath.Base(basePath)
-					metadata.StorePath = filepath.Join(dirName, relativePath)
-				}
-			}
-
-			// Calculate hash and compressed size
-			hash, compressedSize, err := calculateFileMetadata(path)
-			if err != nil {
-				metadata.Error = fmt.Errorf("metadata calculation error: %w", err)
-				metadataChan <- metadata
-				return
-			}
-
-			metadata.Hash = hash
-			metadata.CompressedSize = compressedSize
-			metadataChan <- metadata
-		}(filePath)
-	}
-
-	// Close channel when all workers are done
-	go func() {
-		wg.Wait()
-		close(metadataChan)
-	}()
-
-	// Collect all metadata
-	var fileMetadata []FileMetadata
-	for metadata := range metadataChan {
-		fileMetadata = append(fileMetadata, metadata)
-		if metadata.Error != nil {
-			atomic.AddInt64(&stats.FailedFiles, 1)
-			stats.ErrorsMutex.Lock()
-			stats.Errors = append(stats.Errors, fmt.Errorf("failed to process %s: %w", metadata.FilePath, metadata.Error))
-			stats.ErrorsMutex.Unlock()
+	opts := AddOptions{Compression: config.Compression, SnapshotCheck: config.SnapshotCheck, Context: config.Context}
+	batch, err := newStagingBatch(v.path, v.header, v.key, v.dir, opts)
+	if err != nil {
+		return stats, err
+	}
+	defer batch.close()
+	batch.timeout = config.Timeout
+	batch.memoryBudget = config.MemoryBudget
+	batch.entries = entries
+
+	// Parallel compression of every file, written to the vault in order by one writer
+	// as the files are done
+	files := batch.stageFiles(filePaths, basePath, config.MaxConcurrency, config.ProgressChan)
+	err = v.written(batch.commit(v.dir, files))
+
+	for _, file := range files {
+		if file.Error != nil {
+			stats.FailedFiles++
+			stats.Errors = append(stats.Errors, fmt.Errorf("failed to process %s: %w", file.FilePath, file.Error))
 		} else {
-			atomic.AddInt64(&stats.SuccessfulFiles, 1)
-			atomic.AddInt64(&stats.TotalSize, metadata.FileInfo.Size())
-		}
-	}
-
-	// Phase 2: Single vault reconstruction with all files
-	if stats.SuccessfulFiles > 0 {
-		var successfulMetadata []FileMetadata
-		for _, metadata := range fileMetadata {
-			if metadata.Error == nil {
-				successfulMetadata = append(successfulMetadata, metadata)
-			}
-		}
-
-		if config.ProgressChan != nil {
-			config.ProgressChan <- fmt.Sprintf("Writing %d files to vault...", len(successfulMetadata))
-		}
-
-		if err := addMultipleFilesToVaultSingleWrite(vaultPath, password, successfulMetadata); err != nil {
-			return stats, fmt.Errorf("vault reconstruction error: %w", err)
+			stats.SuccessfulFiles++
+			stats.TotalSize += file.entry.Size
 		}
 	}
-
+	stats.CompressDuration = batch.stageTime
+	stats.WriteDuration = batch.writeTime
+	stats.CommitDuration = batch.commitTime
 	stats.Duration = time.Since(startTime)
-	return stats, nil
-}
 
-// addMultipleFilesToVaultSingleWrite reconstructs vault with all files in single operation
-func addMultipleFilesToVaultSingleWrite(vaultPath, password string, fileMetadata []FileMetadata) error {
-	// Load existing vault directory
-	vaultDir, err := loadVaultDirectory(vaultPath, password)
+	// A cancelled add writes nothing, not even the files staged before
 	if err != nil {
-		return fmt.Errorf("vault directory load error: %w", err)
-	}
-
-	// Add all new file entries to vault directory
-	for _, metadata := range fileMetadata {
-		entry := FileEntry{
-			Path:           metadata.StorePath,
-			Name:           metadata.FileInfo.Name(),
-			IsDir:          false,
-			Size:           metadata.FileInfo.Size(),
-			CompressedSize: metadata.CompressedSize,
-			Mode:           uint32(metadata.FileInfo.Mode()),
-			ModTime:        metadata.FileInfo.ModTime(),
-			Offset:         0, // Will be calculated later
-			SHA256Hash:     metadata.Hash,
-		}
-
-		// Update or add entry
-		found := false
-		for i, existingEntry := range vaultDir.Entries {
-			if existingEntry.Path == entry.Path {
-				vaultDir.Entries[i] = entry
-				found = true
-				break
-			}
-		}
-		if !found {
-			vaultDir.Entries = append(vaultDir.Entries, entry)
-		}
-	}
-
-	// Reconstruct vault with all files in single operation
-	return addMultipleFilesToVaultStreamingBatch(vaultPath, password, *vaultDir, fileMetadata)
-}
-
-// addMultipleFilesToVaultStreamingBatch streams multiple files to vault in single reconstruction
-func addMultipleFilesToVaultStreamingBatch(vaultPath, password string, vaultDir VaultDirectory, fileMetadata []FileMetadata) error {
-	// Create temporary file for the new vault
-	tempPath := vaultPath + ".tmp"
-	defer os.Remove(tempPath)
-
-	// Open original vault file for reading
-	originalFile, err := os.Open(vaultPath)
-	if err != nil {
-		return fmt.Errorf("original file open error: %w", err)
-	}
-	defer originalFile.Close()
-
-	// Read original header
-	var originalHeader VaultHeader
-	if err := binary.Read(originalFile, binary.LittleEndian, &originalHeader); err != nil {
-		return fmt.Errorf("header read error: %w", err)
-	}
-
-	// Calculate file offsets for all entries
-	var totalDataSize int64 = 0
-	for i := range vaultDir.Entries {
-		if !vaultDir.Entries[i].IsDir {
-			vaultDir.Entries[i].Offset = totalDataSize
-			totalDataSize += vaultDir.Entries[i].CompressedSize
-		}
-	}
-
-	// Create vault directory data
-	jsonData, err := json.Marshal(vaultDir)
-	if err != nil {
-		return fmt.Errorf("directory serialization error: %w", err)
-	}
-
-	compressedDir, err := compressData(jsonData)
-	if err != nil {
-		return fmt.Errorf("directory compression error: %w", err)
-	}
-
-	// Encrypt directory
-	key := pbkdf2.Key([]byte(password), originalHeader.Salt[:], int(originalHeader.Iterations), KeyLength, sha256.New)
-	defer func() {
-		for i := range key {
-			key[i] = 0
-		}
-	}()
-
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return fmt.Errorf("AES cipher creation error: %w", err)
-	}
-
-	gcm, err := cipher.NewGCM(block)
-	if err != nil {
-		return fmt.Errorf("GCM creation error: %w", err)
-	}
-
-	encryptedDir := gcm.Seal(nil, originalHeader.Nonce[:], compressedDir, nil)
-
-	// Create new header
-	newHeader := originalHeader
-	newHeader.DirectorySize = uint64(len(encryptedDir))
-
-	// Create temporary file
-	tempFile, err := os.Create(tempPath)
-	if err != nil {
-		return fmt.Errorf("temp file creation error: %w", err)
-	}
-	defer tempFile.Close()
-
-	// Write header and directory
-	if err := binary.Write(tempFile, binary.LittleEndian, newHeader); err != nil {
-		return fmt.Errorf("header write error: %w", err)
-	}
-	if _, err := tempFile.Write(encryptedDir); err != nil {
-		return fmt.Errorf("directory write error: %w", err)
-	}
-
-	// Stream existing file data (excluding new files)
-	existingFilePaths := make(map[string]bool)
-	for _, metadata := range fileMetadata {
-		existingFilePaths[metadata.StorePath] = true
-	}
-
-	headerSize := int64(binary.Size(VaultHeader{}))
-	originalDirectorySize := int64(originalHeader.DirectorySize)
-	originalDataOffset := headerSize + originalDirectorySize
-
-	buffer := make([]byte, StreamBufferSize)
-
-	// Copy existing files that are not being replaced
-	for _, entry := range vaultDir.Entries {
-		if entry.IsDir || existingFilePaths[entry.Path] {
-			continue // Skip directories and files being replaced
+		if cause := contextError(orBackground(config.Context)); cause != nil {
+			return stats, fmt.Errorf("add cancelled: %w", cause)
 		}
-
-		sourceOffset := originalDataOffset + entry.Offset
-		if _, err := originalFile.Seek(sourceOffset, io.SeekStart); err != nil {
-			return fmt.Errorf("existing file seek error: %w", err)
-		}
-
-		limitedReader := io.LimitReader(originalFile, entry.CompressedSize)
-		if _, err := io.CopyBuffer(tempFile, limitedReader, buffer); err != nil {
-			return fmt.Errorf("existing file copy error: %w", err)
-		}
-	}
-
-	// Stream all new files
-	for _, metadata := range fileMetadata {
-		sourceFile, err := os.Open(metadata.FilePath)
-		if err != nil {
-			return fmt.Errorf("source file open error for %s: %w", metadata.FilePath, err)
-		}
-
-		gzipWriter := gzip.NewWriter(tempFile)
-		if _, err := io.CopyBuffer(gzipWriter, sourceFile, buffer); err != nil {
-			sourceFile.Close()
-			gzipWriter.Close()
-			return fmt.Errorf("file compression error for %s: %w", metadata.FilePath, err)
-		}
-
-		if err := gzipWriter.Close(); err != nil {
-			sourceFile.Close()
-			return fmt.Errorf("compression finalization error for %s: %w", metadata.FilePath, err)
-		}
-		sourceFile.Close()
-	}
-
-	if err := tempFile.Sync(); err != nil {
-		return fmt.Errorf("temp file sync error: %w", err)
-	}
-
-	tempFile.Close()
-	originalFile.Close()
-
-	// Atomic replacement
-	if err := os.Rename(tempPath, vaultPath); err != nil {
-		return fmt.Errorf("file replacement error: %w", err)
+		return stats, fmt.Errorf("vault reconstruction error: %w", err)
 	}
-
-	return nil
+	return stats, nil
 }
@@ -48,7 +48,7 @@ func TestCreateVault(t *testing.T) {
 	vaultPath := filepath.Join(tmpDir, "test.vault")
 
 	// Тест 1: Успешное создание vault
-	err := CreateVault(vaultPath, testPassword)
+	err := CreateVault(vaultPath, Password(testPassword))
 	if err != nil {
 		t.Fatalf("CreateVault failed: %v", err)
 	}
@@ -59,20 +59,20 @@ func TestCreateVault(t *testing.T) {
 	}
 
 	// Тест 2: Создание vault с существующим файлом (должен дать ошибку)
-	err = CreateVault(vaultPath, testPassword)
+	err = CreateVault(vaultPath, Password(testPassword))
 	if err == nil {
 		t.Fatal("Expected error when creating vault with existing file")
 	}
 
 	// Тест 3: Создание vault с пустым паролем (должен дать ошибку)
 	vaultPath2 := filepath.Join(tmpDir, "vault2.vault")
-	err = CreateVault(vaultPath2, "")
+	err = CreateVault(vaultPath2, Password(""))
 	if err == nil {
 		t.Fatal("Expected error when creating vault with empty password")
 	}
 
 	// Тест 4: Создание vault с пустым путём (должен дать ошибку)
-	err = CreateVault("", testPassword)
+	err = CreateVault("", Password(testPassword))
 	if err == nil {
 		t.Fatal("Expected error when creating vault with empty path")
 	}
@@ -87,18 +87,18 @@ func TestAddFileToVault(t *testing.T) {
 	testFilePath := createTestFile(t, tmpDir, "test.txt", testContent)
 
 	// Создаём vault
-	if err := CreateVault(vaultPath, testPassword); err != nil {
+	if err := CreateVault(vaultPath, Password(testPassword)); err != nil {
 		t.Fatalf("CreateVault failed: %v", err)
 	}
 
 	// Тест 1: Добавление файла в vault
-	err := AddFileToVault(vaultPath, testPassword, testFilePath)
+	err := AddFileToVault(vaultPath, Password(testPassword), testFilePath)
 	if err != nil {
 		t.Fatalf("AddFileToVault failed: %v", err)
 	}
 
 	// Проверяем что файл добавлен
-	entries, err := ListVault(vaultPath, testPassword)
+	entries, err := ListVault(vaultPath, Password(testPassword))
 	if err != nil {
 		t.Fatalf("ListVault failed: %v", err)
 	}
@@ -118,13 +118,13 @@ func TestAddFileToVault(t *testing.T) {
 
 	// Тест 2: Добавление несуществующего файла (должен дать ошибку)
 	nonExistentPath := filepath.Join(tmpDir, "nonexistent.txt")
-	err = AddFileToVault(vaultPath, testPassword, nonExistentPath)
+	err = AddFileToVault(vaultPath, Password(testPassword), nonExistentPath)
 	if err == nil {
 		t.Fatal("Expected error when adding non-existent file")
 	}
 
 	// Тест 3: Неправильный пароль (должен дать ошибку)
-	err = AddFileToVault(vaultPath, "wrongpassword", testFilePath)
+	err = AddFileToVault(vaultPath, Password("wrongpassword"), testFilePath)
 	if err == nil {
 		t.Fatal("Expected error with wrong password")
 	}
@@ -153,18 +153,18 @@ func TestAddDirectoryToVault(t *testing.T) {
 	createTestFile(t, subDir, "file3.txt", "Content 3")
 
 	// Создаём vault
-	if err := CreateVault(vaultPath, testPassword); err != nil {
+	if err := CreateVault(vaultPath, Password(testPassword)); err != nil {
 		t.Fatalf("CreateVault failed: %v", err)
 	}
 
 	// Тест добавления директории в vault
-	err := AddDirectoryToVault(vaultPath, testPassword, testDir)
+	err := AddDirectoryToVault(vaultPath, Password(testPassword), testDir)
 	if err != nil {
 		t.Fatalf("AddDirectoryToVault failed: %v", err)
 	}
 
 	// Проверяем что директория и файлы добавлены
-	entries, err := ListVault(vaultPath, testPassword)
+	entries, err := ListVault(vaultPath, Password(testPassword))
 	if err != nil {
 		t.Fatalf("ListVault failed: %v", err)
 	}
@@ -195,23 +195,23 @@ func TestExtractFromVault(t *testing.T) {
 	outputDir := filepath.Join(tmpDir, "output")
 
 	// Создаём vault и добавляем тестовый файл
-	if err := CreateVault(vaultPath, testPassword); err != nil {
+	if err := CreateVault(vaultPath, Password(testPassword)); err != nil {
 		t.Fatalf("CreateVault failed: %v", err)
 	}
 
 	testFilePath := createTestFile(t, tmpDir, "test.txt", testContent)
-	if err := AddFileToVault(vaultPath, testPassword, testFilePath); err != nil {
+	if err := AddFileToVault(vaultPath, Password(testPassword), testFilePath); err != nil {
 		t.Fatalf("AddFileToVault failed: %v", err)
 	}
 
 	// Тест извлечения из vault
-	err := ExtractFromVault(vaultPath, testPassword, outputDir)
+	err := ExtractFromVault(vaultPath, Password(testPassword), outputDir)
 	if err != nil {
 		t.Fatalf("ExtractFromVault failed: %v", err)
 	}
 
 	// Получаем список файлов для проверки извлечённого пути
-	entries, err := ListVault(vaultPath, testPassword)
+	entries, err := ListVault(vaultPath, Password(testPassword))
 	if err != nil {
 		t.Fatalf("ListVault failed: %v", err)
 	}
@@ -245,22 +245,22 @@ func TestGetFromVault(t *testing.T) {
 	outputDir := filepath.Join(tmpDir, "output")
 
 	// Создаём vault и добавляем несколько файлов
-	if err := CreateVault(vaultPath, testPassword); err != nil {
+	if err := CreateVault(vaultPath, Password(testPassword)); err != nil {
 		t.Fatalf("CreateVault failed: %v", err)
 	}
 
 	file1 := createTestFile(t, tmpDir, "file1.txt", "Content 1")
 	file2 := createTestFile(t, tmpDir, "file2.txt", "Content 2")
 
-	if err := AddFileToVault(vaultPath, testPassword, file1); err != nil {
+	if err := AddFileToVault(vaultPath, Password(testPassword), file1); err != nil {
 		t.Fatalf("AddFileToVault failed: %v", err)
 	}
-	if err := AddFileToVault(vaultPath, testPassword, file2); err != nil {
+	if err := AddFileToVault(vaultPath, Password(testPassword), file2); err != nil {
 		t.Fatalf("AddFileToVault failed: %v", err)
 	}
 
 	// Получаем список файлов для определения путей
-	entries, err := ListVault(vaultPath, testPassword)
+	entries, err := ListVault(vaultPath, Password(testPassword))
 	if err != nil {
 		t.Fatalf("ListVault failed: %v", err)
 	}
@@ -283,7 +283,7 @@ func TestGetFromVault(t *testing.T) {
 	}
 
 	// Тест селективного извлечения
-	err = GetFromVault(vaultPath, testPassword, outputDir, []string{file1Path})
+	err = GetFromVault(vaultPath, Password(testPassword), outputDir, []string{file1Path})
 	if err != nil {
 		t.Fatalf("GetFromVault failed: %v", err)
 	}
@@ -309,22 +309,22 @@ func TestRemoveFromVault(t *testing.T) {
 	vaultPath := filepath.Join(tmpDir, "test.vault")
 
 	// Создаём vault и добавляем тестовые файлы
-	if err := CreateVault(vaultPath, testPassword); err != nil {
+	if err := CreateVault(vaultPath, Password(testPassword)); err != nil {
 		t.Fatalf("CreateVault failed: %v", err)
 	}
 
 	file1 := createTestFile(t, tmpDir, "file1.txt", "Content 1")
 	file2 := createTestFile(t, tmpDir, "file2.txt", "Content 2")
 
-	if err := AddFileToVault(vaultPath, testPassword, file1); err != nil {
+	if err := AddFileToVault(vaultPath, Password(testPassword), file1); err != nil {
 		t.Fatalf("AddFileToVault failed: %v", err)
 	}
-	if err := AddFileToVault(vaultPath, testPassword, file2); err != nil {
+	if err := AddFileToVault(vaultPath, Password(testPassword), file2); err != nil {
 		t.Fatalf("AddFileToVault failed: %v", err)
 	}
 
 	// Получаем список файлов перед удалением
-	entries, err := ListVault(vaultPath, testPassword)
+	entries, err := ListVault(vaultPath, Password(testPassword))
 	if err != nil {
 		t.Fatalf("ListVault failed: %v", err)
 	}
@@ -347,13 +347,13 @@ func TestRemoveFromVault(t *testing.T) {
 	}
 
 	// Тест удаления файла из vault
-	err = RemoveFromVault(vaultPath, testPassword, []string{file1Path})
+	err = RemoveFromVault(vaultPath, Password(testPassword), []string{file1Path})
 	if err != nil {
 		t.Fatalf("RemoveFromVault failed: %v", err)
 	}
 
 	// Проверяем что файл удалён
-	entries, err = ListVault(vaultPath, testPassword)
+	entries, err = ListVault(vaultPath, Password(testPassword))
 	if err != nil {
 		t.Fatalf("ListVault failed: %v", err)
 	}
@@ -374,7 +374,7 @@ func TestParallelOperations(t *testing.T) {
 	vaultPath := filepath.Join(tmpDir, "test.vault")
 
 	// Создаём vault
-	if err := CreateVault(vaultPath, testPassword); err != nil {
+	if err := CreateVault(vaultPath, Password(testPassword)); err != nil {
 		t.Fatalf("CreateVault failed: %v", err)
 	}
 
@@ -392,7 +392,7 @@ func TestParallelOperations(t *testing.T) {
 	config.MaxConcurrency = 2
 	config.Context = context.Background()
 
-	stats, err := AddMultipleFilesToVaultParallel(vaultPath, testPassword, filePaths, config)
+	stats, err := AddMultipleFilesToVaultParallel(vaultPath, Password(testPassword), filePaths, config)
 	if err != nil {
 		// Выводим детали ошибок для диагностики
 		t.Logf("Parallel add errors: %v", err)
@@ -411,7 +411,7 @@ func TestParallelOperations(t *testing.T) {
 	}
 
 	// Проверяем что файлы добавлены
-	entries, err := ListVault(vaultPath, testPassword)
+	entries, err := ListVault(vaultPath, Password(testPassword))
 	if err != nil {
 		t.Fatalf("ListVault failed: %v", err)
 	}
@@ -427,7 +427,7 @@ func TestParallelOperations(t *testing.T) {
 		targetPaths = append(targetPaths, entry.Path)
 	}
 
-	extractStats, err := ExtractMultipleFilesFromVaultParallel(vaultPath, testPassword, outputDir, targetPaths, config)
+	extractStats, err := ExtractMultipleFilesFromVaultParallel(vaultPath, Password(testPassword), outputDir, targetPaths, config)
 	if err != nil {
 		t.Fatalf("ExtractMultipleFilesFromVaultParallel failed: %v", err)
 	}
@@ -466,7 +466,7 @@ func TestAddDirectoryToVaultParallel(t *testing.T) {
 	}
 
 	// Создаём vault
-	if err := CreateVault(vaultPath, testPassword); err != nil {
+	if err := CreateVault(vaultPath, Password(testPassword)); err != nil {
 		t.Fatalf("CreateVault failed: %v", err)
 	}
 
@@ -474,7 +474,7 @@ func TestAddDirectoryToVaultParallel(t *testing.T) {
 	config := DefaultParallelConfig()
 	config.MaxConcurrency = 2
 
-	stats, err := AddDirectoryToVaultParallel(vaultPath, testPassword, testDir, config)
+	stats, err := AddDirectoryToVaultParallel(vaultPath, Password(testPassword), testDir, config)
 	if err != nil {
 		// Выводим детали ошибок для диагностики
 		t.Logf("Parallel directory add errors: %v", err)
@@ -489,7 +489,7 @@ func TestAddDirectoryToVaultParallel(t *testing.T) {
 	}
 
 	// Проверяем что файлы добавлены
-	entries, err := ListVault(vaultPath, testPassword)
+	entries, err := ListVault(vaultPath, Password(testPassword))
 	if err != nil {
 		t.Fatalf("ListVault failed: %v", err)
 	}
@@ -514,17 +514,17 @@ func TestVaultIntegrity(t *testing.T) {
 	vaultPath := filepath.Join(tmpDir, "test.vault")
 
 	// Создаём vault и добавляем тестовый файл
-	if err := CreateVault(vaultPath, testPassword); err != nil {
+	if err := CreateVault(vaultPath, Password(testPassword)); err != nil {
 		t.Fatalf("CreateVault failed: %v", err)
 	}
 
 	testFilePath := createTestFile(t, tmpDir, "test.txt", testContent)
-	if err := AddFileToVault(vaultPath, testPassword, testFilePath); err != nil {
+	if err := AddFileToVault(vaultPath, Password(testPassword), testFilePath); err != nil {
 		t.Fatalf("AddFileToVault failed: %v", err)
 	}
 
 	// Получаем информацию о файле для проверки хеша
-	entries, err := ListVault(vaultPath, testPassword)
+	entries, err := ListVault(vaultPath, Password(testPassword))
 	if err != nil {
 		t.Fatalf("ListVault failed: %v", err)
 	}
@@ -541,6 +541,105 @@ func TestVaultIntegrity(t *testing.T) {
 	}
 }
 
+// readTestHeader читает заголовок vault файла
+func readTestHeader(t *testing.T, path string) VaultHeader {
+	t.Helper()
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open vault: %v", err)
+	}
+	defer file.Close()
+
+	header, err := readVaultHeader(file)
+	if err != nil {
+		t.Fatalf("Failed to read header: %v", err)
+	}
+	return *header
+}
+
+// readTestDirectoryNonce читает nonce текущей директории: последней дописанной или из заголовка
+func readTestDirectoryNonce(t *testing.T, path string) [NonceLength]byte {
+	t.Helper()
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open vault: %v", err)
+	}
+	defer file.Close()
+
+	header, err := readVaultHeader(file)
+	if err != nil {
+		t.Fatalf("Failed to read header: %v", err)
+	}
+	info, _ := file.Stat()
+	commit, err := findLogCommit(file, header, info.Size())
+	if err != nil {
+		t.Fatalf("Failed to find directory: %v", err)
+	}
+	if commit != nil {
+		return commit.trailer.DirNonce
+	}
+	return header.Nonce
+}
+
+// TestDirectoryNonceNeverReused проверяет что каждое сохранение директории использует новый nonce
+func TestDirectoryNonceNeverReused(t *testing.T) {
+	tmpDir := setupCoreTest(t)
+	defer cleanupCoreTest(t, tmpDir)
+
+	vaultPath := filepath.Join(tmpDir, "nonce.vault")
+	if err := CreateVault(vaultPath, Password(testPassword)); err != nil {
+		t.Fatalf("CreateVault failed: %v", err)
+	}
+
+	seen := map[[NonceLength]byte]string{}
+	record := func(step string) {
+		nonce := readTestDirectoryNonce(t, vaultPath)
+		if previous, exists := seen[nonce]; exists {
+			t.Fatalf("Nonce reused: %s and %s share nonce %x", previous, step, nonce)
+		}
+		seen[nonce] = step
+	}
+	record("create")
+
+	file1 := createTestFile(t, tmpDir, "a.txt", "first file")
+	file2 := createTestFile(t, tmpDir, "b.txt", "second file")
+	subDir := filepath.Join(tmpDir, "dir")
+	os.MkdirAll(subDir, 0755)
+	createTestFile(t, subDir, "c.txt", "third file")
+
+	if err := AddFileToVault(vaultPath, Password(testPassword), file1); err != nil {
+		t.Fatalf("AddFileToVault failed: %v", err)
+	}
+	record("add single file")
+
+	if err := AddFileToVault(vaultPath, Password(testPassword), file1); err != nil {
+		t.Fatalf("AddFileToVault (same file) failed: %v", err)
+	}
+	record("re-add same file")
+
+	if _, err := AddMultipleFilesToVaultParallel(vaultPath, Password(testPassword), []string{file2}, DefaultParallelConfig()); err != nil {
+		t.Fatalf("AddMultipleFilesToVaultParallel failed: %v", err)
+	}
+	record("batch add")
+
+	if _, err := AddDirectoryToVaultParallel(vaultPath, Password(testPassword), subDir, DefaultParallelConfig()); err != nil {
+		t.Fatalf("AddDirectoryToVaultParallel failed: %v", err)
+	}
+	record("directory add")
+
+	if err := RemoveFromVault(vaultPath, Password(testPassword), []string{"a.txt"}); err != nil {
+		t.Fatalf("RemoveFromVault failed: %v", err)
+	}
+	record("remove")
+
+	// Vault должен оставаться читаемым после всех сохранений
+	if _, err := ListVault(vaultPath, Password(testPassword)); err != nil {
+		t.Fatalf("ListVault failed: %v", err)
+	}
+}
+
 // TestCompressionFunctions тестирует функции сжатия
 func TestCompressionFunctions(t *testing.T) {
 	testData := []byte("This is test data for compression testing with some repetitive content repetitive content repetitive content")
@@ -571,44 +670,20 @@ func TestCompressionFunctions(t *testing.T) {
 	}
 }
 
-// TestCalculateFileMetadata тестирует расчёт метаданных файла
-func TestCalculateFileMetadata(t *testing.T) {
-	tmpDir := setupCoreTest(t)
-	defer cleanupCoreTest(t, tmpDir)
-
-	testFilePath := createTestFile(t, tmpDir, "test.txt", testContent)
-
-	hash, compressedSize, err := calculateFileMetadata(testFilePath)
-	if err != nil {
-		t.Fatalf("calculateFileMetadata failed: %v", err)
-	}
-
-	// Проверяем хеш
-	expectedHash := sha256.Sum256([]byte(testContent))
-	if hash != expectedHash {
-		t.Fatalf("Hash mismatch. Expected: %x, got: %x", expectedHash, hash)
-	}
-
-	// Проверяем что размер сжатых данных больше 0
-	if compressedSize <= 0 {
-		t.Fatal("Compressed size should be greater than 0")
-	}
-}
-
 // BenchmarkAddFileToVault бенчмарк для добавления файла
 func BenchmarkAddFileToVault(b *testing.B) {
 	tmpDir, _ := ioutil.TempDir("", "bench_core_*")
 	defer os.RemoveAll(tmpDir)
 
 	vaultPath := filepath.Join(tmpDir, "bench.vault")
-	CreateVault(vaultPath, testPassword)
+	CreateVault(vaultPath, Password(testPassword))
 
 	testFilePath := filepath.Join(tmpDir, "bench_file.txt")
 	ioutil.WriteFile(testFilePath, []byte(testContent), 0644)
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		if err := AddFileToVault(vaultPath, testPassword, testFilePath); err != nil {
+		if err := AddFileToVault(vaultPath, Password(testPassword), testFilePath); err != nil {
 			b.Fatalf("AddFileToVault failed: %v", err)
 		}
 	}
@@ -620,16 +695,16 @@ func BenchmarkExtractFromVault(b *testing.B) {
 	defer os.RemoveAll(tmpDir)
 
 	vaultPath := filepath.Join(tmpDir, "bench.vault")
-	CreateVault(vaultPath, testPassword)
+	CreateVault(vaultPath, Password(testPassword))
 
 	testFilePath := filepath.Join(tmpDir, "bench_file.txt")
 	ioutil.WriteFile(testFilePath, []byte(testContent), 0644)
-	AddFileToVault(vaultPath, testPassword, testFilePath)
+	AddFileToVault(vaultPath, Password(testPassword), testFilePath)
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
 		outputDir := filepath.Join(tmpDir, "bench_output_"+string(rune(i)))
-		if err := ExtractFromVault(vaultPath, testPassword, outputDir); err != nil {
+		if err := ExtractFromVault(vaultPath, Password(testPassword), outputDir); err != nil {
 			b.Fatalf("ExtractFromVault failed: %v", err)
 		}
 	}
@@ -778,18 +853,18 @@ func TestPasswordSanitization(t *testing.T) {
 	password := "SanitizeTest123!"
 
 	// Создаём vault
-	if err := CreateVault(vaultPath, password); err != nil {
+	if err := CreateVault(vaultPath, Password(password)); err != nil {
 		t.Fatalf("CreateVault failed: %v", err)
 	}
 
 	// Тестируем что функции работают с паролем (и очищают его внутри)
-	_, err := ListVault(vaultPath, password)
+	_, err := ListVault(vaultPath, Password(password))
 	if err != nil {
 		t.Fatalf("ListVault failed: %v", err)
 	}
 
 	// Проверяем что пароль всё ещё работает (не был изменён снаружи)
-	_, err = ListVault(vaultPath, password)
+	_, err = ListVault(vaultPath, Password(password))
 	if err != nil {
 		t.Fatalf("ListVault failed on second call: %v", err)
 	}
@@ -803,35 +878,35 @@ func TestErrorConditions(t *testing.T) {
 	// Тест с несуществующим vault файлом
 	nonExistentVault := filepath.Join(tmpDir, "nonexistent.vault")
 
-	_, err := ListVault(nonExistentVault, "password")
+	_, err := ListVault(nonExistentVault, Password("password"))
 	if err == nil {
 		t.Error("Expected error for non-existent vault")
 	}
 
-	err = ExtractFromVault(nonExistentVault, "password", tmpDir)
+	err = ExtractFromVault(nonExistentVault, Password("password"), tmpDir)
 	if err == nil {
 		t.Error("Expected error for non-existent vault")
 	}
 
-	err = RemoveFromVault(nonExistentVault, "password", []string{"file.txt"})
+	err = RemoveFromVault(nonExistentVault, Password("password"), []string{"file.txt"})
 	if err == nil {
 		t.Error("Expected error for non-existent vault")
 	}
 
 	// Тест с недоступной директорией для извлечения
 	vaultPath := filepath.Join(tmpDir, "test.vault")
-	if err := CreateVault(vaultPath, testPassword); err != nil {
+	if err := CreateVault(vaultPath, Password(testPassword)); err != nil {
 		t.Fatalf("CreateVault failed: %v", err)
 	}
 
 	testFile := createTestFile(t, tmpDir, "test.txt", "test content")
-	if err := AddFileToVault(vaultPath, testPassword, testFile); err != nil {
+	if err := AddFileToVault(vaultPath, Password(testPassword), testFile); err != nil {
 		t.Fatalf("AddFileToVault failed: %v", err)
 	}
 
 	// Попытка извлечь в несуществующую директорию с неправильными правами
 	badOutputDir := "/root/nonexistent_dir"
-	err = ExtractFromVault(vaultPath, testPassword, badOutputDir)
+	err = ExtractFromVault(vaultPath, Password(testPassword), badOutputDir)
 	if err == nil {
 		t.Error("Expected error for inaccessible output directory")
 	}
@@ -845,7 +920,7 @@ func BenchmarkCreateVault(b *testing.B) {
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
 		vaultPath := filepath.Join(tmpDir, "bench_"+string(rune('a'+i))+".vault")
-		if err := CreateVault(vaultPath, testPassword); err != nil {
+		if err := CreateVault(vaultPath, Password(testPassword)); err != nil {
 			b.Fatalf("CreateVault failed: %v", err)
 		}
 	}
@@ -0,0 +1,288 @@
+package vault
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// ========================
+// VAULT HANDLE
+// ========================
+//
+// A Vault is a vault opened once: the key is derived (or the master key unwrapped)
+// when it is opened and kept until Close, together with the current directory and a
+// read-only descriptor of the file. Payloads are read with ReadAt, so extraction
+// workers share the descriptor instead of opening the file for every entry.
+//
+// Every operation still takes the vault lock for its duration. If the file was written
+// by anyone else since the directory was read (another handle, another process), the
+// directory is read again with the cached key; the handle's own writes update the
+// cached directory. The free functions (ListVault, ExtractFromVault, AddFileToVault,
+// ...) open a handle for one operation.
+//
+// Of a paged (v5) directory only the root is read at first. Lookups by path and prefix
+// read the pages they need from it; operations that need every entry load the whole
+// directory once and keep it.
+
+// ErrVaultClosed is returned by operations on a closed Vault
+var ErrVaultClosed = errors.New("vault is closed")
+
+// Vault is an open vault. Its methods may be called from several goroutines.
+type Vault struct {
+	path string
+	key  []byte // Key of the directory and payloads; nil once closed
+	slot int    // Key slot the key was unwrapped from
+
+	mu     sync.Mutex      // Serializes refreshes of the state below
+	file   *os.File        // Read-only descriptor payloads are read from
+	header *VaultHeader    // Header of file
+	dir    *VaultDirectory // Current directory; nil when it must be read again
+	root   *pagedDirectory // Current root of a paged directory; nil if not read
+	stamp  os.FileInfo     // The vault file when dir or root was read
+}
+
+// OpenVault opens a vault with a key source, deriving its key once for all operations
+// on the returned handle. The handle must be closed to wipe the key.
+func OpenVault(path string, keySource KeySource) (*Vault, error) {
+	// Lock the vault against writers in other goroutines and processes
+	unlock, err := lockVault(path, false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	return openVault(path, keySource)
+}
+
+// openVault opens a vault; the caller holds the vault lock
+func openVault(path string, keySource KeySource) (*Vault, error) {
+	// First validate the vault file format
+	if err := ValidateVaultFile(path); err != nil {
+		return nil, err
+	}
+
+	file, header, err := openVaultFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// Derive key from the key source (unwraps the master key for v3+)
+	key, slot, err := header.unlockKeySlot(keySource)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	v := &Vault{path: path, key: key, slot: slot, file: file, header: header}
+	if err := v.readDirectory(false); err != nil {
+		v.Close()
+		return nil, err
+	}
+	return v, nil
+}
+
+// openVaultFile opens a vault file for reading and reads its header
+func openVaultFile(path string) (*os.File, *VaultHeader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("file open error: %w", err)
+	}
+
+	header, err := readVaultHeader(file)
+	if err != nil {
+		file.Close()
+		return nil, nil, fmt.Errorf("header read error: %w", err)
+	}
+	return file, header, nil
+}
+
+// Close wipes the key and closes the vault file
+func (v *Vault) Close() error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.key == nil {
+		return nil
+	}
+	clearKey(v.key)
+	v.key = nil
+	v.dir, v.root = nil, nil
+	return v.file.Close()
+}
+
+// Path returns the path of the vault file
+func (v *Vault) Path() string {
+	return v.path
+}
+
+// lock takes the vault lock, shared or exclusive, and makes sure the whole cached
+// directory is current. The returned function releases the lock.
+func (v *Vault) lock(exclusive bool) (func(), error) {
+	return v.lockDirectory(exclusive, true)
+}
+
+// lockLookup takes the shared vault lock for lookups by path, which only need the
+// current root of a paged directory; see current
+func (v *Vault) lockLookup() (func(), error) {
+	return v.lockDirectory(false, false)
+}
+
+// lockDirectory takes the vault lock and refreshes the cached directory, or only the
+// root of a paged one unless full is set
+func (v *Vault) lockDirectory(exclusive, full bool) (func(), error) {
+	unlock, err := lockVault(v.path, exclusive)
+	if err != nil {
+		return nil, err
+	}
+	if err := v.refresh(full); err != nil {
+		unlock()
+		return nil, err
+	}
+	return unlock, nil
+}
+
+// current returns the cached directory with its index built, or nil and the root of
+// the paged directory if the whole directory was not loaded. Callers holding the lock
+// from lockLookup must use it instead of reading the fields, which another reader may
+// fill in meanwhile.
+func (v *Vault) current() (*VaultDirectory, *pagedDirectory) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.dir != nil {
+		v.dir.entryIndex() // Shared readers only look it up
+	}
+	return v.dir, v.root
+}
+
+// refresh reads the directory again if the vault file changed since it was read, and
+// loads the whole of a paged directory if full is set
+func (v *Vault) refresh(full bool) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.key == nil {
+		return ErrVaultClosed
+	}
+
+	info, err := os.Stat(v.path)
+	if err != nil {
+		return fmt.Errorf("file stat error: %w", err)
+	}
+	if (v.dir != nil || v.root != nil) && os.SameFile(info, v.stamp) && info.Size() == v.stamp.Size() && info.ModTime().Equal(v.stamp.ModTime()) {
+		if full && v.dir == nil {
+			return v.loadDirectory()
+		}
+		return nil
+	}
+
+	if err := v.reopen(); err != nil {
+		return err
+	}
+	return v.readDirectory(full)
+}
+
+// reopen opens the vault file again, which a rewrite may have replaced
+func (v *Vault) reopen() error {
+	file, header, err := openVaultFile(v.path)
+	if err != nil {
+		return err
+	}
+	if err := header.verifyKeyedChecksum(v.key); err != nil {
+		file.Close()
+		return err
+	}
+	v.file.Close()
+	v.file, v.header = file, header
+	return nil
+}
+
+// readDirectory reads the current directory from the open vault file; of a paged
+// directory only the root unless full is set
+func (v *Vault) readDirectory(full bool) error {
+	v.dir, v.root = nil, nil
+
+	fileInfo, err := v.file.Stat()
+	if err != nil {
+		return fmt.Errorf("file stat error: %w", err)
+	}
+
+	var vaultDir *VaultDirectory
+	var root *pagedDirectory
+	if v.header.usesPagedDirectory() {
+		root, err = readCurrentPages(v.file, v.header, v.key, fileInfo.Size())
+	} else {
+		vaultDir, err = readCurrentDirectory(v.file, v.header, v.key, fileInfo.Size())
+	}
+	if err != nil {
+		if isInterruptedWrite(v.file, v.header, fileInfo.Size(), err) {
+			err = fmt.Errorf("%w: %w", ErrInterruptedWrite, err)
+		}
+		return err
+	}
+
+	v.dir, v.root, v.stamp = vaultDir, root, fileInfo
+	if full && v.dir == nil {
+		return v.loadDirectory()
+	}
+	return nil
+}
+
+// loadDirectory reads all pages of the cached root into the cached directory
+func (v *Vault) loadDirectory() error {
+	vaultDir, err := v.root.load()
+	if err != nil {
+		v.root = nil
+		return err
+	}
+	v.dir = vaultDir
+	return nil
+}
+
+// written brings the handle up to date after it wrote the vault. An append leaves the
+// cached directory current; after a rewrite, and after a failed write, the directory
+// is read again.
+func (v *Vault) written(err error) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if err != nil {
+		v.dir, v.root = nil, nil // Possibly changed before the write failed
+		return err
+	}
+
+	appended := v.header.usesVaultLog()
+	if err := v.reopen(); err != nil {
+		v.dir, v.root = nil, nil
+		return err
+	}
+	fileInfo, err := v.file.Stat()
+	if err != nil {
+		v.dir, v.root = nil, nil
+		return fmt.Errorf("file stat error: %w", err)
+	}
+	if appended && os.SameFile(fileInfo, v.stamp) {
+		v.root = nil // The appended directory has a root of its own
+		v.stamp = fileInfo
+		if v.dir != nil {
+			v.dir.inboxConflicts = nil // The write recorded the renamed entries
+		}
+		return nil
+	}
+	return v.readDirectory(true)
+}
+
+// writeDirectory writes the cached directory to the vault; the caller holds the
+// exclusive vault lock
+func (v *Vault) writeDirectory(ctx context.Context) error {
+	return v.written(writeVaultDirectory(ctx, v.path, v.key, *v.dir))
+}
+
+// putEntry adds or replaces an entry without payload (directory or link); the caller
+// holds the exclusive vault lock
+func (v *Vault) putEntry(entry FileEntry) error {
+	v.dir.putEntry(entry)
+	return v.writeDirectory(context.Background())
+}
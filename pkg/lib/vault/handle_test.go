@@ -0,0 +1,145 @@
+package vault
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingKeySource считает, сколько раз запрашивался секрет (по разу на вывод ключа).
+// Ключи такого типа хранятся в слоте для произвольных источников.
+type countingKeySource struct {
+	KeySource
+	calls atomic.Int32
+}
+
+func (s *countingKeySource) Secret() ([]byte, error) {
+	s.calls.Add(1)
+	return s.KeySource.Secret()
+}
+
+// TestVaultHandle тестирует открытый vault: ключ выводится один раз, директория
+// обновляется после чужих записей, а извлечение идёт из нескольких горутин
+func TestVaultHandle(t *testing.T) {
+	tmpDir := setupCoreTest(t)
+	defer cleanupCoreTest(t, tmpDir)
+
+	sourceDir := filepath.Join(tmpDir, "source")
+	os.MkdirAll(filepath.Join(sourceDir, "sub"), 0755)
+	contents := make(map[string]string)
+	for i := 0; i < 6; i++ {
+		name := fmt.Sprintf("file%d.txt", i)
+		if i%2 == 1 {
+			name = "sub/" + name
+		}
+		contents["source/"+name] = fmt.Sprintf("%s %d", testContent, i)
+		createTestFile(t, sourceDir, filepath.FromSlash(name), contents["source/"+name])
+	}
+
+	for _, version := range []uint32{2, CurrentVaultVersion} {
+		vaultPath := filepath.Join(tmpDir, fmt.Sprintf("handle-v%d.vault", version))
+		params := testArgon2Params
+		if version < MasterKeyVersion {
+			params = DefaultKDFParams() // Legacy vaults only support PBKDF2
+		}
+		vaultDir := VaultDirectory{Version: version, Entries: []FileEntry{}, CreatedAt: time.Now()}
+		if err := saveVaultDirectory(vaultPath, &countingKeySource{KeySource: Password(testPassword)}, vaultDir, params, nil); err != nil {
+			t.Fatalf("saveVaultDirectory failed: %v", err)
+		}
+
+		// Добавление каталога выводит ключ один раз, а не для каждого файла
+		keySource := &countingKeySource{KeySource: Password(testPassword)}
+		if err := AddDirectoryToVault(vaultPath, keySource, sourceDir); err != nil {
+			t.Fatalf("v%d: AddDirectoryToVault failed: %v", version, err)
+		}
+		if calls := keySource.calls.Load(); calls != 1 {
+			t.Errorf("v%d: adding a directory derived the key %d times", version, calls)
+		}
+
+		keySource.calls.Store(0)
+		v, err := OpenVault(vaultPath, keySource)
+		if err != nil {
+			t.Fatalf("v%d: OpenVault failed: %v", version, err)
+		}
+
+		// Запись через другой дескриптор видна при следующей операции
+		other := createTestFile(t, tmpDir, "other.txt", "written elsewhere")
+		if err := AddFileToVault(vaultPath, &countingKeySource{KeySource: Password(testPassword)}, other); err != nil {
+			t.Fatalf("v%d: AddFileToVault failed: %v", version, err)
+		}
+		contents["other.txt"] = "written elsewhere"
+		entries, err := v.List()
+		if err != nil || len(entries) != len(contents)+2 {
+			t.Fatalf("v%d: expected %d entries after an outside write, got %d (%v)", version, len(contents)+2, len(entries), err)
+		}
+
+		// Собственная запись обновляет кэшированную директорию
+		own := createTestFile(t, tmpDir, "own.txt", "written through the handle")
+		if err := v.AddFile(own, AddOptions{}); err != nil {
+			t.Fatalf("v%d: AddFile failed: %v", version, err)
+		}
+		contents["own.txt"] = "written through the handle"
+
+		// Параллельное извлечение из нескольких горутин через один дескриптор
+		var paths []string
+		for path := range contents {
+			paths = append(paths, path)
+		}
+		var wg sync.WaitGroup
+		for i := 0; i < 3; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				outputDir := filepath.Join(tmpDir, fmt.Sprintf("output-v%d-%d", version, i))
+				var err error
+				if i == 0 {
+					err = v.Get(outputDir, paths, ExtractOptions{})
+				} else {
+					_, err = v.ExtractParallel(outputDir, paths, DefaultParallelConfig())
+				}
+				if err != nil {
+					t.Errorf("v%d: extraction %d failed: %v", version, i, err)
+					return
+				}
+				for path, content := range contents {
+					data, err := os.ReadFile(filepath.Join(outputDir, filepath.FromSlash(path)))
+					if err != nil || string(data) != content {
+						t.Errorf("v%d: extraction %d: content mismatch for %s (%v)", version, i, path, err)
+					}
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		// Удаление и сжатие через дескриптор; после перезаписи файл открывается заново
+		if err := v.Remove([]string{"own.txt"}); err != nil {
+			t.Fatalf("v%d: Remove failed: %v", version, err)
+		}
+		if _, err := v.Compact(CompactOptions{}); err != nil {
+			t.Fatalf("v%d: Compact failed: %v", version, err)
+		}
+		outputDir := filepath.Join(tmpDir, fmt.Sprintf("compacted-v%d", version))
+		if err := v.Get(outputDir, []string{"other.txt"}, ExtractOptions{}); err != nil {
+			t.Fatalf("v%d: Get after compaction failed: %v", version, err)
+		}
+		if data, err := os.ReadFile(filepath.Join(outputDir, "other.txt")); err != nil || string(data) != "written elsewhere" {
+			t.Errorf("v%d: content mismatch after compaction (%v)", version, err)
+		}
+
+		if calls := keySource.calls.Load(); calls != 1 {
+			t.Errorf("v%d: the handle derived the key %d times", version, calls)
+		}
+
+		v.Close()
+		if _, err := v.List(); !errors.Is(err, ErrVaultClosed) {
+			t.Errorf("v%d: expected ErrVaultClosed, got %v", version, err)
+		}
+		delete(contents, "own.txt")
+		delete(contents, "other.txt")
+	}
+}
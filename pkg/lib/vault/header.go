@@ -0,0 +1,228 @@
+package vault
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// ========================
+// HEADER ENCODING
+// ========================
+
+// HeaderAuthVersion is the first vault format version whose header is authenticated
+const HeaderAuthVersion = 3
+
+var (
+	// ErrHeaderTampered is returned when the vault header does not match its checksum
+	// or the authentication tag of the encrypted directory
+	ErrHeaderTampered = errors.New("vault header tampered")
+
+	// ErrInvalidPassword is returned when the supplied password or keyfile does not unlock the vault
+	ErrInvalidPassword = errors.New("invalid password or keyfile")
+)
+
+// legacyVaultHeader is the on-disk header layout of format versions 1 and 2
+type legacyVaultHeader struct {
+	Magic         [8]byte  // "FLINT001"
+	Version       uint32   // Format version
+	Iterations    uint32   // PBKDF2 iteration count
+	Salt          [32]byte // Salt for key derivation
+	Nonce         [12]byte // Nonce for AES-GCM
+	DirectorySize uint64   // Size of encrypted directory data
+}
+
+// headerPrefix is the part of the header shared by all format versions
+type headerPrefix struct {
+	Magic   [8]byte
+	Version uint32
+}
+
+// headerSize returns the encoded header size for a format version
+func headerSize(version uint32) int64 {
+	if version < HeaderAuthVersion {
+		return int64(binary.Size(legacyVaultHeader{}))
+	}
+	return int64(binary.Size(VaultHeader{}))
+}
+
+// encodedSize returns the number of bytes the header occupies on disk
+func (h *VaultHeader) encodedSize() int64 {
+	return headerSize(h.Version)
+}
+
+// readHeaderPrefix reads the magic and version shared by all header layouts
+func readHeaderPrefix(r io.Reader) (headerPrefix, error) {
+	var prefix headerPrefix
+	err := binary.Read(r, binary.LittleEndian, &prefix)
+	return prefix, err
+}
+
+// readVaultHeader reads a header in the layout matching its version.
+// Legacy headers are converted to the current in-memory representation.
+func readVaultHeader(r io.Reader) (*VaultHeader, error) {
+	prefix, err := readHeaderPrefix(r)
+	if err != nil {
+		return nil, err
+	}
+
+	header := &VaultHeader{Magic: prefix.Magic, Version: prefix.Version}
+	if prefix.Version < HeaderAuthVersion {
+		var legacy struct {
+			Iterations    uint32
+			Salt          [32]byte
+			Nonce         [12]byte
+			DirectorySize uint64
+		}
+		if err := binary.Read(r, binary.LittleEndian, &legacy); err != nil {
+			return nil, err
+		}
+		header.KeySlots[0] = KeySlot{Kind: KeySlotPassword, KDF: KDFPBKDF2, Iterations: legacy.Iterations, Salt: legacy.Salt}
+		header.Nonce = legacy.Nonce
+		header.DirectorySize = legacy.DirectorySize
+		return header, nil
+	}
+
+	rest := make([]byte, header.encodedSize()-int64(binary.Size(headerPrefix{})))
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return nil, err
+	}
+
+	full := make([]byte, 0, header.encodedSize())
+	full = append(full, prefix.Magic[:]...)
+	full = binary.LittleEndian.AppendUint32(full, prefix.Version)
+	full = append(full, rest...)
+	if err := binary.Read(bytes.NewReader(full), binary.LittleEndian, header); err != nil {
+		return nil, err
+	}
+	return header, nil
+}
+
+// readVaultHeaderFile reads the header of a vault file
+func readVaultHeaderFile(path string) (*VaultHeader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("file open error: %w", err)
+	}
+	defer file.Close()
+
+	header, err := readVaultHeader(file)
+	if err != nil {
+		return nil, fmt.Errorf("header read error: %w", err)
+	}
+	return header, nil
+}
+
+// writeVaultHeader writes the header in the layout matching its version
+func writeVaultHeader(w io.Writer, header *VaultHeader) error {
+	_, err := w.Write(header.encode())
+	return err
+}
+
+// encode serializes the header in the layout matching its version
+func (h *VaultHeader) encode() []byte {
+	var buf bytes.Buffer
+	if h.Version < HeaderAuthVersion {
+		binary.Write(&buf, binary.LittleEndian, legacyVaultHeader{
+			Magic:         h.Magic,
+			Version:       h.Version,
+			Iterations:    h.KeySlots[0].Iterations,
+			Salt:          h.KeySlots[0].Salt,
+			Nonce:         h.Nonce,
+			DirectorySize: h.DirectorySize,
+		})
+	} else {
+		binary.Write(&buf, binary.LittleEndian, h)
+	}
+	return buf.Bytes()
+}
+
+// headerMACInfo derives the key of the keyed half of the header checksum from the master key
+const headerMACInfo = "flint-vault header mac v3"
+
+// The checksum of a v3+ header has two halves. The first is a truncated SHA-256 of the
+// preceding fields; it is checked before any key derivation and catches accidental or
+// naive modification, but anyone can recompute it. The second is a truncated HMAC under
+// a key derived from the master key, checked as soon as a key slot is unwrapped, so
+// edited key slots, KDF parameters or inbox keys are reported as tampering even when the
+// first half was recomputed. A slot whose own parameters were changed no longer unwraps
+// at all, like a slot opened with a wrong key.
+
+// headerChecksumSize is the size of each half of the header checksum
+const headerChecksumSize = 8
+
+// checksummedBytes returns the encoded header fields covered by the checksum
+func (h *VaultHeader) checksummedBytes() []byte {
+	encoded := h.encode()
+	return encoded[:len(encoded)-len(h.Checksum)]
+}
+
+// plainChecksum returns the truncated SHA-256 of all header fields preceding the checksum
+func (h *VaultHeader) plainChecksum() []byte {
+	sum := sha256.Sum256(h.checksummedBytes())
+	return sum[:headerChecksumSize]
+}
+
+// keyedChecksum returns the truncated HMAC of all header fields preceding the checksum
+// under a key derived from the master key
+func (h *VaultHeader) keyedChecksum(masterKey []byte) []byte {
+	derive := hmac.New(sha256.New, masterKey)
+	derive.Write([]byte(headerMACInfo))
+	macKey := derive.Sum(nil)
+	defer clearKey(macKey)
+
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write(h.checksummedBytes())
+	return mac.Sum(nil)[:headerChecksumSize]
+}
+
+// computeChecksum returns both halves of the checksum of a v3+ header
+func (h *VaultHeader) computeChecksum(masterKey []byte) [16]byte {
+	var checksum [16]byte
+	copy(checksum[:headerChecksumSize], h.plainChecksum())
+	copy(checksum[headerChecksumSize:], h.keyedChecksum(masterKey))
+	return checksum
+}
+
+// verifyChecksum detects accidental or naive modification of header fields before the
+// vault is unlocked
+func (h *VaultHeader) verifyChecksum() error {
+	if h.Version < HeaderAuthVersion {
+		return nil
+	}
+	if !compareHashesConstantTime(h.plainChecksum(), h.Checksum[:headerChecksumSize]) {
+		return fmt.Errorf("%w: header checksum mismatch", ErrHeaderTampered)
+	}
+	return nil
+}
+
+// verifyKeyedChecksum detects modified header fields once the master key is unwrapped
+func (h *VaultHeader) verifyKeyedChecksum(masterKey []byte) error {
+	if h.Version < HeaderAuthVersion {
+		return nil
+	}
+	if !hmac.Equal(h.keyedChecksum(masterKey), h.Checksum[headerChecksumSize:]) {
+		return fmt.Errorf("%w: header authentication failed", ErrHeaderTampered)
+	}
+	return nil
+}
+
+// associatedData returns the header bytes that are bound to the directory ciphertext
+// as AEAD associated data. Legacy headers are not bound. The key slots are
+// authenticated by their wrapped keys and are left out, so that password and key
+// slot changes only rewrite the header.
+func (h *VaultHeader) associatedData() []byte {
+	if h.Version < HeaderAuthVersion {
+		return nil
+	}
+
+	bound := *h
+	bound.KeySlots = [MaxKeySlots]KeySlot{}
+	bound.Checksum = [16]byte{}
+	return bound.encode()
+}
@@ -0,0 +1,161 @@
+package vault
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// rewriteTestHeader изменяет заголовок vault файла на месте; fixChecksum пересчитывает
+// половину контрольной суммы, которую можно вычислить без ключа
+func rewriteTestHeader(t *testing.T, path string, mutate func(h *VaultHeader), fixChecksum bool) {
+	t.Helper()
+
+	header := readTestHeader(t, path)
+	mutate(&header)
+	if fixChecksum {
+		copy(header.Checksum[:], header.plainChecksum())
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("Failed to open vault: %v", err)
+	}
+	defer file.Close()
+
+	if _, err := file.WriteAt(header.encode(), 0); err != nil {
+		t.Fatalf("Failed to write header: %v", err)
+	}
+}
+
+// TestHeaderEncodingRoundTrip тестирует кодирование заголовков v2 и v3
+func TestHeaderEncodingRoundTrip(t *testing.T) {
+	masterKey := bytes.Repeat([]byte{7}, KeyLength)
+	for _, version := range []uint32{2, CurrentVaultVersion} {
+		header := VaultHeader{
+			Version:       version,
+			DirectorySize: 1234,
+		}
+		copy(header.Magic[:], VaultMagic)
+		header.KeySlots[0] = KeySlot{Kind: KeySlotPassword, Iterations: PBKDF2Iters}
+		header.KeySlots[0].Salt[0] = 1
+		header.Nonce[0] = 2
+		if version >= HeaderAuthVersion {
+			header.KeySlots[0].WrappedKey[0] = 3
+			header.KeySlots[MaxKeySlots-1] = KeySlot{Kind: KeySlotKeyfile, KDF: KDFArgon2id, KDFMemory: 8192, KDFTime: 1, KDFParallelism: 1}
+			header.Checksum = header.computeChecksum(masterKey)
+		}
+
+		encoded := header.encode()
+		if int64(len(encoded)) != headerSize(version) {
+			t.Fatalf("Version %d: expected %d encoded bytes, got %d", version, headerSize(version), len(encoded))
+		}
+
+		decoded, err := readVaultHeader(bytes.NewReader(encoded))
+		if err != nil {
+			t.Fatalf("Version %d: readVaultHeader failed: %v", version, err)
+		}
+		if *decoded != header {
+			t.Fatalf("Version %d: decoded header mismatch", version)
+		}
+		if err := decoded.verifyChecksum(); err != nil {
+			t.Fatalf("Version %d: verifyChecksum failed: %v", version, err)
+		}
+		if err := decoded.verifyKeyedChecksum(masterKey); err != nil {
+			t.Fatalf("Version %d: verifyKeyedChecksum failed: %v", version, err)
+		}
+	}
+}
+
+// TestHeaderTamperDetection тестирует обнаружение изменений заголовка
+func TestHeaderTamperDetection(t *testing.T) {
+	tmpDir := setupCoreTest(t)
+	defer cleanupCoreTest(t, tmpDir)
+
+	testFile := createTestFile(t, tmpDir, "data.txt", testContent)
+
+	newVault := func(name string) string {
+		vaultPath := filepath.Join(tmpDir, name)
+		if err := CreateVault(vaultPath, Password(testPassword)); err != nil {
+			t.Fatalf("CreateVault failed: %v", err)
+		}
+		if err := AddFileToVault(vaultPath, Password(testPassword), testFile); err != nil {
+			t.Fatalf("AddFileToVault failed: %v", err)
+		}
+		return vaultPath
+	}
+
+	testCases := []struct {
+		name        string
+		mutate      func(h *VaultHeader)
+		fixChecksum bool
+	}{
+		{"iterations", func(h *VaultHeader) { h.KeySlots[0].Iterations += 1000 }, false},
+		{"directory size", func(h *VaultHeader) { h.DirectorySize -= 1 }, false},
+		{"directory size with checksum", func(h *VaultHeader) { h.DirectorySize -= 1 }, true},
+		{"nonce with checksum", func(h *VaultHeader) { h.Nonce[0] ^= 0xFF }, true},
+	}
+
+	for i, tc := range testCases {
+		vaultPath := newVault(filepath.Base(tc.name) + string(rune('a'+i)) + ".vault")
+		rewriteTestHeader(t, vaultPath, tc.mutate, tc.fixChecksum)
+
+		_, err := ListVault(vaultPath, Password(testPassword))
+		if !errors.Is(err, ErrHeaderTampered) {
+			t.Errorf("%s: expected ErrHeaderTampered, got %v", tc.name, err)
+		}
+	}
+
+	// Неправильный пароль должен давать отдельную ошибку
+	vaultPath := newVault("password.vault")
+	_, err := ListVault(vaultPath, Password("WrongPassword!"))
+	if !errors.Is(err, ErrInvalidPassword) {
+		t.Errorf("Expected ErrInvalidPassword, got %v", err)
+	}
+	if errors.Is(err, ErrHeaderTampered) {
+		t.Error("Wrong password must not be reported as header tampering")
+	}
+
+	// Нетронутый vault открывается
+	if _, err := ListVault(vaultPath, Password(testPassword)); err != nil {
+		t.Errorf("ListVault failed for intact vault: %v", err)
+	}
+}
+
+// TestHeaderKeyedChecksum тестирует, что изменения ключевых слотов с пересчитанной
+// контрольной суммой обнаруживаются после разворачивания мастер-ключа
+func TestHeaderKeyedChecksum(t *testing.T) {
+	tmpDir := setupCoreTest(t)
+	defer cleanupCoreTest(t, tmpDir)
+
+	testCases := []struct {
+		name   string
+		mutate func(h *VaultHeader)
+	}{
+		{"other slot iterations", func(h *VaultHeader) { h.KeySlots[1].Iterations += 1000 }},
+		{"other slot removed", func(h *VaultHeader) { h.KeySlots[1] = KeySlot{} }},
+		{"inbox key", func(h *VaultHeader) { h.InboxKey[0] ^= 0xFF }},
+	}
+
+	for i, tc := range testCases {
+		vaultPath := filepath.Join(tmpDir, string(rune('a'+i))+".vault")
+		if err := CreateVault(vaultPath, Password(testPassword)); err != nil {
+			t.Fatalf("CreateVault failed: %v", err)
+		}
+		if _, err := AddKeySlot(vaultPath, Password(testPassword), Password("second password"), DefaultKDFParams()); err != nil {
+			t.Fatalf("AddKeySlot failed: %v", err)
+		}
+		rewriteTestHeader(t, vaultPath, tc.mutate, true)
+
+		// Проверка без ключа не замечает изменения
+		if err := ValidateVaultFile(vaultPath); err != nil {
+			t.Fatalf("%s: ValidateVaultFile failed: %v", tc.name, err)
+		}
+		_, err := ListVault(vaultPath, Password(testPassword))
+		if !errors.Is(err, ErrHeaderTampered) || errors.Is(err, ErrInvalidPassword) {
+			t.Errorf("%s: expected ErrHeaderTampered, got %v", tc.name, err)
+		}
+	}
+}
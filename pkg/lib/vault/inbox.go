@@ -0,0 +1,541 @@
+package vault
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+)
+
+// ========================
+// PUBLIC-KEY APPENDS
+// ========================
+//
+// Every v3 vault has an inbox key pair: the X25519 public key is stored in the
+// header and the private key in the encrypted directory. AppendToVault needs only
+// the vault file, so CI can add files without being able to read the vault. It
+// encrypts the new files with a random segment key, seals that key to the inbox
+// public key and appends the payloads, a sealed directory of the new entries and
+// a fixed-size trailer to the end of the file. Anyone who unlocks the vault merges
+// the segments into the directory; the next write records them in the vault directory.
+// Appending needs no secret, so an appended file never replaces a file stored with a
+// key: it is listed as "<path>.inbox-<n>" instead and reported as an InboxConflict.
+
+// inboxMagic marks the trailer of an appended segment
+const inboxMagic = "FLINTINB"
+
+// inboxTrailer ends every appended segment: payloads, sealed entries, trailer
+type inboxTrailer struct {
+	EphemeralKey  [32]byte // Ephemeral X25519 public key
+	WrapNonce     [12]byte // Nonce used to wrap the segment key
+	WrappedKey    [48]byte // Segment key sealed to the inbox public key
+	DirNonce      [12]byte // Nonce of the sealed entries
+	DirectorySize uint64   // Size of the sealed entries
+	DataSize      uint64   // Size of the payloads
+	Magic         [8]byte  // "FLINTINB"
+}
+
+// inboxRenameSuffix separates the path of an appended file from the number it is
+// listed under when its path is taken
+const inboxRenameSuffix = ".inbox-"
+
+// InboxConflict describes a file appended by public key whose path was taken by a file
+// stored with a key
+type InboxConflict struct {
+	Path     string // Path the file was appended under; the stored entry is kept
+	StoredAs string // Path the appended file is listed under instead
+}
+
+// inboxSegment locates an appended segment in the vault file
+type inboxSegment struct {
+	start   int64
+	trailer inboxTrailer
+}
+
+// newInboxKey generates the inbox key pair of a new vault
+func newInboxKey() (*ecdh.PrivateKey, error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("inbox key generation error: %w", err)
+	}
+	return key, nil
+}
+
+// encode serializes the trailer; it is also the associated data of the sealed entries
+func (t *inboxTrailer) encode() []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, t)
+	return buf.Bytes()
+}
+
+// AppendToVault adds a file or directory to a vault without a password, using only the
+// public inbox key in the header. Appended files become visible once the vault is opened
+// with a key; an entry whose path is taken by a file stored with a key is listed under
+// "<path>.inbox-<n>" instead of replacing it.
+func AppendToVault(vaultPath, sourcePath string) error {
+	return AppendToVaultWithOptions(vaultPath, sourcePath, AddOptions{})
+}
+
+// AppendToVaultWithOptions adds a file or directory to a vault without a password
+func AppendToVaultWithOptions(vaultPath, sourcePath string, opts AddOptions) error {
+	// Lock the vault against other goroutines and processes
+	unlock, err := lockVault(vaultPath, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := ValidateVaultFile(vaultPath); err != nil {
+		return err
+	}
+
+	header, err := readVaultHeaderFile(vaultPath)
+	if err != nil {
+		return err
+	}
+	if header.Version < MasterKeyVersion || header.InboxKey == [32]byte{} {
+		return fmt.Errorf("vault does not accept appends without a password (requires format v%d)", MasterKeyVersion)
+	}
+
+	inboxKey, err := ecdh.X25519().NewPublicKey(header.InboxKey[:])
+	if err != nil {
+		return fmt.Errorf("invalid inbox key: %w", err)
+	}
+
+	entries, sources, err := collectAppendEntries(sourcePath, opts.Symlinks)
+	if err != nil {
+		return err
+	}
+
+	segmentKey, err := newMasterKey()
+	if err != nil {
+		return err
+	}
+	defer clearKey(segmentKey)
+
+	file, err := os.OpenFile(vaultPath, os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("vault file open error: %w", err)
+	}
+	defer file.Close()
+
+	originalSize, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return fmt.Errorf("vault file seek error: %w", err)
+	}
+
+	// Cut a partially written segment off again, so the vault stays readable
+	success := false
+	defer func() {
+		if !success {
+			file.Truncate(originalSize)
+		}
+	}()
+
+	ctx := orBackground(opts.Context)
+	var dataSize int64
+	buffer := make([]byte, StreamBufferSize)
+	for i := range entries {
+		if !entries[i].hasPayload() {
+			continue
+		}
+		entries[i].Offset = dataSize
+		if _, err := appendPayload(ctx, file, sources[i], header.Version, segmentKey, &entries[i], opts, buffer); err != nil {
+			return fmt.Errorf("append error for %s: %w", entries[i].Path, err)
+		}
+		dataSize += entries[i].CompressedSize
+	}
+
+	// The payloads must be on disk before the trailer that commits them
+	if dataSize > 0 {
+		if err := file.Sync(); err != nil {
+			return fmt.Errorf("vault file sync error: %w", err)
+		}
+	}
+
+	sealedEntries, trailer, err := sealInboxSegment(inboxKey, segmentKey, entries, dataSize)
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Write(sealedEntries); err != nil {
+		return fmt.Errorf("segment directory write error: %w", err)
+	}
+	if _, err := file.Write(trailer.encode()); err != nil {
+		return fmt.Errorf("segment trailer write error: %w", err)
+	}
+
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("vault file sync error: %w", err)
+	}
+
+	success = true
+	return nil
+}
+
+// collectAppendEntries builds the entries for a file or directory tree, using the same
+// store paths as AddFileToVault and AddDirectoryToVault. Directory and link entries have no source.
+func collectAppendEntries(sourcePath string, mode SymlinkMode) ([]FileEntry, []string, error) {
+	rootInfo, err := os.Stat(sourcePath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("source read error: %w", err)
+	}
+
+	// A single file is stored by its name, a directory tree under the directory name
+	basePath := sourcePath
+	if !rootInfo.IsDir() {
+		basePath = ""
+	}
+
+	var entries []FileEntry
+	var sources []string
+
+	err = walkSourceTree(sourcePath, mode, func(path string, info os.FileInfo, linkTarget string) error {
+		storePath, err := storePathFor(basePath, path)
+		if err != nil {
+			return err
+		}
+
+		if isSymlink(info) {
+			entries = append(entries, newSymlinkEntry(storePath, info, linkTarget))
+			sources = append(sources, "")
+			return nil
+		}
+
+		entries = append(entries, FileEntry{
+			Path:    storePath,
+			Name:    info.Name(),
+			IsDir:   info.IsDir(),
+			Mode:    uint32(info.Mode()),
+			ModTime: info.ModTime(),
+		})
+		if info.IsDir() {
+			sources = append(sources, "")
+		} else {
+			sources = append(sources, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("source read error: %w", err)
+	}
+
+	return entries, sources, nil
+}
+
+// appendPayload seals a source file to the end of the vault in a single pass,
+// filling in the entry's size, hash and stored size as it goes. It returns the
+// compression setting the file was sealed with.
+func appendPayload(ctx context.Context, target io.Writer, sourcePath string, version uint32, key []byte, entry *FileEntry, opts AddOptions, buffer []byte) (Compression, error) {
+	source, err := openSourceFile(sourcePath)
+	if err != nil {
+		return Compression{}, err
+	}
+	defer source.Close()
+
+	// Select the compression (auto mode samples the start of the file)
+	compression, reader, err := opts.Compression.resolve(newContextReader(ctx, source))
+	if err != nil {
+		return Compression{}, err
+	}
+	entry.Compression = compression.Algorithm
+
+	if version >= PayloadEncryptionVersion {
+		salt, err := newPayloadSalt()
+		if err != nil {
+			return Compression{}, err
+		}
+		entry.PayloadSalt = salt
+	}
+
+	hasher := sha256.New()
+	var size, stored int64
+	reader = io.TeeReader(reader, io.MultiWriter(hasher, &countingWriter{count: &size}))
+	writer := io.MultiWriter(target, &countingWriter{count: &stored})
+
+	if err := writePayload(writer, reader, version, key, *entry, compression, buffer); err != nil {
+		return Compression{}, err
+	}
+	if opts.SnapshotCheck {
+		if err := source.checkUnchanged(size); err != nil {
+			return Compression{}, err
+		}
+	}
+
+	entry.Size = size
+	entry.CompressedSize = stored
+	copy(entry.SHA256Hash[:], hasher.Sum(nil))
+	return compression, nil
+}
+
+// sealInboxSegment seals the segment key to the inbox public key and the segment
+// entries with the segment key, returning the sealed entries and the trailer
+func sealInboxSegment(inboxKey *ecdh.PublicKey, segmentKey []byte, entries []FileEntry, dataSize int64) ([]byte, *inboxTrailer, error) {
+	trailer := &inboxTrailer{DataSize: uint64(dataSize)}
+	copy(trailer.Magic[:], inboxMagic)
+
+	share, kek, err := sealingKeyForRecipient(inboxKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer clearKey(kek)
+	trailer.EphemeralKey = share
+
+	wrapGCM, err := newKeyWrapGCM(kek)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := rand.Read(trailer.WrapNonce[:]); err != nil {
+		return nil, nil, fmt.Errorf("nonce generation error: %w", err)
+	}
+	copy(trailer.WrappedKey[:], wrapGCM.Seal(nil, trailer.WrapNonce[:], segmentKey, []byte(inboxMagic)))
+
+	jsonData, err := json.Marshal(entries)
+	if err != nil {
+		return nil, nil, fmt.Errorf("segment directory serialization error: %w", err)
+	}
+	compressed, err := compressData(jsonData)
+	if err != nil {
+		return nil, nil, fmt.Errorf("segment directory compression error: %w", err)
+	}
+
+	gcm, err := newKeyWrapGCM(segmentKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := rand.Read(trailer.DirNonce[:]); err != nil {
+		return nil, nil, fmt.Errorf("nonce generation error: %w", err)
+	}
+	trailer.DirectorySize = uint64(len(compressed) + gcm.Overhead())
+
+	return gcm.Seal(nil, trailer.DirNonce[:], compressed, trailer.encode()), trailer, nil
+}
+
+// mergeInboxSegments opens the segments appended after dataEnd (the end of the data
+// and directory read so far) with the inbox private key and merges their entries into
+// the directory, oldest first. Appended payload offsets are rebased onto the data area,
+// so rewrites copy them like any other.
+func mergeInboxSegments(file *os.File, header *VaultHeader, dataEnd, fileSize int64, vaultDir *VaultDirectory) error {
+	entries, err := readInboxEntries(file, header, dataEnd, fileSize, vaultDir.InboxKey)
+	if err != nil {
+		return err
+	}
+
+	index := vaultDir.entryIndex()
+	entries, vaultDir.inboxConflicts, err = resolveInboxConflicts(entries, func(path string) (FileEntry, bool, error) {
+		i, ok := index[path]
+		if !ok {
+			return FileEntry{}, false, nil
+		}
+		return vaultDir.Entries[i], true, nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		vaultDir.putEntry(entry)
+	}
+	return nil
+}
+
+// resolveInboxConflicts renames the appended entries, oldest first, whose path is taken
+// by an entry stored with a key, so that appending by public key can add files but never
+// replace them. An appended directory that exists already is dropped. Appended entries
+// that are not renamed still replace each other. stored looks an entry up by path.
+func resolveInboxConflicts(appended []FileEntry, stored func(path string) (FileEntry, bool, error)) ([]FileEntry, []InboxConflict, error) {
+	var conflicts []InboxConflict
+	resolved := appended[:0]
+	taken := make(map[string]bool) // Paths given to renamed entries
+	for _, entry := range appended {
+		existing, ok, err := stored(entry.Path)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !ok {
+			resolved = append(resolved, entry)
+			continue
+		}
+		if entry.IsDir && existing.IsDir {
+			continue
+		}
+
+		for n := 1; ; n++ {
+			suffix := inboxRenameSuffix + strconv.Itoa(n)
+			if taken[entry.Path+suffix] {
+				continue
+			}
+			if _, ok, err := stored(entry.Path + suffix); err != nil {
+				return nil, nil, err
+			} else if ok {
+				continue
+			}
+
+			conflicts = append(conflicts, InboxConflict{Path: entry.Path, StoredAs: entry.Path + suffix})
+			entry.Path += suffix
+			entry.Name += suffix
+			taken[entry.Path] = true
+			break
+		}
+		resolved = append(resolved, entry)
+	}
+	return resolved, conflicts, nil
+}
+
+// InboxConflicts returns the files appended by public key since the last write whose
+// path was taken by a file stored with a key, with the paths they are listed under
+func (v *Vault) InboxConflicts() ([]InboxConflict, error) {
+	// Lock the vault against writers in other goroutines and processes
+	unlock, err := v.lockLookup()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	vaultDir, root := v.current()
+	if vaultDir == nil {
+		vaultDir = &root.meta
+	}
+	return append([]InboxConflict(nil), vaultDir.inboxConflicts...), nil
+}
+
+// readInboxEntries returns the entries of the segments appended after dataEnd, oldest
+// first, with their offsets rebased onto the data area
+func readInboxEntries(file *os.File, header *VaultHeader, dataEnd, fileSize int64, privateKey []byte) ([]FileEntry, error) {
+	if header.Version < MasterKeyVersion || len(privateKey) == 0 || fileSize <= dataEnd {
+		return nil, nil
+	}
+
+	dataStart := header.encodedSize() + int64(header.DirectorySize)
+	segments, err := findInboxSegments(file, dataEnd, fileSize)
+	if err != nil {
+		return nil, err
+	}
+
+	inboxKey, err := ecdh.X25519().NewPrivateKey(privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid inbox key: %w", err)
+	}
+
+	var appended []FileEntry
+	for i := len(segments) - 1; i >= 0; i-- {
+		entries, err := openInboxSegment(file, inboxKey, segments[i])
+		if err != nil {
+			return nil, fmt.Errorf("appended segment at offset %d: %w", segments[i].start, err)
+		}
+
+		for _, entry := range entries {
+			entry.Offset += segments[i].start - dataStart
+			appended = append(appended, entry)
+		}
+	}
+
+	return appended, nil
+}
+
+// findInboxSegments walks the trailers back from the end of the file to the data area
+// and returns the segments newest first
+func findInboxSegments(file *os.File, dataEnd, fileSize int64) ([]inboxSegment, error) {
+	var segments []inboxSegment
+	for end := fileSize; end > dataEnd; {
+		segment, err := readInboxSegment(file, dataEnd, end)
+		if err != nil {
+			return nil, err
+		}
+		segments = append(segments, *segment)
+		end = segment.start
+	}
+
+	return segments, nil
+}
+
+// readInboxSegment reads the trailer of the segment ending at end, which must lie
+// entirely after dataEnd
+func readInboxSegment(file *os.File, dataEnd, end int64) (*inboxSegment, error) {
+	trailerSize := int64(binary.Size(inboxTrailer{}))
+	if end-dataEnd < trailerSize {
+		return nil, fmt.Errorf("unexpected %d bytes after the vault data", end-dataEnd)
+	}
+
+	var trailer inboxTrailer
+	if err := binary.Read(io.NewSectionReader(file, end-trailerSize, trailerSize), binary.LittleEndian, &trailer); err != nil {
+		return nil, fmt.Errorf("segment trailer read error: %w", err)
+	}
+	if string(trailer.Magic[:]) != inboxMagic {
+		return nil, fmt.Errorf("unexpected data after the vault data at offset %d", end-trailerSize)
+	}
+
+	available := uint64(end - trailerSize - dataEnd)
+	if trailer.DirectorySize > available || trailer.DataSize > available-trailer.DirectorySize {
+		return nil, fmt.Errorf("segment trailer at offset %d exceeds the vault data", end-trailerSize)
+	}
+
+	start := end - trailerSize - int64(trailer.DirectorySize) - int64(trailer.DataSize)
+	return &inboxSegment{start: start, trailer: trailer}, nil
+}
+
+// openInboxSegment unwraps the segment key and returns the segment entries with their
+// payload key set and offsets relative to the segment start
+func openInboxSegment(file *os.File, inboxKey *ecdh.PrivateKey, segment inboxSegment) ([]FileEntry, error) {
+	trailer := &segment.trailer
+
+	kek, err := openingKeyForIdentity(inboxKey, trailer.EphemeralKey)
+	if err != nil {
+		return nil, err
+	}
+	defer clearKey(kek)
+
+	wrapGCM, err := newKeyWrapGCM(kek)
+	if err != nil {
+		return nil, err
+	}
+	segmentKey, err := wrapGCM.Open(nil, trailer.WrapNonce[:], trailer.WrappedKey[:], []byte(inboxMagic))
+	if err != nil {
+		return nil, fmt.Errorf("segment key does not match the inbox key")
+	}
+
+	sealed := make([]byte, trailer.DirectorySize)
+	if _, err := file.ReadAt(sealed, segment.start+int64(trailer.DataSize)); err != nil {
+		return nil, fmt.Errorf("segment directory read error: %w", err)
+	}
+
+	gcm, err := newKeyWrapGCM(segmentKey)
+	if err != nil {
+		return nil, err
+	}
+	compressed, err := gcm.Open(nil, trailer.DirNonce[:], sealed, trailer.encode())
+	if err != nil {
+		return nil, fmt.Errorf("segment directory does not match its authentication tag")
+	}
+
+	jsonData, err := decompressData(compressed)
+	if err != nil {
+		return nil, fmt.Errorf("segment directory decompression error: %w", err)
+	}
+
+	var entries []FileEntry
+	if err := json.Unmarshal(jsonData, &entries); err != nil {
+		return nil, fmt.Errorf("segment directory deserialization error: %w", err)
+	}
+
+	for i := range entries {
+		if len(entries[i].Chunks) > 0 {
+			return nil, fmt.Errorf("entry %s of a segment cannot refer to vault chunks", entries[i].Path)
+		}
+		if !entries[i].hasPayload() {
+			continue
+		}
+		if entries[i].Offset < 0 || entries[i].CompressedSize < 0 || entries[i].Offset+entries[i].CompressedSize > int64(trailer.DataSize) {
+			return nil, fmt.Errorf("entry %s exceeds the segment data", entries[i].Path)
+		}
+		entries[i].PayloadKey = segmentKey
+	}
+
+	return entries, nil
+}
@@ -0,0 +1,234 @@
+package vault
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// TestAppendToVault тестирует добавление файлов без пароля через публичный inbox-ключ
+func TestAppendToVault(t *testing.T) {
+	tmpDir := setupCoreTest(t)
+	defer cleanupCoreTest(t, tmpDir)
+
+	vaultPath := filepath.Join(tmpDir, "inbox.vault")
+	if err := CreateVaultWithKDF(vaultPath, Password(testPassword), testArgon2Params); err != nil {
+		t.Fatalf("CreateVaultWithKDF failed: %v", err)
+	}
+	existing := createTestFile(t, tmpDir, "existing.txt", "existing content")
+	if err := AddFileToVault(vaultPath, Password(testPassword), existing); err != nil {
+		t.Fatalf("AddFileToVault failed: %v", err)
+	}
+
+	// Файл и каталог добавляются без ключа
+	report := createTestFile(t, tmpDir, "report.txt", testContent)
+	if err := AppendToVault(vaultPath, report); err != nil {
+		t.Fatalf("AppendToVault (file) failed: %v", err)
+	}
+	artifacts := filepath.Join(tmpDir, "artifacts")
+	if err := os.MkdirAll(filepath.Join(artifacts, "bin"), 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	createTestFile(t, artifacts, "build.log", "build output")
+	createTestFile(t, filepath.Join(artifacts, "bin"), "tool", "binary data")
+	if err := AppendToVault(vaultPath, artifacts); err != nil {
+		t.Fatalf("AppendToVault (directory) failed: %v", err)
+	}
+
+	// Добавление без ключа не заменяет сохранённый с ключом файл
+	if err := os.WriteFile(existing, []byte("replaced by CI"), 0644); err != nil {
+		t.Fatalf("Failed to update file: %v", err)
+	}
+	if err := AppendToVault(vaultPath, existing); err != nil {
+		t.Fatalf("AppendToVault (replace) failed: %v", err)
+	}
+
+	expected := map[string]string{
+		"existing.txt":         "existing content",
+		"existing.txt.inbox-1": "replaced by CI",
+		"report.txt":           testContent,
+		"artifacts/build.log":  "build output",
+		"artifacts/bin/tool":   "binary data",
+	}
+	checkContents := func(stage string) {
+		t.Helper()
+
+		entries, err := ListVault(vaultPath, Password(testPassword))
+		if err != nil {
+			t.Fatalf("%s: ListVault failed: %v", stage, err)
+		}
+		if len(entries) != 7 {
+			t.Fatalf("%s: expected 7 entries, got %d", stage, len(entries))
+		}
+
+		outputDir := filepath.Join(tmpDir, stage)
+		if err := ExtractFromVault(vaultPath, Password(testPassword), outputDir); err != nil {
+			t.Fatalf("%s: ExtractFromVault failed: %v", stage, err)
+		}
+		for path, content := range expected {
+			data, err := os.ReadFile(filepath.Join(outputDir, path))
+			if err != nil || string(data) != content {
+				t.Errorf("%s: content mismatch for %s", stage, path)
+			}
+		}
+	}
+	checkContents("appended")
+
+	// Запись с ключом фиксирует добавленные файлы в директории vault
+	if err := RemoveFromVault(vaultPath, Password(testPassword), []string{"report.txt"}); err != nil {
+		t.Fatalf("RemoveFromVault failed: %v", err)
+	}
+	if err := AppendToVault(vaultPath, report); err != nil {
+		t.Fatalf("AppendToVault after rewrite failed: %v", err)
+	}
+	checkContents("rewritten")
+}
+
+// TestAppendToVaultErrors тестирует ошибки добавления без пароля
+func TestAppendToVaultErrors(t *testing.T) {
+	tmpDir := setupCoreTest(t)
+	defer cleanupCoreTest(t, tmpDir)
+
+	testFile := createTestFile(t, tmpDir, "data.txt", testContent)
+
+	// Legacy vault не имеет inbox-ключа
+	legacyPath := filepath.Join(tmpDir, "legacy.vault")
+	createLegacyVault(t, legacyPath, testPassword)
+	if err := AppendToVault(legacyPath, testFile); err == nil {
+		t.Error("Expected error for legacy vault")
+	}
+
+	vaultPath := filepath.Join(tmpDir, "inbox.vault")
+	if err := CreateVaultWithKDF(vaultPath, Password(testPassword), testArgon2Params); err != nil {
+		t.Fatalf("CreateVaultWithKDF failed: %v", err)
+	}
+	if err := AppendToVault(vaultPath, filepath.Join(tmpDir, "missing.txt")); err == nil {
+		t.Error("Expected error for missing source")
+	}
+	info, _ := os.Stat(vaultPath)
+	if info.Size() != headerSize(CurrentVaultVersion)+int64(readTestHeader(t, vaultPath).DirectorySize) {
+		t.Error("Failed append must not change the vault file")
+	}
+
+	// Повреждённый сегмент обнаруживается при открытии
+	if err := AppendToVault(vaultPath, testFile); err != nil {
+		t.Fatalf("AppendToVault failed: %v", err)
+	}
+	data, _ := os.ReadFile(vaultPath)
+	data[len(data)-40] ^= 0xFF
+	if err := os.WriteFile(vaultPath, data, 0644); err != nil {
+		t.Fatalf("Failed to write vault: %v", err)
+	}
+	if _, err := ListVault(vaultPath, Password(testPassword)); err == nil {
+		t.Error("Expected error for tampered segment")
+	}
+
+	// Лишние байты в конце файла
+	data[len(data)-40] ^= 0xFF
+	data = append(data, []byte("garbage")...)
+	if err := os.WriteFile(vaultPath, data, 0644); err != nil {
+		t.Fatalf("Failed to write vault: %v", err)
+	}
+	if _, err := ListVault(vaultPath, Password(testPassword)); err == nil {
+		t.Error("Expected error for trailing garbage")
+	}
+}
+
+// TestAppendToVaultConflicts тестирует, что добавление без ключа не заменяет файлы,
+// сохранённые с ключом, а переименовывает добавленные и сообщает о них
+func TestAppendToVaultConflicts(t *testing.T) {
+	tmpDir := setupCoreTest(t)
+	defer cleanupCoreTest(t, tmpDir)
+
+	for _, version := range []uint32{ChunkedVersion, PagedDirectoryVersion} {
+		vaultPath := filepath.Join(tmpDir, fmt.Sprintf("conflicts-v%d.vault", version))
+		vaultDir := VaultDirectory{Version: version, Entries: []FileEntry{}, CreatedAt: time.Now()}
+		if err := saveVaultDirectory(vaultPath, Password(testPassword), vaultDir, testArgon2Params, nil); err != nil {
+			t.Fatalf("saveVaultDirectory failed: %v", err)
+		}
+
+		// Файлы, сохранённые с ключом
+		keyed := filepath.Join(tmpDir, fmt.Sprintf("keyed-v%d", version))
+		os.MkdirAll(filepath.Join(keyed, "docs"), 0755)
+		createTestFile(t, keyed, "notes.txt", "stored with a key")
+		createTestFile(t, filepath.Join(keyed, "docs"), "a.txt", "keyed a")
+		if err := AddFileToVault(vaultPath, Password(testPassword), filepath.Join(keyed, "notes.txt")); err != nil {
+			t.Fatalf("AddFileToVault failed: %v", err)
+		}
+		if err := AddDirectoryToVault(vaultPath, Password(testPassword), filepath.Join(keyed, "docs")); err != nil {
+			t.Fatalf("AddDirectoryToVault failed: %v", err)
+		}
+
+		// Те же пути добавляются без ключа
+		appended := filepath.Join(tmpDir, fmt.Sprintf("appended-v%d", version))
+		os.MkdirAll(filepath.Join(appended, "docs"), 0755)
+		createTestFile(t, filepath.Join(appended, "docs"), "a.txt", "appended a")
+		createTestFile(t, filepath.Join(appended, "docs"), "b.txt", "appended b")
+		for _, content := range []string{"first append", "second append"} {
+			createTestFile(t, appended, "notes.txt", content)
+			if err := AppendToVault(vaultPath, filepath.Join(appended, "notes.txt")); err != nil {
+				t.Fatalf("AppendToVault failed: %v", err)
+			}
+		}
+		if err := AppendToVault(vaultPath, filepath.Join(appended, "docs")); err != nil {
+			t.Fatalf("AppendToVault (directory) failed: %v", err)
+		}
+
+		v, err := OpenVault(vaultPath, Password(testPassword))
+		if err != nil {
+			t.Fatalf("OpenVault failed: %v", err)
+		}
+		conflicts, err := v.InboxConflicts()
+		if err != nil {
+			t.Fatalf("InboxConflicts failed: %v", err)
+		}
+		expectedConflicts := []InboxConflict{
+			{Path: "notes.txt", StoredAs: "notes.txt.inbox-1"},
+			{Path: "notes.txt", StoredAs: "notes.txt.inbox-2"},
+			{Path: "docs/a.txt", StoredAs: "docs/a.txt.inbox-1"},
+		}
+		if !slices.Equal(conflicts, expectedConflicts) {
+			t.Errorf("v%d: unexpected conflicts: %+v", version, conflicts)
+		}
+		if entries, err := v.ListPrefix("notes"); err != nil || len(entries) != 3 {
+			t.Errorf("v%d: expected 3 notes entries, got %d (%v)", version, len(entries), err)
+		}
+		if entries, err := v.List(); err != nil || len(entries) != 7 {
+			t.Errorf("v%d: expected 7 entries, got %d (%v)", version, len(entries), err)
+		}
+		v.Close()
+
+		outputDir := filepath.Join(tmpDir, fmt.Sprintf("output-v%d", version))
+		if err := GetFromVault(vaultPath, Password(testPassword), outputDir, []string{"notes.txt"}); err != nil {
+			t.Fatalf("GetFromVault failed: %v", err)
+		}
+		expected := map[string]string{
+			"notes.txt":          "stored with a key",
+			"notes.txt.inbox-1":  "first append",
+			"notes.txt.inbox-2":  "second append",
+			"docs/a.txt":         "keyed a",
+			"docs/a.txt.inbox-1": "appended a",
+			"docs/b.txt":         "appended b",
+		}
+		checkMigratedContents(t, vaultPath, Password(testPassword), outputDir, expected)
+
+		// Запись с ключом сохраняет переименованные файлы, и конфликтов больше нет
+		if err := RemoveFromVault(vaultPath, Password(testPassword), []string{"docs/b.txt"}); err != nil {
+			t.Fatalf("RemoveFromVault failed: %v", err)
+		}
+		v, err = OpenVault(vaultPath, Password(testPassword))
+		if err != nil {
+			t.Fatalf("OpenVault failed: %v", err)
+		}
+		if conflicts, err := v.InboxConflicts(); err != nil || len(conflicts) != 0 {
+			t.Errorf("v%d: conflicts left after a write: %+v (%v)", version, conflicts, err)
+		}
+		if entries, err := v.List(); err != nil || len(entries) != 6 {
+			t.Errorf("v%d: expected 6 entries after the write, got %d (%v)", version, len(entries), err)
+		}
+		v.Close()
+	}
+}
@@ -0,0 +1,72 @@
+package vault
+
+// ========================
+// DIRECTORY INDEX
+// ========================
+//
+// Entries are looked up by path through an index of their positions in the directory,
+// so adding, replacing, selecting and removing entries does not scan the whole
+// directory for every path. The index is built on the first lookup after the directory
+// was read and kept current by putEntry and removeEntries; code that replaces Entries
+// directly must go through these or reset the index. Positions only change when
+// entries are removed, which rebuilds the index along with the entries.
+
+// entryIndex returns the index of the directory's entries by path, building it if needed.
+// Of several entries with the same path the first one is indexed.
+func (d *VaultDirectory) entryIndex() map[string]int {
+	if d.index == nil {
+		d.index = make(map[string]int, len(d.Entries))
+		for i := range d.Entries {
+			if _, ok := d.index[d.Entries[i].Path]; !ok {
+				d.index[d.Entries[i].Path] = i
+			}
+		}
+	}
+	return d.index
+}
+
+// putEntry adds an entry or replaces the one with the same path
+func (d *VaultDirectory) putEntry(entry FileEntry) {
+	index := d.entryIndex()
+	if i, ok := index[entry.Path]; ok {
+		d.Entries[i] = entry // Update existing
+		return
+	}
+	index[entry.Path] = len(d.Entries)
+	d.Entries = append(d.Entries, entry) // Add new
+}
+
+// removeEntries removes the entries with the given paths and returns how many were removed
+func (d *VaultDirectory) removeEntries(paths map[string]bool) int {
+	index := d.entryIndex()
+	found := false
+	for path := range paths {
+		if _, ok := index[path]; ok {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return 0
+	}
+
+	kept := d.Entries[:0]
+	for _, entry := range d.Entries {
+		if !paths[entry.Path] {
+			kept = append(kept, entry)
+		}
+	}
+	removed := len(d.Entries) - len(kept)
+	clear(d.Entries[len(kept):])
+	d.Entries = kept
+	d.index = nil // Positions moved
+	return removed
+}
+
+// clone returns a copy of the directory whose entries can be changed independently
+func (d *VaultDirectory) clone() *VaultDirectory {
+	clone := *d
+	clone.Entries = append([]FileEntry(nil), d.Entries...)
+	clone.index = nil
+	return &clone
+}
@@ -0,0 +1,110 @@
+package vault
+
+import (
+	"fmt"
+	"testing"
+)
+
+// testDirectory создаёт директорию с n файлами
+func testDirectory(n int) *VaultDirectory {
+	vaultDir := &VaultDirectory{Version: CurrentVaultVersion, Entries: make([]FileEntry, n)}
+	for i := range vaultDir.Entries {
+		vaultDir.Entries[i] = FileEntry{Path: fmt.Sprintf("dir%d/file%d.txt", i%100, i), Size: int64(i), CompressedSize: int64(i)}
+	}
+	return vaultDir
+}
+
+// TestDirectoryIndex тестирует, что индекс путей остаётся согласованным с записями
+func TestDirectoryIndex(t *testing.T) {
+	vaultDir := testDirectory(10)
+	v := &Vault{dir: vaultDir}
+
+	// Замена сохраняет позицию, новая запись добавляется в конец
+	vaultDir.putEntry(FileEntry{Path: "dir3/file3.txt", Size: 300})
+	vaultDir.putEntry(FileEntry{Path: "new.txt", Size: 1})
+	if len(vaultDir.Entries) != 11 || vaultDir.Entries[3].Size != 300 || vaultDir.Entries[10].Path != "new.txt" {
+		t.Fatalf("Unexpected entries after put: %+v", vaultDir.Entries)
+	}
+
+	// Выборка идёт в порядке директории, без повторов и с нормализацией путей
+	selected, err := v.selectEntries([]string{"new.txt", "dir3/./file3.txt", "missing.txt", "new.txt", "dir1/file1.txt"})
+	if err != nil || len(selected) != 3 || selected[0].Path != "dir1/file1.txt" || selected[1].Path != "dir3/file3.txt" || selected[2].Path != "new.txt" {
+		t.Fatalf("Unexpected selection: %+v", selected)
+	}
+
+	// После удаления позиции сдвигаются, а индекс следует за ними
+	if removed := vaultDir.removeEntries(map[string]bool{"dir0/file0.txt": true, "dir5/file5.txt": true, "missing.txt": true}); removed != 2 {
+		t.Fatalf("Expected 2 removed entries, got %d", removed)
+	}
+	if removed := vaultDir.removeEntries(map[string]bool{"dir0/file0.txt": true}); removed != 0 {
+		t.Fatalf("Removing a missing entry removed %d entries", removed)
+	}
+	vaultDir.putEntry(FileEntry{Path: "dir9/file9.txt", Size: 900})
+	vaultDir.putEntry(FileEntry{Path: "dir0/file0.txt"})
+	for path, i := range vaultDir.entryIndex() {
+		if vaultDir.Entries[i].Path != path {
+			t.Errorf("Index points %s at %s", path, vaultDir.Entries[i].Path)
+		}
+	}
+	if len(vaultDir.Entries) != 10 || len(vaultDir.entryIndex()) != 10 {
+		t.Fatalf("Expected 10 indexed entries, got %d (%d indexed)", len(vaultDir.Entries), len(vaultDir.entryIndex()))
+	}
+	if selected, err := v.selectEntries([]string{"dir9/file9.txt"}); err != nil || len(selected) != 1 || selected[0].Size != 900 {
+		t.Errorf("Replaced entry not found after removal: %+v", selected)
+	}
+
+	// Копия не разделяет ни записи, ни индекс
+	clone := vaultDir.clone()
+	clone.putEntry(FileEntry{Path: "clone-only.txt"})
+	clone.Entries[0].Size = -1
+	if len(vaultDir.Entries) != 10 || vaultDir.Entries[0].Size == -1 {
+		t.Error("Changing a clone changed the directory")
+	}
+	if _, ok := vaultDir.entryIndex()["clone-only.txt"]; ok {
+		t.Error("Clone shares the index of the directory")
+	}
+}
+
+// BenchmarkDirectoryIndex измеряет поиск по путям в директориях из 10k, 100k и 1M записей:
+// построение индекса после чтения директории, размещение пакета из 1000 файлов и
+// выборку 100 файлов для извлечения
+func BenchmarkDirectoryIndex(b *testing.B) {
+	for _, size := range []int{10_000, 100_000, 1_000_000} {
+		vaultDir := testDirectory(size)
+		v := &Vault{dir: vaultDir}
+
+		batch := make([]FileEntry, 1000)
+		for i := range batch {
+			batch[i] = vaultDir.Entries[(i*7919)%size]
+		}
+		targets := make([]string, 100)
+		for i := range targets {
+			targets[i] = vaultDir.Entries[(i*104729)%size].Path
+		}
+
+		b.Run(fmt.Sprintf("index/%dk", size/1000), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				vaultDir.index = nil
+				vaultDir.entryIndex()
+			}
+		})
+		b.Run(fmt.Sprintf("put/%dk", size/1000), func(b *testing.B) {
+			vaultDir.entryIndex()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for _, entry := range batch {
+					vaultDir.putEntry(entry)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("select/%dk", size/1000), func(b *testing.B) {
+			vaultDir.entryIndex()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if selected, err := v.selectEntries(targets); err != nil || len(selected) != len(targets) {
+					b.Fatal("Selection missed entries")
+				}
+			}
+		})
+	}
+}
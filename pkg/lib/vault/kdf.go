@@ -0,0 +1,115 @@
+package vault
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// ========================
+// KEY DERIVATION
+// ========================
+
+const (
+	// KDFPBKDF2 selects PBKDF2-HMAC-SHA256 (the only KDF of legacy vaults)
+	KDFPBKDF2 uint8 = 0
+
+	// KDFArgon2id selects the memory-hard Argon2id KDF
+	KDFArgon2id uint8 = 1
+
+	// Default Argon2id cost parameters
+	Argon2DefaultMemory      = 64 * 1024 // 64 MiB (in KiB)
+	Argon2DefaultTime        = 3         // Passes over memory
+	Argon2DefaultParallelism = 4         // Lanes
+
+	// Bounds accepted when opening a vault, to reject absurd (tampered) costs
+	argon2MaxMemory = 4 * 1024 * 1024 // 4 GiB (in KiB)
+	argon2MaxTime   = 100
+)
+
+// KDFParams describes how the vault key is derived from a password or keyfile
+type KDFParams struct {
+	Algorithm   uint8  // KDFPBKDF2 or KDFArgon2id
+	Iterations  uint32 // PBKDF2 iteration count
+	Memory      uint32 // Argon2id memory cost in KiB
+	Time        uint32 // Argon2id time cost (passes)
+	Parallelism uint8  // Argon2id parallelism (lanes)
+}
+
+// DefaultKDFParams returns the default key derivation parameters (PBKDF2, 100,000 iterations)
+func DefaultKDFParams() KDFParams {
+	return KDFParams{Algorithm: KDFPBKDF2, Iterations: PBKDF2Iters}
+}
+
+// Argon2idKDFParams returns Argon2id parameters; zero values select the defaults
+func Argon2idKDFParams(memoryKiB, time uint32, parallelism uint8) KDFParams {
+	if memoryKiB == 0 {
+		memoryKiB = Argon2DefaultMemory
+	}
+	if time == 0 {
+		time = Argon2DefaultTime
+	}
+	if parallelism == 0 {
+		parallelism = Argon2DefaultParallelism
+	}
+	return KDFParams{Algorithm: KDFArgon2id, Memory: memoryKiB, Time: time, Parallelism: parallelism}
+}
+
+// ParseKDFName converts a KDF name as used on the command line to its algorithm ID
+func ParseKDFName(name string) (uint8, error) {
+	switch strings.ToLower(name) {
+	case "", "pbkdf2", "pbkdf2-sha256":
+		return KDFPBKDF2, nil
+	case "argon2id", "argon2":
+		return KDFArgon2id, nil
+	default:
+		return 0, fmt.Errorf("unknown key derivation function: %s (supported: pbkdf2, argon2id)", name)
+	}
+}
+
+// Name returns the human-readable name of the KDF
+func (p KDFParams) Name() string {
+	switch p.Algorithm {
+	case KDFPBKDF2:
+		return "pbkdf2-sha256"
+	case KDFArgon2id:
+		return "argon2id"
+	default:
+		return fmt.Sprintf("unknown(%d)", p.Algorithm)
+	}
+}
+
+// Validate checks that the parameters are within sane bounds
+func (p KDFParams) Validate() error {
+	switch p.Algorithm {
+	case KDFPBKDF2:
+		if p.Iterations < 10000 || p.Iterations > 10000000 {
+			return fmt.Errorf("suspicious PBKDF2 iteration count: %d (expected: 10,000 - 10,000,000)", p.Iterations)
+		}
+	case KDFArgon2id:
+		if p.Parallelism == 0 {
+			return fmt.Errorf("invalid Argon2id parallelism: must be at least 1")
+		}
+		if p.Time < 1 || p.Time > argon2MaxTime {
+			return fmt.Errorf("suspicious Argon2id time cost: %d (expected: 1 - %d)", p.Time, argon2MaxTime)
+		}
+		if p.Memory < 8*uint32(p.Parallelism) || p.Memory > argon2MaxMemory {
+			return fmt.Errorf("suspicious Argon2id memory cost: %d KiB (expected: %d - %d KiB)",
+				p.Memory, 8*uint32(p.Parallelism), argon2MaxMemory)
+		}
+	default:
+		return fmt.Errorf("unsupported key derivation function: %d", p.Algorithm)
+	}
+	return nil
+}
+
+// deriveKey derives a KeyLength-byte key from the secret and salt
+func (p KDFParams) deriveKey(secret []byte, salt []byte) []byte {
+	if p.Algorithm == KDFArgon2id {
+		return argon2.IDKey(secret, salt, p.Time, p.Memory, p.Parallelism, KeyLength)
+	}
+	return pbkdf2.Key(secret, salt, int(p.Iterations), KeyLength, sha256.New)
+}
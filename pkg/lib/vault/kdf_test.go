@@ -0,0 +1,120 @@
+package vault
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testArgon2Params — дешёвые параметры Argon2id для тестов
+var testArgon2Params = Argon2idKDFParams(8*1024, 1, 1)
+
+// TestArgon2idVault тестирует vault с ключом, полученным через Argon2id
+func TestArgon2idVault(t *testing.T) {
+	tmpDir := setupCoreTest(t)
+	defer cleanupCoreTest(t, tmpDir)
+
+	vaultPath := filepath.Join(tmpDir, "argon.vault")
+	if err := CreateVaultWithKDF(vaultPath, Password(testPassword), testArgon2Params); err != nil {
+		t.Fatalf("CreateVaultWithKDF failed: %v", err)
+	}
+
+	info, err := GetVaultInfo(vaultPath)
+	if err != nil {
+		t.Fatalf("GetVaultInfo failed: %v", err)
+	}
+	if info.KDF != testArgon2Params {
+		t.Fatalf("Expected KDF params %+v, got %+v", testArgon2Params, info.KDF)
+	}
+	if info.KDF.Name() != "argon2id" {
+		t.Errorf("Expected KDF name argon2id, got %s", info.KDF.Name())
+	}
+	if err := ValidateVaultFile(vaultPath); err != nil {
+		t.Fatalf("ValidateVaultFile failed: %v", err)
+	}
+
+	testFile := createTestFile(t, tmpDir, "argon.txt", testContent)
+	if err := AddFileToVault(vaultPath, Password(testPassword), testFile); err != nil {
+		t.Fatalf("AddFileToVault failed: %v", err)
+	}
+
+	outputDir := filepath.Join(tmpDir, "output")
+	if err := ExtractFromVault(vaultPath, Password(testPassword), outputDir); err != nil {
+		t.Fatalf("ExtractFromVault failed: %v", err)
+	}
+	content, err := os.ReadFile(filepath.Join(outputDir, "argon.txt"))
+	if err != nil || string(content) != testContent {
+		t.Fatal("Extracted content mismatch")
+	}
+
+	if _, err := ListVault(vaultPath, Password("WrongPassword!")); !errors.Is(err, ErrInvalidPassword) {
+		t.Errorf("Expected ErrInvalidPassword, got %v", err)
+	}
+
+	// Изменение параметров KDF в заголовке должно обнаруживаться
+	rewriteTestHeader(t, vaultPath, func(h *VaultHeader) { h.KeySlots[0].KDFTime = 2 }, false)
+	if _, err := ListVault(vaultPath, Password(testPassword)); !errors.Is(err, ErrHeaderTampered) {
+		t.Errorf("Expected ErrHeaderTampered, got %v", err)
+	}
+}
+
+// TestPBKDF2RemainsDefault проверяет что PBKDF2 vault по-прежнему создаются и открываются
+func TestPBKDF2RemainsDefault(t *testing.T) {
+	tmpDir := setupCoreTest(t)
+	defer cleanupCoreTest(t, tmpDir)
+
+	vaultPath := filepath.Join(tmpDir, "pbkdf2.vault")
+	if err := CreateVault(vaultPath, Password(testPassword)); err != nil {
+		t.Fatalf("CreateVault failed: %v", err)
+	}
+
+	info, err := GetVaultInfo(vaultPath)
+	if err != nil {
+		t.Fatalf("GetVaultInfo failed: %v", err)
+	}
+	if info.KDF != DefaultKDFParams() || info.Iterations != PBKDF2Iters {
+		t.Fatalf("Expected default PBKDF2 params, got %+v", info.KDF)
+	}
+	if _, err := ListVault(vaultPath, Password(testPassword)); err != nil {
+		t.Fatalf("ListVault failed: %v", err)
+	}
+}
+
+// TestKDFParamsValidation тестирует проверку параметров KDF
+func TestKDFParamsValidation(t *testing.T) {
+	valid := []KDFParams{
+		DefaultKDFParams(),
+		Argon2idKDFParams(0, 0, 0),
+		testArgon2Params,
+	}
+	for _, params := range valid {
+		if err := params.Validate(); err != nil {
+			t.Errorf("Expected %+v to be valid: %v", params, err)
+		}
+	}
+
+	invalid := []KDFParams{
+		{Algorithm: KDFPBKDF2, Iterations: 100},
+		{Algorithm: KDFArgon2id, Memory: 4, Time: 1, Parallelism: 1},
+		{Algorithm: KDFArgon2id, Memory: 64 * 1024, Time: 0, Parallelism: 1},
+		{Algorithm: KDFArgon2id, Memory: 64 * 1024, Time: 1, Parallelism: 0},
+		{Algorithm: KDFArgon2id, Memory: argon2MaxMemory + 1, Time: 1, Parallelism: 1},
+		{Algorithm: 42},
+	}
+	for _, params := range invalid {
+		if err := params.Validate(); err == nil {
+			t.Errorf("Expected %+v to be rejected", params)
+		}
+	}
+
+	for name, expected := range map[string]uint8{"pbkdf2": KDFPBKDF2, "argon2id": KDFArgon2id, "ARGON2ID": KDFArgon2id} {
+		algorithm, err := ParseKDFName(name)
+		if err != nil || algorithm != expected {
+			t.Errorf("ParseKDFName(%q) = %d, %v", name, algorithm, err)
+		}
+	}
+	if _, err := ParseKDFName("scrypt"); err == nil {
+		t.Error("Expected error for unknown KDF")
+	}
+}
@@ -0,0 +1,421 @@
+package vault
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+)
+
+// ========================
+// KEY SLOTS
+// ========================
+//
+// A v3 header has MaxKeySlots key slots. Every active slot wraps the same master
+// key with a key derived from its own password or keyfile, so several people can
+// open a vault with different secrets. Adding or removing a slot only rewrites
+// the header; file data is never re-encrypted. The new header is saved before it
+// is written (see rewriteVaultHeader), so a crash during the change cannot lose the
+// slots that still work. Recipient slots wrap the master key for an X25519 public
+// key instead of a derived key (see recipient.go).
+
+// MaxKeySlots is the number of key slots in a vault header
+const MaxKeySlots = 8
+
+// Key slot kinds
+const (
+	KeySlotEmpty              uint8 = 0 // Unused slot
+	KeySlotPassword           uint8 = 1 // Unlocked by a password
+	KeySlotKeyfile            uint8 = 2 // Unlocked by a keyfile
+	KeySlotPasswordAndKeyfile uint8 = 3 // Unlocked by a password together with a keyfile
+	KeySlotCustom             uint8 = 4 // Unlocked by a caller-defined KeySource
+	KeySlotRecipient          uint8 = 5 // Unlocked by the identity of an X25519 recipient
+)
+
+// KeySlot wraps the master key with a key derived from one key source
+type KeySlot struct {
+	Kind           uint8    // Key slot kind (KeySlotEmpty for unused slots)
+	KDF            uint8    // Key derivation function: KDFPBKDF2 or KDFArgon2id
+	KDFParallelism uint8    // Argon2id parallelism
+	WrapVersion    uint8    // Vault version the master key was wrapped under if older than the header's (zero otherwise)
+	Iterations     uint32   // PBKDF2 iteration count
+	KDFMemory      uint32   // Argon2id memory cost in KiB
+	KDFTime        uint32   // Argon2id time cost
+	Salt           [32]byte // Salt for key derivation (recipient slots: ephemeral X25519 public key)
+	WrapNonce      [12]byte // Nonce used to wrap the master key
+	WrappedKey     [48]byte // Master key sealed with the derived key
+	Recipient      [32]byte // X25519 public key of a recipient slot (zero otherwise)
+}
+
+// KeySlotInfo describes an active key slot
+type KeySlotInfo struct {
+	Index     int       // Slot index in the header
+	Kind      uint8     // Key slot kind
+	KDF       KDFParams // Key derivation function and its cost parameters (zero for recipient slots)
+	Recipient string    // Encoded public key of a recipient slot
+}
+
+// KindName returns the human-readable name of the slot kind
+func (i KeySlotInfo) KindName() string {
+	return keySlotKindName(i.Kind)
+}
+
+// keySlotKind returns the slot kind matching a key source
+func keySlotKind(keySource KeySource) uint8 {
+	switch keySource.(type) {
+	case passwordSource:
+		return KeySlotPassword
+	case keyfileSource:
+		return KeySlotKeyfile
+	case combinedSource:
+		return KeySlotPasswordAndKeyfile
+	case identitySource:
+		return KeySlotRecipient
+	default:
+		return KeySlotCustom
+	}
+}
+
+// keySlotKindName returns the human-readable name of a slot kind
+func keySlotKindName(kind uint8) string {
+	switch kind {
+	case KeySlotEmpty:
+		return "empty"
+	case KeySlotPassword:
+		return "password"
+	case KeySlotKeyfile:
+		return "keyfile"
+	case KeySlotPasswordAndKeyfile:
+		return "password and keyfile"
+	case KeySlotCustom:
+		return "custom"
+	case KeySlotRecipient:
+		return "recipient"
+	default:
+		return fmt.Sprintf("unknown(%d)", kind)
+	}
+}
+
+// active reports whether the slot holds a wrapped master key
+func (s *KeySlot) active() bool {
+	return s.Kind != KeySlotEmpty
+}
+
+// kdfParams returns the key derivation parameters recorded in the slot
+func (s *KeySlot) kdfParams() KDFParams {
+	return KDFParams{
+		Algorithm:   s.KDF,
+		Iterations:  s.Iterations,
+		Memory:      s.KDFMemory,
+		Time:        s.KDFTime,
+		Parallelism: s.KDFParallelism,
+	}
+}
+
+// setKDFParams records the key derivation parameters in the slot
+func (s *KeySlot) setKDFParams(p KDFParams) {
+	s.KDF = p.Algorithm
+	s.Iterations = p.Iterations
+	s.KDFMemory = p.Memory
+	s.KDFTime = p.Time
+	s.KDFParallelism = p.Parallelism
+}
+
+// deriveKey derives the slot key from the key source secret
+func (s *KeySlot) deriveKey(keySource KeySource) ([]byte, error) {
+	if keySource == nil {
+		return nil, fmt.Errorf("key source cannot be nil")
+	}
+
+	secret, err := keySource.Secret()
+	if err != nil {
+		return nil, err
+	}
+	defer clearKey(secret)
+
+	return s.kdfParams().deriveKey(secret, s.Salt[:]), nil
+}
+
+// validate checks the kind and key derivation parameters of an active slot
+func (s *KeySlot) validate() error {
+	if s.Kind > KeySlotRecipient {
+		return fmt.Errorf("unknown key slot kind: %d", s.Kind)
+	}
+	if s.Kind == KeySlotRecipient {
+		return nil
+	}
+	return s.kdfParams().Validate()
+}
+
+// keyWrapAssociatedData returns the header and slot fields bound to a wrapped master key.
+// A slot kept by an upgrade stays bound to the version it was wrapped under.
+func (h *VaultHeader) keyWrapAssociatedData(index int) []byte {
+	slot := &h.KeySlots[index]
+	version := h.Version
+	if slot.WrapVersion != 0 {
+		version = uint32(slot.WrapVersion)
+	}
+
+	data := make([]byte, 0, 96)
+	data = append(data, h.Magic[:]...)
+	data = binary.LittleEndian.AppendUint32(data, version)
+	data = append(data, byte(index), slot.Kind, slot.KDF, slot.KDFParallelism)
+	data = binary.LittleEndian.AppendUint32(data, slot.Iterations)
+	data = binary.LittleEndian.AppendUint32(data, slot.KDFMemory)
+	data = binary.LittleEndian.AppendUint32(data, slot.KDFTime)
+	data = append(data, slot.Salt[:]...)
+	data = append(data, slot.Recipient[:]...)
+	return data
+}
+
+// upgrade raises the format version of a v3+ header, keeping the wrapped master keys,
+// which only the key sources of their slots could wrap again
+func (h *VaultHeader) upgrade(version uint32) {
+	for i := range h.KeySlots {
+		if h.KeySlots[i].active() && h.KeySlots[i].WrapVersion == 0 {
+			h.KeySlots[i].WrapVersion = uint8(h.Version)
+		}
+	}
+	h.Version = version
+}
+
+// wrapMasterKey derives a key from the key source with fresh salt and the given KDF
+// parameters, and stores the master key sealed with it in the given slot
+func (h *VaultHeader) wrapMasterKey(index int, keySource KeySource, params KDFParams, masterKey []byte) error {
+	slot := KeySlot{Kind: keySlotKind(keySource)}
+	if slot.Kind == KeySlotRecipient {
+		return fmt.Errorf("an identity cannot be used as a new key, add its recipient instead")
+	}
+
+	slot.setKDFParams(params)
+	if _, err := rand.Read(slot.Salt[:]); err != nil {
+		return fmt.Errorf("salt generation error: %w", err)
+	}
+	if _, err := rand.Read(slot.WrapNonce[:]); err != nil {
+		return fmt.Errorf("nonce generation error: %w", err)
+	}
+
+	kek, err := slot.deriveKey(keySource)
+	if err != nil {
+		return err
+	}
+	defer clearKey(kek)
+
+	gcm, err := newKeyWrapGCM(kek)
+	if err != nil {
+		return err
+	}
+
+	h.KeySlots[index] = slot
+	copy(h.KeySlots[index].WrappedKey[:], gcm.Seal(nil, slot.WrapNonce[:], masterKey, h.keyWrapAssociatedData(index)))
+	return nil
+}
+
+// unwrapMasterKey opens the master key stored in a slot with a derived key
+func (h *VaultHeader) unwrapMasterKey(index int, kek []byte) ([]byte, error) {
+	slot := &h.KeySlots[index]
+
+	gcm, err := newKeyWrapGCM(kek)
+	if err != nil {
+		return nil, err
+	}
+	return gcm.Open(nil, slot.WrapNonce[:], slot.WrappedKey[:], h.keyWrapAssociatedData(index))
+}
+
+// unlockKeySlot returns the key that encrypts the directory and payloads together
+// with the index of the slot it was unwrapped from. Only slots of the key source's
+// kind are tried, so a wrong key costs one key derivation per matching slot, and
+// an identity only tries the slots of its own recipient.
+// Legacy vaults use the key derived with the slot 0 parameters directly.
+func (h *VaultHeader) unlockKeySlot(keySource KeySource) ([]byte, int, error) {
+	if keySource == nil {
+		return nil, 0, fmt.Errorf("key source cannot be nil")
+	}
+
+	if h.Version < MasterKeyVersion {
+		key, err := h.KeySlots[0].deriveKey(keySource)
+		return key, 0, err
+	}
+
+	secret, err := keySource.Secret()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer clearKey(secret)
+
+	kind := keySlotKind(keySource)
+	for i := range h.KeySlots {
+		slot := &h.KeySlots[i]
+		if slot.Kind != kind {
+			continue
+		}
+
+		var kek []byte
+		if kind == KeySlotRecipient {
+			var ok bool
+			kek, ok, err = slot.recipientSlotKey(secret)
+			if err != nil {
+				return nil, 0, err
+			}
+			if !ok {
+				continue
+			}
+		} else {
+			kek = slot.kdfParams().deriveKey(secret, slot.Salt[:])
+		}
+
+		masterKey, err := h.unwrapMasterKey(i, kek)
+		clearKey(kek)
+		if err == nil {
+			// The slot opened, so a header that fails authentication was modified
+			if err := h.verifyKeyedChecksum(masterKey); err != nil {
+				clearKey(masterKey)
+				return nil, 0, err
+			}
+			return masterKey, i, nil
+		}
+	}
+
+	return nil, 0, fmt.Errorf("decryption failed: %w", ErrInvalidPassword)
+}
+
+// activeKeySlots returns the number of slots holding a wrapped master key
+func (h *VaultHeader) activeKeySlots() int {
+	count := 0
+	for i := range h.KeySlots {
+		if h.KeySlots[i].active() {
+			count++
+		}
+	}
+	return count
+}
+
+// keySlotInfos describes the active key slots of the header
+func (h *VaultHeader) keySlotInfos() []KeySlotInfo {
+	var infos []KeySlotInfo
+	for i := range h.KeySlots {
+		slot := &h.KeySlots[i]
+		if !slot.active() {
+			continue
+		}
+
+		info := KeySlotInfo{Index: i, Kind: slot.Kind, KDF: slot.kdfParams()}
+		if slot.Kind == KeySlotRecipient {
+			if recipient, err := ecdh.X25519().NewPublicKey(slot.Recipient[:]); err == nil {
+				info.Recipient = Recipient{key: recipient}.String()
+			}
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// ListKeySlots returns the active key slots of a vault. No password is required.
+func ListKeySlots(vaultPath string) ([]KeySlotInfo, error) {
+	unlock, err := lockVault(vaultPath, false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	if err := ValidateVaultFile(vaultPath); err != nil {
+		return nil, err
+	}
+
+	header, err := readVaultHeaderFile(vaultPath)
+	if err != nil {
+		return nil, err
+	}
+	return header.keySlotInfos(), nil
+}
+
+// AddKeySlot wraps the master key for an additional key source in a free key slot
+// and returns the slot index. keySource must unlock an existing slot.
+func AddKeySlot(vaultPath string, keySource, newKey KeySource, params KDFParams) (int, error) {
+	if newKey == nil {
+		return 0, fmt.Errorf("new key source cannot be nil")
+	}
+
+	if err := params.Validate(); err != nil {
+		return 0, fmt.Errorf("invalid key derivation parameters: %w", err)
+	}
+
+	return addKeySlot(vaultPath, keySource, func(header *VaultHeader, index int, masterKey []byte) error {
+		return header.wrapMasterKey(index, newKey, params, masterKey)
+	})
+}
+
+// addKeySlot unlocks the vault and lets wrap fill the first free key slot
+func addKeySlot(vaultPath string, keySource KeySource, wrap func(header *VaultHeader, index int, masterKey []byte) error) (int, error) {
+	// Lock the vault against other goroutines and processes
+	unlock, err := lockVault(vaultPath, true)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	_, header, masterKey, _, err := openVaultKeySlot(vaultPath, keySource)
+	if err != nil {
+		return 0, err
+	}
+	defer clearKey(masterKey)
+
+	if header.Version < MasterKeyVersion {
+		return 0, fmt.Errorf("key slots require vault format v%d or newer (vault is v%d)", MasterKeyVersion, header.Version)
+	}
+
+	index := -1
+	for i := range header.KeySlots {
+		if !header.KeySlots[i].active() {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		return 0, fmt.Errorf("all %d key slots are in use", MaxKeySlots)
+	}
+
+	if err := wrap(header, index, masterKey); err != nil {
+		return 0, err
+	}
+
+	if err := rewriteVaultHeader(vaultPath, header, masterKey); err != nil {
+		return 0, err
+	}
+	return index, nil
+}
+
+// RemoveKeySlot erases a key slot. keySource must unlock one of the slots (possibly
+// the one being removed). The last remaining slot cannot be removed.
+func RemoveKeySlot(vaultPath string, keySource KeySource, index int) error {
+	if index < 0 || index >= MaxKeySlots {
+		return fmt.Errorf("invalid key slot: %d (expected: 0 - %d)", index, MaxKeySlots-1)
+	}
+
+	// Lock the vault against other goroutines and processes
+	unlock, err := lockVault(vaultPath, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	_, header, masterKey, _, err := openVaultKeySlot(vaultPath, keySource)
+	if err != nil {
+		return err
+	}
+	defer clearKey(masterKey)
+
+	if header.Version < MasterKeyVersion {
+		return fmt.Errorf("key slots require vault format v%d or newer (vault is v%d)", MasterKeyVersion, header.Version)
+	}
+
+	if !header.KeySlots[index].active() {
+		return fmt.Errorf("key slot %d is not in use", index)
+	}
+	if header.activeKeySlots() == 1 {
+		return fmt.Errorf("cannot remove the last key slot")
+	}
+
+	header.KeySlots[index] = KeySlot{}
+	return rewriteVaultHeader(vaultPath, header, masterKey)
+}
@@ -0,0 +1,207 @@
+package vault
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestKeySlots тестирует добавление, удаление и просмотр слотов ключей
+func TestKeySlots(t *testing.T) {
+	tmpDir := setupCoreTest(t)
+	defer cleanupCoreTest(t, tmpDir)
+
+	vaultPath := filepath.Join(tmpDir, "slots.vault")
+	if err := CreateVault(vaultPath, Password(testPassword)); err != nil {
+		t.Fatalf("CreateVault failed: %v", err)
+	}
+	testFile := createTestFile(t, tmpDir, "data.txt", testContent)
+	if err := AddFileToVault(vaultPath, Password(testPassword), testFile); err != nil {
+		t.Fatalf("AddFileToVault failed: %v", err)
+	}
+
+	before, _ := os.ReadFile(vaultPath)
+	header := readTestHeader(t, vaultPath)
+	headerLen := header.encodedSize()
+
+	keyfile := createTestKeyfile(t, tmpDir, "member.key")
+	const memberPassword = "MemberPassword789!"
+
+	keyfileSlot, err := AddKeySlot(vaultPath, Password(testPassword), Keyfile(keyfile), DefaultKDFParams())
+	if err != nil {
+		t.Fatalf("AddKeySlot (keyfile) failed: %v", err)
+	}
+	memberSlot, err := AddKeySlot(vaultPath, Password(testPassword), Password(memberPassword), testArgon2Params)
+	if err != nil {
+		t.Fatalf("AddKeySlot (password) failed: %v", err)
+	}
+	if keyfileSlot != 1 || memberSlot != 2 {
+		t.Fatalf("Expected slots 1 and 2, got %d and %d", keyfileSlot, memberSlot)
+	}
+
+	// Данные не перешифровываются
+	after, _ := os.ReadFile(vaultPath)
+	if !bytes.Equal(after[headerLen:], before[headerLen:]) {
+		t.Fatal("Adding key slots must only rewrite the header")
+	}
+
+	slots, err := ListKeySlots(vaultPath)
+	if err != nil {
+		t.Fatalf("ListKeySlots failed: %v", err)
+	}
+	expectedKinds := []uint8{KeySlotPassword, KeySlotKeyfile, KeySlotPassword}
+	if len(slots) != len(expectedKinds) {
+		t.Fatalf("Expected %d slots, got %d", len(expectedKinds), len(slots))
+	}
+	for i, slot := range slots {
+		if slot.Index != i || slot.Kind != expectedKinds[i] {
+			t.Errorf("Slot %d: unexpected %+v", i, slot)
+		}
+	}
+	if slots[2].KDF != testArgon2Params {
+		t.Errorf("Expected Argon2id parameters in slot 2, got %+v", slots[2].KDF)
+	}
+
+	// Каждый слот открывает vault
+	for _, source := range []KeySource{Password(testPassword), Keyfile(keyfile), Password(memberPassword)} {
+		if entries, err := ListVault(vaultPath, source); err != nil || len(entries) != 1 {
+			t.Errorf("%s: ListVault failed: %v", source.Description(), err)
+		}
+	}
+
+	// Удаление исходного слота ключом другого участника
+	if err := RemoveKeySlot(vaultPath, Password(memberPassword), 0); err != nil {
+		t.Fatalf("RemoveKeySlot failed: %v", err)
+	}
+	if _, err := ListVault(vaultPath, Password(testPassword)); !errors.Is(err, ErrInvalidPassword) {
+		t.Errorf("Expected ErrInvalidPassword for removed slot, got %v", err)
+	}
+	outputDir := filepath.Join(tmpDir, "output")
+	if err := ExtractFromVault(vaultPath, Keyfile(keyfile), outputDir); err != nil {
+		t.Fatalf("ExtractFromVault failed: %v", err)
+	}
+	content, err := os.ReadFile(filepath.Join(outputDir, "data.txt"))
+	if err != nil || string(content) != testContent {
+		t.Fatal("Extracted content mismatch")
+	}
+
+	// Ошибочные операции
+	if err := RemoveKeySlot(vaultPath, Keyfile(keyfile), 0); err == nil {
+		t.Error("Expected error for removing an empty slot")
+	}
+	if err := RemoveKeySlot(vaultPath, Keyfile(keyfile), MaxKeySlots); err == nil {
+		t.Error("Expected error for out of range slot")
+	}
+	if _, err := AddKeySlot(vaultPath, Password("WrongPassword!"), Password("Another789!"), DefaultKDFParams()); !errors.Is(err, ErrInvalidPassword) {
+		t.Errorf("Expected ErrInvalidPassword, got %v", err)
+	}
+	if err := RemoveKeySlot(vaultPath, Keyfile(keyfile), memberSlot); err != nil {
+		t.Fatalf("RemoveKeySlot failed: %v", err)
+	}
+	if err := RemoveKeySlot(vaultPath, Keyfile(keyfile), keyfileSlot); err == nil {
+		t.Error("Expected error for removing the last slot")
+	}
+}
+
+// TestKeySlotsFull проверяет ограничение числа слотов
+func TestKeySlotsFull(t *testing.T) {
+	tmpDir := setupCoreTest(t)
+	defer cleanupCoreTest(t, tmpDir)
+
+	vaultPath := filepath.Join(tmpDir, "full.vault")
+	if err := CreateVaultWithKDF(vaultPath, Password(testPassword), testArgon2Params); err != nil {
+		t.Fatalf("CreateVaultWithKDF failed: %v", err)
+	}
+
+	for i := 1; i < MaxKeySlots; i++ {
+		keyfile := createTestKeyfile(t, tmpDir, "member.key")
+		if _, err := AddKeySlot(vaultPath, Password(testPassword), Keyfile(keyfile), testArgon2Params); err != nil {
+			t.Fatalf("AddKeySlot %d failed: %v", i, err)
+		}
+	}
+
+	if _, err := AddKeySlot(vaultPath, Password(testPassword), Password("Another789!"), testArgon2Params); err == nil {
+		t.Error("Expected error when all key slots are in use")
+	}
+
+	// Смена пароля затрагивает только слот, открытый старым паролем
+	if err := ChangeVaultPassword(vaultPath, Password(testPassword), Password("Changed789!")); err != nil {
+		t.Fatalf("ChangeVaultPassword failed: %v", err)
+	}
+	slots, err := ListKeySlots(vaultPath)
+	if err != nil || len(slots) != MaxKeySlots {
+		t.Fatalf("Expected %d slots after password change, got %d (%v)", MaxKeySlots, len(slots), err)
+	}
+	if _, err := ListVault(vaultPath, Password("Changed789!")); err != nil {
+		t.Errorf("ListVault with changed password failed: %v", err)
+	}
+}
+
+// TestKeySlotTornHeader тестирует, что сбой при изменении слотов не теряет рабочие слоты
+func TestKeySlotTornHeader(t *testing.T) {
+	tmpDir := setupCoreTest(t)
+	defer cleanupCoreTest(t, tmpDir)
+
+	vaultPath := filepath.Join(tmpDir, "torn.vault")
+	if err := CreateVaultWithKDF(vaultPath, Password(testPassword), testArgon2Params); err != nil {
+		t.Fatalf("CreateVaultWithKDF failed: %v", err)
+	}
+	keyfile := Keyfile(createTestKeyfile(t, tmpDir, "member.key"))
+	if _, err := AddKeySlot(vaultPath, Password(testPassword), keyfile, testArgon2Params); err != nil {
+		t.Fatalf("AddKeySlot failed: %v", err)
+	}
+	newKey := Password("Another789!")
+
+	operations := []struct {
+		name   string
+		change func() error
+		keys   []KeySource // Key sources that open the vault after the change
+	}{
+		{"add", func() error {
+			_, err := AddKeySlot(vaultPath, Password(testPassword), newKey, testArgon2Params)
+			return err
+		}, []KeySource{Password(testPassword), keyfile, newKey}},
+		{"remove", func() error {
+			return RemoveKeySlot(vaultPath, keyfile, 2)
+		}, []KeySource{Password(testPassword), keyfile}},
+	}
+
+	for _, op := range operations {
+		before, err := os.ReadFile(vaultPath)
+		if err != nil {
+			t.Fatalf("Failed to read vault: %v", err)
+		}
+		if err := op.change(); err != nil {
+			t.Fatalf("%s: key slot change failed: %v", op.name, err)
+		}
+		newHeader, err := os.ReadFile(vaultPath)
+		if err != nil {
+			t.Fatalf("Failed to read vault: %v", err)
+		}
+		newHeader = newHeader[:headerSize(CurrentVaultVersion)]
+
+		// Сбой посреди записи заголовка, после сохранения его копии
+		torn := bytes.Clone(before)
+		copy(torn, newHeader[:len(newHeader)/3])
+		if err := os.WriteFile(vaultPath, torn, 0600); err != nil {
+			t.Fatalf("Failed to write vault: %v", err)
+		}
+		if err := os.WriteFile(headerCopyPath(vaultPath), newHeader, 0600); err != nil {
+			t.Fatalf("Failed to write header copy: %v", err)
+		}
+		if _, err := ListVault(vaultPath, Password(testPassword)); !errors.Is(err, ErrInterruptedWrite) {
+			t.Errorf("%s: expected ErrInterruptedWrite, got %v", op.name, err)
+		}
+
+		if report, err := RecoverVault(vaultPath, keyfile, RecoverOptions{}); err != nil || !report.RestoredHeader {
+			t.Fatalf("%s: unexpected recovery: %+v (%v)", op.name, report, err)
+		}
+		for i, key := range op.keys {
+			if _, err := ListVault(vaultPath, key); err != nil {
+				t.Errorf("%s: key %d does not open the recovered vault: %v", op.name, i, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package vault
+
+import (
+	"crypto/rand"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// createTestKeyfile создаёт keyfile со случайным содержимым
+func createTestKeyfile(t *testing.T, dir, name string) string {
+	t.Helper()
+
+	data := make([]byte, 64)
+	rand.Read(data)
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("Failed to create keyfile: %v", err)
+	}
+	return path
+}
+
+// TestKeyfileVault тестирует vault, открываемый только keyfile
+func TestKeyfileVault(t *testing.T) {
+	tmpDir := setupCoreTest(t)
+	defer cleanupCoreTest(t, tmpDir)
+
+	keyfile := createTestKeyfile(t, tmpDir, "vault.key")
+	otherKeyfile := createTestKeyfile(t, tmpDir, "other.key")
+
+	vaultPath := filepath.Join(tmpDir, "keyfile.vault")
+	if err := CreateVault(vaultPath, Keyfile(keyfile)); err != nil {
+		t.Fatalf("CreateVault failed: %v", err)
+	}
+	testFile := createTestFile(t, tmpDir, "data.txt", testContent)
+	if err := AddFileToVault(vaultPath, Keyfile(keyfile), testFile); err != nil {
+		t.Fatalf("AddFileToVault failed: %v", err)
+	}
+
+	outputDir := filepath.Join(tmpDir, "output")
+	if err := ExtractFromVault(vaultPath, Keyfile(keyfile), outputDir); err != nil {
+		t.Fatalf("ExtractFromVault failed: %v", err)
+	}
+	content, err := os.ReadFile(filepath.Join(outputDir, "data.txt"))
+	if err != nil || string(content) != testContent {
+		t.Fatal("Extracted content mismatch")
+	}
+
+	// Чужой keyfile и пароль не подходят
+	if _, err := ListVault(vaultPath, Keyfile(otherKeyfile)); !errors.Is(err, ErrInvalidPassword) {
+		t.Errorf("Expected ErrInvalidPassword for wrong keyfile, got %v", err)
+	}
+	if _, err := ListVault(vaultPath, Password(testPassword)); !errors.Is(err, ErrInvalidPassword) {
+		t.Errorf("Expected ErrInvalidPassword for password, got %v", err)
+	}
+
+	// Отсутствующий или пустой keyfile
+	if _, err := ListVault(vaultPath, Keyfile(filepath.Join(tmpDir, "missing.key"))); err == nil {
+		t.Error("Expected error for missing keyfile")
+	}
+	emptyKeyfile := filepath.Join(tmpDir, "empty.key")
+	os.WriteFile(emptyKeyfile, nil, 0600)
+	if err := CreateVault(filepath.Join(tmpDir, "empty.vault"), Keyfile(emptyKeyfile)); err == nil {
+		t.Error("Expected error for empty keyfile")
+	}
+}
+
+// TestPasswordAndKeyfileVault тестирует vault, требующий пароль и keyfile одновременно
+func TestPasswordAndKeyfileVault(t *testing.T) {
+	tmpDir := setupCoreTest(t)
+	defer cleanupCoreTest(t, tmpDir)
+
+	keyfile := createTestKeyfile(t, tmpDir, "vault.key")
+	combined := PasswordAndKeyfile(testPassword, keyfile)
+
+	vaultPath := filepath.Join(tmpDir, "combined.vault")
+	if err := CreateVault(vaultPath, combined); err != nil {
+		t.Fatalf("CreateVault failed: %v", err)
+	}
+	testFile := createTestFile(t, tmpDir, "data.txt", testContent)
+	if err := AddFileToVault(vaultPath, combined, testFile); err != nil {
+		t.Fatalf("AddFileToVault failed: %v", err)
+	}
+	if entries, err := ListVault(vaultPath, combined); err != nil || len(entries) != 1 {
+		t.Fatalf("ListVault failed: %v", err)
+	}
+
+	// Ни пароль, ни keyfile по отдельности не открывают vault
+	for _, source := range []KeySource{Password(testPassword), Keyfile(keyfile), PasswordAndKeyfile("WrongPassword!", keyfile)} {
+		if _, err := ListVault(vaultPath, source); !errors.Is(err, ErrInvalidPassword) {
+			t.Errorf("%s: expected ErrInvalidPassword, got %v", source.Description(), err)
+		}
+	}
+
+	// Переход с пароля и keyfile на только пароль без перешифрования данных
+	if err := ChangeVaultPassword(vaultPath, combined, Password(testPassword)); err != nil {
+		t.Fatalf("ChangeVaultPassword failed: %v", err)
+	}
+	if _, err := ListVault(vaultPath, Password(testPassword)); err != nil {
+		t.Errorf("ListVault with password failed: %v", err)
+	}
+}
@@ -0,0 +1,166 @@
+package vault
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ========================
+// VAULT LOCKING
+// ========================
+//
+// Operations lock the vault for their whole duration: shared for reading (list,
+// extract) and exclusive for anything that writes. Within a process a read-write
+// mutex per vault serializes goroutines; across processes an advisory lock is held
+// on "<vault>.lock". The lock is not taken on the vault itself because rewrites
+// replace the vault file, and the lock file is never removed, so two processes can
+// never hold locks on different files. A writer holding the lock writes its PID into
+// it for the error message of processes that have to give up.
+
+// ErrVaultLocked is returned when another process holds the vault lock for longer than LockTimeout
+var ErrVaultLocked = errors.New("vault is locked")
+
+// LockTimeout is how long operations wait for a vault locked by another process.
+// Zero fails at once.
+var LockTimeout time.Duration
+
+// lockRetryInterval is how often a vault locked by another process is retried
+const lockRetryInterval = 50 * time.Millisecond
+
+// Global vault access synchronization within the process
+var vaultMutexes = make(map[string]*sync.RWMutex)
+var vaultMutexesLock sync.Mutex
+
+// getVaultMutex returns the in-process lock of a vault file
+func getVaultMutex(vaultPath string) *sync.RWMutex {
+	if absPath, err := filepath.Abs(vaultPath); err == nil {
+		vaultPath = absPath
+	}
+
+	vaultMutexesLock.Lock()
+	defer vaultMutexesLock.Unlock()
+
+	if mutex, exists := vaultMutexes[vaultPath]; exists {
+		return mutex
+	}
+
+	mutex := &sync.RWMutex{}
+	vaultMutexes[vaultPath] = mutex
+	return mutex
+}
+
+// lockVault locks a vault shared or exclusively, in this process and across processes.
+// The returned function releases the lock.
+func lockVault(vaultPath string, exclusive bool) (func(), error) {
+	mutex := getVaultMutex(vaultPath)
+	if exclusive {
+		mutex.Lock()
+	} else {
+		mutex.RLock()
+	}
+	release := func() {
+		if exclusive {
+			mutex.Unlock()
+		} else {
+			mutex.RUnlock()
+		}
+	}
+
+	file, err := lockVaultFile(vaultPath, exclusive)
+	if err != nil {
+		release()
+		return nil, err
+	}
+
+	return func() {
+		if file != nil {
+			// Clear the PID first, so it never names a writer that has left
+			if exclusive {
+				_ = file.Truncate(0)
+			}
+			unlockFile(file)
+			file.Close()
+		}
+		release()
+	}, nil
+}
+
+// lockVaultFile takes the advisory lock on the lock file of a vault, waiting up to
+// LockTimeout. Exclusive locks create the lock file if needed, also for a vault that
+// does not exist yet, so that creations of the same vault exclude each other; whether
+// the vault exists is only meaningful under the lock. Shared locks never create it: a
+// nil file is returned when there is no lock file to open, because the vault does not
+// exist or was never written by this version, or because it is only read from a
+// location that cannot be written to (e.g. read-only media).
+func lockVaultFile(vaultPath string, exclusive bool) (*os.File, error) {
+	lockPath := vaultPath + ".lock"
+	if !exclusive {
+		file, err := os.Open(lockPath)
+		if err != nil {
+			return nil, nil
+		}
+		return waitLockFile(file, false)
+	}
+
+	file, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("lock file open error: %w", err)
+	}
+	return waitLockFile(file, true)
+}
+
+// waitLockFile takes the advisory lock on an open lock file, waiting up to LockTimeout.
+// The file is closed if the lock cannot be taken.
+func waitLockFile(file *os.File, exclusive bool) (*os.File, error) {
+
+	deadline := time.Now().Add(LockTimeout)
+	for {
+		locked, err := tryLockFile(file, exclusive)
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("vault lock error: %w", err)
+		}
+		if locked {
+			break
+		}
+
+		if !time.Now().Before(deadline) {
+			pid := lockHolder(file)
+			file.Close()
+			if pid > 0 {
+				return nil, fmt.Errorf("%w by PID %d", ErrVaultLocked, pid)
+			}
+			return nil, ErrVaultLocked
+		}
+		time.Sleep(lockRetryInterval)
+	}
+
+	// Record the writer for processes that find the vault locked. Readers share the
+	// lock and would overwrite each other's PID, so they leave the file alone. The PID
+	// only serves the error message, so failing to record it is deliberately ignored.
+	if exclusive {
+		if err := file.Truncate(0); err == nil {
+			_, _ = file.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+		}
+	}
+	return file, nil
+}
+
+// lockHolder reads the PID of the process holding the lock exclusively (0 if unknown,
+// or if the lock is held by readers)
+func lockHolder(file *os.File) int {
+	buffer := make([]byte, 32)
+	n, _ := file.ReadAt(buffer, 0)
+	line, _, _ := strings.Cut(string(buffer[:n]), "\n")
+	pid, err := strconv.Atoi(strings.TrimSpace(line))
+	if err != nil {
+		return 0
+	}
+	return pid
+}
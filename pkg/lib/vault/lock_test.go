@@ -0,0 +1,240 @@
+package vault
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestVaultLock тестирует блокировку vault другим процессом
+func TestVaultLock(t *testing.T) {
+	tmpDir := setupCoreTest(t)
+	defer cleanupCoreTest(t, tmpDir)
+	defer func() { LockTimeout = 0 }()
+
+	vaultPath := filepath.Join(tmpDir, "locked.vault")
+	if err := CreateVaultWithKDF(vaultPath, Password(testPassword), testArgon2Params); err != nil {
+		t.Fatalf("CreateVaultWithKDF failed: %v", err)
+	}
+	testFile := createTestFile(t, tmpDir, "data.txt", testContent)
+
+	// Отдельный дескриптор файла блокировки ведёт себя как другой процесс
+	held, err := lockVaultFile(vaultPath, true)
+	if err != nil {
+		t.Fatalf("lockVaultFile failed: %v", err)
+	}
+
+	_, err = ListVault(vaultPath, Password(testPassword))
+	if !errors.Is(err, ErrVaultLocked) {
+		t.Fatalf("Expected ErrVaultLocked, got %v", err)
+	}
+	if !strings.Contains(err.Error(), fmt.Sprintf("by PID %d", os.Getpid())) {
+		t.Errorf("Error does not name the holder: %v", err)
+	}
+	if err := AddFileToVault(vaultPath, Password(testPassword), testFile); !errors.Is(err, ErrVaultLocked) {
+		t.Errorf("Expected ErrVaultLocked for add, got %v", err)
+	}
+
+	// С таймаутом операция дожидается освобождения
+	LockTimeout = 5 * time.Second
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		unlockFile(held)
+		held.Close()
+	}()
+	if err := AddFileToVault(vaultPath, Password(testPassword), testFile); err != nil {
+		t.Fatalf("AddFileToVault after release failed: %v", err)
+	}
+	LockTimeout = 0
+
+	// Разделяемая блокировка пропускает чтение, но не запись
+	shared, err := lockVaultFile(vaultPath, false)
+	if err != nil {
+		t.Fatalf("lockVaultFile (shared) failed: %v", err)
+	}
+	if entries, err := ListVault(vaultPath, Password(testPassword)); err != nil || len(entries) != 1 {
+		t.Errorf("ListVault under a shared lock failed: %v", err)
+	}
+	if err := RemoveFromVault(vaultPath, Password(testPassword), []string{"data.txt"}); !errors.Is(err, ErrVaultLocked) {
+		t.Errorf("Expected ErrVaultLocked for remove, got %v", err)
+	}
+	unlockFile(shared)
+	shared.Close()
+
+	if err := RemoveFromVault(vaultPath, Password(testPassword), []string{"data.txt"}); err != nil {
+		t.Errorf("RemoveFromVault after release failed: %v", err)
+	}
+}
+
+// TestConcurrentVaultWrites тестирует одновременные добавления из нескольких горутин
+func TestConcurrentVaultWrites(t *testing.T) {
+	tmpDir := setupCoreTest(t)
+	defer cleanupCoreTest(t, tmpDir)
+
+	vaultPath := filepath.Join(tmpDir, "concurrent.vault")
+	if err := CreateVaultWithKDF(vaultPath, Password(testPassword), testArgon2Params); err != nil {
+		t.Fatalf("CreateVaultWithKDF failed: %v", err)
+	}
+
+	const writers = 8
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for i := 0; i < writers; i++ {
+		path := createTestFile(t, tmpDir, fmt.Sprintf("file%d.txt", i), fmt.Sprintf("content %d", i))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- AddFileToVault(vaultPath, Password(testPassword), path)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("Concurrent AddFileToVault failed: %v", err)
+		}
+	}
+
+	entries, err := ListVault(vaultPath, Password(testPassword))
+	if err != nil {
+		t.Fatalf("ListVault failed: %v", err)
+	}
+	if len(entries) != writers {
+		t.Errorf("Expected %d entries, got %d", writers, len(entries))
+	}
+}
+
+// TestCreateVaultLock тестирует блокировку ещё не созданного vault другим процессом
+func TestCreateVaultLock(t *testing.T) {
+	tmpDir := setupCoreTest(t)
+	defer cleanupCoreTest(t, tmpDir)
+	defer func() { LockTimeout = 0 }()
+
+	vaultPath := filepath.Join(tmpDir, "new.vault")
+
+	// Другой процесс, создающий тот же vault, держит блокировку
+	held, err := lockVaultFile(vaultPath, true)
+	if err != nil {
+		t.Fatalf("lockVaultFile failed: %v", err)
+	}
+	if err := CreateVaultWithKDF(vaultPath, Password(testPassword), testArgon2Params); !errors.Is(err, ErrVaultLocked) {
+		t.Fatalf("Expected ErrVaultLocked, got %v", err)
+	}
+
+	// Пока создание ждёт, другой процесс создаёт vault и отпускает блокировку
+	LockTimeout = 5 * time.Second
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		if err := saveVaultDirectory(vaultPath, Password("other-password"), VaultDirectory{Version: CurrentVaultVersion, Entries: []FileEntry{}}, testArgon2Params, nil); err != nil {
+			t.Errorf("saveVaultDirectory failed: %v", err)
+		}
+		unlockFile(held)
+		held.Close()
+	}()
+	if err := CreateVaultWithKDF(vaultPath, Password(testPassword), testArgon2Params); err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Fatalf("Expected an existing vault error, got %v", err)
+	}
+
+	if _, err := ListVault(vaultPath, Password("other-password")); err != nil {
+		t.Errorf("Vault of the other creation was replaced: %v", err)
+	}
+}
+
+// TestSharedLockCreatesNoLockFile тестирует чтение отсутствующего vault
+func TestSharedLockCreatesNoLockFile(t *testing.T) {
+	tmpDir := setupCoreTest(t)
+	defer cleanupCoreTest(t, tmpDir)
+
+	vaultPath := filepath.Join(tmpDir, "nothere.vault")
+	if _, err := ListVault(vaultPath, Password(testPassword)); err == nil {
+		t.Fatal("Expected error for a missing vault")
+	}
+	if _, err := os.Stat(vaultPath + ".lock"); !os.IsNotExist(err) {
+		t.Errorf("Reading a missing vault left a lock file: %v", err)
+	}
+}
+
+// TestReadOnlyVaultDirectory тестирует чтение vault из каталога без права записи
+func TestReadOnlyVaultDirectory(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("root can write to read-only directories")
+	}
+
+	tmpDir := setupCoreTest(t)
+	defer cleanupCoreTest(t, tmpDir)
+
+	readOnlyDir := filepath.Join(tmpDir, "readonly")
+	if err := os.MkdirAll(readOnlyDir, 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	vaultPath := filepath.Join(readOnlyDir, "test.vault")
+	if err := CreateVaultWithKDF(vaultPath, Password(testPassword), testArgon2Params); err != nil {
+		t.Fatalf("CreateVaultWithKDF failed: %v", err)
+	}
+	if err := AddFileToVault(vaultPath, Password(testPassword), createTestFile(t, tmpDir, "data.txt", testContent)); err != nil {
+		t.Fatalf("AddFileToVault failed: %v", err)
+	}
+
+	// Копия vault на носителе только для чтения не имеет файла блокировки
+	if err := os.Remove(vaultPath + ".lock"); err != nil {
+		t.Fatalf("Failed to remove lock file: %v", err)
+	}
+	if err := os.Chmod(readOnlyDir, 0555); err != nil {
+		t.Fatalf("Failed to make directory read-only: %v", err)
+	}
+	defer os.Chmod(readOnlyDir, 0755)
+
+	if entries, err := ListVault(vaultPath, Password(testPassword)); err != nil || len(entries) != 1 {
+		t.Fatalf("ListVault in a read-only directory failed: %v", err)
+	}
+	if err := ExtractFromVault(vaultPath, Password(testPassword), filepath.Join(tmpDir, "output")); err != nil {
+		t.Fatalf("ExtractFromVault in a read-only directory failed: %v", err)
+	}
+	if err := AddFileToVault(vaultPath, Password(testPassword), filepath.Join(tmpDir, "data.txt")); err == nil {
+		t.Error("Expected error for writing to a read-only directory")
+	}
+}
+
+// TestSharedLockHolderPID тестирует, что читатели не записывают свой PID
+func TestSharedLockHolderPID(t *testing.T) {
+	tmpDir := setupCoreTest(t)
+	defer cleanupCoreTest(t, tmpDir)
+
+	vaultPath := filepath.Join(tmpDir, "shared.vault")
+	if err := CreateVaultWithKDF(vaultPath, Password(testPassword), testArgon2Params); err != nil {
+		t.Fatalf("CreateVaultWithKDF failed: %v", err)
+	}
+
+	// Ушедший писатель не остаётся записанным в файле блокировки
+	if content := mustReadFile(t, vaultPath+".lock"); len(content) != 0 {
+		t.Errorf("Lock file still names a released writer: %q", content)
+	}
+
+	for i := 0; i < 2; i++ {
+		shared, err := lockVaultFile(vaultPath, false)
+		if err != nil {
+			t.Fatalf("lockVaultFile (shared) failed: %v", err)
+		}
+		defer func() {
+			unlockFile(shared)
+			shared.Close()
+		}()
+	}
+	if content := mustReadFile(t, vaultPath+".lock"); len(content) != 0 {
+		t.Errorf("Readers wrote into the lock file: %q", content)
+	}
+
+	testFile := createTestFile(t, tmpDir, "data.txt", testContent)
+	err := AddFileToVault(vaultPath, Password(testPassword), testFile)
+	if !errors.Is(err, ErrVaultLocked) {
+		t.Fatalf("Expected ErrVaultLocked, got %v", err)
+	}
+	if strings.Contains(err.Error(), "by PID") {
+		t.Errorf("Error names a reader as the holder: %v", err)
+	}
+}
@@ -0,0 +1,235 @@
+package vault
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+// ========================
+// LOG-STRUCTURED WRITES
+// ========================
+//
+// Writes to v3+ vaults append instead of rewriting the file: the new payloads are
+// written after everything else, followed by the whole directory sealed with the
+// vault key and a fixed-size trailer. The newest trailer at the end of the file
+// (possibly followed by public-key appends) locates the current directory; the one
+// after the header is only read until the first append. Payload offsets stay
+// relative to the data area after the header directory, so readers do not care
+// where a payload was written. Superseded payloads and directories stay in the
+// file until it is rewritten.
+
+// logMagic marks the trailer of an appended directory
+const logMagic = "FLINTLOG"
+
+// logTrailer ends every append: payloads, sealed directory, trailer
+type logTrailer struct {
+	DirNonce      [12]byte // Nonce of the sealed directory
+	DirectorySize uint64   // Size of the sealed directory
+	DataSize      uint64   // Size of the payloads appended with the directory
+	Magic         [8]byte  // "FLINTLOG"
+}
+
+// logCommit locates an appended directory in the vault file
+type logCommit struct {
+	start   int64 // Offset of the first payload
+	end     int64 // Offset just past the trailer
+	trailer logTrailer
+}
+
+// directoryEnd returns the offset just past the appended directory, where the trailer starts
+func (c *logCommit) directoryEnd() int64 {
+	return c.end - int64(binary.Size(logTrailer{}))
+}
+
+// encode serializes the trailer; it is also part of the associated data of the directory
+func (t *logTrailer) encode() []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, t)
+	return buf.Bytes()
+}
+
+// usesVaultLog reports whether writes to the vault append instead of rewriting it
+func (h *VaultHeader) usesVaultLog() bool {
+	return h.Version >= MasterKeyVersion
+}
+
+// vaultUsesLog reads the header of a vault and reports whether writes to it append
+func vaultUsesLog(vaultPath string) (bool, error) {
+	header, err := readVaultHeaderFile(vaultPath)
+	if err != nil {
+		return false, err
+	}
+	return header.usesVaultLog(), nil
+}
+
+// appendToVaultLog appends the directory to the end of the vault. On error the file is
+// cut back to its previous size, so the previous directory stays current.
+func appendToVaultLog(vaultPath string, key []byte, vaultDir VaultDirectory) error {
+	file, err := os.OpenFile(vaultPath, os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("vault file open error: %w", err)
+	}
+	defer file.Close()
+
+	header, err := readVaultHeader(file)
+	if err != nil {
+		return fmt.Errorf("header read error: %w", err)
+	}
+	if !header.usesVaultLog() {
+		return fmt.Errorf("vault format version %d does not support appends", header.Version)
+	}
+
+	originalSize, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return fmt.Errorf("vault file seek error: %w", err)
+	}
+
+	if err := commitVaultLog(file, header, key, vaultDir, 0); err != nil {
+		file.Truncate(originalSize)
+		return err
+	}
+	return nil
+}
+
+// commitVaultLog writes the directory and its trailer after dataSize bytes of data
+// appended at the end of the file, syncing the data first so the trailer never
+// commits data that is not on disk
+func commitVaultLog(file *os.File, header *VaultHeader, key []byte, vaultDir VaultDirectory, dataSize int64) error {
+	if dataSize > 0 {
+		if err := file.Sync(); err != nil {
+			return fmt.Errorf("vault file sync error: %w", err)
+		}
+	}
+
+	sealedDir, trailer, err := sealLogDirectory(key, header, vaultDir, dataSize)
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Write(sealedDir); err != nil {
+		return fmt.Errorf("directory write error: %w", err)
+	}
+	if _, err := file.Write(trailer.encode()); err != nil {
+		return fmt.Errorf("directory trailer write error: %w", err)
+	}
+
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("vault file sync error: %w", err)
+	}
+	return nil
+}
+
+// sealLogDirectory serializes, compresses and encrypts the directory for an append.
+// The header and the trailer are bound to it as associated data.
+func sealLogDirectory(key []byte, header *VaultHeader, vaultDir VaultDirectory, dataSize int64) ([]byte, *logTrailer, error) {
+	encoded, err := encodeDirectory(key, header.Version, vaultDir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	gcm, err := newKeyWrapGCM(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	trailer := &logTrailer{
+		DirectorySize: encoded.sealedSize(gcm.Overhead()),
+		DataSize:      uint64(dataSize),
+	}
+	copy(trailer.Magic[:], logMagic)
+	if _, err := rand.Read(trailer.DirNonce[:]); err != nil {
+		return nil, nil, fmt.Errorf("nonce generation error: %w", err)
+	}
+
+	return encoded.seal(gcm, trailer.DirNonce[:], logAssociatedData(header, trailer)), trailer, nil
+}
+
+// logAssociatedData binds an appended directory to the vault header and its trailer
+func logAssociatedData(header *VaultHeader, trailer *logTrailer) []byte {
+	return append(header.associatedData(), trailer.encode()...)
+}
+
+// findLogCommit walks back from the end of the file over public-key appends to the
+// newest appended directory. It returns nil if no directory was appended yet or the
+// file ends in data that is not a trailer (which the inbox merge then reports).
+func findLogCommit(file *os.File, header *VaultHeader, fileSize int64) (*logCommit, error) {
+	dataStart := header.encodedSize() + int64(header.DirectorySize)
+	trailerSize := int64(binary.Size(logTrailer{}))
+
+	for end := fileSize; end-dataStart >= int64(len(logMagic)); {
+		magic := make([]byte, len(logMagic))
+		if _, err := file.ReadAt(magic, end-int64(len(magic))); err != nil {
+			return nil, fmt.Errorf("trailer read error: %w", err)
+		}
+
+		switch string(magic) {
+		case inboxMagic:
+			segment, err := readInboxSegment(file, dataStart, end)
+			if err != nil {
+				return nil, err
+			}
+			end = segment.start
+
+		case logMagic:
+			if end-dataStart < trailerSize {
+				return nil, fmt.Errorf("directory trailer at offset %d exceeds the vault data", end-trailerSize)
+			}
+
+			var trailer logTrailer
+			if err := binary.Read(io.NewSectionReader(file, end-trailerSize, trailerSize), binary.LittleEndian, &trailer); err != nil {
+				return nil, fmt.Errorf("directory trailer read error: %w", err)
+			}
+
+			available := uint64(end - trailerSize - dataStart)
+			if trailer.DirectorySize > available || trailer.DataSize > available-trailer.DirectorySize {
+				return nil, fmt.Errorf("directory trailer at offset %d exceeds the vault data", end-trailerSize)
+			}
+
+			start := end - trailerSize - int64(trailer.DirectorySize) - int64(trailer.DataSize)
+			return &logCommit{start: start, end: end, trailer: trailer}, nil
+
+		default:
+			return nil, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// openLogDirectory reads and decrypts an appended directory
+func openLogDirectory(file *os.File, key []byte, header *VaultHeader, commit *logCommit) (*VaultDirectory, error) {
+	body, pagesStart, err := openLogBody(file, key, header, commit)
+	if err != nil {
+		return nil, err
+	}
+	return decodeDirectory(file, key, header.Version, body, pagesStart, commit.directoryEnd())
+}
+
+// openLogBody reads and decrypts an appended directory (the root of a paged directory)
+// and returns it with the offset of the pages
+func openLogBody(file *os.File, key []byte, header *VaultHeader, commit *logCommit) ([]byte, int64, error) {
+	trailer := &commit.trailer
+	sealedDir, pagesStart, err := readSealedDirectory(file, header.Version, commit.directoryEnd()-int64(trailer.DirectorySize), trailer.DirectorySize)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	gcm, err := newKeyWrapGCM(key)
+	if err != nil {
+		return nil, 0, err
+	}
+	compressedDir, err := gcm.Open(nil, trailer.DirNonce[:], sealedDir, logAssociatedData(header, trailer))
+	if err != nil {
+		return nil, 0, fmt.Errorf("%w: directory appended at offset %d does not match its authentication tag", ErrHeaderTampered, commit.start)
+	}
+	return compressedDir, pagesStart, nil
+}
+
+// payloadDataEnd returns the offset just past the last payload or chunk of the directory
+func payloadDataEnd(header *VaultHeader, entries []FileEntry) int64 {
+	return header.encodedSize() + int64(header.DirectorySize) + dataAreaEnd(entries)
+}
@@ -0,0 +1,281 @@
+package vault
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// vaultFileSize возвращает размер файла vault
+func vaultFileSize(t *testing.T, path string) int64 {
+	t.Helper()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Failed to stat vault: %v", err)
+	}
+	return info.Size()
+}
+
+// TestVaultLogAppend тестирует дописывание вместо перезаписи vault
+func TestVaultLogAppend(t *testing.T) {
+	tmpDir := setupCoreTest(t)
+	defer cleanupCoreTest(t, tmpDir)
+
+	vaultPath := filepath.Join(tmpDir, "log.vault")
+	if err := CreateVaultWithKDF(vaultPath, Password(testPassword), testArgon2Params); err != nil {
+		t.Fatalf("CreateVaultWithKDF failed: %v", err)
+	}
+	headerDirectorySize := readTestHeader(t, vaultPath).DirectorySize
+
+	// Несжимаемый файл, чтобы копирование его данных было заметно по размеру
+	large := make([]byte, 512*1024)
+	rand.Read(large)
+	largePath := filepath.Join(tmpDir, "large.bin")
+	if err := os.WriteFile(largePath, large, 0644); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	if err := AddFileToVault(vaultPath, Password(testPassword), largePath); err != nil {
+		t.Fatalf("AddFileToVault (large) failed: %v", err)
+	}
+
+	// Запись старых данных не повторяется: файл растёт только на новый файл и директорию
+	before := vaultFileSize(t, vaultPath)
+	small := createTestFile(t, tmpDir, "small.txt", testContent)
+	if err := AddFileToVault(vaultPath, Password(testPassword), small); err != nil {
+		t.Fatalf("AddFileToVault (small) failed: %v", err)
+	}
+	if growth := vaultFileSize(t, vaultPath) - before; growth <= 0 || growth >= int64(len(large)) {
+		t.Errorf("Adding a small file grew the vault by %d bytes", growth)
+	}
+
+	// Замена, пакетное добавление, каталог и удаление тоже дописываются
+	if err := os.WriteFile(small, []byte("replaced content"), 0644); err != nil {
+		t.Fatalf("Failed to update file: %v", err)
+	}
+	if _, err := AddMultipleFilesToVaultParallel(vaultPath, Password(testPassword), []string{small}, DefaultParallelConfig()); err != nil {
+		t.Fatalf("AddMultipleFilesToVaultParallel failed: %v", err)
+	}
+	subDir := filepath.Join(tmpDir, "docs")
+	if err := os.MkdirAll(subDir, 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	createTestFile(t, subDir, "readme.md", "readme")
+	if _, err := AddDirectoryToVaultParallel(vaultPath, Password(testPassword), subDir, DefaultParallelConfig()); err != nil {
+		t.Fatalf("AddDirectoryToVaultParallel failed: %v", err)
+	}
+	before = vaultFileSize(t, vaultPath)
+	if err := RemoveFromVault(vaultPath, Password(testPassword), []string{"large.bin"}); err != nil {
+		t.Fatalf("RemoveFromVault failed: %v", err)
+	}
+	if vaultFileSize(t, vaultPath) <= before {
+		t.Error("RemoveFromVault should append a directory instead of rewriting the vault")
+	}
+
+	if readTestHeader(t, vaultPath).DirectorySize != headerDirectorySize {
+		t.Error("Appends must not rewrite the header directory")
+	}
+
+	entries, err := ListVault(vaultPath, Password(testPassword))
+	if err != nil {
+		t.Fatalf("ListVault failed: %v", err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("Expected 3 entries, got %d", len(entries))
+	}
+
+	outputDir := filepath.Join(tmpDir, "output")
+	if err := ExtractFromVault(vaultPath, Password(testPassword), outputDir); err != nil {
+		t.Fatalf("ExtractFromVault failed: %v", err)
+	}
+	for path, content := range map[string]string{"small.txt": "replaced content", "docs/readme.md": "readme"} {
+		data, err := os.ReadFile(filepath.Join(outputDir, path))
+		if err != nil || string(data) != content {
+			t.Errorf("Content mismatch for %s", path)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(outputDir, "large.bin")); err == nil {
+		t.Error("Removed file was extracted")
+	}
+}
+
+// TestVaultLogWithInbox тестирует чередование дописанных директорий и добавлений без пароля
+func TestVaultLogWithInbox(t *testing.T) {
+	tmpDir := setupCoreTest(t)
+	defer cleanupCoreTest(t, tmpDir)
+
+	vaultPath := filepath.Join(tmpDir, "log.vault")
+	if err := CreateVaultWithKDF(vaultPath, Password(testPassword), testArgon2Params); err != nil {
+		t.Fatalf("CreateVaultWithKDF failed: %v", err)
+	}
+
+	files := map[string]string{
+		"one.txt":   "added with key",
+		"two.txt":   "appended without key",
+		"three.txt": "added with key after append",
+		"four.txt":  "appended last",
+	}
+	for _, name := range []string{"one.txt", "two.txt", "three.txt", "four.txt"} {
+		path := createTestFile(t, tmpDir, name, files[name])
+		var err error
+		if name == "two.txt" || name == "four.txt" {
+			err = AppendToVault(vaultPath, path)
+		} else {
+			err = AddFileToVault(vaultPath, Password(testPassword), path)
+		}
+		if err != nil {
+			t.Fatalf("Adding %s failed: %v", name, err)
+		}
+	}
+
+	outputDir := filepath.Join(tmpDir, "output")
+	if err := ExtractFromVault(vaultPath, Password(testPassword), outputDir); err != nil {
+		t.Fatalf("ExtractFromVault failed: %v", err)
+	}
+	for name, content := range files {
+		data, err := os.ReadFile(filepath.Join(outputDir, name))
+		if err != nil || string(data) != content {
+			t.Errorf("Content mismatch for %s", name)
+		}
+	}
+}
+
+// TestVaultLogFailures тестирует прерванные и повреждённые дописывания
+func TestVaultLogFailures(t *testing.T) {
+	tmpDir := setupCoreTest(t)
+	defer cleanupCoreTest(t, tmpDir)
+
+	vaultPath := filepath.Join(tmpDir, "log.vault")
+	if err := CreateVaultWithKDF(vaultPath, Password(testPassword), testArgon2Params); err != nil {
+		t.Fatalf("CreateVaultWithKDF failed: %v", err)
+	}
+	testFile := createTestFile(t, tmpDir, "data.txt", testContent)
+	if err := AddFileToVault(vaultPath, Password(testPassword), testFile); err != nil {
+		t.Fatalf("AddFileToVault failed: %v", err)
+	}
+
+	// Ошибка при записи обрезает файл до прежнего размера
+	before := vaultFileSize(t, vaultPath)
+	vaultDir, header, key, err := openVaultDirectory(vaultPath, Password(testPassword))
+	if err != nil {
+		t.Fatalf("openVaultDirectory failed: %v", err)
+	}
+	batch, err := newStagingBatch(vaultPath, header, key, vaultDir, AddOptions{})
+	if err != nil {
+		t.Fatalf("newStagingBatch failed: %v", err)
+	}
+	files := batch.stageFiles([]string{createTestFile(t, tmpDir, "other.txt", "other content")}, "", 1, nil)
+	batch.close() // Подготовленные данные пропадают до записи
+	if err := batch.commit(vaultDir, files); err == nil {
+		t.Fatal("Expected error for missing staged data")
+	}
+	if vaultFileSize(t, vaultPath) != before {
+		t.Error("Failed append must not change the vault file")
+	}
+	if entries, err := ListVault(vaultPath, Password(testPassword)); err != nil || len(entries) != 1 {
+		t.Fatalf("Vault unreadable after failed append: %v", err)
+	}
+
+	// Повреждённая дописанная директория обнаруживается
+	data, _ := os.ReadFile(vaultPath)
+	data[len(data)-60] ^= 0xFF
+	if err := os.WriteFile(vaultPath, data, 0644); err != nil {
+		t.Fatalf("Failed to write vault: %v", err)
+	}
+	if _, err := ListVault(vaultPath, Password(testPassword)); !errors.Is(err, ErrHeaderTampered) {
+		t.Errorf("Expected ErrHeaderTampered for tampered directory, got %v", err)
+	}
+
+	// Недописанный хвост не откатывает vault к старой директории молча
+	data[len(data)-60] ^= 0xFF
+	data = append(data, []byte("partial payload")...)
+	if err := os.WriteFile(vaultPath, data, 0644); err != nil {
+		t.Fatalf("Failed to write vault: %v", err)
+	}
+	if _, err := ListVault(vaultPath, Password(testPassword)); err == nil {
+		t.Error("Expected error for a partially written append")
+	}
+}
+
+// countLogCommits возвращает число дописанных директорий vault
+func countLogCommits(t *testing.T, path string) int {
+	t.Helper()
+
+	file, header, err := openVaultFile(path)
+	if err != nil {
+		t.Fatalf("Failed to open vault: %v", err)
+	}
+	defer file.Close()
+
+	size := vaultFileSize(t, path)
+	ends, err := findTrailerEnds(file, header, size)
+	if err != nil {
+		t.Fatalf("Failed to scan vault: %v", err)
+	}
+	if endsInTrailer(file, header, size) {
+		return len(ends) + 1 // The trailer at the very end is not among the ends
+	}
+	return len(ends)
+}
+
+// TestParallelAddSingleWrite тестирует, что параллельное добавление дерева записывает
+// vault один раз, сколько бы в нём ни было каталогов
+func TestParallelAddSingleWrite(t *testing.T) {
+	tmpDir := setupCoreTest(t)
+	defer cleanupCoreTest(t, tmpDir)
+
+	vaultPath := filepath.Join(tmpDir, "tree.vault")
+	if err := CreateVaultWithKDF(vaultPath, Password(testPassword), testArgon2Params); err != nil {
+		t.Fatalf("CreateVaultWithKDF failed: %v", err)
+	}
+
+	expected := 0
+	for _, tree := range []struct {
+		name  string
+		dirs  int
+		files bool
+	}{{"small", 2, true}, {"wide", 40, true}, {"empty", 25, false}} {
+		root := filepath.Join(tmpDir, tree.name)
+		for i := 0; i < tree.dirs; i++ {
+			dir := filepath.Join(root, fmt.Sprintf("dir%d", i), "nested")
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				t.Fatalf("Failed to create directory: %v", err)
+			}
+			if tree.files {
+				createTestFile(t, dir, "file.txt", fmt.Sprintf("%s %d", testContent, i))
+			}
+		}
+		expected += 1 + 2*tree.dirs
+
+		before := countLogCommits(t, vaultPath)
+		stats, err := AddDirectoryToVaultParallel(vaultPath, Password(testPassword), root, DefaultParallelConfig())
+		if err != nil {
+			t.Fatalf("%s: AddDirectoryToVaultParallel failed: %v", tree.name, err)
+		}
+		if stats.FailedFiles != 0 {
+			t.Fatalf("%s: %d files failed: %v", tree.name, stats.FailedFiles, stats.Errors)
+		}
+		if commits := countLogCommits(t, vaultPath) - before; commits != 1 {
+			t.Errorf("%s: adding %d directories wrote the vault %d times", tree.name, 2*tree.dirs+1, commits)
+		}
+		if tree.files {
+			expected += tree.dirs
+		}
+	}
+
+	entries, err := ListVault(vaultPath, Password(testPassword))
+	if err != nil {
+		t.Fatalf("ListVault failed: %v", err)
+	}
+	if len(entries) != expected {
+		t.Fatalf("Expected %d entries, got %d", expected, len(entries))
+	}
+	for _, entry := range entries {
+		if entry.Path == "wide/dir7/nested" && !entry.IsDir {
+			t.Error("Directory entry lost its type")
+		}
+	}
+}
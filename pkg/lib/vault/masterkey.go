@@ -0,0 +1,136 @@
+package vault
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"os"
+)
+
+// ========================
+// MASTER KEY WRAPPING
+// ========================
+//
+// Since v3 the directory and all payloads are encrypted with a random master key.
+// The header stores that key sealed ("wrapped") in key slots with keys derived
+// from passwords or keyfiles, so changing a password only rewrites the header.
+// The KDF parameters and salt of a slot are bound to its wrapped key as associated data.
+
+// MasterKeyVersion is the first vault format version with a wrapped master key
+const MasterKeyVersion = 3
+
+// newMasterKey generates a random master key
+func newMasterKey() ([]byte, error) {
+	key := make([]byte, KeyLength)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("master key generation error: %w", err)
+	}
+	return key, nil
+}
+
+// newKeyWrapGCM creates the cipher used to wrap the master key
+func newKeyWrapGCM(kek []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, fmt.Errorf("AES cipher creation error: %w", err)
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("GCM creation error: %w", err)
+	}
+	return gcm, nil
+}
+
+// unlockVaultKey returns the key that encrypts the directory and payloads.
+// Legacy vaults use the password-derived key directly; v3+ vaults unwrap the master key.
+func unlockVaultKey(keySource KeySource, header *VaultHeader) ([]byte, error) {
+	key, _, err := header.unlockKeySlot(keySource)
+	return key, err
+}
+
+// ChangeVaultPassword re-wraps the vault master key in the key slot unlocked by oldKey
+// with a new key source (password, keyfile or both), keeping the slot's key derivation parameters. Only the header is
+// rewritten; the directory and file payloads are left untouched.
+func ChangeVaultPassword(vaultPath string, oldKey, newKey KeySource) error {
+	return ChangeVaultPasswordWithKDF(vaultPath, oldKey, newKey, nil)
+}
+
+// ChangeVaultPasswordWithKDF changes the vault password and optionally switches the
+// key derivation function or its cost parameters (for example to bump PBKDF2 iterations).
+// A nil params keeps the current parameters.
+func ChangeVaultPasswordWithKDF(vaultPath string, oldKey, newKey KeySource, params *KDFParams) error {
+	if newKey == nil {
+		return fmt.Errorf("new key source cannot be nil")
+	}
+
+	// Lock the vault against other goroutines and processes
+	unlock, err := lockVault(vaultPath, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// Verify the old key and the vault integrity before touching anything
+	_, header, masterKey, slot, err := openVaultKeySlot(vaultPath, oldKey)
+	if err != nil {
+		return err
+	}
+	defer clearKey(masterKey)
+
+	if header.Version < MasterKeyVersion {
+		return fmt.Errorf("password change requires vault format v%d or newer (vault is v%d)", MasterKeyVersion, header.Version)
+	}
+
+	if header.KeySlots[slot].Kind == KeySlotRecipient {
+		return fmt.Errorf("recipient key slots have no password to change")
+	}
+
+	newParams := header.KeySlots[slot].kdfParams()
+	if params != nil {
+		newParams = *params
+	}
+	if err := newParams.Validate(); err != nil {
+		return fmt.Errorf("invalid key derivation parameters: %w", err)
+	}
+
+	if err := header.wrapMasterKey(slot, newKey, newParams, masterKey); err != nil {
+		return err
+	}
+
+	return rewriteVaultHeader(vaultPath, header, masterKey)
+}
+
+// rewriteVaultHeader overwrites the header of a v3+ vault in place. The header has a
+// fixed size and the key slots are not bound to the directory, so no data moves. The new
+// header is saved next to the vault first, so a crash that tears the header leaves a
+// complete copy for RecoverVault to write back.
+func rewriteVaultHeader(vaultPath string, header *VaultHeader, masterKey []byte) error {
+	header.Checksum = header.computeChecksum(masterKey)
+	encoded := header.encode()
+
+	if err := writeHeaderCopy(vaultPath, encoded); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(vaultPath, os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("vault file open error: %w", err)
+	}
+	defer file.Close()
+
+	if _, err := file.WriteAt(encoded, 0); err != nil {
+		return fmt.Errorf("header write error: %w", err)
+	}
+
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("vault file sync error: %w", err)
+	}
+
+	// The header is durable; a copy left by a crash from here on is discarded by recovery
+	if err := os.Remove(headerCopyPath(vaultPath)); err != nil {
+		return fmt.Errorf("header copy removal error: %w", err)
+	}
+	return nil
+}
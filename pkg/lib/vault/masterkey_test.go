@@ -0,0 +1,130 @@
+package vault
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestChangeVaultPassword тестирует смену пароля без перезаписи данных
+func TestChangeVaultPassword(t *testing.T) {
+	tmpDir := setupCoreTest(t)
+	defer cleanupCoreTest(t, tmpDir)
+
+	vaultPath := filepath.Join(tmpDir, "passwd.vault")
+	if err := CreateVault(vaultPath, Password(testPassword)); err != nil {
+		t.Fatalf("CreateVault failed: %v", err)
+	}
+	testFile := createTestFile(t, tmpDir, "data.txt", testContent)
+	if err := AddFileToVault(vaultPath, Password(testPassword), testFile); err != nil {
+		t.Fatalf("AddFileToVault failed: %v", err)
+	}
+
+	before, err := os.ReadFile(vaultPath)
+	if err != nil {
+		t.Fatalf("Failed to read vault: %v", err)
+	}
+	header := readTestHeader(t, vaultPath)
+	headerLen := header.encodedSize()
+
+	const newPassword = "NewPassword456!"
+	if err := ChangeVaultPassword(vaultPath, Password(testPassword), Password(newPassword)); err != nil {
+		t.Fatalf("ChangeVaultPassword failed: %v", err)
+	}
+
+	// Директория и данные файлов не должны меняться
+	after, err := os.ReadFile(vaultPath)
+	if err != nil {
+		t.Fatalf("Failed to read vault: %v", err)
+	}
+	if len(after) != len(before) || !bytes.Equal(after[headerLen:], before[headerLen:]) {
+		t.Fatal("Password change must only rewrite the header")
+	}
+
+	if _, err := ListVault(vaultPath, Password(testPassword)); !errors.Is(err, ErrInvalidPassword) {
+		t.Errorf("Expected ErrInvalidPassword for old password, got %v", err)
+	}
+
+	outputDir := filepath.Join(tmpDir, "output")
+	if err := ExtractFromVault(vaultPath, Password(newPassword), outputDir); err != nil {
+		t.Fatalf("ExtractFromVault with new password failed: %v", err)
+	}
+	content, err := os.ReadFile(filepath.Join(outputDir, "data.txt"))
+	if err != nil || string(content) != testContent {
+		t.Fatal("Extracted content mismatch")
+	}
+
+	// Неправильный текущий пароль не должен менять vault
+	if err := ChangeVaultPassword(vaultPath, Password("WrongPassword!"), Password("Another789!")); !errors.Is(err, ErrInvalidPassword) {
+		t.Errorf("Expected ErrInvalidPassword, got %v", err)
+	}
+	unchanged, _ := os.ReadFile(vaultPath)
+	if !bytes.Equal(unchanged, after) {
+		t.Error("Vault modified by failed password change")
+	}
+
+	if err := ChangeVaultPassword(vaultPath, Password(newPassword), Password("")); err == nil {
+		t.Error("Expected error for empty new password")
+	}
+}
+
+// TestChangeVaultPasswordWithKDF тестирует смену параметров KDF вместе с паролем
+func TestChangeVaultPasswordWithKDF(t *testing.T) {
+	tmpDir := setupCoreTest(t)
+	defer cleanupCoreTest(t, tmpDir)
+
+	vaultPath := filepath.Join(tmpDir, "rekdf.vault")
+	if err := CreateVault(vaultPath, Password(testPassword)); err != nil {
+		t.Fatalf("CreateVault failed: %v", err)
+	}
+	testFile := createTestFile(t, tmpDir, "data.txt", testContent)
+	if err := AddFileToVault(vaultPath, Password(testPassword), testFile); err != nil {
+		t.Fatalf("AddFileToVault failed: %v", err)
+	}
+
+	// Увеличиваем число итераций PBKDF2, пароль прежний
+	bumped := KDFParams{Algorithm: KDFPBKDF2, Iterations: 2 * PBKDF2Iters}
+	if err := ChangeVaultPasswordWithKDF(vaultPath, Password(testPassword), Password(testPassword), &bumped); err != nil {
+		t.Fatalf("ChangeVaultPasswordWithKDF failed: %v", err)
+	}
+	info, err := GetVaultInfo(vaultPath)
+	if err != nil {
+		t.Fatalf("GetVaultInfo failed: %v", err)
+	}
+	if info.KDF != bumped {
+		t.Errorf("Expected KDF %+v, got %+v", bumped, info.KDF)
+	}
+
+	// Переход на Argon2id
+	if err := ChangeVaultPasswordWithKDF(vaultPath, Password(testPassword), Password(testPassword), &testArgon2Params); err != nil {
+		t.Fatalf("ChangeVaultPasswordWithKDF (argon2id) failed: %v", err)
+	}
+	entries, err := ListVault(vaultPath, Password(testPassword))
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("ListVault after KDF change failed: %v", err)
+	}
+
+	// Некорректные параметры отклоняются
+	invalid := KDFParams{Algorithm: KDFPBKDF2, Iterations: 10}
+	if err := ChangeVaultPasswordWithKDF(vaultPath, Password(testPassword), Password(testPassword), &invalid); err == nil {
+		t.Error("Expected error for invalid KDF parameters")
+	}
+}
+
+// TestChangeVaultPasswordLegacy проверяет что для vault v2 смена пароля не поддерживается
+func TestChangeVaultPasswordLegacy(t *testing.T) {
+	tmpDir := setupCoreTest(t)
+	defer cleanupCoreTest(t, tmpDir)
+
+	vaultPath := filepath.Join(tmpDir, "legacy.vault")
+	createLegacyVault(t, vaultPath, testPassword)
+
+	if err := ChangeVaultPassword(vaultPath, Password(testPassword), Password("NewPassword456!")); err == nil {
+		t.Error("Expected error for legacy vault")
+	}
+	if _, err := ListVault(vaultPath, Password(testPassword)); err != nil {
+		t.Errorf("Legacy vault must remain usable: %v", err)
+	}
+}
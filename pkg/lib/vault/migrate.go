@@ -0,0 +1,290 @@
+package vault
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+)
+
+// ========================
+// FORMAT MIGRATION
+// ========================
+//
+// Migration rewrites a vault in a newer format version in place, through a temp file
+// that replaces the vault only once it is complete. The data of every file is read and
+// checked against its SHA-256 hash on the way, so a vault with damaged data is never
+// migrated.
+//
+// v3+ vaults keep their master key: payloads and chunks are verified and then copied
+// as they are, like a compaction with CompactOptions.Upgrade, and every key slot keeps
+// working. Legacy v1/v2 vaults get a header with key slots and a new master key wrapped
+// for the same password, using the same key derivation parameters. Their stored
+// payloads are already compressed, so they are only encrypted while they are copied
+// and keep their compression. Files keep whole-file payloads in both cases; only files
+// added later are stored as chunks.
+
+// MigrateOptions controls a format migration
+type MigrateOptions struct {
+	// Check only reports what the migration would change
+	Check bool
+
+	// Context cancels the migration; the vault is left unchanged
+	Context context.Context
+}
+
+// MigrationReport describes a migration
+type MigrationReport struct {
+	FromVersion  uint32   // Format version of the vault before migration
+	ToVersion    uint32   // Format version after migration
+	Entries      int      // Number of entries in the directory, all kept
+	Files        int      // Number of files whose data is verified against its hash
+	Changes      []string // What the migration changes, empty if the vault is already in the target version
+	OriginalSize int64    // Vault file size before migration
+	MigratedSize int64    // Vault file size after migration (zero for a check)
+}
+
+// MigrateVault rewrites the vault in the target format version, or the current one if
+// targetVersion is zero. Every file's data is verified against its SHA-256 hash first;
+// the vault is only replaced once the migrated copy is complete.
+func MigrateVault(vaultPath string, keySource KeySource, targetVersion uint32, opts MigrateOptions) (*MigrationReport, error) {
+	if keySource == nil {
+		return nil, fmt.Errorf("key source cannot be nil")
+	}
+	if targetVersion == 0 {
+		targetVersion = CurrentVaultVersion
+	}
+
+	v, err := OpenVault(vaultPath, keySource)
+	if err != nil {
+		return nil, err
+	}
+	defer v.Close()
+
+	return v.migrate(keySource, targetVersion, opts)
+}
+
+// migrate migrates the open vault; legacy vaults need the key source to wrap the new
+// master key
+func (v *Vault) migrate(keySource KeySource, targetVersion uint32, opts MigrateOptions) (*MigrationReport, error) {
+	// Lock the vault against other goroutines and processes
+	unlock, err := v.lock(true)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	report := &MigrationReport{
+		FromVersion:  v.header.Version,
+		ToVersion:    targetVersion,
+		Entries:      len(v.dir.Entries),
+		OriginalSize: v.stamp.Size(),
+	}
+	for _, entry := range v.dir.Entries {
+		if entry.isFile() {
+			report.Files++
+		}
+	}
+
+	switch {
+	case targetVersion > CurrentVaultVersion:
+		return nil, fmt.Errorf("unsupported target version: %d (supported: %d-%d)", targetVersion, MasterKeyVersion, CurrentVaultVersion)
+	case targetVersion < v.header.Version:
+		return nil, fmt.Errorf("vault version %d cannot be migrated back to version %d", v.header.Version, targetVersion)
+	case targetVersion == v.header.Version:
+		return report, nil // Nothing to change
+	case targetVersion < MasterKeyVersion:
+		return nil, fmt.Errorf("unsupported target version: %d (supported: %d-%d)", targetVersion, MasterKeyVersion, CurrentVaultVersion)
+	}
+
+	report.Changes = migrationChanges(v.header.Version, targetVersion)
+	if opts.Check {
+		return report, nil
+	}
+
+	ctx := orBackground(opts.Context)
+	if v.header.Version >= MasterKeyVersion {
+		err = v.migrateKeepingKey(ctx, targetVersion)
+	} else {
+		err = v.migrateLegacy(ctx, keySource, targetVersion)
+	}
+	if err := v.written(err); err != nil {
+		return nil, fmt.Errorf("vault migration error: %w", err)
+	}
+	report.MigratedSize = v.stamp.Size()
+
+	return report, nil
+}
+
+// migrationChanges describes the format changes between two versions
+func migrationChanges(from, to uint32) []string {
+	var changes []string
+	if from < MasterKeyVersion {
+		changes = append(changes,
+			"authenticated header with key slots; a new master key is wrapped for the same password",
+			"file payloads encrypted with per-file keys (compressed data is kept as stored)",
+			"public inbox key for appends without the password")
+	} else {
+		changes = append(changes, "payloads and chunks copied unchanged; all key slots keep working")
+	}
+	if from < ChunkedVersion && to >= ChunkedVersion {
+		changes = append(changes, "files added from now on are stored as deduplicated chunks")
+	}
+	if from < PagedDirectoryVersion && to >= PagedDirectoryVersion {
+		changes = append(changes, "directory stored in sorted, separately sealed pages")
+	}
+	return changes
+}
+
+// verifyEntryData reads the data of a file entry and checks it against its hash
+func (v *Vault) verifyEntryData(ctx context.Context, entry FileEntry, buffer []byte) error {
+	data, err := v.openEntryData(entry)
+	if err != nil {
+		return fmt.Errorf("%s: %w", entry.Path, err)
+	}
+	defer data.Close()
+
+	hasher := sha256.New()
+	if _, err := io.CopyBuffer(hasher, newContextReader(ctx, data), buffer); err != nil {
+		return fmt.Errorf("%s: file data read error: %w", entry.Path, err)
+	}
+	if !compareHashesConstantTime(hasher.Sum(nil), entry.SHA256Hash[:]) {
+		return fmt.Errorf("%s: integrity check failed: file data corrupted", entry.Path)
+	}
+	return nil
+}
+
+// migrateKeepingKey verifies the files of a v3+ vault and rewrites it in the target
+// version with its payloads, chunks and key slots unchanged; the caller holds the
+// exclusive vault lock
+func (v *Vault) migrateKeepingKey(ctx context.Context, targetVersion uint32) error {
+	buffer := make([]byte, StreamBufferSize)
+	for _, entry := range v.dir.Entries {
+		if !entry.isFile() {
+			continue
+		}
+		if err := v.verifyEntryData(ctx, entry, buffer); err != nil {
+			return err
+		}
+	}
+
+	vaultDir := *v.dir
+	vaultDir.Version = targetVersion
+	return updateVaultDirectoryStreamingOptimized(ctx, v.path, v.key, vaultDir)
+}
+
+// migrateLegacy rewrites a v1/v2 vault in the target version with a new master key.
+// Each payload is encrypted as it is copied while its data is decompressed and checked
+// against its hash. The caller holds the exclusive vault lock.
+func (v *Vault) migrateLegacy(ctx context.Context, keySource KeySource, targetVersion uint32) error {
+	vaultDir := *v.dir.clone()
+	vaultDir.Version = targetVersion
+
+	// Encrypting only adds the chunk tags, so the new layout is known before copying
+	var offset int64
+	for i := range vaultDir.Entries {
+		entry := &vaultDir.Entries[i]
+		if !entry.hasPayload() {
+			continue
+		}
+		salt, err := newPayloadSalt()
+		if err != nil {
+			return err
+		}
+		entry.PayloadSalt = salt
+		entry.Offset = offset
+		entry.CompressedSize = encryptedPayloadSize(entry.CompressedSize)
+		offset += entry.CompressedSize
+	}
+
+	header, key, err := newVaultHeader(keySource, &vaultDir, v.header.KeySlots[0].kdfParams(), nil)
+	if err != nil {
+		return err
+	}
+	encryptedDir, err := sealVaultDirectory(key, header, vaultDir)
+	if err != nil {
+		clearKey(key)
+		return err
+	}
+
+	// Create a uniquely named temporary file for the new vault
+	tempFile, err := createVaultTempFile(v.path)
+	if err != nil {
+		clearKey(key)
+		return err
+	}
+	defer os.Remove(tempFile.Name()) // Clean up temp file
+	defer tempFile.Close()
+
+	err = v.writeMigratedLegacy(ctx, tempFile, header, encryptedDir, key, vaultDir.Entries)
+	if err == nil {
+		err = replaceVaultFile(tempFile, v.path)
+	}
+	if err != nil {
+		clearKey(key)
+		return err
+	}
+
+	// The handle goes on with the master key of the migrated vault
+	v.mu.Lock()
+	clearKey(v.key)
+	v.key, v.slot = key, 0
+	v.mu.Unlock()
+	return nil
+}
+
+// writeMigratedLegacy writes the migrated vault to target: the header, the directory
+// and the payloads of the legacy vault, encrypted in the order of the migrated entries
+func (v *Vault) writeMigratedLegacy(ctx context.Context, target *os.File, header *VaultHeader, encryptedDir, key []byte, entries []FileEntry) error {
+	if err := writeVaultHeader(target, header); err != nil {
+		return fmt.Errorf("header write error: %w", err)
+	}
+	if _, err := target.Write(encryptedDir); err != nil {
+		return fmt.Errorf("directory write error: %w", err)
+	}
+
+	dataStart := v.header.encodedSize() + int64(v.header.DirectorySize)
+	buffer := make([]byte, StreamBufferSize)
+	for i, entry := range entries {
+		if !entry.hasPayload() {
+			continue
+		}
+		legacy := v.dir.Entries[i]
+
+		var written int64
+		sealer, err := newPayloadWriter(io.MultiWriter(target, &countingWriter{count: &written}), key, entry.PayloadSalt)
+		if err != nil {
+			return err
+		}
+
+		// The stored bytes go to the sealer as they are and, on the way, to the hash check
+		stored := io.TeeReader(newContextReader(ctx, io.NewSectionReader(v.file, dataStart+legacy.Offset, legacy.CompressedSize)), sealer)
+		decompressor, err := newDecompressor(stored, legacy.Compression)
+		if err != nil {
+			return fmt.Errorf("%s: streaming decompression setup error: %w", entry.Path, err)
+		}
+		hasher := sha256.New()
+		_, err = io.CopyBuffer(hasher, decompressor, buffer)
+		decompressor.Close()
+		if err != nil {
+			return fmt.Errorf("%s: file data read error: %w", entry.Path, err)
+		}
+		if !compareHashesConstantTime(hasher.Sum(nil), entry.SHA256Hash[:]) {
+			return fmt.Errorf("%s: integrity check failed: file data corrupted", entry.Path)
+		}
+
+		// Whatever the decompressor left unread still belongs to the payload
+		if _, err := io.CopyBuffer(io.Discard, stored, buffer); err != nil {
+			return fmt.Errorf("%s: file data read error: %w", entry.Path, err)
+		}
+		if err := sealer.Close(); err != nil {
+			return fmt.Errorf("payload encryption finalization error: %w", err)
+		}
+		if written != entry.CompressedSize {
+			return fmt.Errorf("%s: migrated payload takes %d bytes instead of %d", entry.Path, written, entry.CompressedSize)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,203 @@
+package vault
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// createMigrationSource создаёт vault заданной версии с каталогом из нескольких файлов
+func createMigrationSource(t *testing.T, tmpDir string, version uint32) (string, map[string]string) {
+	t.Helper()
+
+	vaultPath := filepath.Join(tmpDir, fmt.Sprintf("migrate-v%d.vault", version))
+	params := testArgon2Params
+	if version < MasterKeyVersion {
+		params = DefaultKDFParams() // Legacy vaults only support PBKDF2
+	}
+	vaultDir := VaultDirectory{Version: version, Entries: []FileEntry{}, CreatedAt: time.Unix(1700000000, 0), Comment: "migrated"}
+	if err := saveVaultDirectory(vaultPath, Password(testPassword), vaultDir, params, nil); err != nil {
+		t.Fatalf("saveVaultDirectory failed: %v", err)
+	}
+
+	sourceDir := filepath.Join(tmpDir, fmt.Sprintf("source-v%d", version))
+	os.MkdirAll(filepath.Join(sourceDir, "sub"), 0755)
+	contents := make(map[string]string)
+	for i := 0; i < 4; i++ {
+		name := fmt.Sprintf("file%d.txt", i)
+		if i%2 == 1 {
+			name = "sub/" + name
+		}
+		contents[filepath.Base(sourceDir)+"/"+name] = fmt.Sprintf("%s %d", testContent, i)
+		createTestFile(t, sourceDir, filepath.FromSlash(name), contents[filepath.Base(sourceDir)+"/"+name])
+	}
+	contents[filepath.Base(sourceDir)+"/empty.txt"] = ""
+	createTestFile(t, sourceDir, "empty.txt", "")
+	if err := AddDirectoryToVault(vaultPath, Password(testPassword), sourceDir); err != nil {
+		t.Fatalf("AddDirectoryToVault failed: %v", err)
+	}
+	return vaultPath, contents
+}
+
+// checkMigratedContents извлекает vault и сравнивает содержимое файлов
+func checkMigratedContents(t *testing.T, vaultPath string, keySource KeySource, outputDir string, contents map[string]string) {
+	t.Helper()
+
+	if err := ExtractFromVault(vaultPath, keySource, outputDir); err != nil {
+		t.Fatalf("ExtractFromVault failed: %v", err)
+	}
+	for path, content := range contents {
+		data, err := os.ReadFile(filepath.Join(outputDir, filepath.FromSlash(path)))
+		if err != nil || string(data) != content {
+			t.Errorf("Content mismatch for %s (%v)", path, err)
+		}
+	}
+}
+
+// TestMigrateLegacyVault тестирует перевод vault v2 в текущий формат: проверка ничего
+// не меняет, данные шифруются, а метаданные и пароль сохраняются
+func TestMigrateLegacyVault(t *testing.T) {
+	tmpDir := setupCoreTest(t)
+	defer cleanupCoreTest(t, tmpDir)
+
+	vaultPath, contents := createMigrationSource(t, tmpDir, 2)
+	before, _ := os.ReadFile(vaultPath)
+
+	// Проверка только сообщает об изменениях
+	report, err := MigrateVault(vaultPath, Password(testPassword), 0, MigrateOptions{Check: true})
+	if err != nil {
+		t.Fatalf("MigrateVault check failed: %v", err)
+	}
+	if report.FromVersion != 2 || report.ToVersion != CurrentVaultVersion || report.Files != 5 || len(report.Changes) == 0 || report.MigratedSize != 0 {
+		t.Errorf("Unexpected check report: %+v", report)
+	}
+	if after, _ := os.ReadFile(vaultPath); !bytes.Equal(before, after) {
+		t.Fatal("Check changed the vault")
+	}
+
+	report, err = MigrateVault(vaultPath, Password(testPassword), 0, MigrateOptions{})
+	if err != nil {
+		t.Fatalf("MigrateVault failed: %v", err)
+	}
+	if report.MigratedSize != vaultFileSize(t, vaultPath) {
+		t.Errorf("Report gives size %d, vault has %d bytes", report.MigratedSize, vaultFileSize(t, vaultPath))
+	}
+
+	info, err := GetVaultInfo(vaultPath)
+	if err != nil || info.Version != CurrentVaultVersion || !info.PayloadsEncrypted || !info.PagedDirectory {
+		t.Fatalf("Vault was not migrated: %+v (%v)", info, err)
+	}
+	if info.KDF != DefaultKDFParams() {
+		t.Errorf("Key derivation changed: %+v", info.KDF)
+	}
+	vaultDir, err := loadVaultDirectory(vaultPath, Password(testPassword))
+	if err != nil {
+		t.Fatalf("loadVaultDirectory failed: %v", err)
+	}
+	if vaultDir.Comment != "migrated" || !vaultDir.CreatedAt.Equal(time.Unix(1700000000, 0)) || len(vaultDir.InboxKey) == 0 {
+		t.Errorf("Directory metadata not kept: %+v", vaultDir)
+	}
+	checkMigratedContents(t, vaultPath, Password(testPassword), filepath.Join(tmpDir, "output"), contents)
+
+	// Перенесённый vault принимает добавления по публичному ключу
+	inbox := createTestFile(t, tmpDir, "inbox.txt", "appended after migration")
+	if err := AppendToVault(vaultPath, inbox); err != nil {
+		t.Fatalf("AppendToVault failed: %v", err)
+	}
+
+	// Повторный перенос ничего не меняет
+	if report, err := MigrateVault(vaultPath, Password(testPassword), 0, MigrateOptions{}); err != nil || len(report.Changes) != 0 {
+		t.Errorf("Migrating a current vault changed it: %+v (%v)", report, err)
+	}
+	if _, err := MigrateVault(vaultPath, Password(testPassword), 4, MigrateOptions{}); err == nil {
+		t.Error("Expected an error migrating to an older version")
+	}
+}
+
+// TestMigrateKeepsKeySlots тестирует перевод vault v3 в v4 и v5: данные копируются
+// без изменений, а все слоты ключей продолжают открывать vault
+func TestMigrateKeepsKeySlots(t *testing.T) {
+	tmpDir := setupCoreTest(t)
+	defer cleanupCoreTest(t, tmpDir)
+
+	vaultPath, contents := createMigrationSource(t, tmpDir, PayloadEncryptionVersion)
+	secondKey := Password("second password")
+	if _, err := AddKeySlot(vaultPath, Password(testPassword), secondKey, testArgon2Params); err != nil {
+		t.Fatalf("AddKeySlot failed: %v", err)
+	}
+
+	for _, target := range []uint32{ChunkedVersion, CurrentVaultVersion} {
+		report, err := MigrateVault(vaultPath, secondKey, target, MigrateOptions{})
+		if err != nil {
+			t.Fatalf("v%d: MigrateVault failed: %v", target, err)
+		}
+		if report.ToVersion != target || len(report.Changes) == 0 {
+			t.Errorf("v%d: unexpected report: %+v", target, report)
+		}
+		if info, _ := GetVaultInfo(vaultPath); info.Version != target {
+			t.Fatalf("v%d: vault has version %d", target, info.Version)
+		}
+		checkMigratedContents(t, vaultPath, Password(testPassword), filepath.Join(tmpDir, fmt.Sprintf("output-v%d", target)), contents)
+	}
+
+	extra := createTestFile(t, tmpDir, "extra.txt", "added after migration")
+	if err := AddFileToVault(vaultPath, secondKey, extra); err != nil {
+		t.Fatalf("AddFileToVault failed: %v", err)
+	}
+	contents["extra.txt"] = "added after migration"
+	checkMigratedContents(t, vaultPath, secondKey, filepath.Join(tmpDir, "output-extra"), contents)
+}
+
+// TestMigrateRejectsDamagedData тестирует, что повреждённые или прерванные переносы
+// оставляют vault без изменений
+func TestMigrateRejectsDamagedData(t *testing.T) {
+	tmpDir := setupCoreTest(t)
+	defer cleanupCoreTest(t, tmpDir)
+
+	for _, version := range []uint32{2, ChunkedVersion} {
+		vaultPath, _ := createMigrationSource(t, tmpDir, version)
+
+		// Отменённый перенос
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		before, _ := os.ReadFile(vaultPath)
+		if _, err := MigrateVault(vaultPath, Password(testPassword), 0, MigrateOptions{Context: ctx}); !errors.Is(err, context.Canceled) {
+			t.Errorf("v%d: expected context.Canceled, got %v", version, err)
+		}
+		if after, _ := os.ReadFile(vaultPath); !bytes.Equal(before, after) {
+			t.Fatalf("v%d: cancelled migration changed the vault", version)
+		}
+
+		// Повреждённые данные файла
+		vaultDir, err := loadVaultDirectory(vaultPath, Password(testPassword))
+		if err != nil {
+			t.Fatalf("v%d: loadVaultDirectory failed: %v", version, err)
+		}
+		header := readTestHeader(t, vaultPath)
+		damaged := bytes.Clone(before)
+		for _, entry := range vaultDir.Entries {
+			if entry.hasPayload() && entry.Size > 0 {
+				damaged[header.encodedSize()+int64(header.DirectorySize)+entry.Offset+entry.CompressedSize/2] ^= 1
+				break
+			}
+			if len(entry.Chunks) > 0 && entry.Size > 0 {
+				damaged[header.encodedSize()+int64(header.DirectorySize)+entry.Chunks[0].Offset+entry.Chunks[0].StoredSize/2] ^= 1
+				break
+			}
+		}
+		if err := os.WriteFile(vaultPath, damaged, 0600); err != nil {
+			t.Fatalf("Failed to damage vault: %v", err)
+		}
+		if _, err := MigrateVault(vaultPath, Password(testPassword), 0, MigrateOptions{}); err == nil {
+			t.Errorf("v%d: expected an error migrating damaged data", version)
+		}
+		if after, _ := os.ReadFile(vaultPath); !bytes.Equal(damaged, after) {
+			t.Errorf("v%d: failed migration changed the vault", version)
+		}
+	}
+}
@@ -0,0 +1,720 @@
+package vault
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// ========================
+// PAGED DIRECTORY
+// ========================
+//
+// Up to v4 the directory is a single gzip'd JSON document, so listing one file means
+// decrypting and parsing all of them. Since v5 it is a two-level structure like a
+// shallow B-tree: the entries are sorted by path, encoded in a compact binary form and
+// cut into pages of about DirectoryPageSize bytes, each sealed on its own, and a root
+// holds the vault metadata and the first path of every page. The root takes the place
+// of the JSON document, sealed with the nonce and associated data of the header or
+// log trailer, and the pages follow it:
+//
+//	root size (uint32) | sealed root | sealed page 0 | sealed page 1 | ...
+//
+// Pages are sealed with a key derived from the vault key and a random salt kept in the
+// root, and numbered by their nonce, so a page only opens at its place in the directory
+// it was written with. Looking up paths or listing a prefix reads the root and then only
+// the pages that can hold them. Within a page each path is stored as the length of the
+// prefix it shares with the previous one plus the rest.
+
+const (
+	// PagedDirectoryVersion is the first vault format version with a paged directory
+	PagedDirectoryVersion = 5
+
+	// DirectoryPageSize is the encoded size at which a directory page is closed (64KB)
+	DirectoryPageSize = 64 * 1024
+
+	// directoryPageKeyInfo is the HKDF info string for the key of the directory pages
+	directoryPageKeyInfo = "flint-vault directory page key v5"
+)
+
+// Flags of an encoded entry
+const (
+	entryFlagDir     = 1 << iota // IsDir
+	entryFlagSymlink             // IsSymlink; the link target follows
+	entryFlagName                // Name is not the last element of the path and follows
+	entryFlagHash                // SHA256Hash is set and follows
+	entryFlagSalt                // PayloadSalt is set and follows
+)
+
+// errMalformedDirectory is returned for encoded directory data that does not parse
+var errMalformedDirectory = errors.New("truncated or malformed directory data")
+
+// usesPagedDirectory reports whether the vault stores its directory in pages
+func (h *VaultHeader) usesPagedDirectory() bool {
+	return h.Version >= PagedDirectoryVersion
+}
+
+// encodedDirectory is a directory ready to be sealed with the nonce of the header or
+// trailer: the compressed JSON document, or the compressed root of a paged directory
+// together with its sealed pages
+type encodedDirectory struct {
+	paged bool
+	body  []byte
+	pages [][]byte
+}
+
+// encodeDirectory serializes and compresses the directory in the format of the version
+func encodeDirectory(key []byte, version uint32, vaultDir VaultDirectory) (*encodedDirectory, error) {
+	if version >= PagedDirectoryVersion {
+		return encodePagedDirectory(key, vaultDir)
+	}
+
+	// Serialize directory
+	jsonData, err := json.Marshal(vaultDir)
+	if err != nil {
+		return nil, fmt.Errorf("directory serialization error: %w", err)
+	}
+
+	// Compress directory
+	compressedDir, err := compressData(jsonData)
+	if err != nil {
+		return nil, fmt.Errorf("directory compression error: %w", err)
+	}
+	return &encodedDirectory{body: compressedDir}, nil
+}
+
+// sealedSize returns the size of the sealed directory for a cipher with the given overhead
+func (d *encodedDirectory) sealedSize(overhead int) uint64 {
+	size := uint64(len(d.body) + overhead)
+	if d.paged {
+		size += 4
+		for _, page := range d.pages {
+			size += uint64(len(page))
+		}
+	}
+	return size
+}
+
+// seal seals the directory (the root of a paged one) and appends the pages
+func (d *encodedDirectory) seal(gcm cipher.AEAD, nonce, associatedData []byte) []byte {
+	if !d.paged {
+		return gcm.Seal(nil, nonce, d.body, associatedData)
+	}
+
+	sealed := make([]byte, 4, d.sealedSize(gcm.Overhead()))
+	binary.LittleEndian.PutUint32(sealed, uint32(len(d.body)+gcm.Overhead()))
+	sealed = gcm.Seal(sealed, nonce, d.body, associatedData)
+	for _, page := range d.pages {
+		sealed = append(sealed, page...)
+	}
+	return sealed
+}
+
+// readSealedDirectory reads the part of the directory at offset that is sealed with the
+// nonce of the header or trailer: the whole JSON document, or the root of a paged
+// directory. It also returns the offset of the pages.
+func readSealedDirectory(file io.ReaderAt, version uint32, offset int64, size uint64) ([]byte, int64, error) {
+	if version >= PagedDirectoryVersion {
+		var rootSize [4]byte
+		if size < uint64(len(rootSize)) {
+			return nil, 0, fmt.Errorf("encrypted directory read error: %w", errMalformedDirectory)
+		}
+		if _, err := file.ReadAt(rootSize[:], offset); err != nil {
+			return nil, 0, fmt.Errorf("encrypted directory read error: %w", err)
+		}
+		if uint64(binary.LittleEndian.Uint32(rootSize[:])) > size-uint64(len(rootSize)) {
+			return nil, 0, fmt.Errorf("encrypted directory read error: root exceeds the directory")
+		}
+		offset += int64(len(rootSize))
+		size = uint64(binary.LittleEndian.Uint32(rootSize[:]))
+	}
+
+	sealed := make([]byte, size)
+	if _, err := file.ReadAt(sealed, offset); err != nil {
+		return nil, 0, fmt.Errorf("encrypted directory read error: %w", err)
+	}
+	return sealed, offset + int64(size), nil
+}
+
+// decodeDirectory decodes an opened directory; the pages of a paged directory, between
+// pagesStart and end, are read in full
+func decodeDirectory(file io.ReaderAt, key []byte, version uint32, body []byte, pagesStart, end int64) (*VaultDirectory, error) {
+	if version >= PagedDirectoryVersion {
+		root, err := decodePagedRoot(file, key, body, pagesStart, end)
+		if err != nil {
+			return nil, err
+		}
+		return root.load()
+	}
+
+	// Decompress directory data
+	jsonData, err := decompressData(body)
+	if err != nil {
+		return nil, fmt.Errorf("directory decompression error: %w", err)
+	}
+
+	// Deserialize JSON
+	var vaultDir VaultDirectory
+	if err := json.Unmarshal(jsonData, &vaultDir); err != nil {
+		return nil, fmt.Errorf("directory deserialization error: %w", err)
+	}
+	return &vaultDir, nil
+}
+
+// directoryPage locates a sealed page of a paged directory
+type directoryPage struct {
+	first   string // Path of the first entry
+	entries int    // Number of entries
+	offset  int64  // Offset of the sealed page in the vault file
+	size    int64  // Size of the sealed page
+}
+
+// pagedDirectory is the root of a paged directory; pages are read when needed
+type pagedDirectory struct {
+	meta    VaultDirectory  // Directory fields other than the entries
+	dataEnd int64           // End of the data the entries refer to, relative to the data area
+	pages   []directoryPage // Pages in path order
+	inbox   []FileEntry     // Entries appended by public key since, oldest first
+
+	file io.ReaderAt
+	aead cipher.AEAD
+}
+
+// newDirectoryPageAEAD creates the cipher of the pages of a directory
+func newDirectoryPageAEAD(vaultKey, salt []byte) (cipher.AEAD, error) {
+	key := make([]byte, KeyLength)
+	defer clearKey(key)
+	reader := hkdf.New(sha256.New, vaultKey, salt, []byte(directoryPageKeyInfo))
+	if _, err := io.ReadFull(reader, key); err != nil {
+		return nil, fmt.Errorf("directory page key derivation error: %w", err)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("AES cipher creation error: %w", err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("GCM creation error: %w", err)
+	}
+	return gcm, nil
+}
+
+// directoryPageNonce builds the nonce of page number index
+func directoryPageNonce(index int) []byte {
+	nonce := make([]byte, NonceLength)
+	binary.BigEndian.PutUint64(nonce[NonceLength-8:], uint64(index))
+	return nonce
+}
+
+// encodePagedDirectory sorts the entries by path, cuts them into pages and seals them,
+// and encodes the root
+func encodePagedDirectory(key []byte, vaultDir VaultDirectory) (*encodedDirectory, error) {
+	entries := slices.Clone(vaultDir.Entries)
+	slices.SortStableFunc(entries, func(a, b FileEntry) int {
+		return strings.Compare(a.Path, b.Path)
+	})
+
+	salt := make([]byte, 32)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("salt generation error: %w", err)
+	}
+	aead, err := newDirectoryPageAEAD(key, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	encoded := &encodedDirectory{paged: true}
+	var table, page directoryEncoder
+	var first, previous string
+	count := 0
+	closePage := func() {
+		encoded.pages = append(encoded.pages, aead.Seal(nil, directoryPageNonce(len(encoded.pages)), page.buf, nil))
+		table.string(first)
+		table.uint(uint64(count))
+		table.uint(uint64(len(encoded.pages[len(encoded.pages)-1])))
+		page.buf = page.buf[:0]
+		count = 0
+	}
+	for i := range entries {
+		if count == 0 {
+			first, previous = entries[i].Path, ""
+		}
+		page.entry(&entries[i], previous)
+		previous = entries[i].Path
+		count++
+		if len(page.buf) >= DirectoryPageSize {
+			closePage()
+		}
+	}
+	if count > 0 {
+		closePage()
+	}
+
+	var root directoryEncoder
+	root.uint(uint64(vaultDir.Version))
+	root.time(vaultDir.CreatedAt)
+	root.string(vaultDir.Comment)
+	root.bytes(vaultDir.InboxKey)
+	root.int(dataAreaEnd(entries))
+	root.buf = append(root.buf, salt...)
+	root.uint(uint64(len(encoded.pages)))
+	root.buf = append(root.buf, table.buf...)
+
+	encoded.body, err = compressData(root.buf)
+	if err != nil {
+		return nil, fmt.Errorf("directory compression error: %w", err)
+	}
+	return encoded, nil
+}
+
+// decodePagedRoot decodes the opened root of a paged directory whose pages lie between
+// pagesStart and end
+func decodePagedRoot(file io.ReaderAt, key, body []byte, pagesStart, end int64) (*pagedDirectory, error) {
+	data, err := decompressData(body)
+	if err != nil {
+		return nil, fmt.Errorf("directory decompression error: %w", err)
+	}
+
+	decoder := &directoryDecoder{buf: data}
+	root := &pagedDirectory{file: file}
+	root.meta.Version = uint32(decoder.uint())
+	root.meta.CreatedAt = decoder.time()
+	root.meta.Comment = decoder.string()
+	root.meta.InboxKey = decoder.bytes()
+	root.dataEnd = decoder.int()
+	salt := decoder.next(32)
+
+	count := decoder.uint()
+	if count > uint64(len(decoder.buf)) {
+		return nil, fmt.Errorf("directory deserialization error: %w", errMalformedDirectory)
+	}
+	offset := pagesStart
+	for range count {
+		page := directoryPage{first: decoder.string(), entries: int(decoder.int64()), offset: offset, size: decoder.int64()}
+		offset += page.size
+		root.pages = append(root.pages, page)
+	}
+	if decoder.err != nil || len(decoder.buf) != 0 {
+		return nil, fmt.Errorf("directory deserialization error: %w", errMalformedDirectory)
+	}
+	if offset != end {
+		return nil, fmt.Errorf("directory deserialization error: pages end at %d instead of %d", offset, end)
+	}
+
+	root.aead, err = newDirectoryPageAEAD(key, salt)
+	if err != nil {
+		return nil, err
+	}
+	return root, nil
+}
+
+// readPage reads, opens and decodes page number index
+func (p *pagedDirectory) readPage(index int) ([]FileEntry, error) {
+	page := p.pages[index]
+	sealed := make([]byte, page.size)
+	if _, err := p.file.ReadAt(sealed, page.offset); err != nil {
+		return nil, fmt.Errorf("directory page read error: %w", err)
+	}
+
+	data, err := p.aead.Open(nil, directoryPageNonce(index), sealed, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: directory page %d does not match its authentication tag", ErrHeaderTampered, index)
+	}
+
+	decoder := &directoryDecoder{buf: data}
+	if page.entries > len(data) {
+		return nil, fmt.Errorf("directory page %d: %w", index, errMalformedDirectory)
+	}
+	entries := make([]FileEntry, 0, page.entries)
+	previous := ""
+	for range page.entries {
+		entry := decoder.entry(previous)
+		previous = entry.Path
+		entries = append(entries, entry)
+	}
+	if decoder.err != nil || len(decoder.buf) != 0 || (len(entries) > 0 && entries[0].Path != page.first) {
+		return nil, fmt.Errorf("directory page %d: %w", index, errMalformedDirectory)
+	}
+	return entries, nil
+}
+
+// load reads all pages and returns the whole directory
+func (p *pagedDirectory) load() (*VaultDirectory, error) {
+	total := 0
+	for _, page := range p.pages {
+		total += page.entries
+	}
+
+	vaultDir := p.meta
+	vaultDir.Entries = make([]FileEntry, 0, total+len(p.inbox))
+	for i := range p.pages {
+		entries, err := p.readPage(i)
+		if err != nil {
+			return nil, err
+		}
+		vaultDir.Entries = append(vaultDir.Entries, entries...)
+	}
+	for _, entry := range p.inbox {
+		vaultDir.putEntry(entry)
+	}
+	return &vaultDir, nil
+}
+
+// pageFor returns the page that holds path if the directory has it, or -1
+func (p *pagedDirectory) pageFor(path string) int {
+	return sort.Search(len(p.pages), func(i int) bool { return p.pages[i].first > path }) - 1
+}
+
+// lookup returns a function that looks entries up by path in the pages, without the
+// appended entries, reading each page once
+func (p *pagedDirectory) lookup() func(path string) (FileEntry, bool, error) {
+	pages := make(map[int][]FileEntry)
+	return func(path string) (FileEntry, bool, error) {
+		index := p.pageFor(path)
+		if index < 0 {
+			return FileEntry{}, false, nil
+		}
+		entries, ok := pages[index]
+		if !ok {
+			var err error
+			if entries, err = p.readPage(index); err != nil {
+				return FileEntry{}, false, err
+			}
+			pages[index] = entries
+		}
+		i, ok := slices.BinarySearchFunc(entries, path, compareEntryPath)
+		if !ok {
+			return FileEntry{}, false, nil
+		}
+		return entries[i], true, nil
+	}
+}
+
+// find returns the entries with the given paths in path order, reading each page
+// that can hold one of them once
+func (p *pagedDirectory) find(paths []string) ([]FileEntry, error) {
+	found := make(map[string]FileEntry, len(paths))
+	pages := make(map[int][]FileEntry)
+	for _, path := range paths {
+		index := p.pageFor(path)
+		if index < 0 {
+			continue
+		}
+		entries, ok := pages[index]
+		if !ok {
+			var err error
+			if entries, err = p.readPage(index); err != nil {
+				return nil, err
+			}
+			pages[index] = entries
+		}
+		if i, ok := slices.BinarySearchFunc(entries, path, compareEntryPath); ok {
+			found[path] = entries[i]
+		}
+	}
+
+	wanted := make(map[string]bool, len(paths))
+	for _, path := range paths {
+		wanted[path] = true
+	}
+	for _, entry := range p.inbox {
+		if wanted[entry.Path] {
+			found[entry.Path] = entry
+		}
+	}
+
+	entries := make([]FileEntry, 0, len(found))
+	for _, entry := range found {
+		entries = append(entries, entry)
+	}
+	slices.SortFunc(entries, func(a, b FileEntry) int { return strings.Compare(a.Path, b.Path) })
+	return entries, nil
+}
+
+// listPrefix returns the entries whose path starts with prefix in path order, reading
+// only the pages that can hold them
+func (p *pagedDirectory) listPrefix(prefix string) ([]FileEntry, error) {
+	var entries []FileEntry
+	start := max(p.pageFor(prefix), 0)
+	for i := start; i < len(p.pages); i++ {
+		// Paths with the prefix sort together, so no later page holds any
+		if i > start && p.pages[i].first > prefix && !strings.HasPrefix(p.pages[i].first, prefix) {
+			break
+		}
+		page, err := p.readPage(i)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range page {
+			if strings.HasPrefix(entry.Path, prefix) {
+				entries = append(entries, entry)
+			}
+		}
+	}
+
+	for _, entry := range p.inbox {
+		if !strings.HasPrefix(entry.Path, prefix) {
+			continue
+		}
+		if i, ok := slices.BinarySearchFunc(entries, entry.Path, compareEntryPath); ok {
+			entries[i] = entry
+		} else {
+			entries = slices.Insert(entries, i, entry)
+		}
+	}
+	return entries, nil
+}
+
+// compareEntryPath orders an entry against a path
+func compareEntryPath(entry FileEntry, path string) int {
+	return strings.Compare(entry.Path, path)
+}
+
+// dataAreaEnd returns the end of the data the entries refer to, relative to the data area
+func dataAreaEnd(entries []FileEntry) int64 {
+	var end int64
+	for _, entry := range entries {
+		if entry.hasPayload() && entry.Offset+entry.CompressedSize > end {
+			end = entry.Offset + entry.CompressedSize
+		}
+		for _, ref := range entry.Chunks {
+			if ref.Offset+ref.StoredSize > end {
+				end = ref.Offset + ref.StoredSize
+			}
+		}
+	}
+	return end
+}
+
+// directoryEncoder appends the binary encoding of directory fields
+type directoryEncoder struct {
+	buf []byte
+}
+
+func (e *directoryEncoder) uint(v uint64) {
+	e.buf = binary.AppendUvarint(e.buf, v)
+}
+
+func (e *directoryEncoder) int(v int64) {
+	e.buf = binary.AppendVarint(e.buf, v)
+}
+
+func (e *directoryEncoder) bytes(b []byte) {
+	e.uint(uint64(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+func (e *directoryEncoder) string(s string) {
+	e.uint(uint64(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+func (e *directoryEncoder) time(t time.Time) {
+	data, err := t.MarshalBinary()
+	if err != nil {
+		data, _ = t.UTC().MarshalBinary() // Zone offsets of seconds cannot be encoded
+	}
+	e.bytes(data)
+}
+
+// entry encodes an entry whose path follows previous in the page
+func (e *directoryEncoder) entry(entry *FileEntry, previous string) {
+	shared := 0
+	for shared < len(previous) && shared < len(entry.Path) && previous[shared] == entry.Path[shared] {
+		shared++
+	}
+	e.uint(uint64(shared))
+	e.string(entry.Path[shared:])
+
+	var flags byte
+	if entry.IsDir {
+		flags |= entryFlagDir
+	}
+	if entry.IsSymlink {
+		flags |= entryFlagSymlink
+	}
+	if entry.Name != path.Base(entry.Path) {
+		flags |= entryFlagName
+	}
+	if entry.SHA256Hash != [32]byte{} {
+		flags |= entryFlagHash
+	}
+	if entry.PayloadSalt != [32]byte{} {
+		flags |= entryFlagSalt
+	}
+	e.buf = append(e.buf, flags)
+
+	if flags&entryFlagName != 0 {
+		e.string(entry.Name)
+	}
+	e.int(entry.Size)
+	e.int(entry.CompressedSize)
+	e.uint(uint64(entry.Mode))
+	e.time(entry.ModTime)
+	e.int(entry.Offset)
+	if flags&entryFlagHash != 0 {
+		e.buf = append(e.buf, entry.SHA256Hash[:]...)
+	}
+	if flags&entryFlagSalt != 0 {
+		e.buf = append(e.buf, entry.PayloadSalt[:]...)
+	}
+	e.bytes(entry.PayloadKey)
+	if entry.IsSymlink {
+		e.string(entry.LinkTarget)
+	}
+	e.string(entry.Compression)
+
+	e.uint(uint64(len(entry.Chunks)))
+	for _, ref := range entry.Chunks {
+		e.buf = append(e.buf, ref.ID[:]...)
+		e.bytes(ref.Salt)
+		e.int(ref.Offset)
+		e.int(ref.Size)
+		e.int(ref.StoredSize)
+		e.string(ref.Compression)
+	}
+}
+
+// directoryDecoder decodes directory fields; after the first error it returns zero values
+type directoryDecoder struct {
+	buf []byte
+	err error
+}
+
+func (d *directoryDecoder) fail() {
+	if d.err == nil {
+		d.err = errMalformedDirectory
+	}
+	d.buf = nil
+}
+
+// next returns the next n bytes
+func (d *directoryDecoder) next(n uint64) []byte {
+	if n > uint64(len(d.buf)) {
+		d.fail()
+		return nil
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *directoryDecoder) uint() uint64 {
+	v, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		d.fail()
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *directoryDecoder) int() int64 {
+	v, n := binary.Varint(d.buf)
+	if n <= 0 {
+		d.fail()
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+// int64 decodes a size written with uint
+func (d *directoryDecoder) int64() int64 {
+	v := d.uint()
+	if v > uint64(1<<62) {
+		d.fail()
+		return 0
+	}
+	return int64(v)
+}
+
+func (d *directoryDecoder) bytes() []byte {
+	b := d.next(d.uint())
+	if len(b) == 0 {
+		return nil
+	}
+	return bytes.Clone(b)
+}
+
+func (d *directoryDecoder) string() string {
+	return string(d.next(d.uint()))
+}
+
+func (d *directoryDecoder) time() time.Time {
+	var t time.Time
+	if err := t.UnmarshalBinary(d.next(d.uint())); err != nil {
+		d.fail()
+	}
+	return t
+}
+
+// entry decodes an entry whose path follows previous in the page
+func (d *directoryDecoder) entry(previous string) FileEntry {
+	shared := d.uint()
+	if shared > uint64(len(previous)) {
+		d.fail()
+		return FileEntry{}
+	}
+	entry := FileEntry{Path: previous[:shared] + d.string()}
+
+	flags := d.next(1)
+	if flags == nil {
+		return FileEntry{}
+	}
+	entry.IsDir = flags[0]&entryFlagDir != 0
+	entry.IsSymlink = flags[0]&entryFlagSymlink != 0
+	entry.Name = path.Base(entry.Path)
+	if flags[0]&entryFlagName != 0 {
+		entry.Name = d.string()
+	}
+	entry.Size = d.int()
+	entry.CompressedSize = d.int()
+	entry.Mode = uint32(d.uint())
+	entry.ModTime = d.time()
+	entry.Offset = d.int()
+	if flags[0]&entryFlagHash != 0 {
+		copy(entry.SHA256Hash[:], d.next(32))
+	}
+	if flags[0]&entryFlagSalt != 0 {
+		copy(entry.PayloadSalt[:], d.next(32))
+	}
+	entry.PayloadKey = d.bytes()
+	if entry.IsSymlink {
+		entry.LinkTarget = d.string()
+	}
+	entry.Compression = d.string()
+
+	// Every chunk takes more than its 32-byte ID
+	chunks := d.uint()
+	if chunks > uint64(len(d.buf)/32) {
+		d.fail()
+		return FileEntry{}
+	}
+	for range chunks {
+		var ref ChunkRef
+		copy(ref.ID[:], d.next(32))
+		ref.Salt = d.bytes()
+		ref.Offset = d.int()
+		ref.Size = d.int()
+		ref.StoredSize = d.int()
+		ref.Compression = d.string()
+		entry.Chunks = append(entry.Chunks, ref)
+	}
+	return entry
+}
@@ -0,0 +1,255 @@
+package vault
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingReaderAt считает чтения, чтобы проверить, какие страницы директории читаются
+type countingReaderAt struct {
+	io.ReaderAt
+	reads atomic.Int32
+}
+
+func (r *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	r.reads.Add(1)
+	return r.ReaderAt.ReadAt(p, off)
+}
+
+// testPagedEntries создаёт n записей со всеми полями, которые хранит страница директории
+func testPagedEntries(n int) []FileEntry {
+	entries := make([]FileEntry, n)
+	for i := range entries {
+		entry := FileEntry{
+			Path:           fmt.Sprintf("dir%03d/file%05d.txt", i%50, i),
+			Size:           int64(i * 100),
+			CompressedSize: int64(i * 60),
+			Mode:           0644,
+			ModTime:        time.Unix(int64(1700000000+i), 0).UTC(),
+			Offset:         int64(i * 60),
+		}
+		entry.Name = filepath.Base(entry.Path)
+		entry.SHA256Hash[0], entry.PayloadSalt[31] = byte(i), byte(i+1)
+		switch i % 5 {
+		case 1:
+			entry = FileEntry{Path: fmt.Sprintf("dir%03d/sub%05d", i%50, i), IsDir: true, Mode: uint32(os.ModeDir | 0755), ModTime: entry.ModTime}
+			entry.Name = filepath.Base(entry.Path)
+		case 2:
+			entry.IsSymlink, entry.LinkTarget = true, "../target"
+			entry.Size, entry.CompressedSize, entry.SHA256Hash, entry.PayloadSalt = 0, 0, [32]byte{}, [32]byte{}
+		case 3:
+			entry.Name = "renamed"
+			entry.PayloadKey = []byte{1, 2, 3}
+			entry.Compression = "zstd"
+		case 4:
+			entry.Chunks = []ChunkRef{{ID: ChunkID{byte(i)}, Salt: []byte{4, 5}, Offset: 10, Size: 20, StoredSize: 30, Compression: "zstd"}}
+		}
+		entries[i] = entry
+	}
+	return entries
+}
+
+// openTestPages шифрует директорию в формате v5 и открывает её корень
+func openTestPages(t *testing.T, key []byte, vaultDir VaultDirectory) (*pagedDirectory, *countingReaderAt, []byte) {
+	t.Helper()
+
+	encoded, err := encodeDirectory(key, PagedDirectoryVersion, vaultDir)
+	if err != nil {
+		t.Fatalf("encodeDirectory failed: %v", err)
+	}
+	gcm, err := newKeyWrapGCM(key)
+	if err != nil {
+		t.Fatalf("newKeyWrapGCM failed: %v", err)
+	}
+	nonce := make([]byte, NonceLength)
+	sealed := encoded.seal(gcm, nonce, []byte("associated data"))
+	if uint64(len(sealed)) != encoded.sealedSize(gcm.Overhead()) {
+		t.Fatalf("Sealed directory takes %d bytes, expected %d", len(sealed), encoded.sealedSize(gcm.Overhead()))
+	}
+
+	file := &countingReaderAt{ReaderAt: bytes.NewReader(sealed)}
+	sealedRoot, pagesStart, err := readSealedDirectory(file, PagedDirectoryVersion, 0, uint64(len(sealed)))
+	if err != nil {
+		t.Fatalf("readSealedDirectory failed: %v", err)
+	}
+	body, err := gcm.Open(nil, nonce, sealedRoot, []byte("associated data"))
+	if err != nil {
+		t.Fatalf("Failed to open the root: %v", err)
+	}
+	root, err := decodePagedRoot(file, key, body, pagesStart, int64(len(sealed)))
+	if err != nil {
+		t.Fatalf("decodePagedRoot failed: %v", err)
+	}
+	return root, file, sealed
+}
+
+// TestPagedDirectory тестирует страничную директорию: все поля переживают кодирование,
+// поиск и выборка по префиксу читают только нужные страницы, а подмена страницы
+// обнаруживается
+func TestPagedDirectory(t *testing.T) {
+	key := make([]byte, KeyLength)
+	rand.Read(key)
+
+	entries := testPagedEntries(5000)
+	vaultDir := VaultDirectory{
+		Version:   PagedDirectoryVersion,
+		Entries:   slices.Clone(entries),
+		CreatedAt: time.Unix(1600000000, 0).UTC(),
+		Comment:   "paged",
+		InboxKey:  []byte{7, 8, 9},
+	}
+	slices.Reverse(vaultDir.Entries) // Encoding sorts them
+
+	root, file, sealed := openTestPages(t, key, vaultDir)
+	if len(root.pages) < 3 {
+		t.Fatalf("Expected several pages, got %d", len(root.pages))
+	}
+	if root.dataEnd != dataAreaEnd(entries) {
+		t.Errorf("Root records data end %d, expected %d", root.dataEnd, dataAreaEnd(entries))
+	}
+
+	// Полная загрузка возвращает все записи в порядке путей
+	loaded, err := root.load()
+	if err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	sorted := slices.Clone(entries)
+	slices.SortFunc(sorted, func(a, b FileEntry) int { return strings.Compare(a.Path, b.Path) })
+	if !reflect.DeepEqual(loaded.Entries, sorted) {
+		t.Error("Loaded entries differ from the encoded ones")
+	}
+	if loaded.Version != vaultDir.Version || !loaded.CreatedAt.Equal(vaultDir.CreatedAt) || loaded.Comment != vaultDir.Comment || !bytes.Equal(loaded.InboxKey, vaultDir.InboxKey) {
+		t.Errorf("Directory metadata differs: %+v", loaded)
+	}
+
+	// Поиск читает одну страницу на путь
+	file.reads.Store(0)
+	found, err := root.find([]string{sorted[4000].Path, sorted[4000].Path + ".missing", sorted[4000].Path})
+	if err != nil || len(found) != 1 || !reflect.DeepEqual(found[0], sorted[4000]) {
+		t.Fatalf("find returned %+v (%v)", found, err)
+	}
+	if reads := file.reads.Load(); reads != 1 {
+		t.Errorf("Finding one path read %d pages", reads)
+	}
+
+	// Выборка по префиксу читает только страницы, которые могут его содержать
+	file.reads.Store(0)
+	listed, err := root.listPrefix("dir049/")
+	if err != nil {
+		t.Fatalf("listPrefix failed: %v", err)
+	}
+	if len(listed) != 100 || !strings.HasPrefix(listed[0].Path, "dir049/") || !strings.HasPrefix(listed[99].Path, "dir049/") {
+		t.Fatalf("listPrefix returned %d entries", len(listed))
+	}
+	if reads := int(file.reads.Load()); reads >= len(root.pages) {
+		t.Errorf("Listing a prefix read %d of %d pages", reads, len(root.pages))
+	}
+
+	// Записи, добавленные после директории, перекрывают записи страниц
+	replaced := sorted[10]
+	replaced.Size = -1
+	root.inbox = []FileEntry{replaced, {Path: "dir000/zzz.txt", Name: "zzz.txt"}}
+	if found, err := root.find([]string{replaced.Path, "dir000/zzz.txt"}); err != nil || len(found) != 2 || found[0].Size != -1 {
+		t.Errorf("find ignored appended entries: %+v (%v)", found, err)
+	}
+	if listed, err := root.listPrefix("dir000/"); err != nil || len(listed) != 101 || listed[len(listed)-1].Path != "dir000/zzz.txt" {
+		t.Errorf("listPrefix ignored appended entries (%d entries, %v)", len(listed), err)
+	}
+
+	// Подменённая страница не открывается
+	sealed[len(sealed)-1] ^= 1
+	if _, err := root.readPage(len(root.pages) - 1); !errors.Is(err, ErrHeaderTampered) {
+		t.Errorf("Expected ErrHeaderTampered for a modified page, got %v", err)
+	}
+}
+
+// TestUpgradeToPagedDirectory тестирует перевод vault v4 в текущий формат при сжатии
+func TestUpgradeToPagedDirectory(t *testing.T) {
+	tmpDir := setupCoreTest(t)
+	defer cleanupCoreTest(t, tmpDir)
+
+	vaultPath := filepath.Join(tmpDir, "upgrade.vault")
+	vaultDir := VaultDirectory{Version: ChunkedVersion, Entries: []FileEntry{}, CreatedAt: time.Now()}
+	if err := saveVaultDirectory(vaultPath, Password(testPassword), vaultDir, testArgon2Params, nil); err != nil {
+		t.Fatalf("saveVaultDirectory failed: %v", err)
+	}
+	secondKey := Password("second password")
+	if _, err := AddKeySlot(vaultPath, Password(testPassword), secondKey, testArgon2Params); err != nil {
+		t.Fatalf("AddKeySlot failed: %v", err)
+	}
+
+	sourceDir := filepath.Join(tmpDir, "source")
+	os.MkdirAll(filepath.Join(sourceDir, "docs"), 0755)
+	for i := 0; i < 4; i++ {
+		createTestFile(t, sourceDir, fmt.Sprintf("docs/file%d.txt", i), fmt.Sprintf("%s %d", testContent, i))
+	}
+	createTestFile(t, sourceDir, "other.txt", "other")
+	if err := AddDirectoryToVault(vaultPath, Password(testPassword), sourceDir); err != nil {
+		t.Fatalf("AddDirectoryToVault failed: %v", err)
+	}
+
+	// Без флага сжатие сохраняет версию
+	if _, err := CompactVault(vaultPath, Password(testPassword), CompactOptions{}); err != nil {
+		t.Fatalf("CompactVault failed: %v", err)
+	}
+	if info, _ := GetVaultInfo(vaultPath); info.Version != ChunkedVersion || info.PagedDirectory {
+		t.Fatalf("Compaction changed the format: %+v", info)
+	}
+
+	if _, err := CompactVault(vaultPath, Password(testPassword), CompactOptions{Upgrade: true}); err != nil {
+		t.Fatalf("CompactVault with upgrade failed: %v", err)
+	}
+	if info, _ := GetVaultInfo(vaultPath); info.Version != CurrentVaultVersion || !info.PagedDirectory {
+		t.Fatalf("Vault was not upgraded: %+v", info)
+	}
+
+	// Оба ключа открывают обновлённый vault, а записи дописываются в новом формате
+	extra := createTestFile(t, tmpDir, "extra.txt", "appended after the upgrade")
+	if err := AddFileToVault(vaultPath, secondKey, extra); err != nil {
+		t.Fatalf("AddFileToVault with the second key failed: %v", err)
+	}
+	inbox := createTestFile(t, tmpDir, "inbox.txt", "appended by public key")
+	if err := AppendToVault(vaultPath, inbox); err != nil {
+		t.Fatalf("AppendToVault failed: %v", err)
+	}
+
+	listed, err := ListVaultPrefix(vaultPath, Password(testPassword), "source/docs/")
+	if err != nil || len(listed) != 4 {
+		t.Fatalf("Expected 4 entries under source/docs/, got %d (%v)", len(listed), err)
+	}
+	if listed, err := ListVaultPrefix(vaultPath, secondKey, ""); err != nil || len(listed) != 9 {
+		t.Fatalf("Expected 9 entries, got %d (%v)", len(listed), err)
+	}
+
+	outputDir := filepath.Join(tmpDir, "output")
+	targets := []string{"source/docs/file2.txt", "extra.txt", "inbox.txt"}
+	if _, err := ExtractMultipleFilesFromVaultParallel(vaultPath, Password(testPassword), outputDir, targets, DefaultParallelConfig()); err != nil {
+		t.Fatalf("Extraction failed: %v", err)
+	}
+	for path, content := range map[string]string{targets[0]: testContent + " 2", targets[1]: "appended after the upgrade", targets[2]: "appended by public key"} {
+		if data, err := os.ReadFile(filepath.Join(outputDir, filepath.FromSlash(path))); err != nil || string(data) != content {
+			t.Errorf("Content mismatch for %s (%v)", path, err)
+		}
+	}
+
+	// Vault v2 нельзя обновить на месте
+	legacyPath := filepath.Join(tmpDir, "legacy.vault")
+	legacyDir := VaultDirectory{Version: 2, Entries: []FileEntry{}, CreatedAt: time.Now()}
+	if err := saveVaultDirectory(legacyPath, Password(testPassword), legacyDir, DefaultKDFParams(), nil); err != nil {
+		t.Fatalf("saveVaultDirectory failed: %v", err)
+	}
+	if _, err := CompactVault(legacyPath, Password(testPassword), CompactOptions{Upgrade: true}); err == nil {
+		t.Error("Expected an error upgrading a v2 vault")
+	}
+}
@@ -0,0 +1,166 @@
+package vault
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ========================
+// ENTRY PATHS
+// ========================
+//
+// Entry paths are stored relative and slash-separated. The directory of a vault
+// is not trusted on extraction: every path is checked before anything is written,
+// so a crafted entry such as "../../etc/x" or "/etc/x" cannot escape the output
+// directory.
+
+// ErrUnsafePath is returned for entry paths that are absolute or point outside
+// the output directory
+var ErrUnsafePath = errors.New("unsafe entry path")
+
+// ExtractOptions controls how entry paths are mapped into the output directory
+type ExtractOptions struct {
+	// AllowUnsafePaths joins entry paths to the output directory unchecked.
+	// Only use it for vaults from a trusted source.
+	AllowUnsafePaths bool
+
+	// Context cancels the extraction between and within files; a file that is
+	// not complete is removed
+	Context context.Context
+}
+
+// storePathFor returns the vault path of a file or directory added from basePath:
+// its name when basePath is empty, otherwise the name of basePath followed by the
+// path relative to it
+func storePathFor(basePath, filePath string) (string, error) {
+	if basePath == "" {
+		return normalizeStorePath(filepath.Base(filePath))
+	}
+
+	absBase, err := filepath.Abs(basePath)
+	if err != nil {
+		return "", fmt.Errorf("path resolution error: %w", err)
+	}
+	absPath, err := filepath.Abs(filePath)
+	if err != nil {
+		return "", fmt.Errorf("path resolution error: %w", err)
+	}
+
+	relativePath, err := filepath.Rel(absBase, absPath)
+	if err != nil {
+		return "", fmt.Errorf("relative path error: %w", err)
+	}
+	return normalizeStorePath(filepath.Join(filepath.Base(absBase), relativePath))
+}
+
+// normalizeStorePath converts a path to the stored form (clean, relative, slash-separated)
+func normalizeStorePath(p string) (string, error) {
+	clean := cleanEntryPath(p)
+	if err := checkEntryPath(clean); err != nil {
+		return "", err
+	}
+	return clean, nil
+}
+
+// cleanEntryPath converts a user-supplied path to the stored form for lookups
+func cleanEntryPath(p string) string {
+	return path.Clean(filepath.ToSlash(p))
+}
+
+// checkEntryPath rejects empty and absolute paths, drive letters and ".." components.
+// Backslashes count as separators, so paths crafted for Windows are caught everywhere.
+func checkEntryPath(p string) error {
+	if err := checkRelativePath(p); err != nil {
+		return err
+	}
+
+	for _, part := range strings.FieldsFunc(p, isPathSeparator) {
+		if part == ".." {
+			return fmt.Errorf("%w: %q escapes the output directory", ErrUnsafePath, p)
+		}
+	}
+	return nil
+}
+
+// checkRelativePath rejects empty and absolute paths and drive letters
+func checkRelativePath(p string) error {
+	switch {
+	case p == "" || p == ".":
+		return fmt.Errorf("%w: empty path", ErrUnsafePath)
+	case strings.ContainsRune(p, 0):
+		return fmt.Errorf("%w: %q contains a NUL byte", ErrUnsafePath, p)
+	case strings.HasPrefix(p, "/") || strings.HasPrefix(p, `\`) || filepath.IsAbs(p):
+		return fmt.Errorf("%w: %q is absolute", ErrUnsafePath, p)
+	case len(p) >= 2 && p[1] == ':' && isDriveLetter(p[0]):
+		return fmt.Errorf("%w: %q has a drive letter", ErrUnsafePath, p)
+	}
+	return nil
+}
+
+// resolveExtractPath returns the output path of an entry, refusing entry paths
+// that would resolve outside outputDir unless allowUnsafe is set
+func resolveExtractPath(outputDir, entryPath string, allowUnsafe bool) (string, error) {
+	if allowUnsafe {
+		return filepath.Join(outputDir, entryPath), nil
+	}
+
+	if err := checkEntryPath(entryPath); err != nil {
+		return "", err
+	}
+
+	target := filepath.Join(outputDir, filepath.FromSlash(entryPath))
+	relativePath, err := filepath.Rel(outputDir, target)
+	if err != nil || relativePath == "." || relativePath == ".." || strings.HasPrefix(relativePath, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%w: %q escapes the output directory", ErrUnsafePath, entryPath)
+	}
+	return target, nil
+}
+
+// resolveExtractPaths checks all entries before anything is extracted and returns
+// their output paths in entry order. Link targets and entries that would be written
+// through a link are checked as well.
+func resolveExtractPaths(outputDir string, entries []FileEntry, allowUnsafe bool) ([]string, error) {
+	links := make(map[string]bool)
+	for _, entry := range entries {
+		if entry.IsSymlink {
+			links[entry.Path] = true
+		}
+	}
+
+	checked := make(map[string]bool)
+	paths := make([]string, len(entries))
+	for i, entry := range entries {
+		target, err := resolveExtractPath(outputDir, entry.Path, allowUnsafe)
+		if err != nil {
+			return nil, err
+		}
+		paths[i] = target
+
+		if allowUnsafe {
+			continue
+		}
+		if entry.IsSymlink {
+			if err := checkLinkTarget(entry.Path, entry.LinkTarget); err != nil {
+				return nil, err
+			}
+		}
+		if err := checkSymlinkAncestors(outputDir, entry, links, checked); err != nil {
+			return nil, err
+		}
+	}
+	return paths, nil
+}
+
+// isPathSeparator reports whether r separates path components on any platform
+func isPathSeparator(r rune) bool {
+	return r == '/' || r == '\\'
+}
+
+// isDriveLetter reports whether c can start a Windows drive name
+func isDriveLetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
@@ -0,0 +1,169 @@
+package vault
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// createMaliciousVault создаёт vault, в каталоге которого записаны заданные пути
+func createMaliciousVault(t *testing.T, dir string, entryPaths []string) string {
+	t.Helper()
+
+	vaultPath := filepath.Join(dir, "malicious.vault")
+	if err := CreateVaultWithKDF(vaultPath, Password(testPassword), testArgon2Params); err != nil {
+		t.Fatalf("CreateVaultWithKDF failed: %v", err)
+	}
+
+	sourceDir := filepath.Join(dir, "source")
+	if err := os.MkdirAll(sourceDir, 0755); err != nil {
+		t.Fatalf("Failed to create source directory: %v", err)
+	}
+	for i := range entryPaths {
+		name := fmt.Sprintf("file%d.txt", i)
+		if err := AddFileToVault(vaultPath, Password(testPassword), createTestFile(t, sourceDir, name, "payload "+name)); err != nil {
+			t.Fatalf("AddFileToVault failed: %v", err)
+		}
+	}
+
+	// Подмена путей в каталоге, как это сделал бы злоумышленник
+	vaultDir, err := loadVaultDirectory(vaultPath, Password(testPassword))
+	if err != nil {
+		t.Fatalf("loadVaultDirectory failed: %v", err)
+	}
+	for i := range vaultDir.Entries {
+		vaultDir.Entries[i].Path = entryPaths[i]
+	}
+	if err := updateVaultDirectory(vaultPath, Password(testPassword), *vaultDir); err != nil {
+		t.Fatalf("updateVaultDirectory failed: %v", err)
+	}
+	return vaultPath
+}
+
+// TestCheckEntryPath тестирует проверку путей записей
+func TestCheckEntryPath(t *testing.T) {
+	safe := []string{"file.txt", "dir/file.txt", "dir/sub/file.txt", "a..b", "dir/.hidden", "./file.txt"}
+	for _, p := range safe {
+		if err := checkEntryPath(p); err != nil {
+			t.Errorf("checkEntryPath(%q) failed: %v", p, err)
+		}
+	}
+
+	unsafe := []string{
+		"", ".", "..", "../file.txt", "dir/../../file.txt", "/etc/passwd",
+		`..\file.txt`, `dir\..\..\file.txt`, `\windows\file.txt`, "C:/file.txt", `c:file.txt`, "file\x00.txt",
+	}
+	for _, p := range unsafe {
+		if err := checkEntryPath(p); !errors.Is(err, ErrUnsafePath) {
+			t.Errorf("checkEntryPath(%q): expected ErrUnsafePath, got %v", p, err)
+		}
+	}
+}
+
+// TestStorePathFor тестирует нормализацию путей при добавлении
+func TestStorePathFor(t *testing.T) {
+	tmpDir := setupCoreTest(t)
+	defer cleanupCoreTest(t, tmpDir)
+
+	base := filepath.Join(tmpDir, "project")
+	tests := []struct {
+		basePath string
+		filePath string
+		expected string
+	}{
+		{"", filepath.Join(tmpDir, "file.txt"), "file.txt"},
+		{base, base, "project"},
+		{base, filepath.Join(base, "src", "main.go"), "project/src/main.go"},
+		{base + string(filepath.Separator), filepath.Join(base, "a.txt"), "project/a.txt"},
+	}
+	for _, test := range tests {
+		result, err := storePathFor(test.basePath, test.filePath)
+		if err != nil || result != test.expected {
+			t.Errorf("storePathFor(%q, %q) = %q, %v; expected %q", test.basePath, test.filePath, result, err, test.expected)
+		}
+	}
+
+	// Относительные пути вроде ".." не попадают в хранилище
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	if err := os.MkdirAll(filepath.Join(base, "sub"), 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if err := os.Chdir(filepath.Join(base, "sub")); err != nil {
+		t.Fatalf("Chdir failed: %v", err)
+	}
+	result, err := storePathFor("..", filepath.Join("..", "a.txt"))
+	if err != nil || result != "project/a.txt" {
+		t.Errorf("storePathFor(\"..\") = %q, %v; expected project/a.txt", result, err)
+	}
+}
+
+// TestExtractRejectsUnsafePaths тестирует извлечение из специально созданных vault
+func TestExtractRejectsUnsafePaths(t *testing.T) {
+	maliciousPaths := []string{"../escape.txt", "/absolute.txt", "dir/../../nested.txt", `..\windows.txt`}
+
+	for _, maliciousPath := range maliciousPaths {
+		t.Run(maliciousPath, func(t *testing.T) {
+			tmpDir := setupCoreTest(t)
+			defer cleanupCoreTest(t, tmpDir)
+
+			vaultPath := createMaliciousVault(t, tmpDir, []string{"safe.txt", maliciousPath})
+			outputDir := filepath.Join(tmpDir, "output", "nested")
+
+			if err := ExtractFromVault(vaultPath, Password(testPassword), outputDir); !errors.Is(err, ErrUnsafePath) {
+				t.Fatalf("ExtractFromVault: expected ErrUnsafePath, got %v", err)
+			}
+
+			// Выборочное извлечение находит запись только по нормализованному пути
+			if cleanEntryPath(maliciousPath) == maliciousPath {
+				if err := GetFromVault(vaultPath, Password(testPassword), outputDir, []string{maliciousPath}); !errors.Is(err, ErrUnsafePath) {
+					t.Fatalf("GetFromVault: expected ErrUnsafePath, got %v", err)
+				}
+				config := DefaultParallelConfig()
+				if _, err := ExtractMultipleFilesFromVaultParallel(vaultPath, Password(testPassword), outputDir, []string{"safe.txt", maliciousPath}, config); !errors.Is(err, ErrUnsafePath) {
+					t.Fatalf("ExtractMultipleFilesFromVaultParallel: expected ErrUnsafePath, got %v", err)
+				}
+			}
+
+			// Ничего не записано, даже безопасные файлы
+			if _, err := os.Stat(outputDir); !os.IsNotExist(err) {
+				t.Error("Output directory must not be created for a rejected vault")
+			}
+			for _, escaped := range []string{"escape.txt", "nested.txt", filepath.Join("output", "escape.txt")} {
+				if _, err := os.Stat(filepath.Join(tmpDir, escaped)); err == nil {
+					t.Errorf("File escaped the output directory: %s", escaped)
+				}
+			}
+
+			// Безопасные записи того же vault извлекаются выборочно
+			if err := GetFromVault(vaultPath, Password(testPassword), outputDir, []string{"safe.txt"}); err != nil {
+				t.Fatalf("GetFromVault (safe entry) failed: %v", err)
+			}
+		})
+	}
+}
+
+// TestExtractAllowUnsafePaths тестирует явное разрешение небезопасных путей
+func TestExtractAllowUnsafePaths(t *testing.T) {
+	tmpDir := setupCoreTest(t)
+	defer cleanupCoreTest(t, tmpDir)
+
+	vaultPath := createMaliciousVault(t, tmpDir, []string{"../escape.txt"})
+	outputDir := filepath.Join(tmpDir, "output")
+
+	if err := ExtractFromVaultWithOptions(vaultPath, Password(testPassword), outputDir, ExtractOptions{AllowUnsafePaths: true}); err != nil {
+		t.Fatalf("ExtractFromVaultWithOptions failed: %v", err)
+	}
+	content, err := os.ReadFile(filepath.Join(tmpDir, "escape.txt"))
+	if err != nil || string(content) != "payload file0.txt" {
+		t.Fatalf("Expected the entry to be written outside the output directory: %v", err)
+	}
+
+	config := DefaultParallelConfig()
+	config.AllowUnsafePaths = true
+	if _, err := ExtractMultipleFilesFromVaultParallel(vaultPath, Password(testPassword), outputDir, []string{"../escape.txt"}, config); err != nil {
+		t.Fatalf("ExtractMultipleFilesFromVaultParallel failed: %v", err)
+	}
+}
@@ -0,0 +1,232 @@
+package vault
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// ========================
+// PAYLOAD ENCRYPTION
+// ========================
+//
+// Starting with format version 3 every file payload is stored as a sequence of
+// AES-256-GCM sealed chunks (STREAM construction). Each file gets its own key,
+// derived from the vault key with HKDF and a random per-file salt, and each
+// chunk nonce is built from a big-endian chunk counter plus a "last chunk"
+// flag so that chunks cannot be reordered, dropped or truncated unnoticed.
+
+const (
+	// PayloadEncryptionVersion is the first vault format version with encrypted payloads
+	PayloadEncryptionVersion = 3
+
+	// PayloadChunkSize is the plaintext size of a single encrypted payload chunk (64KB)
+	PayloadChunkSize = 64 * 1024
+
+	// payloadTagSize is the GCM authentication tag size appended to every chunk
+	payloadTagSize = 16
+
+	// payloadKeyInfo is the HKDF info string for per-file payload keys
+	payloadKeyInfo = "flint-vault payload key v3"
+)
+
+// newPayloadSalt generates a random per-file salt for payload key derivation
+func newPayloadSalt() ([32]byte, error) {
+	var salt [32]byte
+	if _, err := rand.Read(salt[:]); err != nil {
+		return salt, fmt.Errorf("payload salt generation error: %w", err)
+	}
+	return salt, nil
+}
+
+// derivePayloadKey derives a per-file payload key from the vault key
+func derivePayloadKey(vaultKey []byte, salt [32]byte) ([]byte, error) {
+	key := make([]byte, KeyLength)
+	reader := hkdf.New(sha256.New, vaultKey, salt[:], []byte(payloadKeyInfo))
+	if _, err := io.ReadFull(reader, key); err != nil {
+		return nil, fmt.Errorf("payload key derivation error: %w", err)
+	}
+	return key, nil
+}
+
+// newPayloadAEAD creates the chunk cipher for a file entry
+func newPayloadAEAD(vaultKey []byte, salt [32]byte) (cipher.AEAD, error) {
+	key, err := derivePayloadKey(vaultKey, salt)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for i := range key {
+			key[i] = 0
+		}
+	}()
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("AES cipher creation error: %w", err)
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("GCM creation error: %w", err)
+	}
+	return gcm, nil
+}
+
+// payloadChunkNonce builds the nonce for chunk number counter
+func payloadChunkNonce(counter uint64, last bool) []byte {
+	nonce := make([]byte, NonceLength)
+	binary.BigEndian.PutUint64(nonce[3:11], counter)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// encryptedPayloadSize returns the stored size of a payload with the given compressed size
+func encryptedPayloadSize(compressedSize int64) int64 {
+	chunks := (compressedSize + PayloadChunkSize - 1) / PayloadChunkSize
+	if chunks == 0 {
+		chunks = 1 // Empty payloads still carry one authenticated chunk
+	}
+	return compressedSize + chunks*payloadTagSize
+}
+
+// payloadWriter encrypts a payload stream chunk by chunk
+type payloadWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	buf     []byte
+	counter uint64
+	closed  bool
+}
+
+// newPayloadWriter returns a writer that seals everything written to it into w.
+// Close must be called to seal the final chunk.
+func newPayloadWriter(w io.Writer, vaultKey []byte, salt [32]byte) (io.WriteCloser, error) {
+	aead, err := newPayloadAEAD(vaultKey, salt)
+	if err != nil {
+		return nil, err
+	}
+	return &payloadWriter{
+		w:    w,
+		aead: aead,
+		buf:  make([]byte, 0, PayloadChunkSize),
+	}, nil
+}
+
+func (p *payloadWriter) Write(data []byte) (int, error) {
+	if p.closed {
+		return 0, fmt.Errorf("write to closed payload writer")
+	}
+
+	written := 0
+	for len(data) > 0 {
+		// A full buffer is only sealed once more data arrives, so the final
+		// chunk can always be flagged as last in Close.
+		if len(p.buf) == PayloadChunkSize {
+			if err := p.sealChunk(false); err != nil {
+				return written, err
+			}
+		}
+
+		n := copy(p.buf[len(p.buf):PayloadChunkSize], data)
+		p.buf = p.buf[:len(p.buf)+n]
+		data = data[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// Close seals the final chunk
+func (p *payloadWriter) Close() error {
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+	return p.sealChunk(true)
+}
+
+func (p *payloadWriter) sealChunk(last bool) error {
+	sealed := p.aead.Seal(nil, payloadChunkNonce(p.counter, last), p.buf, nil)
+	if _, err := p.w.Write(sealed); err != nil {
+		return fmt.Errorf("payload chunk write error: %w", err)
+	}
+	p.counter++
+	p.buf = p.buf[:0]
+	return nil
+}
+
+// payloadReader decrypts and verifies a payload stream chunk by chunk
+type payloadReader struct {
+	r         io.Reader
+	aead      cipher.AEAD
+	remaining int64
+	counter   uint64
+	chunk     []byte
+	plain     []byte
+	done      bool
+}
+
+// newPayloadReader returns a reader that opens storedSize bytes of sealed chunks from r
+func newPayloadReader(r io.Reader, storedSize int64, vaultKey []byte, salt [32]byte) (io.Reader, error) {
+	if storedSize < payloadTagSize {
+		return nil, fmt.Errorf("payload too small: %d bytes", storedSize)
+	}
+
+	aead, err := newPayloadAEAD(vaultKey, salt)
+	if err != nil {
+		return nil, err
+	}
+	return &payloadReader{
+		r:         r,
+		aead:      aead,
+		remaining: storedSize,
+		chunk:     make([]byte, PayloadChunkSize+payloadTagSize),
+	}, nil
+}
+
+func (p *payloadReader) Read(out []byte) (int, error) {
+	for len(p.plain) == 0 {
+		if p.done {
+			return 0, io.EOF
+		}
+		if err := p.openChunk(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(out, p.plain)
+	p.plain = p.plain[n:]
+	return n, nil
+}
+
+func (p *payloadReader) openChunk() error {
+	size := int64(len(p.chunk))
+	if p.remaining < size {
+		size = p.remaining
+	}
+	last := size == p.remaining
+
+	sealed := p.chunk[:size]
+	if _, err := io.ReadFull(p.r, sealed); err != nil {
+		return fmt.Errorf("payload chunk read error: %w", err)
+	}
+
+	plain, err := p.aead.Open(sealed[:0], payloadChunkNonce(p.counter, last), sealed, nil)
+	if err != nil {
+		return fmt.Errorf("payload authentication failed: file data corrupted or tampered")
+	}
+
+	p.remaining -= size
+	p.counter++
+	p.plain = plain
+	p.done = last
+	return nil
+}
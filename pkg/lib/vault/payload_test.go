@@ -0,0 +1,263 @@
+package vault
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// createLegacyVault создаёт vault в формате v2 (содержимое файлов не шифруется)
+func createLegacyVault(t *testing.T, path, password string) {
+	t.Helper()
+
+	vaultDir := VaultDirectory{
+		Version:   2,
+		Entries:   []FileEntry{},
+		CreatedAt: time.Now(),
+		Comment:   "Legacy vault",
+	}
+	if err := saveVaultDirectory(path, Password(password), vaultDir, DefaultKDFParams(), nil); err != nil {
+		t.Fatalf("saveVaultDirectory failed: %v", err)
+	}
+}
+
+// TestPayloadStreamRoundTrip тестирует шифрование payload по чанкам
+func TestPayloadStreamRoundTrip(t *testing.T) {
+	key := make([]byte, KeyLength)
+	rand.Read(key)
+	salt, err := newPayloadSalt()
+	if err != nil {
+		t.Fatalf("newPayloadSalt failed: %v", err)
+	}
+
+	sizes := []int{0, 1, PayloadChunkSize - 1, PayloadChunkSize, PayloadChunkSize + 1, 3*PayloadChunkSize + 17}
+	for _, size := range sizes {
+		plain := make([]byte, size)
+		rand.Read(plain)
+
+		var sealed bytes.Buffer
+		writer, err := newPayloadWriter(&sealed, key, salt)
+		if err != nil {
+			t.Fatalf("newPayloadWriter failed: %v", err)
+		}
+		if _, err := writer.Write(plain); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		if err := writer.Close(); err != nil {
+			t.Fatalf("Close failed: %v", err)
+		}
+
+		if int64(sealed.Len()) != encryptedPayloadSize(int64(size)) {
+			t.Fatalf("Size %d: expected stored size %d, got %d", size, encryptedPayloadSize(int64(size)), sealed.Len())
+		}
+
+		reader, err := newPayloadReader(bytes.NewReader(sealed.Bytes()), int64(sealed.Len()), key, salt)
+		if err != nil {
+			t.Fatalf("newPayloadReader failed: %v", err)
+		}
+		decrypted, err := io.ReadAll(reader)
+		if err != nil {
+			t.Fatalf("Size %d: read failed: %v", size, err)
+		}
+		if !bytes.Equal(decrypted, plain) {
+			t.Fatalf("Size %d: decrypted data mismatch", size)
+		}
+	}
+}
+
+// TestPayloadTamperDetection тестирует обнаружение повреждения и усечения payload
+func TestPayloadTamperDetection(t *testing.T) {
+	key := make([]byte, KeyLength)
+	rand.Read(key)
+	salt, _ := newPayloadSalt()
+
+	plain := make([]byte, 2*PayloadChunkSize+100)
+	rand.Read(plain)
+
+	var sealed bytes.Buffer
+	writer, _ := newPayloadWriter(&sealed, key, salt)
+	writer.Write(plain)
+	writer.Close()
+	data := sealed.Bytes()
+
+	readAll := func(payload []byte, salt [32]byte) error {
+		reader, err := newPayloadReader(bytes.NewReader(payload), int64(len(payload)), key, salt)
+		if err != nil {
+			return err
+		}
+		_, err = io.ReadAll(reader)
+		return err
+	}
+
+	// Изменённый байт
+	corrupted := append([]byte(nil), data...)
+	corrupted[PayloadChunkSize+10] ^= 0xFF
+	if readAll(corrupted, salt) == nil {
+		t.Error("Expected error for corrupted chunk")
+	}
+
+	// Усечение по границе чанка
+	truncated := data[:2*(PayloadChunkSize+payloadTagSize)]
+	if readAll(truncated, salt) == nil {
+		t.Error("Expected error for truncated payload")
+	}
+
+	// Чужая соль (ключ другого файла)
+	otherSalt, _ := newPayloadSalt()
+	if readAll(data, otherSalt) == nil {
+		t.Error("Expected error for wrong payload key")
+	}
+}
+
+// TestPayloadsAreEncrypted проверяет что содержимое файлов не хранится в открытом виде
+func TestPayloadsAreEncrypted(t *testing.T) {
+	tmpDir := setupCoreTest(t)
+	defer cleanupCoreTest(t, tmpDir)
+
+	vaultPath := filepath.Join(tmpDir, "encrypted.vault")
+	if err := CreateVault(vaultPath, Password(testPassword)); err != nil {
+		t.Fatalf("CreateVault failed: %v", err)
+	}
+
+	secret := strings.Repeat("TOP-SECRET-DOCUMENT ", 200)
+	testFile := createTestFile(t, tmpDir, "secret.txt", secret)
+	if err := AddFileToVault(vaultPath, Password(testPassword), testFile); err != nil {
+		t.Fatalf("AddFileToVault failed: %v", err)
+	}
+
+	entries, err := ListVault(vaultPath, Password(testPassword))
+	if err != nil {
+		t.Fatalf("ListVault failed: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("Expected 1 entry, got %d", len(entries))
+	}
+
+	// Вырезаем payload из файла и пытаемся распаковать его как gzip
+	raw, err := os.ReadFile(vaultPath)
+	if err != nil {
+		t.Fatalf("Failed to read vault: %v", err)
+	}
+	header, err := readVaultHeader(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("readVaultHeader failed: %v", err)
+	}
+	dataStart := header.encodedSize() + int64(header.DirectorySize)
+	payload := raw[dataStart+entries[0].Offset : dataStart+entries[0].Offset+entries[0].CompressedSize]
+
+	if _, err := gzip.NewReader(bytes.NewReader(payload)); err == nil {
+		t.Error("Payload must not be a plain gzip stream")
+	}
+	if bytes.Contains(raw, []byte("TOP-SECRET")) {
+		t.Error("Plaintext found in vault file")
+	}
+
+	outputDir := filepath.Join(tmpDir, "output")
+	if err := ExtractFromVault(vaultPath, Password(testPassword), outputDir); err != nil {
+		t.Fatalf("ExtractFromVault failed: %v", err)
+	}
+	extracted, err := os.ReadFile(filepath.Join(outputDir, "secret.txt"))
+	if err != nil || string(extracted) != secret {
+		t.Fatal("Extracted content mismatch")
+	}
+
+	info, err := GetVaultInfo(vaultPath)
+	if err != nil {
+		t.Fatalf("GetVaultInfo failed: %v", err)
+	}
+	if !info.PayloadsEncrypted {
+		t.Error("Expected PayloadsEncrypted for current vault version")
+	}
+
+	// Повреждение payload должно обнаруживаться при извлечении
+	raw[dataStart+entries[0].Offset+5] ^= 0xFF
+	if err := os.WriteFile(vaultPath, raw, 0644); err != nil {
+		t.Fatalf("Failed to write vault: %v", err)
+	}
+	if err := ExtractFromVault(vaultPath, Password(testPassword), filepath.Join(tmpDir, "tampered")); err == nil {
+		t.Error("Expected error for tampered payload")
+	}
+}
+
+// TestLegacyVaultCompatibility тестирует работу с vault формата v2
+func TestLegacyVaultCompatibility(t *testing.T) {
+	tmpDir := setupCoreTest(t)
+	defer cleanupCoreTest(t, tmpDir)
+
+	vaultPath := filepath.Join(tmpDir, "legacy.vault")
+	createLegacyVault(t, vaultPath, testPassword)
+
+	info, err := GetVaultInfo(vaultPath)
+	if err != nil {
+		t.Fatalf("GetVaultInfo failed: %v", err)
+	}
+	if info.Version != 2 || info.PayloadsEncrypted {
+		t.Fatalf("Expected legacy v2 vault with unencrypted payloads, got version %d (encrypted=%v)", info.Version, info.PayloadsEncrypted)
+	}
+
+	file1 := createTestFile(t, tmpDir, "one.txt", "legacy content one")
+	file2 := createTestFile(t, tmpDir, "two.txt", "legacy content two")
+	if err := AddFileToVault(vaultPath, Password(testPassword), file1); err != nil {
+		t.Fatalf("AddFileToVault failed: %v", err)
+	}
+	if _, err := AddMultipleFilesToVaultParallel(vaultPath, Password(testPassword), []string{file2}, DefaultParallelConfig()); err != nil {
+		t.Fatalf("AddMultipleFilesToVaultParallel failed: %v", err)
+	}
+
+	outputDir := filepath.Join(tmpDir, "output")
+	if err := ExtractFromVault(vaultPath, Password(testPassword), outputDir); err != nil {
+		t.Fatalf("ExtractFromVault failed: %v", err)
+	}
+	for name, expected := range map[string]string{"one.txt": "legacy content one", "two.txt": "legacy content two"} {
+		content, err := os.ReadFile(filepath.Join(outputDir, name))
+		if err != nil || string(content) != expected {
+			t.Errorf("Content mismatch for %s", name)
+		}
+	}
+}
+
+// TestReplaceAndRemoveKeepPayloadsIntact проверяет смещения после замены и удаления файлов
+func TestReplaceAndRemoveKeepPayloadsIntact(t *testing.T) {
+	tmpDir := setupCoreTest(t)
+	defer cleanupCoreTest(t, tmpDir)
+
+	vaultPath := filepath.Join(tmpDir, "offsets.vault")
+	if err := CreateVault(vaultPath, Password(testPassword)); err != nil {
+		t.Fatalf("CreateVault failed: %v", err)
+	}
+
+	first := createTestFile(t, tmpDir, "first.txt", "first version")
+	second := createTestFile(t, tmpDir, "second.txt", strings.Repeat("second ", 50))
+	third := createTestFile(t, tmpDir, "third.txt", "third")
+	for _, path := range []string{first, second, third} {
+		if err := AddFileToVault(vaultPath, Password(testPassword), path); err != nil {
+			t.Fatalf("AddFileToVault failed: %v", err)
+		}
+	}
+
+	// Заменяем первый файл и удаляем второй
+	first = createTestFile(t, tmpDir, "first.txt", "first version, but longer this time")
+	if err := AddFileToVault(vaultPath, Password(testPassword), first); err != nil {
+		t.Fatalf("AddFileToVault (replace) failed: %v", err)
+	}
+	if err := RemoveFromVault(vaultPath, Password(testPassword), []string{"second.txt"}); err != nil {
+		t.Fatalf("RemoveFromVault failed: %v", err)
+	}
+
+	outputDir := filepath.Join(tmpDir, "output")
+	if err := ExtractFromVault(vaultPath, Password(testPassword), outputDir); err != nil {
+		t.Fatalf("ExtractFromVault failed: %v", err)
+	}
+	for name, expected := range map[string]string{"first.txt": "first version, but longer this time", "third.txt": "third"} {
+		content, err := os.ReadFile(filepath.Join(outputDir, name))
+		if err != nil || string(content) != expected {
+			t.Errorf("Content mismatch for %s: %q", name, content)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package vault
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// ========================
+// PUBLIC-KEY RECIPIENTS
+// ========================
+//
+// A vault can be opened for X25519 recipients: a recipient key slot holds the
+// master key sealed to the recipient's public key with an ephemeral key share,
+// and the matching identity (private key) unwraps it. No password is shared.
+
+const (
+	// RecipientPrefix starts every encoded recipient (public key)
+	RecipientPrefix = "flint1"
+
+	// IdentityPrefix starts every encoded identity (private key)
+	IdentityPrefix = "FLINT-SECRET-KEY-"
+
+	// x25519WrapInfo is the HKDF info for keys sealed to X25519 public keys
+	x25519WrapInfo = "flint-vault x25519 wrap v3"
+
+	// maxIdentityFileSize bounds how much of an identity file is read
+	maxIdentityFileSize = 64 * 1024
+)
+
+// Recipient is an X25519 public key a vault can be opened for
+type Recipient struct {
+	key *ecdh.PublicKey
+}
+
+// Identity is an X25519 private key that opens vaults created for its recipient
+type Identity struct {
+	key *ecdh.PrivateKey
+}
+
+// identitySource unlocks a vault with an identity file
+type identitySource struct {
+	path string
+}
+
+// GenerateIdentity creates a new random identity
+func GenerateIdentity() (*Identity, error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("identity generation error: %w", err)
+	}
+	return &Identity{key: key}, nil
+}
+
+// ParseRecipient decodes a recipient as printed by Recipient.String ("flint1...")
+func ParseRecipient(s string) (Recipient, error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, RecipientPrefix) {
+		return Recipient{}, fmt.Errorf("invalid recipient: must start with %q", RecipientPrefix)
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(s, RecipientPrefix))
+	if err != nil {
+		return Recipient{}, fmt.Errorf("invalid recipient encoding: %w", err)
+	}
+
+	key, err := ecdh.X25519().NewPublicKey(raw)
+	if err != nil {
+		return Recipient{}, fmt.Errorf("invalid recipient key: %w", err)
+	}
+	return Recipient{key: key}, nil
+}
+
+// ParseIdentity decodes an identity from the contents of an identity file.
+// Empty lines and lines starting with '#' are ignored.
+func ParseIdentity(data string) (*Identity, error) {
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !strings.HasPrefix(line, IdentityPrefix) {
+			return nil, fmt.Errorf("invalid identity: must start with %q", IdentityPrefix)
+		}
+
+		raw, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(line, IdentityPrefix))
+		if err != nil {
+			return nil, fmt.Errorf("invalid identity encoding: %w", err)
+		}
+
+		key, err := ecdh.X25519().NewPrivateKey(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid identity key: %w", err)
+		}
+		return &Identity{key: key}, nil
+	}
+
+	return nil, fmt.Errorf("no identity found")
+}
+
+// String encodes the recipient ("flint1...")
+func (r Recipient) String() string {
+	return RecipientPrefix + base64.RawURLEncoding.EncodeToString(r.key.Bytes())
+}
+
+// Recipient returns the public key matching the identity
+func (i *Identity) Recipient() Recipient {
+	return Recipient{key: i.key.PublicKey()}
+}
+
+// String encodes the identity ("FLINT-SECRET-KEY-..."); keep it secret
+func (i *Identity) String() string {
+	return IdentityPrefix + base64.RawURLEncoding.EncodeToString(i.key.Bytes())
+}
+
+// IdentityFile returns a key source that opens recipient key slots with the identity
+// stored in a file (as written by the keygen command)
+func IdentityFile(path string) KeySource {
+	return identitySource{path: path}
+}
+
+// Secret returns the raw X25519 private key
+func (s identitySource) Secret() ([]byte, error) {
+	if s.path == "" {
+		return nil, fmt.Errorf("identity file path cannot be empty")
+	}
+
+	file, err := os.Open(s.path)
+	if err != nil {
+		return nil, fmt.Errorf("identity file open error: %w", err)
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, maxIdentityFileSize))
+	if err != nil {
+		return nil, fmt.Errorf("identity file read error: %w", err)
+	}
+	defer clearKey(data)
+
+	identity, err := ParseIdentity(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("identity file %s: %w", s.path, err)
+	}
+	return identity.key.Bytes(), nil
+}
+
+// Description names the key source
+func (s identitySource) Description() string {
+	return "identity"
+}
+
+// x25519WrappingKey derives the key that wraps a secret for a recipient from the ECDH shared secret
+func x25519WrappingKey(shared []byte, ephemeral, recipient []byte) ([]byte, error) {
+	salt := make([]byte, 0, len(ephemeral)+len(recipient))
+	salt = append(salt, ephemeral...)
+	salt = append(salt, recipient...)
+
+	key := make([]byte, KeyLength)
+	reader := hkdf.New(sha256.New, shared, salt, []byte(x25519WrapInfo))
+	if _, err := io.ReadFull(reader, key); err != nil {
+		return nil, fmt.Errorf("wrapping key derivation error: %w", err)
+	}
+	return key, nil
+}
+
+// sealingKeyForRecipient generates an ephemeral key share and returns it together with
+// the key that wraps secrets for the recipient
+func sealingKeyForRecipient(recipient *ecdh.PublicKey) ([32]byte, []byte, error) {
+	var share [32]byte
+
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return share, nil, fmt.Errorf("ephemeral key generation error: %w", err)
+	}
+
+	shared, err := ephemeral.ECDH(recipient)
+	if err != nil {
+		return share, nil, fmt.Errorf("key agreement error: %w", err)
+	}
+	defer clearKey(shared)
+
+	copy(share[:], ephemeral.PublicKey().Bytes())
+	key, err := x25519WrappingKey(shared, share[:], recipient.Bytes())
+	return share, key, err
+}
+
+// openingKeyForIdentity returns the key that unwraps secrets sealed with an ephemeral
+// key share for the identity's public key
+func openingKeyForIdentity(identity *ecdh.PrivateKey, share [32]byte) ([]byte, error) {
+	ephemeral, err := ecdh.X25519().NewPublicKey(share[:])
+	if err != nil {
+		return nil, fmt.Errorf("invalid ephemeral key share: %w", err)
+	}
+
+	shared, err := identity.ECDH(ephemeral)
+	if err != nil {
+		return nil, fmt.Errorf("key agreement error: %w", err)
+	}
+	defer clearKey(shared)
+
+	return x25519WrappingKey(shared, share[:], identity.PublicKey().Bytes())
+}
+
+// recipientSlotKey returns the key that unwraps a recipient slot, or ok=false when the
+// identity belongs to another recipient
+func (s *KeySlot) recipientSlotKey(secret []byte) ([]byte, bool, error) {
+	identity, err := ecdh.X25519().NewPrivateKey(secret)
+	if err != nil {
+		return nil, false, fmt.Errorf("invalid identity key: %w", err)
+	}
+	if !bytes.Equal(identity.PublicKey().Bytes(), s.Recipient[:]) {
+		return nil, false, nil
+	}
+
+	key, err := openingKeyForIdentity(identity, s.Salt)
+	return key, err == nil, err
+}
+
+// wrapMasterKeyForRecipient stores the master key sealed to a recipient in the given slot
+func (h *VaultHeader) wrapMasterKeyForRecipient(index int, recipient Recipient, masterKey []byte) error {
+	if recipient.key == nil {
+		return fmt.Errorf("recipient cannot be empty")
+	}
+
+	slot := KeySlot{Kind: KeySlotRecipient}
+	copy(slot.Recipient[:], recipient.key.Bytes())
+	if _, err := rand.Read(slot.WrapNonce[:]); err != nil {
+		return fmt.Errorf("nonce generation error: %w", err)
+	}
+
+	share, kek, err := sealingKeyForRecipient(recipient.key)
+	if err != nil {
+		return err
+	}
+	defer clearKey(kek)
+	slot.Salt = share
+
+	gcm, err := newKeyWrapGCM(kek)
+	if err != nil {
+		return err
+	}
+
+	h.KeySlots[index] = slot
+	copy(h.KeySlots[index].WrappedKey[:], gcm.Seal(nil, slot.WrapNonce[:], masterKey, h.keyWrapAssociatedData(index)))
+	return nil
+}
+
+// AddRecipientSlot wraps the master key for a recipient in a free key slot and returns
+// the slot index. keySource must unlock an existing slot.
+func AddRecipientSlot(vaultPath string, keySource KeySource, recipient Recipient) (int, error) {
+	return addKeySlot(vaultPath, keySource, func(header *VaultHeader, index int, masterKey []byte) error {
+		return header.wrapMasterKeyForRecipient(index, recipient, masterKey)
+	})
+}
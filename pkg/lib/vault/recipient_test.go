@@ -0,0 +1,176 @@
+package vault
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// createTestIdentity создаёт identity и сохраняет её в файл
+func createTestIdentity(t *testing.T, dir, name string) (*Identity, string) {
+	t.Helper()
+
+	identity, err := GenerateIdentity()
+	if err != nil {
+		t.Fatalf("GenerateIdentity failed: %v", err)
+	}
+	path := filepath.Join(dir, name)
+	content := "# public key: " + identity.Recipient().String() + "\n" + identity.String() + "\n"
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("Failed to create identity file: %v", err)
+	}
+	return identity, path
+}
+
+// TestRecipientEncoding тестирует разбор recipient и identity
+func TestRecipientEncoding(t *testing.T) {
+	identity, err := GenerateIdentity()
+	if err != nil {
+		t.Fatalf("GenerateIdentity failed: %v", err)
+	}
+
+	encoded := identity.Recipient().String()
+	if !strings.HasPrefix(encoded, RecipientPrefix) {
+		t.Fatalf("Unexpected recipient encoding: %s", encoded)
+	}
+	recipient, err := ParseRecipient(encoded)
+	if err != nil {
+		t.Fatalf("ParseRecipient failed: %v", err)
+	}
+	if recipient.String() != encoded {
+		t.Error("Recipient round trip mismatch")
+	}
+
+	parsed, err := ParseIdentity("# comment\n\n" + identity.String() + "\n")
+	if err != nil {
+		t.Fatalf("ParseIdentity failed: %v", err)
+	}
+	if parsed.Recipient().String() != encoded {
+		t.Error("Identity round trip mismatch")
+	}
+
+	for _, invalid := range []string{"", "age1abc", RecipientPrefix + "!!!", RecipientPrefix + "AAAA"} {
+		if _, err := ParseRecipient(invalid); err == nil {
+			t.Errorf("Expected error for recipient %q", invalid)
+		}
+	}
+	for _, invalid := range []string{"", "# only a comment\n", "not-an-identity", IdentityPrefix + "AAAA"} {
+		if _, err := ParseIdentity(invalid); err == nil {
+			t.Errorf("Expected error for identity %q", invalid)
+		}
+	}
+}
+
+// TestRecipientVault тестирует vault, открываемый несколькими identity без пароля
+func TestRecipientVault(t *testing.T) {
+	tmpDir := setupCoreTest(t)
+	defer cleanupCoreTest(t, tmpDir)
+
+	alice, aliceFile := createTestIdentity(t, tmpDir, "alice.txt")
+	bob, bobFile := createTestIdentity(t, tmpDir, "bob.txt")
+	_, eveFile := createTestIdentity(t, tmpDir, "eve.txt")
+
+	vaultPath := filepath.Join(tmpDir, "recipients.vault")
+	recipients := []Recipient{alice.Recipient(), bob.Recipient()}
+	if err := CreateVaultWithRecipients(vaultPath, nil, DefaultKDFParams(), recipients); err != nil {
+		t.Fatalf("CreateVaultWithRecipients failed: %v", err)
+	}
+
+	testFile := createTestFile(t, tmpDir, "data.txt", testContent)
+	if err := AddFileToVault(vaultPath, IdentityFile(aliceFile), testFile); err != nil {
+		t.Fatalf("AddFileToVault failed: %v", err)
+	}
+
+	outputDir := filepath.Join(tmpDir, "output")
+	if err := ExtractFromVault(vaultPath, IdentityFile(bobFile), outputDir); err != nil {
+		t.Fatalf("ExtractFromVault failed: %v", err)
+	}
+	content, err := os.ReadFile(filepath.Join(outputDir, "data.txt"))
+	if err != nil || string(content) != testContent {
+		t.Fatal("Extracted content mismatch")
+	}
+
+	// Чужая identity и пароль не открывают vault
+	if _, err := ListVault(vaultPath, IdentityFile(eveFile)); !errors.Is(err, ErrInvalidPassword) {
+		t.Errorf("Expected ErrInvalidPassword for foreign identity, got %v", err)
+	}
+	if _, err := ListVault(vaultPath, Password(testPassword)); !errors.Is(err, ErrInvalidPassword) {
+		t.Errorf("Expected ErrInvalidPassword for password, got %v", err)
+	}
+	if _, err := ListVault(vaultPath, IdentityFile(filepath.Join(tmpDir, "missing.txt"))); err == nil {
+		t.Error("Expected error for missing identity file")
+	}
+
+	slots, err := ListKeySlots(vaultPath)
+	if err != nil || len(slots) != 2 {
+		t.Fatalf("Expected 2 key slots, got %d (%v)", len(slots), err)
+	}
+	for i, slot := range slots {
+		if slot.Kind != KeySlotRecipient || slot.Recipient != recipients[i].String() {
+			t.Errorf("Slot %d: unexpected %+v", i, slot)
+		}
+	}
+
+	// Пароль можно добавить через слот, identity — нельзя
+	if _, err := AddKeySlot(vaultPath, IdentityFile(aliceFile), Password(testPassword), testArgon2Params); err != nil {
+		t.Fatalf("AddKeySlot failed: %v", err)
+	}
+	if _, err := ListVault(vaultPath, Password(testPassword)); err != nil {
+		t.Errorf("ListVault with added password failed: %v", err)
+	}
+	if _, err := AddKeySlot(vaultPath, Password(testPassword), IdentityFile(eveFile), testArgon2Params); err == nil {
+		t.Error("Expected error for adding an identity as a key slot")
+	}
+	if err := ChangeVaultPassword(vaultPath, IdentityFile(bobFile), Password("Another789!")); err == nil {
+		t.Error("Expected error for changing the password of a recipient slot")
+	}
+}
+
+// TestAddRecipientSlot тестирует добавление recipient к vault с паролем
+func TestAddRecipientSlot(t *testing.T) {
+	tmpDir := setupCoreTest(t)
+	defer cleanupCoreTest(t, tmpDir)
+
+	vaultPath := filepath.Join(tmpDir, "password.vault")
+	if err := CreateVaultWithKDF(vaultPath, Password(testPassword), testArgon2Params); err != nil {
+		t.Fatalf("CreateVaultWithKDF failed: %v", err)
+	}
+	testFile := createTestFile(t, tmpDir, "data.txt", testContent)
+	if err := AddFileToVault(vaultPath, Password(testPassword), testFile); err != nil {
+		t.Fatalf("AddFileToVault failed: %v", err)
+	}
+
+	identity, identityFile := createTestIdentity(t, tmpDir, "identity.txt")
+	if _, err := ListVault(vaultPath, IdentityFile(identityFile)); !errors.Is(err, ErrInvalidPassword) {
+		t.Errorf("Expected ErrInvalidPassword before adding the recipient, got %v", err)
+	}
+
+	index, err := AddRecipientSlot(vaultPath, Password(testPassword), identity.Recipient())
+	if err != nil || index != 1 {
+		t.Fatalf("AddRecipientSlot failed: slot %d, %v", index, err)
+	}
+	if entries, err := ListVault(vaultPath, IdentityFile(identityFile)); err != nil || len(entries) != 1 {
+		t.Fatalf("ListVault with identity failed: %v", err)
+	}
+
+	if err := RemoveKeySlot(vaultPath, IdentityFile(identityFile), 0); err != nil {
+		t.Fatalf("RemoveKeySlot failed: %v", err)
+	}
+	if _, err := ListVault(vaultPath, Password(testPassword)); !errors.Is(err, ErrInvalidPassword) {
+		t.Errorf("Expected ErrInvalidPassword for removed password slot, got %v", err)
+	}
+
+	// Слишком много recipient при создании
+	var recipients []Recipient
+	for i := 0; i < MaxKeySlots; i++ {
+		recipients = append(recipients, identity.Recipient())
+	}
+	if err := CreateVaultWithRecipients(filepath.Join(tmpDir, "full.vault"), Password(testPassword), testArgon2Params, recipients); err == nil {
+		t.Error("Expected error for too many recipients")
+	}
+	if err := CreateVaultWithRecipients(filepath.Join(tmpDir, "none.vault"), nil, testArgon2Params, nil); err == nil {
+		t.Error("Expected error for a vault without keys")
+	}
+}
@@ -0,0 +1,535 @@
+package vault
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+)
+
+// ========================
+// CRASH RECOVERY
+// ========================
+//
+// A write can be interrupted in three ways. A rewrite (legacy vaults, compaction,
+// creation) builds the new vault in a uniquely named temp file next to it and renames
+// it over the vault, so a crash leaves a stale "<vault>.<random>.tmp". An append to a
+// v3+ vault is only committed by the trailer written last, so a crash leaves a tail
+// that does not end in a trailer. Opening the vault reports such a tail; recovery
+// cuts it off or, for a rewrite that was complete but not yet renamed, finishes it.
+// A header rewrite (password and key slot changes) overwrites the header in place after
+// saving the new header to "<vault>.header", so a crash that tears the header leaves a
+// complete copy; recovery writes it back.
+
+// ErrInterruptedWrite is returned when a vault ends in a partial append; RecoverVault repairs it
+var ErrInterruptedWrite = errors.New("vault has an interrupted write")
+
+// tempFileSuffix ends the name of every temp file of a rewrite
+const tempFileSuffix = ".tmp"
+
+// headerCopySuffix ends the name of the copy of a header being rewritten in place
+const headerCopySuffix = ".header"
+
+// RecoverOptions controls a recovery
+type RecoverOptions struct {
+	// DryRun only reports the leftovers of interrupted writes
+	DryRun bool
+}
+
+// RecoveryReport lists the leftovers of interrupted writes and what recovery did with them
+type RecoveryReport struct {
+	CompletedTempFile  string   // Complete rewrite that replaced the vault
+	DiscardedTempFiles []string // Partial or outdated rewrites that were removed
+	TruncatedBytes     int64    // Partially appended bytes cut off the end of the vault
+	RestoredHeader     bool     // Header torn by an interrupted rewrite was written back from its copy
+}
+
+// Clean reports whether no interrupted writes were found
+func (r *RecoveryReport) Clean() bool {
+	return r.CompletedTempFile == "" && len(r.DiscardedTempFiles) == 0 && r.TruncatedBytes == 0 && !r.RestoredHeader
+}
+
+// createVaultTempFile creates a uniquely named temp file next to the vault for a rewrite.
+// It gets the permissions of the vault if the vault exists, and 0600 otherwise.
+func createVaultTempFile(vaultPath string) (*os.File, error) {
+	tempFile, err := os.CreateTemp(filepath.Dir(vaultPath), filepath.Base(vaultPath)+".*"+tempFileSuffix)
+	if err != nil {
+		return nil, fmt.Errorf("temp file creation error: %w", err)
+	}
+
+	if info, err := os.Stat(vaultPath); err == nil {
+		if err := tempFile.Chmod(info.Mode().Perm()); err != nil {
+			tempFile.Close()
+			os.Remove(tempFile.Name())
+			return nil, fmt.Errorf("temp file permission error: %w", err)
+		}
+	}
+	return tempFile, nil
+}
+
+// replaceVaultFile flushes and closes a finished temp file and renames it over the vault.
+// The directory is synced too, so the rename survives a crash.
+func replaceVaultFile(tempFile *os.File, vaultPath string) error {
+	if err := tempFile.Sync(); err != nil {
+		return fmt.Errorf("temp file sync error: %w", err)
+	}
+	if err := tempFile.Close(); err != nil {
+		return fmt.Errorf("temp file close error: %w", err)
+	}
+
+	if err := os.Rename(tempFile.Name(), vaultPath); err != nil {
+		return fmt.Errorf("file replacement error: %w", err)
+	}
+
+	return syncDir(filepath.Dir(vaultPath))
+}
+
+// headerCopyPath returns the path of the copy saved while the header is rewritten in place
+func headerCopyPath(vaultPath string) string {
+	return vaultPath + headerCopySuffix
+}
+
+// writeHeaderCopy durably saves the encoded header about to be written over the vault header
+func writeHeaderCopy(vaultPath string, encoded []byte) error {
+	file, err := os.OpenFile(headerCopyPath(vaultPath), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("header copy creation error: %w", err)
+	}
+	defer file.Close()
+
+	if _, err := file.Write(encoded); err != nil {
+		return fmt.Errorf("header copy write error: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("header copy sync error: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("header copy close error: %w", err)
+	}
+	return syncDir(filepath.Dir(vaultPath))
+}
+
+// syncDir flushes a directory, making renames and new files in it durable.
+// Windows cannot sync directories and commits renames on its own.
+func syncDir(path string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+
+	dir, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("directory open error: %w", err)
+	}
+	defer dir.Close()
+
+	if err := dir.Sync(); err != nil {
+		return fmt.Errorf("directory sync error: %w", err)
+	}
+	return nil
+}
+
+// findVaultTempFiles returns the temp files left next to the vault by interrupted
+// rewrites, including the fixed "<vault>.tmp" of older versions
+func findVaultTempFiles(vaultPath string) ([]string, error) {
+	dir, base := filepath.Dir(vaultPath), filepath.Base(vaultPath)
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("directory read error: %w", err)
+	}
+
+	var tempPaths []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.Type().IsRegular() && strings.HasPrefix(name, base+".") && strings.HasSuffix(name, tempFileSuffix) {
+			tempPaths = append(tempPaths, filepath.Join(dir, name))
+		}
+	}
+	return tempPaths, nil
+}
+
+// RecoverVault finds the leftovers of writes interrupted by a crash and completes or
+// discards them. A temp file that holds a complete vault newer than the vault replaces
+// it; other temp files are removed. A partially appended tail is cut off, back to the
+// newest directory that was committed. A vault whose end looks committed but does not
+// authenticate is damaged rather than interrupted and is left alone.
+func RecoverVault(vaultPath string, keySource KeySource, opts RecoverOptions) (*RecoveryReport, error) {
+	if keySource == nil {
+		return nil, fmt.Errorf("key source cannot be nil")
+	}
+
+	// Lock the vault against other goroutines and processes
+	unlock, err := lockVault(vaultPath, true)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	report := &RecoveryReport{}
+
+	// A header torn by an interrupted header rewrite is written back from its copy
+	// before the key can be checked against it
+	restored, discarded, err := recoverVaultHeader(vaultPath, keySource, opts.DryRun)
+	if err != nil {
+		return nil, err
+	}
+	report.RestoredHeader = restored
+	if discarded != "" {
+		report.DiscardedTempFiles = append(report.DiscardedTempFiles, discarded)
+	}
+	if restored && opts.DryRun {
+		return report, nil
+	}
+
+	vaultInfo, err := os.Stat(vaultPath)
+	vaultExists := err == nil
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("file stat error: %w", err)
+	}
+
+	// The vault must open with the key before any temp file is judged by it
+	if vaultExists {
+		if err := checkVaultKey(vaultPath, keySource); err != nil {
+			return nil, err
+		}
+	}
+
+	tempPaths, err := findVaultTempFiles(vaultPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// Of the complete rewrites newer than the vault, the newest wins
+	var newest string
+	var newestInfo os.FileInfo
+	for _, tempPath := range tempPaths {
+		tempInfo, err := os.Stat(tempPath)
+		if err != nil {
+			return nil, fmt.Errorf("file stat error: %w", err)
+		}
+
+		complete, err := isCompleteVaultFile(tempPath, keySource)
+		if err != nil {
+			// Without a vault that confirms the key, a temp file that does not open may
+			// still be the only copy of a new vault
+			if !vaultExists || !errors.Is(err, ErrInvalidPassword) {
+				return nil, err
+			}
+			complete = false
+		}
+		if !complete || (vaultExists && !tempInfo.ModTime().After(vaultInfo.ModTime())) {
+			continue
+		}
+		if newestInfo == nil || tempInfo.ModTime().After(newestInfo.ModTime()) {
+			newest, newestInfo = tempPath, tempInfo
+		}
+	}
+
+	for _, tempPath := range tempPaths {
+		if tempPath == newest {
+			continue
+		}
+		report.DiscardedTempFiles = append(report.DiscardedTempFiles, tempPath)
+		if !opts.DryRun {
+			if err := os.Remove(tempPath); err != nil {
+				return nil, fmt.Errorf("temp file removal error: %w", err)
+			}
+		}
+	}
+
+	if newest != "" {
+		report.CompletedTempFile = newest
+		if opts.DryRun {
+			return report, nil
+		}
+
+		if err := os.Rename(newest, vaultPath); err != nil {
+			return nil, fmt.Errorf("file replacement error: %w", err)
+		}
+		if err := syncDir(filepath.Dir(vaultPath)); err != nil {
+			return nil, err
+		}
+		vaultExists = true
+	}
+
+	if !vaultExists {
+		return report, nil
+	}
+
+	truncated, err := recoverVaultTail(vaultPath, keySource, opts.DryRun)
+	if err != nil {
+		return nil, err
+	}
+	report.TruncatedBytes = truncated
+
+	return report, nil
+}
+
+// recoverVaultHeader handles the header copy left by an interrupted header rewrite. If
+// the vault header is torn, the copy is written back once the key source unlocks it and
+// the directory authenticates with it; if the header is intact, the rewrite either never
+// began or finished and the copy is only removed. It reports whether the header was
+// restored and the path of a removed copy.
+func recoverVaultHeader(vaultPath string, keySource KeySource, dryRun bool) (bool, string, error) {
+	copyPath := headerCopyPath(vaultPath)
+	encoded, err := os.ReadFile(copyPath)
+	if os.IsNotExist(err) {
+		return false, "", nil
+	}
+	if err != nil {
+		return false, "", fmt.Errorf("header copy read error: %w", err)
+	}
+
+	discard := func() (bool, string, error) {
+		if !dryRun {
+			if err := os.Remove(copyPath); err != nil {
+				return false, "", fmt.Errorf("header copy removal error: %w", err)
+			}
+		}
+		return false, copyPath, nil
+	}
+
+	flag := os.O_RDWR
+	if dryRun {
+		flag = os.O_RDONLY
+	}
+	file, err := os.OpenFile(vaultPath, flag, 0)
+	if os.IsNotExist(err) {
+		return discard()
+	}
+	if err != nil {
+		return false, "", fmt.Errorf("vault file open error: %w", err)
+	}
+	defer file.Close()
+
+	if current, err := readVaultHeader(file); err == nil && current.verifyChecksum() == nil {
+		// Like temp files, the copy is only removed with a key that unlocks the vault
+		key, err := unlockVaultKey(keySource, current)
+		if err != nil {
+			return false, "", err
+		}
+		clearKey(key)
+		return discard()
+	}
+
+	header, err := readVaultHeader(bytes.NewReader(encoded))
+	if err != nil || header.Version < HeaderAuthVersion || int64(len(encoded)) != header.encodedSize() || header.verifyChecksum() != nil {
+		return false, "", fmt.Errorf("%w: header checksum mismatch and its saved copy is incomplete", ErrHeaderTampered)
+	}
+
+	// Unlocking checks the keyed checksum of the copy, and the directory after the
+	// header is bound to it, so only a copy of this vault's header is written back
+	key, err := unlockVaultKey(keySource, header)
+	if err != nil {
+		return false, "", err
+	}
+	defer clearKey(key)
+	if _, _, err := openBaseBody(file, key, header); err != nil {
+		return false, "", fmt.Errorf("saved header copy does not match the vault: %w", err)
+	}
+
+	if dryRun {
+		return true, "", nil
+	}
+	if _, err := file.WriteAt(encoded, 0); err != nil {
+		return false, "", fmt.Errorf("header write error: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		return false, "", fmt.Errorf("vault file sync error: %w", err)
+	}
+	if err := os.Remove(copyPath); err != nil {
+		return false, "", fmt.Errorf("header copy removal error: %w", err)
+	}
+	return true, "", nil
+}
+
+// checkVaultKey verifies that the key source unlocks the vault, whether or not the
+// end of the file is intact
+func checkVaultKey(vaultPath string, keySource KeySource) error {
+	header, err := readVaultHeaderFile(vaultPath)
+	if err != nil {
+		return fmt.Errorf("header read error: %w", err)
+	}
+
+	key, err := unlockVaultKey(keySource, header)
+	if err != nil {
+		return err
+	}
+	clearKey(key)
+	return nil
+}
+
+// isCompleteVaultFile reports whether a temp file holds a whole vault that opens with
+// the key source. A key source that does not unlock it is reported as an error.
+func isCompleteVaultFile(path string, keySource KeySource) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, fmt.Errorf("temp file open error: %w", err)
+	}
+	defer file.Close()
+
+	header, err := readVaultHeader(file)
+	if err != nil || string(header.Magic[:]) != VaultMagic {
+		return false, nil
+	}
+
+	key, err := unlockVaultKey(keySource, header)
+	if err != nil {
+		return false, err
+	}
+	defer clearKey(key)
+
+	info, err := file.Stat()
+	if err != nil {
+		return false, fmt.Errorf("file stat error: %w", err)
+	}
+
+	vaultDir, err := readCurrentDirectory(file, header, key, info.Size())
+	if err != nil {
+		return false, nil
+	}
+
+	// A rewrite writes the payloads after the directory, so a partial one misses some
+	return payloadDataEnd(header, vaultDir.Entries) <= info.Size(), nil
+}
+
+// recoverVaultTail cuts a partially appended tail off the vault and returns its size.
+// Only a file that does not end in a trailer was interrupted; one that ends in a trailer
+// but does not open is reported as damaged.
+func recoverVaultTail(vaultPath string, keySource KeySource, dryRun bool) (int64, error) {
+	flag := os.O_RDWR
+	if dryRun {
+		flag = os.O_RDONLY
+	}
+	file, err := os.OpenFile(vaultPath, flag, 0)
+	if err != nil {
+		return 0, fmt.Errorf("vault file open error: %w", err)
+	}
+	defer file.Close()
+
+	header, err := readVaultHeader(file)
+	if err != nil {
+		return 0, fmt.Errorf("header read error: %w", err)
+	}
+
+	key, err := unlockVaultKey(keySource, header)
+	if err != nil {
+		return 0, err
+	}
+	defer clearKey(key)
+
+	info, err := file.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("file stat error: %w", err)
+	}
+	size := info.Size()
+
+	openErr := func() error {
+		_, err := readCurrentDirectory(file, header, key, size)
+		return err
+	}()
+	if openErr == nil {
+		return 0, nil
+	}
+	if !isInterruptedWrite(file, header, size, openErr) {
+		return 0, fmt.Errorf("vault is damaged, not interrupted: %w", openErr)
+	}
+
+	// Walk back over the places where an earlier append was committed
+	commitEnds, err := findTrailerEnds(file, header, size)
+	if err != nil {
+		return 0, err
+	}
+	baseDir, err := openBaseDirectory(file, key, header)
+	if err != nil {
+		return 0, err
+	}
+	baseEnd := payloadDataEnd(header, baseDir.Entries)
+	if baseEnd < size {
+		commitEnds = append(commitEnds, baseEnd)
+	}
+
+	for _, end := range commitEnds {
+		if _, err := readCurrentDirectory(file, header, key, end); err != nil {
+			continue
+		}
+
+		if !dryRun {
+			if err := file.Truncate(end); err != nil {
+				return 0, fmt.Errorf("vault file truncate error: %w", err)
+			}
+			if err := file.Sync(); err != nil {
+				return 0, fmt.Errorf("vault file sync error: %w", err)
+			}
+		}
+		return size - end, nil
+	}
+
+	return 0, fmt.Errorf("no committed directory found: %w", openErr)
+}
+
+// isInterruptedWrite reports whether the vault failed to open with err because an append
+// was cut short: every append ends in a trailer, and no directory failed authentication
+func isInterruptedWrite(file *os.File, header *VaultHeader, size int64, err error) bool {
+	return header.usesVaultLog() && !errors.Is(err, ErrHeaderTampered) && !endsInTrailer(file, header, size)
+}
+
+// endsInTrailer reports whether the first size bytes of the vault end in a log or inbox trailer
+func endsInTrailer(file *os.File, header *VaultHeader, size int64) bool {
+	magic := make([]byte, len(logMagic))
+	if size-int64(len(magic)) < header.encodedSize()+int64(header.DirectorySize) {
+		return false
+	}
+	if _, err := file.ReadAt(magic, size-int64(len(magic))); err != nil {
+		return false
+	}
+	return string(magic) == logMagic || string(magic) == inboxMagic
+}
+
+// findTrailerEnds scans the vault data before size for trailer magics and returns the
+// offsets just past them, newest first. Most are commits; the odd match inside
+// encrypted data is rejected when the directory it would locate fails to open.
+func findTrailerEnds(file *os.File, header *VaultHeader, size int64) ([]int64, error) {
+	dataStart := header.encodedSize() + int64(header.DirectorySize)
+	magics := [][]byte{[]byte(logMagic), []byte(inboxMagic)}
+	overlap := int64(max(len(logMagic), len(inboxMagic)) - 1)
+
+	var ends []int64
+	buffer := make([]byte, StreamBufferSize)
+	for chunkEnd := size; chunkEnd > dataStart; {
+		chunkStart := max(chunkEnd-int64(len(buffer)), dataStart)
+		chunk := buffer[:chunkEnd-chunkStart]
+		if _, err := file.ReadAt(chunk, chunkStart); err != nil && err != io.EOF {
+			return nil, fmt.Errorf("vault data read error: %w", err)
+		}
+
+		for _, magic := range magics {
+			for offset := 0; ; {
+				index := bytes.Index(chunk[offset:], magic)
+				if index < 0 {
+					break
+				}
+				end := chunkStart + int64(offset+index+len(magic))
+				// Matches spanning two chunks are found in both
+				if end < size && !slices.Contains(ends, end) {
+					ends = append(ends, end)
+				}
+				offset += index + 1
+			}
+		}
+
+		if chunkStart == dataStart {
+			break
+		}
+		chunkEnd = chunkStart + overlap
+	}
+
+	slices.Sort(ends)
+	slices.Reverse(ends)
+	return ends, nil
+}
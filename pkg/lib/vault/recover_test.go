@@ -0,0 +1,519 @@
+package vault
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// truncateTestVault записывает в vault первые size байт его прежнего содержимого
+func truncateTestVault(t *testing.T, vaultPath string, data []byte, size int64) {
+	t.Helper()
+
+	if err := os.WriteFile(vaultPath, data[:size], 0600); err != nil {
+		t.Fatalf("Failed to write vault: %v", err)
+	}
+}
+
+// TestRecoverInterruptedAppend тестирует восстановление после обрыва дописывания на любом этапе
+func TestRecoverInterruptedAppend(t *testing.T) {
+	tmpDir := setupCoreTest(t)
+	defer cleanupCoreTest(t, tmpDir)
+
+	vaultPath := filepath.Join(tmpDir, "recover.vault")
+	if err := CreateVaultWithKDF(vaultPath, Password(testPassword), testArgon2Params); err != nil {
+		t.Fatalf("CreateVaultWithKDF failed: %v", err)
+	}
+	kept := createTestFile(t, tmpDir, "kept.txt", testContent)
+	if err := AddFileToVault(vaultPath, Password(testPassword), kept); err != nil {
+		t.Fatalf("AddFileToVault failed: %v", err)
+	}
+	committed := vaultFileSize(t, vaultPath)
+
+	// Дописывание с ключом и без него, обрезанное в данных, директории и трейлере
+	data := make([]byte, 3*PayloadChunkSize)
+	rand.Read(data)
+	lostPath := filepath.Join(tmpDir, "lost.bin")
+	if err := os.WriteFile(lostPath, data, 0644); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+
+	writers := map[string]func() error{
+		"add": func() error {
+			return AddFileToVault(vaultPath, Password(testPassword), lostPath)
+		},
+		"append": func() error {
+			return AppendToVault(vaultPath, lostPath)
+		},
+	}
+
+	for name, write := range writers {
+		t.Run(name, func(t *testing.T) {
+			truncateTestVault(t, vaultPath, mustReadFile(t, vaultPath), committed)
+			if err := write(); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+			full := mustReadFile(t, vaultPath)
+			appended := int64(len(full)) - committed
+
+			for _, cut := range []int64{1, PayloadChunkSize, appended / 2, appended - 70, appended - 1} {
+				truncateTestVault(t, vaultPath, full, committed+cut)
+
+				if _, err := ListVault(vaultPath, Password(testPassword)); !errors.Is(err, ErrInterruptedWrite) {
+					t.Fatalf("Cut at %d: expected ErrInterruptedWrite, got %v", cut, err)
+				}
+
+				dryRun, err := RecoverVault(vaultPath, Password(testPassword), RecoverOptions{DryRun: true})
+				if err != nil || dryRun.TruncatedBytes != cut || vaultFileSize(t, vaultPath) != committed+cut {
+					t.Fatalf("Cut at %d: dry run reported %+v (%v)", cut, dryRun, err)
+				}
+
+				report, err := RecoverVault(vaultPath, Password(testPassword), RecoverOptions{})
+				if err != nil {
+					t.Fatalf("Cut at %d: RecoverVault failed: %v", cut, err)
+				}
+				if report.TruncatedBytes != cut || vaultFileSize(t, vaultPath) != committed {
+					t.Errorf("Cut at %d: truncated %d bytes", cut, report.TruncatedBytes)
+				}
+
+				entries, err := ListVault(vaultPath, Password(testPassword))
+				if err != nil || len(entries) != 1 || entries[0].Path != "kept.txt" {
+					t.Fatalf("Cut at %d: vault not recovered: %v", cut, err)
+				}
+			}
+
+			// Восстановленный vault принимает новые записи
+			if err := write(); err != nil {
+				t.Fatalf("Write after recovery failed: %v", err)
+			}
+			if entries, err := ListVault(vaultPath, Password(testPassword)); err != nil || len(entries) != 2 {
+				t.Errorf("ListVault after recovery failed: %v", err)
+			}
+		})
+	}
+
+	// Целый vault восстанавливать нечего
+	report, err := RecoverVault(vaultPath, Password(testPassword), RecoverOptions{})
+	if err != nil || !report.Clean() {
+		t.Errorf("Expected a clean report, got %+v (%v)", report, err)
+	}
+	if _, err := RecoverVault(vaultPath, Password("WrongPassword1!"), RecoverOptions{}); err == nil {
+		t.Error("Expected error for wrong password")
+	}
+}
+
+// TestRecoverDamagedVault тестирует отказ обрезать vault с повреждённой директорией
+func TestRecoverDamagedVault(t *testing.T) {
+	tmpDir := setupCoreTest(t)
+	defer cleanupCoreTest(t, tmpDir)
+
+	vaultPath := filepath.Join(tmpDir, "damaged.vault")
+	if err := CreateVaultWithKDF(vaultPath, Password(testPassword), testArgon2Params); err != nil {
+		t.Fatalf("CreateVaultWithKDF failed: %v", err)
+	}
+	testFile := createTestFile(t, tmpDir, "data.txt", testContent)
+	if err := AddFileToVault(vaultPath, Password(testPassword), testFile); err != nil {
+		t.Fatalf("AddFileToVault failed: %v", err)
+	}
+
+	data := mustReadFile(t, vaultPath)
+	data[len(data)-60] ^= 0xFF
+	if err := os.WriteFile(vaultPath, data, 0600); err != nil {
+		t.Fatalf("Failed to write vault: %v", err)
+	}
+
+	if _, err := RecoverVault(vaultPath, Password(testPassword), RecoverOptions{}); !errors.Is(err, ErrHeaderTampered) {
+		t.Errorf("Expected ErrHeaderTampered, got %v", err)
+	}
+	if vaultFileSize(t, vaultPath) != int64(len(data)) {
+		t.Error("Damaged vault must not be truncated")
+	}
+}
+
+// TestRecoverTempFiles тестирует завершение и удаление временных файлов прерванной перезаписи
+func TestRecoverTempFiles(t *testing.T) {
+	tmpDir := setupCoreTest(t)
+	defer cleanupCoreTest(t, tmpDir)
+
+	vaultPath := filepath.Join(tmpDir, "rewrite.vault")
+	if err := CreateVaultWithKDF(vaultPath, Password(testPassword), testArgon2Params); err != nil {
+		t.Fatalf("CreateVaultWithKDF failed: %v", err)
+	}
+	if temps, _ := findVaultTempFiles(vaultPath); len(temps) != 0 {
+		t.Fatalf("Writes left temp files: %v", temps)
+	}
+
+	data := make([]byte, 2*PayloadChunkSize)
+	rand.Read(data)
+	dataPath := filepath.Join(tmpDir, "data.bin")
+	if err := os.WriteFile(dataPath, data, 0644); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	if err := AddFileToVault(vaultPath, Password(testPassword), dataPath); err != nil {
+		t.Fatalf("AddFileToVault failed: %v", err)
+	}
+	before := mustReadFile(t, vaultPath)
+
+	// Сжатая копия с ещё одним файлом — результат перезаписи, не успевшей заменить vault
+	if err := AddFileToVault(vaultPath, Password(testPassword), createTestFile(t, tmpDir, "new.txt", testContent)); err != nil {
+		t.Fatalf("AddFileToVault failed: %v", err)
+	}
+	if _, err := CompactVault(vaultPath, Password(testPassword), CompactOptions{}); err != nil {
+		t.Fatalf("CompactVault failed: %v", err)
+	}
+	rewritten := mustReadFile(t, vaultPath)
+	header := readTestHeader(t, vaultPath)
+	if err := os.WriteFile(vaultPath, before, 0600); err != nil {
+		t.Fatalf("Failed to write vault: %v", err)
+	}
+
+	now := time.Now()
+	temps := map[string]struct {
+		data    []byte
+		modTime time.Time
+	}{
+		"complete": {rewritten, now.Add(time.Minute)},
+		"partial":  {rewritten[:header.encodedSize()+int64(header.DirectorySize)+100], now.Add(2 * time.Minute)},
+		"outdated": {rewritten, now.Add(-time.Hour)},
+	}
+	for name, temp := range temps {
+		path := vaultPath + "." + name + ".tmp"
+		if err := os.WriteFile(path, temp.data, 0600); err != nil {
+			t.Fatalf("Failed to write temp file: %v", err)
+		}
+		if err := os.Chtimes(path, temp.modTime, temp.modTime); err != nil {
+			t.Fatalf("Failed to set modification time: %v", err)
+		}
+	}
+	// Временный файл прежних версий с фиксированным именем
+	if err := os.WriteFile(vaultPath+".tmp", []byte("partial"), 0600); err != nil {
+		t.Fatalf("Failed to write temp file: %v", err)
+	}
+
+	dryRun, err := RecoverVault(vaultPath, Password(testPassword), RecoverOptions{DryRun: true})
+	if err != nil {
+		t.Fatalf("RecoverVault (dry run) failed: %v", err)
+	}
+	if filepath.Base(dryRun.CompletedTempFile) != "rewrite.vault.complete.tmp" || len(dryRun.DiscardedTempFiles) != 3 {
+		t.Fatalf("Unexpected dry run report: %+v", dryRun)
+	}
+	if remaining, _ := findVaultTempFiles(vaultPath); len(remaining) != 4 {
+		t.Fatal("Dry run must not remove temp files")
+	}
+
+	report, err := RecoverVault(vaultPath, Password(testPassword), RecoverOptions{})
+	if err != nil {
+		t.Fatalf("RecoverVault failed: %v", err)
+	}
+	if report.CompletedTempFile != dryRun.CompletedTempFile || len(report.DiscardedTempFiles) != 3 {
+		t.Errorf("Unexpected report: %+v", report)
+	}
+	if remaining, _ := findVaultTempFiles(vaultPath); len(remaining) != 0 {
+		t.Errorf("Temp files left after recovery: %v", remaining)
+	}
+	if entries, err := ListVault(vaultPath, Password(testPassword)); err != nil || len(entries) != 2 {
+		t.Errorf("Completed rewrite not in place: %v", err)
+	}
+
+	// Без vault полный временный файл создаёт его, а неверный пароль ничего не удаляет
+	os.Remove(vaultPath)
+	if err := os.WriteFile(vaultPath+".create.tmp", rewritten, 0600); err != nil {
+		t.Fatalf("Failed to write temp file: %v", err)
+	}
+	if _, err := RecoverVault(vaultPath, Password("WrongPassword1!"), RecoverOptions{}); !errors.Is(err, ErrInvalidPassword) {
+		t.Errorf("Expected ErrInvalidPassword, got %v", err)
+	}
+	if report, err := RecoverVault(vaultPath, Password(testPassword), RecoverOptions{}); err != nil || report.CompletedTempFile == "" {
+		t.Fatalf("Interrupted creation not completed: %+v (%v)", report, err)
+	}
+	if _, err := ListVault(vaultPath, Password(testPassword)); err != nil {
+		t.Errorf("ListVault after completed creation failed: %v", err)
+	}
+}
+
+// TestRecoverKilledWriter тестирует восстановление после убийства процесса во время записи
+func TestRecoverKilledWriter(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Killing the writer mid-stream relies on Unix signals")
+	}
+
+	tmpDir := setupCoreTest(t)
+	defer cleanupCoreTest(t, tmpDir)
+
+	data := make([]byte, 32*1024*1024)
+	rand.Read(data)
+	dataPath := filepath.Join(tmpDir, "large.bin")
+	if err := os.WriteFile(dataPath, data, 0644); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+
+	vaults := map[string]func(path string){
+		"append": func(path string) {
+			if err := CreateVaultWithKDF(path, Password(testPassword), testArgon2Params); err != nil {
+				t.Fatalf("CreateVaultWithKDF failed: %v", err)
+			}
+		},
+		"rewrite": func(path string) {
+			createLegacyVault(t, path, testPassword)
+		},
+	}
+
+	for name, create := range vaults {
+		t.Run(name, func(t *testing.T) {
+			vaultPath := filepath.Join(tmpDir, name+".vault")
+			create(vaultPath)
+			kept := createTestFile(t, tmpDir, "kept.txt", testContent)
+			if err := AddFileToVault(vaultPath, Password(testPassword), kept); err != nil {
+				t.Fatalf("AddFileToVault failed: %v", err)
+			}
+			before := vaultFileSize(t, vaultPath)
+
+			// Писатель — этот же тестовый бинарник, запущенный в режиме помощника
+			cmd := exec.Command(os.Args[0], "-test.run=^TestRecoverKilledWriterHelper$")
+			cmd.Env = append(os.Environ(), "FLINT_VAULT_WRITER="+vaultPath, "FLINT_VAULT_SOURCE="+dataPath)
+			if err := cmd.Start(); err != nil {
+				t.Fatalf("Failed to start writer: %v", err)
+			}
+
+			// Процесс убивается, как только начинает писать новые данные
+			done := make(chan error, 1)
+			go func() { done <- cmd.Wait() }()
+			killed := false
+			for !killed {
+				select {
+				case <-done:
+					t.Skip("Writer finished before it could be killed")
+				default:
+				}
+				if vaultFileSize(t, vaultPath) > before || len(mustFindTempFiles(t, vaultPath)) > 0 {
+					time.Sleep(5 * time.Millisecond)
+					cmd.Process.Kill()
+					<-done
+					killed = true
+				}
+				time.Sleep(time.Millisecond)
+			}
+
+			report, err := RecoverVault(vaultPath, Password(testPassword), RecoverOptions{})
+			if err != nil {
+				t.Fatalf("RecoverVault failed: %v", err)
+			}
+			t.Logf("Recovered: %+v", report)
+			if remaining := mustFindTempFiles(t, vaultPath); len(remaining) != 0 {
+				t.Errorf("Temp files left after recovery: %v", remaining)
+			}
+
+			entries, err := ListVault(vaultPath, Password(testPassword))
+			if err != nil {
+				t.Fatalf("ListVault after recovery failed: %v", err)
+			}
+			found := make(map[string]bool)
+			for _, entry := range entries {
+				found[entry.Path] = true
+			}
+			if !found["kept.txt"] {
+				t.Error("Committed file lost by recovery")
+			}
+
+			outputDir := filepath.Join(tmpDir, name+"-output")
+			if err := ExtractFromVault(vaultPath, Password(testPassword), outputDir); err != nil {
+				t.Errorf("ExtractFromVault after recovery failed: %v", err)
+			}
+		})
+	}
+}
+
+// TestRecoverKilledWriterHelper добавляет файл в vault по заданию TestRecoverKilledWriter
+func TestRecoverKilledWriterHelper(t *testing.T) {
+	vaultPath := os.Getenv("FLINT_VAULT_WRITER")
+	if vaultPath == "" {
+		t.Skip("Runs only as the writer process of TestRecoverKilledWriter")
+	}
+
+	if err := AddFileToVault(vaultPath, Password(testPassword), os.Getenv("FLINT_VAULT_SOURCE")); err != nil {
+		t.Fatalf("AddFileToVault failed: %v", err)
+	}
+}
+
+// TestRecoverTornHeader тестирует восстановление заголовка, разорванного сбоем при смене пароля
+func TestRecoverTornHeader(t *testing.T) {
+	tmpDir := setupCoreTest(t)
+	defer cleanupCoreTest(t, tmpDir)
+
+	vaultPath := filepath.Join(tmpDir, "header.vault")
+	if err := CreateVaultWithKDF(vaultPath, Password(testPassword), testArgon2Params); err != nil {
+		t.Fatalf("CreateVaultWithKDF failed: %v", err)
+	}
+	if err := AddFileToVault(vaultPath, Password(testPassword), createTestFile(t, tmpDir, "kept.txt", testContent)); err != nil {
+		t.Fatalf("AddFileToVault failed: %v", err)
+	}
+	before := mustReadFile(t, vaultPath)
+
+	newPassword := Password("new password")
+	if err := ChangeVaultPassword(vaultPath, Password(testPassword), newPassword); err != nil {
+		t.Fatalf("ChangeVaultPassword failed: %v", err)
+	}
+	if _, err := os.Stat(headerCopyPath(vaultPath)); !os.IsNotExist(err) {
+		t.Fatalf("Password change left its header copy: %v", err)
+	}
+	changed := mustReadFile(t, vaultPath)
+	newHeader := changed[:headerSize(CurrentVaultVersion)]
+
+	// Сбой посреди записи: новый заголовок сохранён, но записан в vault лишь наполовину
+	torn := bytes.Clone(before)
+	copy(torn, newHeader[:len(newHeader)/2])
+	if err := os.WriteFile(vaultPath, torn, 0600); err != nil {
+		t.Fatalf("Failed to write vault: %v", err)
+	}
+	if err := os.WriteFile(headerCopyPath(vaultPath), newHeader, 0600); err != nil {
+		t.Fatalf("Failed to write header copy: %v", err)
+	}
+	if _, err := ListVault(vaultPath, newPassword); !errors.Is(err, ErrInterruptedWrite) {
+		t.Errorf("Expected ErrInterruptedWrite, got %v", err)
+	}
+
+	dryRun, err := RecoverVault(vaultPath, newPassword, RecoverOptions{DryRun: true})
+	if err != nil || !dryRun.RestoredHeader {
+		t.Fatalf("Unexpected dry run report: %+v (%v)", dryRun, err)
+	}
+	if !bytes.Equal(mustReadFile(t, vaultPath), torn) {
+		t.Fatal("Dry run changed the vault")
+	}
+	if _, err := RecoverVault(vaultPath, Password("WrongPassword1!"), RecoverOptions{}); !errors.Is(err, ErrInvalidPassword) {
+		t.Errorf("Expected ErrInvalidPassword, got %v", err)
+	}
+
+	report, err := RecoverVault(vaultPath, newPassword, RecoverOptions{})
+	if err != nil || !report.RestoredHeader {
+		t.Fatalf("Unexpected report: %+v (%v)", report, err)
+	}
+	if !bytes.Equal(mustReadFile(t, vaultPath), changed) {
+		t.Error("Restored vault differs from the completed password change")
+	}
+	if _, err := os.Stat(headerCopyPath(vaultPath)); !os.IsNotExist(err) {
+		t.Errorf("Header copy left after recovery: %v", err)
+	}
+
+	// Копия при целом заголовке устарела и только удаляется
+	if err := os.WriteFile(headerCopyPath(vaultPath), before[:headerSize(CurrentVaultVersion)], 0600); err != nil {
+		t.Fatalf("Failed to write header copy: %v", err)
+	}
+	report, err = RecoverVault(vaultPath, newPassword, RecoverOptions{})
+	if err != nil || report.RestoredHeader || len(report.DiscardedTempFiles) != 1 {
+		t.Fatalf("Unexpected report for a stale copy: %+v (%v)", report, err)
+	}
+	if !bytes.Equal(mustReadFile(t, vaultPath), changed) {
+		t.Error("Stale header copy was written back")
+	}
+}
+
+// TestRecoverKilledPasswd тестирует восстановление после убийства процесса во время смены пароля
+func TestRecoverKilledPasswd(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Killing the writer mid-stream relies on Unix signals")
+	}
+
+	tmpDir := setupCoreTest(t)
+	defer cleanupCoreTest(t, tmpDir)
+
+	vaultPath := filepath.Join(tmpDir, "passwd.vault")
+	if err := CreateVaultWithKDF(vaultPath, Password(testPassword), testArgon2Params); err != nil {
+		t.Fatalf("CreateVaultWithKDF failed: %v", err)
+	}
+	if err := AddFileToVault(vaultPath, Password(testPassword), createTestFile(t, tmpDir, "kept.txt", testContent)); err != nil {
+		t.Fatalf("AddFileToVault failed: %v", err)
+	}
+
+	// Писатель меняет пароль туда и обратно, пока его не убьют
+	cmd := exec.Command(os.Args[0], "-test.run=^TestRecoverKilledPasswdHelper$")
+	cmd.Env = append(os.Environ(), "FLINT_VAULT_PASSWD="+vaultPath)
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Failed to start writer: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	// Процесс убивается, пока копия заголовка существует
+	for killed := false; !killed; {
+		select {
+		case <-done:
+			t.Skip("Writer finished before it could be killed")
+		default:
+		}
+		if _, err := os.Stat(headerCopyPath(vaultPath)); err == nil {
+			cmd.Process.Kill()
+			<-done
+			killed = true
+		}
+	}
+
+	// Действует либо старый, либо новый пароль
+	var keySource KeySource
+	var report *RecoveryReport
+	for _, password := range []string{testPassword, "second password"} {
+		var err error
+		report, err = RecoverVault(vaultPath, Password(password), RecoverOptions{})
+		if err == nil {
+			keySource = Password(password)
+			break
+		}
+		if !errors.Is(err, ErrInvalidPassword) {
+			t.Fatalf("RecoverVault failed: %v", err)
+		}
+	}
+	if keySource == nil {
+		t.Fatal("Neither password opens the vault after recovery")
+	}
+	t.Logf("Recovered: %+v", report)
+	if _, err := os.Stat(headerCopyPath(vaultPath)); !os.IsNotExist(err) {
+		t.Errorf("Header copy left after recovery: %v", err)
+	}
+
+	entries, err := ListVault(vaultPath, keySource)
+	if err != nil || len(entries) != 1 || entries[0].Path != "kept.txt" {
+		t.Fatalf("Vault does not open after recovery: %v (%v)", entries, err)
+	}
+}
+
+// TestRecoverKilledPasswdHelper меняет пароль vault по заданию TestRecoverKilledPasswd
+func TestRecoverKilledPasswdHelper(t *testing.T) {
+	vaultPath := os.Getenv("FLINT_VAULT_PASSWD")
+	if vaultPath == "" {
+		t.Skip("Runs only as the writer process of TestRecoverKilledPasswd")
+	}
+
+	passwords := []KeySource{Password(testPassword), Password("second password")}
+	for i := 0; i < 10000; i++ {
+		if err := ChangeVaultPassword(vaultPath, passwords[i%2], passwords[(i+1)%2]); err != nil {
+			t.Fatalf("ChangeVaultPassword failed: %v", err)
+		}
+	}
+}
+
+// mustReadFile читает файл целиком
+func mustReadFile(t *testing.T, path string) []byte {
+	t.Helper()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read %s: %v", path, err)
+	}
+	return data
+}
+
+// mustFindTempFiles возвращает временные файлы рядом с vault
+func mustFindTempFiles(t *testing.T, vaultPath string) []string {
+	t.Helper()
+
+	temps, err := findVaultTempFiles(vaultPath)
+	if err != nil {
+		t.Fatalf("findVaultTempFiles failed: %v", err)
+	}
+	return temps
+}
@@ -0,0 +1,744 @@
+package vault
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ========================
+// SINGLE-PASS STAGING
+// ========================
+//
+// Added files are read exactly once. Workers hash, compress and seal files in parallel;
+// the sealed payloads (or, for v4+ vaults, the new chunks) are kept in memory up to the
+// batch's memory budget and go to a spool file of the worker next to the vault beyond it.
+// A single writer appends them to v3+ vaults in the order the files were given, each as
+// soon as it is staged, so writing overlaps compression; the directory follows once all
+// files are written. Older vaults keep their directory in front of the data, so they are
+// rewritten after all files are staged. The spool files are named like the vault's
+// temporary files, so `recover` removes the ones a crash leaves.
+//
+// The hash and sizes of an entry are taken from the bytes that were compressed, so they
+// always match the stored data. A file written to while it is read still yields a torn
+// copy, though; with AddOptions.SnapshotCheck its size and modification time are compared
+// after reading, and a file that changed is read again or, after snapshotAttempts tries,
+// fails with ErrSourceChanged.
+
+// ErrSourceChanged is returned when a source file changes while it is added with a snapshot check
+var ErrSourceChanged = errors.New("source file changed while it was read")
+
+// snapshotAttempts is how often a file that keeps changing is read before it fails
+const snapshotAttempts = 3
+
+// sourceFile is a source file opened for adding, with its state when it was opened
+type sourceFile struct {
+	*os.File
+	opened os.FileInfo
+}
+
+// openSourceFile opens a source file and records its size and modification time
+func openSourceFile(path string) (*sourceFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("source file open error: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("file info error: %w", err)
+	}
+	return &sourceFile{File: file, opened: info}, nil
+}
+
+// checkUnchanged returns ErrSourceChanged unless the file still has the size and
+// modification time it had when opened and read bytes were read from it
+func (s *sourceFile) checkUnchanged(read int64) error {
+	info, err := s.Stat()
+	if err != nil {
+		return fmt.Errorf("file info error: %w", err)
+	}
+	if read != s.opened.Size() || info.Size() != s.opened.Size() || !info.ModTime().Equal(s.opened.ModTime()) {
+		return fmt.Errorf("%w: %s (%d bytes modified %s when opened, read %d, now %d bytes modified %s)",
+			ErrSourceChanged, s.Name(), s.opened.Size(), s.opened.ModTime().Format(time.RFC3339Nano),
+			read, info.Size(), info.ModTime().Format(time.RFC3339Nano))
+	}
+	return nil
+}
+
+// spoolExtent is a range of a spool file holding staged data
+type spoolExtent struct {
+	spool  *os.File
+	offset int64
+	size   int64
+}
+
+// spoolWriter appends to a spool file and tracks its size
+type spoolWriter struct {
+	file *os.File
+	size int64
+}
+
+func (s *spoolWriter) Write(p []byte) (int, error) {
+	n, err := s.file.Write(p)
+	s.size += int64(n)
+	return n, err
+}
+
+// extentSince returns the data written since the given size
+func (s *spoolWriter) extentSince(start int64) spoolExtent {
+	return spoolExtent{spool: s.file, offset: start, size: s.size - start}
+}
+
+// stagedData is a staged payload or chunk, held in memory or in a spool
+type stagedData struct {
+	memory []byte
+	extent spoolExtent // Spooled data; no spool while the data is in memory
+}
+
+// size returns the number of staged bytes
+func (d *stagedData) size() int64 {
+	if d.extent.spool != nil {
+		return d.extent.size
+	}
+	return int64(len(d.memory))
+}
+
+// stagingWriter stages one payload or chunk. Data is kept in memory while the batch's
+// memory budget allows; once it runs out, what was kept moves to the worker's spool
+// together with the rest.
+type stagingWriter struct {
+	batch   *stagingBatch
+	spool   *spoolWriter
+	memory  []byte
+	start   int64 // Spool offset of the data once spilled
+	spilled bool
+}
+
+func (w *stagingWriter) Write(p []byte) (int, error) {
+	if !w.spilled {
+		if w.batch.reserveMemory(int64(len(p))) {
+			w.memory = append(w.memory, p...)
+			return len(p), nil
+		}
+
+		w.spilled = true
+		w.start = w.spool.size
+		_, err := w.spool.Write(w.memory)
+		w.discard()
+		if err != nil {
+			return 0, err
+		}
+	}
+	return w.spool.Write(p)
+}
+
+// data returns what was staged
+func (w *stagingWriter) data() stagedData {
+	if w.spilled {
+		return stagedData{extent: w.spool.extentSince(w.start)}
+	}
+	return stagedData{memory: w.memory}
+}
+
+// discard releases the memory of data that will not be written
+func (w *stagingWriter) discard() {
+	w.batch.releaseMemory(int64(len(w.memory)))
+	w.memory = nil
+}
+
+// stagedFile is a source file staged for the vault writer
+type stagedFile struct {
+	FileMetadata
+	entry   FileEntry     // Entry of the file; chunk references get their offsets when written
+	payload stagedData    // Payload of a file stored whole
+	done    chan struct{} // Closed once the file is staged or failed
+}
+
+// stagedChunk is a new chunk, staged by the first file found to contain it
+type stagedChunk struct {
+	ref    ChunkRef      // Reference without an offset
+	data   stagedData    // Sealed chunk
+	staged bool          // Whether the claiming file staged the chunk before it failed
+	done   chan struct{} // Closed once the claiming file is done with the chunk
+}
+
+// stagingBatch stages files for one vault write
+type stagingBatch struct {
+	vaultPath    string
+	version      uint32
+	usesLog      bool
+	key          []byte
+	opts         AddOptions
+	ctx          context.Context
+	cancel       context.CancelCauseFunc
+	timeout      time.Duration        // Longest time a file may go without progress; zero for no limit
+	memoryBudget int64                // Bytes of staged data kept in memory; the rest is spooled
+	chunkKeys    *chunkKeys           // Only for vaults that store chunks
+	known        map[ChunkID]ChunkRef // Chunks stored in the vault already
+	entries      []FileEntry          // Entries without data (directories, links), committed with the files
+
+	memoryUsed atomic.Int64
+	staged     chan struct{} // Closed once all workers are done
+
+	mu      sync.Mutex
+	claimed map[ChunkID]*stagedChunk // New chunks, claimed by the first file containing them
+	spools  []*os.File
+
+	// Phase timings, for ParallelStats
+	stageTime  time.Duration // From starting the workers until the last one finished
+	writeTime  time.Duration // Spent writing data into the vault
+	commitTime time.Duration // Spent committing the new directory
+}
+
+// newStagingBatch prepares staging files into the vault with the given directory
+func newStagingBatch(vaultPath string, header *VaultHeader, key []byte, vaultDir *VaultDirectory, opts AddOptions) (*stagingBatch, error) {
+	if err := opts.Compression.validate(); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancelCause(orBackground(opts.Context))
+	batch := &stagingBatch{
+		vaultPath:    vaultPath,
+		version:      header.Version,
+		usesLog:      header.usesVaultLog(),
+		key:          key,
+		opts:         opts,
+		ctx:          ctx,
+		cancel:       cancel,
+		memoryBudget: DefaultMemoryBudget,
+	}
+	if header.Version >= ChunkedVersion {
+		keys, err := newChunkKeys(key)
+		if err != nil {
+			cancel(nil)
+			return nil, err
+		}
+		batch.chunkKeys = keys
+		batch.known = knownChunks(vaultDir.Entries)
+		batch.claimed = make(map[ChunkID]*stagedChunk)
+	}
+	return batch, nil
+}
+
+// close stops the workers, removes the spool files and wipes the chunking keys
+func (b *stagingBatch) close() {
+	b.cancel(nil)
+	b.wait()
+	for _, spool := range b.spools {
+		spool.Close()
+		os.Remove(spool.Name())
+	}
+	b.spools = nil
+	if b.chunkKeys != nil {
+		b.chunkKeys.clear()
+	}
+}
+
+// wait waits until the workers are done
+func (b *stagingBatch) wait() {
+	if b.staged != nil {
+		<-b.staged
+	}
+}
+
+// reserveMemory takes n bytes of the memory budget if they are left
+func (b *stagingBatch) reserveMemory(n int64) bool {
+	for {
+		used := b.memoryUsed.Load()
+		if used+n > b.memoryBudget {
+			return false
+		}
+		if b.memoryUsed.CompareAndSwap(used, used+n) {
+			return true
+		}
+	}
+}
+
+// releaseMemory returns n bytes to the memory budget
+func (b *stagingBatch) releaseMemory(n int64) {
+	b.memoryUsed.Add(-n)
+}
+
+// newSpool creates a spool file for one worker
+func (b *stagingBatch) newSpool() (*spoolWriter, error) {
+	file, err := createVaultTempFile(b.vaultPath)
+	if err != nil {
+		return nil, err
+	}
+
+	b.mu.Lock()
+	b.spools = append(b.spools, file)
+	b.mu.Unlock()
+	return &spoolWriter{file: file}, nil
+}
+
+// stageFiles starts staging the files with up to the given number of workers and
+// returns them in the order given, each to be waited for on its done channel. Files
+// that could not be staged carry the reason in Error.
+func (b *stagingBatch) stageFiles(filePaths []string, basePath string, workers int, progress chan string) []*stagedFile {
+	files := make([]*stagedFile, len(filePaths))
+	jobs := make(chan *stagedFile, len(filePaths))
+	for i, path := range filePaths {
+		files[i] = &stagedFile{FileMetadata: FileMetadata{FilePath: path}, done: make(chan struct{})}
+		jobs <- files[i]
+	}
+	close(jobs)
+
+	start := time.Now()
+	b.staged = make(chan struct{})
+	workers = min(workers, len(filePaths))
+	var wg sync.WaitGroup
+	for range max(workers, 1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			spool, err := b.newSpool()
+			var idHash hash.Hash
+			var chunks *chunker
+			if b.chunkKeys != nil {
+				idHash = b.chunkKeys.newIDHash()
+				chunks = newChunker(nil, &b.chunkKeys.gear)
+			}
+			buffer := make([]byte, StreamBufferSize)
+
+			for file := range jobs {
+				if err != nil {
+					file.Error = err
+				} else if cause := contextError(b.ctx); cause != nil {
+					file.Error = cause
+				} else {
+					if progress != nil {
+						progress <- fmt.Sprintf("Compressing: %s", file.FilePath)
+					}
+					file.Error = b.stageFile(spool, file, basePath, idHash, chunks, buffer)
+				}
+				close(file.done)
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		b.stageTime = time.Since(start)
+		close(b.staged)
+	}()
+	return files
+}
+
+// stageFile stages a source file, filling in its entry. With a snapshot check a file
+// that changed while it was read is read again.
+func (b *stagingBatch) stageFile(spool *spoolWriter, file *stagedFile, basePath string, idHash hash.Hash, chunks *chunker, buffer []byte) error {
+	ctx := withIdleTimeout(b.ctx, b.timeout)
+	defer ctx.stop()
+
+	for attempt := 1; ; attempt++ {
+		err := b.readFile(ctx, spool, file, basePath, idHash, chunks, buffer)
+		if !errors.Is(err, ErrSourceChanged) || attempt == snapshotAttempts {
+			return err
+		}
+	}
+}
+
+// readFile makes one attempt at staging a source file
+func (b *stagingBatch) readFile(ctx context.Context, spool *spoolWriter, file *stagedFile, basePath string, idHash hash.Hash, chunks *chunker, buffer []byte) error {
+	info, err := os.Stat(file.FilePath)
+	if err != nil {
+		return fmt.Errorf("file info error: %w", err)
+	}
+	file.FileInfo = info
+
+	file.StorePath, err = storePathFor(basePath, file.FilePath)
+	if err != nil {
+		return err
+	}
+
+	file.entry = FileEntry{
+		Path:    file.StorePath,
+		Name:    info.Name(),
+		Mode:    uint32(info.Mode()),
+		ModTime: info.ModTime(),
+	}
+
+	if chunks == nil {
+		staging := &stagingWriter{batch: b, spool: spool}
+		opts := AddOptions{Compression: b.opts.Compression, SnapshotCheck: b.opts.SnapshotCheck}
+		file.Compression, err = appendPayload(ctx, staging, file.FilePath, b.version, b.key, &file.entry, opts, buffer)
+		if err != nil {
+			staging.discard()
+			return err
+		}
+		file.payload = staging.data()
+	} else if err := b.stageChunks(ctx, spool, file, idHash, chunks, buffer); err != nil {
+		return err
+	}
+
+	file.Hash = file.entry.SHA256Hash
+	file.CompressedSize = file.entry.CompressedSize
+	return nil
+}
+
+// stageChunks splits a source file into chunks and stages the ones not seen before.
+// The compressed size of the entry only counts the chunks it staged itself.
+func (b *stagingBatch) stageChunks(ctx context.Context, spool *spoolWriter, file *stagedFile, idHash hash.Hash, chunks *chunker, buffer []byte) error {
+	source, err := openSourceFile(file.FilePath)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	// Select the compression (auto mode samples the start of the file)
+	var reader io.Reader
+	file.Compression, reader, err = b.opts.Compression.resolve(newContextReader(ctx, source))
+	if err != nil {
+		return err
+	}
+
+	hasher := sha256.New()
+	chunks.reset(io.TeeReader(reader, hasher))
+	entry := &file.entry
+	for {
+		data, err := chunks.next()
+		if err == io.EOF {
+			if len(entry.Chunks) > 0 {
+				break
+			}
+			data = nil // An empty file still gets a chunk to record its compression
+		} else if err != nil {
+			return fmt.Errorf("file read error: %w", err)
+		}
+
+		id := chunkID(idHash, data)
+		entry.Chunks = append(entry.Chunks, ChunkRef{ID: id, Size: int64(len(data))})
+		entry.Size += int64(len(data))
+
+		if chunk := b.claimChunk(id); chunk != nil {
+			err := b.stageChunk(chunk, spool, id, data, file.Compression, buffer)
+			close(chunk.done)
+			if err != nil {
+				return err
+			}
+			entry.CompressedSize += chunk.ref.StoredSize
+		}
+
+		if data == nil {
+			break
+		}
+	}
+
+	if b.opts.SnapshotCheck {
+		if err := source.checkUnchanged(entry.Size); err != nil {
+			return err
+		}
+	}
+
+	copy(entry.SHA256Hash[:], hasher.Sum(nil))
+	return nil
+}
+
+// stageChunk seals a claimed chunk with a salt of its own
+func (b *stagingBatch) stageChunk(chunk *stagedChunk, spool *spoolWriter, id ChunkID, data []byte, compression Compression, buffer []byte) error {
+	salt, err := newPayloadSalt()
+	if err != nil {
+		return err
+	}
+
+	staging := &stagingWriter{batch: b, spool: spool}
+	if err := writePayload(staging, bytes.NewReader(data), b.version, b.key, FileEntry{PayloadSalt: salt}, compression, buffer); err != nil {
+		staging.discard()
+		return err
+	}
+	chunk.data = staging.data()
+	chunk.ref = ChunkRef{ID: id, Salt: salt[:], Size: int64(len(data)), StoredSize: chunk.data.size(), Compression: compression.Algorithm}
+	chunk.staged = true
+	return nil
+}
+
+// claimChunk returns a new chunk for the caller to stage, or nil if the chunk is
+// stored already or another file stages it
+func (b *stagingBatch) claimChunk(id ChunkID) *stagedChunk {
+	if _, ok := b.known[id]; ok {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.claimed[id]; ok {
+		return nil
+	}
+	chunk := &stagedChunk{done: make(chan struct{})}
+	b.claimed[id] = chunk
+	return chunk
+}
+
+// claimedChunk returns the new chunk with the given ID
+func (b *stagingBatch) claimedChunk(id ChunkID) *stagedChunk {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.claimed[id]
+}
+
+// commit writes the data of the staged files to the vault as the workers finish them,
+// puts their entries into the directory and writes it too. It returns once the workers are done; on error
+// the files not staged yet are abandoned.
+func (b *stagingBatch) commit(vaultDir *VaultDirectory, files []*stagedFile) error {
+	var err error
+	if b.usesLog {
+		err = b.appendToLog(vaultDir, files)
+	} else {
+		err = b.rewriteVault(vaultDir, files)
+	}
+	if err != nil {
+		b.cancel(err)
+	}
+	b.wait()
+	return err
+}
+
+// placeEntries puts the batch's entries without data and the entries of the files
+// staged successfully into the directory and returns the files' store paths in the
+// order first added. Of several files with the same store path the last one wins.
+func (b *stagingBatch) placeEntries(vaultDir *VaultDirectory, files []*stagedFile) ([]string, map[string]*stagedFile) {
+	staged := make(map[string]*stagedFile, len(files))
+	var newPaths []string
+	for _, file := range files {
+		if file.Error != nil {
+			continue
+		}
+		if _, ok := staged[file.StorePath]; !ok {
+			newPaths = append(newPaths, file.StorePath)
+		}
+		staged[file.StorePath] = file
+	}
+
+	for _, entry := range b.entries {
+		vaultDir.putEntry(entry)
+	}
+	for _, path := range newPaths {
+		vaultDir.putEntry(staged[path].entry)
+	}
+	return newPaths, staged
+}
+
+// writeStaged copies staged data into the vault and returns its memory to the budget
+func (b *stagingBatch) writeStaged(target io.Writer, data *stagedData, buffer []byte) error {
+	start := time.Now()
+	defer func() { b.writeTime += time.Since(start) }()
+
+	if data.extent.spool != nil {
+		return copySpoolExtent(b.ctx, target, data.extent, buffer)
+	}
+	if err := contextError(b.ctx); err != nil {
+		return err
+	}
+	if _, err := target.Write(data.memory); err != nil {
+		return fmt.Errorf("staged data copy error: %w", err)
+	}
+	b.releaseMemory(int64(len(data.memory)))
+	data.memory = nil
+	return nil
+}
+
+// appendToLog appends the staged data to a v3+ vault in the order of the files, each
+// as soon as it is staged, and then the directory. Each new chunk is written once, by
+// the first entry referring to it. Data of a file replaced by a later one with the same
+// store path stays unreferenced until the vault is compacted. On error the file is cut
+// back to its previous size, so the previous directory stays current.
+func (b *stagingBatch) appendToLog(vaultDir *VaultDirectory, files []*stagedFile) error {
+	file, err := os.OpenFile(b.vaultPath, os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("vault file open error: %w", err)
+	}
+	defer file.Close()
+
+	header, err := readVaultHeader(file)
+	if err != nil {
+		return fmt.Errorf("header read error: %w", err)
+	}
+
+	originalSize, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return fmt.Errorf("vault file seek error: %w", err)
+	}
+
+	success := false
+	defer func() {
+		if !success {
+			file.Truncate(originalSize)
+		}
+	}()
+
+	dataStart := header.encodedSize() + int64(header.DirectorySize)
+	var dataSize int64
+	written := make(map[ChunkID]ChunkRef)
+	buffer := make([]byte, StreamBufferSize)
+	for _, staged := range files {
+		<-staged.done
+		if staged.Error != nil {
+			continue
+		}
+
+		entry := &staged.entry
+		if len(entry.Chunks) == 0 {
+			entry.Offset = originalSize + dataSize - dataStart
+			size := staged.payload.size()
+			if err := b.writeStaged(file, &staged.payload, buffer); err != nil {
+				return fmt.Errorf("%w (file %s)", err, staged.FilePath)
+			}
+			dataSize += size
+			continue
+		}
+
+		// Chunk references are filled in from the vault or from the written chunks
+		entry.CompressedSize = 0
+		for i := range entry.Chunks {
+			id := entry.Chunks[i].ID
+			ref, ok := b.known[id]
+			if !ok {
+				ref, ok = written[id]
+			}
+			if !ok {
+				chunk := b.claimedChunk(id)
+				<-chunk.done
+				if !chunk.staged {
+					staged.Error = fmt.Errorf("data shared with a file that could not be added")
+					break
+				}
+				ref = chunk.ref
+				ref.Offset = originalSize + dataSize - dataStart
+				if err := b.writeStaged(file, &chunk.data, buffer); err != nil {
+					return fmt.Errorf("%w (file %s)", err, staged.FilePath)
+				}
+				dataSize += ref.StoredSize
+				written[id] = ref
+			}
+			entry.Chunks[i] = ref
+			entry.CompressedSize += ref.StoredSize
+		}
+	}
+
+	// A cancelled add writes nothing, not even the files staged before
+	b.wait()
+	if err := contextError(b.ctx); err != nil {
+		return err
+	}
+
+	newPaths, _ := b.placeEntries(vaultDir, files)
+	if len(newPaths) == 0 && len(b.entries) == 0 {
+		return nil
+	}
+
+	// The offsets of the entries are only valid if exactly the staged data was written
+	end, err := file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return fmt.Errorf("vault file seek error: %w", err)
+	}
+	if end != originalSize+dataSize {
+		return fmt.Errorf("vault data size mismatch: wrote %d bytes, expected %d", end-originalSize, dataSize)
+	}
+
+	start := time.Now()
+	if err := commitVaultLog(file, header, b.key, *vaultDir, dataSize); err != nil {
+		return err
+	}
+	b.commitTime = time.Since(start)
+
+	success = true
+	return nil
+}
+
+// rewriteVault writes a legacy vault anew with the staged payloads after the retained
+// ones. The directory comes first in these vaults, so all files are staged before
+// anything is written.
+func (b *stagingBatch) rewriteVault(vaultDir *VaultDirectory, files []*stagedFile) error {
+	b.wait()
+	if err := contextError(b.ctx); err != nil {
+		return err
+	}
+
+	newPaths, staged := b.placeEntries(vaultDir, files)
+	if len(newPaths) == 0 && len(b.entries) == 0 {
+		return nil
+	}
+
+	// Open original vault file for reading
+	originalFile, err := os.Open(b.vaultPath)
+	if err != nil {
+		return fmt.Errorf("original file open error: %w", err)
+	}
+	defer originalFile.Close()
+
+	originalHeader, err := readVaultHeader(originalFile)
+	if err != nil {
+		return fmt.Errorf("header read error: %w", err)
+	}
+
+	// Calculate file offsets for all entries, keeping the old ones for copying
+	retained := layoutPayloads(vaultDir.Entries, newPaths)
+
+	// Encrypt directory with existing key parameters and a fresh nonce
+	newHeader := *originalHeader
+	encryptedDir, err := sealVaultDirectory(b.key, &newHeader, *vaultDir)
+	if err != nil {
+		return err
+	}
+
+	// Create a uniquely named temporary file for the new vault
+	tempFile, err := createVaultTempFile(b.vaultPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name()) // Clean up temp file
+	defer tempFile.Close()
+
+	// Write header and directory
+	if err := writeVaultHeader(tempFile, &newHeader); err != nil {
+		return fmt.Errorf("header write error: %w", err)
+	}
+	if _, err := tempFile.Write(encryptedDir); err != nil {
+		return fmt.Errorf("directory write error: %w", err)
+	}
+
+	// Copy existing files that are not being replaced
+	start := time.Now()
+	if err := copyNeededFileDataStreaming(b.ctx, originalFile, tempFile, retained, originalHeader); err != nil {
+		return fmt.Errorf("existing file copy error: %w", err)
+	}
+	b.writeTime += time.Since(start)
+
+	// Copy the staged payloads in layout order
+	buffer := make([]byte, StreamBufferSize)
+	for _, path := range newPaths {
+		if err := b.writeStaged(tempFile, &staged[path].payload, buffer); err != nil {
+			return fmt.Errorf("%w (file %s)", err, staged[path].FilePath)
+		}
+	}
+
+	originalFile.Close()
+
+	// Atomic replacement
+	start = time.Now()
+	defer func() { b.commitTime = time.Since(start) }()
+	return replaceVaultFile(tempFile, b.vaultPath)
+}
+
+// copySpoolExtent copies spooled data into the vault
+func copySpoolExtent(ctx context.Context, target io.Writer, extent spoolExtent, buffer []byte) error {
+	n, err := io.CopyBuffer(target, newContextReader(ctx, io.NewSectionReader(extent.spool, extent.offset, extent.size)), buffer)
+	if err != nil {
+		return fmt.Errorf("staged data copy error: %w", err)
+	}
+	if n != extent.size {
+		return fmt.Errorf("staged data copy error: copied %d of %d bytes", n, extent.size)
+	}
+	return nil
+}
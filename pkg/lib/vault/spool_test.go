@@ -0,0 +1,281 @@
+package vault
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestStageFiles тестирует однопроходную подготовку файлов во временных файлах
+func TestStageFiles(t *testing.T) {
+	tmpDir := setupCoreTest(t)
+	defer cleanupCoreTest(t, tmpDir)
+
+	vaultPath := filepath.Join(tmpDir, "stage.vault")
+	if err := CreateVaultWithKDF(vaultPath, Password(testPassword), testArgon2Params); err != nil {
+		t.Fatalf("CreateVaultWithKDF failed: %v", err)
+	}
+
+	data := make([]byte, 512*1024)
+	rand.Read(data)
+	first := filepath.Join(tmpDir, "first.bin")
+	second := filepath.Join(tmpDir, "second.bin")
+	for _, path := range []string{first, second} {
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatalf("Failed to create file: %v", err)
+		}
+	}
+
+	vaultDir, header, key, err := openVaultDirectory(vaultPath, Password(testPassword))
+	if err != nil {
+		t.Fatalf("openVaultDirectory failed: %v", err)
+	}
+	defer clearKey(key)
+	batch, err := newStagingBatch(vaultPath, header, key, vaultDir, AddOptions{})
+	if err != nil {
+		t.Fatalf("newStagingBatch failed: %v", err)
+	}
+
+	files := batch.stageFiles([]string{first, filepath.Join(tmpDir, "missing.bin"), second}, "", 4, nil)
+	batch.wait()
+	if files[1].Error == nil {
+		t.Error("Expected error for a missing file")
+	}
+	var stored int64
+	for _, file := range []*stagedFile{files[0], files[2]} {
+		if file.Error != nil {
+			t.Fatalf("Staging %s failed: %v", file.FilePath, file.Error)
+		}
+		if file.Hash != sha256.Sum256(data) || file.entry.Size != int64(len(data)) {
+			t.Errorf("Wrong hash or size for %s", file.FilePath)
+		}
+		stored += file.CompressedSize
+	}
+
+	// Одинаковые чанки двух файлов подготавливаются один раз
+	if stored >= int64(len(data))*3/2 {
+		t.Errorf("Identical files staged %d bytes", stored)
+	}
+	if len(batch.spools) == 0 {
+		t.Fatal("No spool files were created")
+	}
+
+	if err := batch.commit(vaultDir, files); err != nil {
+		t.Fatalf("commit failed: %v", err)
+	}
+	spools := batch.spools
+	batch.close()
+	for _, spool := range spools {
+		if _, err := os.Stat(spool.Name()); !os.IsNotExist(err) {
+			t.Errorf("Spool file %s was not removed", spool.Name())
+		}
+	}
+
+	outputDir := filepath.Join(tmpDir, "output")
+	if err := ExtractFromVault(vaultPath, Password(testPassword), outputDir); err != nil {
+		t.Fatalf("ExtractFromVault failed: %v", err)
+	}
+	for _, name := range []string{"first.bin", "second.bin"} {
+		if extracted, err := os.ReadFile(filepath.Join(outputDir, name)); err != nil || string(extracted) != string(data) {
+			t.Errorf("Content mismatch for %s (%v)", name, err)
+		}
+	}
+}
+
+// TestStagingMemoryBudget тестирует подготовку в памяти в пределах бюджета и
+// сброс остального во временный файл
+func TestStagingMemoryBudget(t *testing.T) {
+	tmpDir := setupCoreTest(t)
+	defer cleanupCoreTest(t, tmpDir)
+
+	// Данные сверх бюджета переносятся во временный файл вместе с уже накопленными
+	batch := &stagingBatch{vaultPath: filepath.Join(tmpDir, "budget.vault"), cancel: func(error) {}, memoryBudget: 10}
+	spool, err := batch.newSpool()
+	if err != nil {
+		t.Fatalf("newSpool failed: %v", err)
+	}
+	defer batch.close()
+	staging := &stagingWriter{batch: batch, spool: spool}
+	staging.Write([]byte("123456"))
+	if data := staging.data(); data.extent.spool != nil || batch.memoryUsed.Load() != 6 {
+		t.Errorf("Data within the budget was not kept in memory (%d bytes used)", batch.memoryUsed.Load())
+	}
+	staging.Write([]byte("789012"))
+	data := staging.data()
+	if data.extent.spool == nil || data.size() != 12 || batch.memoryUsed.Load() != 0 {
+		t.Errorf("Data beyond the budget was not spooled: %d bytes, %d in memory", data.size(), batch.memoryUsed.Load())
+	}
+
+	sourceDir := filepath.Join(tmpDir, "source")
+	os.MkdirAll(sourceDir, 0755)
+	var files []string
+	for i := 0; i < 4; i++ {
+		content := make([]byte, 300*1024)
+		rand.Read(content)
+		path := filepath.Join(sourceDir, fmt.Sprintf("file%d.bin", i))
+		if err := os.WriteFile(path, content, 0644); err != nil {
+			t.Fatalf("Failed to create file: %v", err)
+		}
+		files = append(files, path)
+	}
+
+	for _, version := range []uint32{PayloadEncryptionVersion, CurrentVaultVersion} {
+		for _, budget := range []int64{0, 512 * 1024, DefaultMemoryBudget} {
+			vaultPath := filepath.Join(tmpDir, fmt.Sprintf("budget-v%d-%d.vault", version, budget))
+			vaultDir := VaultDirectory{Version: version, Entries: []FileEntry{}, CreatedAt: time.Now()}
+			if err := saveVaultDirectory(vaultPath, Password(testPassword), vaultDir, testArgon2Params, nil); err != nil {
+				t.Fatalf("saveVaultDirectory failed: %v", err)
+			}
+
+			config := DefaultParallelConfig()
+			config.MemoryBudget = budget
+			stats, err := AddDirectoryToVaultParallel(vaultPath, Password(testPassword), sourceDir, config)
+			if err != nil || stats.SuccessfulFiles != int64(len(files)) {
+				t.Fatalf("v%d, budget %d: add failed: %+v (%v)", version, budget, stats, err)
+			}
+			if stats.CompressDuration <= 0 || stats.WriteDuration <= 0 || stats.CommitDuration <= 0 {
+				t.Errorf("v%d, budget %d: phase timings missing: %+v", version, budget, stats)
+			}
+
+			outputDir := filepath.Join(tmpDir, fmt.Sprintf("output-v%d-%d", version, budget))
+			if err := ExtractFromVault(vaultPath, Password(testPassword), outputDir); err != nil {
+				t.Fatalf("ExtractFromVault failed: %v", err)
+			}
+			for _, path := range files {
+				original, _ := os.ReadFile(path)
+				extracted, err := os.ReadFile(filepath.Join(outputDir, "source", filepath.Base(path)))
+				if err != nil || !bytes.Equal(extracted, original) {
+					t.Errorf("v%d, budget %d: content mismatch for %s (%v)", version, budget, path, err)
+				}
+			}
+		}
+	}
+}
+
+// TestSnapshotCheck тестирует обнаружение файлов, изменившихся во время чтения
+func TestSnapshotCheck(t *testing.T) {
+	tmpDir := setupCoreTest(t)
+	defer cleanupCoreTest(t, tmpDir)
+
+	path := createTestFile(t, tmpDir, "growing.log", testContent)
+	source, err := openSourceFile(path)
+	if err != nil {
+		t.Fatalf("openSourceFile failed: %v", err)
+	}
+	defer source.Close()
+
+	if err := source.checkUnchanged(int64(len(testContent))); err != nil {
+		t.Errorf("Unchanged file reported as changed: %v", err)
+	}
+	if err := source.checkUnchanged(int64(len(testContent)) - 1); !errors.Is(err, ErrSourceChanged) {
+		t.Errorf("Expected ErrSourceChanged for a short read, got %v", err)
+	}
+
+	// Дописанный после открытия файл считается изменившимся
+	appended, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("Failed to open file: %v", err)
+	}
+	appended.WriteString("more lines\n")
+	appended.Close()
+	if err := source.checkUnchanged(int64(len(testContent))); !errors.Is(err, ErrSourceChanged) {
+		t.Errorf("Expected ErrSourceChanged for an appended file, got %v", err)
+	}
+
+	vaultPath := filepath.Join(tmpDir, "snapshot.vault")
+	if err := CreateVaultWithKDF(vaultPath, Password(testPassword), testArgon2Params); err != nil {
+		t.Fatalf("CreateVaultWithKDF failed: %v", err)
+	}
+	opts := AddOptions{SnapshotCheck: true}
+	if err := AddFileToVaultWithOptions(vaultPath, Password(testPassword), path, opts); err != nil {
+		t.Fatalf("AddFileToVaultWithOptions failed for a stable file: %v", err)
+	}
+	if err := AppendToVaultWithOptions(vaultPath, path, opts); err != nil {
+		t.Fatalf("AppendToVaultWithOptions failed for a stable file: %v", err)
+	}
+
+	// Файлы procfs сообщают нулевой размер, но содержат данные, поэтому проверка
+	// не проходит ни с одной попытки
+	if runtime.GOOS != "linux" {
+		return
+	}
+	if err := AddFileToVaultWithOptions(vaultPath, Password(testPassword), "/proc/self/status", opts); !errors.Is(err, ErrSourceChanged) {
+		t.Errorf("Expected ErrSourceChanged for a procfs file, got %v", err)
+	}
+	config := DefaultParallelConfig()
+	config.SnapshotCheck = true
+	stats, err := AddMultipleFilesToVaultParallel(vaultPath, Password(testPassword), []string{"/proc/self/status", path}, config)
+	if err != nil || stats.FailedFiles != 1 || stats.SuccessfulFiles != 1 {
+		t.Errorf("Expected only the procfs file to fail: %+v (%v)", stats, err)
+	}
+	if err := AddFileToVault(vaultPath, Password(testPassword), "/proc/self/status"); err != nil {
+		t.Errorf("AddFileToVault without a snapshot check failed: %v", err)
+	}
+}
+
+// createBenchmarkTree создаёт каталог из files файлов общим размером totalSize,
+// наполовину сжимаемых
+func createBenchmarkTree(b *testing.B, dir string, files int, totalSize int64) {
+	b.Helper()
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		b.Fatalf("Failed to create directory: %v", err)
+	}
+	text := []byte(strings.Repeat("benchmark line with some repetition 0123456789\n", 1024))
+	block := make([]byte, len(text))
+	for i := 0; i < files; i++ {
+		file, err := os.Create(filepath.Join(dir, fmt.Sprintf("file%03d.dat", i)))
+		if err != nil {
+			b.Fatalf("Failed to create file: %v", err)
+		}
+		for written := int64(0); written < totalSize/int64(files); written += int64(2 * len(text)) {
+			rand.Read(block)
+			file.Write(block)
+			file.Write(text)
+		}
+		file.Close()
+	}
+}
+
+// BenchmarkAddLargeTree измеряет пропускную способность добавления каталога.
+// Размер входных данных задаётся в МБ через FLINT_VAULT_BENCH_MB (по умолчанию 256),
+// например FLINT_VAULT_BENCH_MB=4096 для нескольких гигабайт.
+func BenchmarkAddLargeTree(b *testing.B) {
+	totalSize := int64(256) << 20
+	if mb, err := strconv.Atoi(os.Getenv("FLINT_VAULT_BENCH_MB")); err == nil && mb > 0 {
+		totalSize = int64(mb) << 20
+	}
+
+	tmpDir := b.TempDir()
+	sourceDir := filepath.Join(tmpDir, "source")
+	createBenchmarkTree(b, sourceDir, 16, totalSize)
+
+	for _, version := range []uint32{PayloadEncryptionVersion, CurrentVaultVersion} {
+		b.Run(fmt.Sprintf("v%d", version), func(b *testing.B) {
+			b.SetBytes(totalSize)
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				vaultPath := filepath.Join(tmpDir, fmt.Sprintf("bench-v%d.vault", version))
+				os.Remove(vaultPath)
+				vaultDir := VaultDirectory{Version: version, Entries: []FileEntry{}, CreatedAt: time.Now()}
+				if err := saveVaultDirectory(vaultPath, Password(testPassword), vaultDir, testArgon2Params, nil); err != nil {
+					b.Fatalf("saveVaultDirectory failed: %v", err)
+				}
+				b.StartTimer()
+
+				if _, err := AddDirectoryToVaultParallel(vaultPath, Password(testPassword), sourceDir, DefaultParallelConfig()); err != nil {
+					b.Fatalf("AddDirectoryToVaultParallel failed: %v", err)
+				}
+			}
+		})
+	}
+}
@@ -1,18 +1,23 @@
 package vault
 
 import (
-	"encoding/binary"
 	"fmt"
+	"io"
 	"os"
 )
 
 // VaultInfo contains basic information about a vault file that can be read without a password
 type VaultInfo struct {
-	IsFlintVault bool   // Whether this is a valid Flint Vault file
-	Version      uint32 // Vault format version
-	Iterations   uint32 // PBKDF2 iteration count used
-	FileSize     int64  // Total file size in bytes
-	FilePath     string // Path to the vault file
+	IsFlintVault      bool          // Whether this is a valid Flint Vault file
+	Version           uint32        // Vault format version
+	Iterations        uint32        // PBKDF2 iteration count of the first key slot (0 for Argon2id)
+	KDF               KDFParams     // Key derivation function and cost parameters of the first key slot
+	KeySlots          []KeySlotInfo // Active key slots
+	PayloadsEncrypted bool          // Whether file contents are encrypted (false for legacy v1/v2 vaults)
+	ChunkedPayloads   bool          // Whether files are stored as deduplicated chunks (v4+)
+	PagedDirectory    bool          // Whether the directory is stored in sorted pages read on demand (v5+)
+	FileSize          int64         // Total file size in bytes
+	FilePath          string        // Path to the vault file
 }
 
 // IsFlintVault checks if the specified file is a valid Flint Vault file.
@@ -37,8 +42,8 @@ func IsFlintVault(path string) (bool, error) {
 	defer file.Close()
 
 	// Try to read the header
-	var header VaultHeader
-	if err := binary.Read(file, binary.LittleEndian, &header); err != nil {
+	header, err := readVaultHeader(file)
+	if err != nil {
 		return false, nil // Not enough data for header, not a vault file
 	}
 
@@ -60,7 +65,11 @@ func IsFlintVault(path string) (bool, error) {
 // The returned information includes:
 //   - Whether the file is a valid Flint Vault
 //   - Vault format version
-//   - PBKDF2 iteration count
+//   - Key derivation function and its parameters (PBKDF2 iterations or Argon2id costs)
+//   - Active key slots
+//   - Whether file payloads are encrypted (vaults older than v3 store them unencrypted)
+//   - Whether files are stored as deduplicated chunks (v4+)
+//   - Whether the directory is stored in pages (v5+)
 //   - File size
 //   - File path
 func GetVaultInfo(path string) (*VaultInfo, error) {
@@ -86,8 +95,8 @@ func GetVaultInfo(path string) (*VaultInfo, error) {
 	defer file.Close()
 
 	// Try to read the header
-	var header VaultHeader
-	if err := binary.Read(file, binary.LittleEndian, &header); err != nil {
+	header, err := readVaultHeader(file)
+	if err != nil {
 		return info, nil // Not enough data for header, not a vault file
 	}
 
@@ -95,7 +104,14 @@ func GetVaultInfo(path string) (*VaultInfo, error) {
 	if string(header.Magic[:]) == VaultMagic {
 		info.IsFlintVault = true
 		info.Version = header.Version
-		info.Iterations = header.Iterations
+		info.KeySlots = header.keySlotInfos()
+		if len(info.KeySlots) > 0 {
+			info.KDF = info.KeySlots[0].KDF
+			info.Iterations = info.KDF.Iterations
+		}
+		info.PayloadsEncrypted = header.Version >= PayloadEncryptionVersion
+		info.ChunkedPayloads = header.Version >= ChunkedVersion
+		info.PagedDirectory = header.usesPagedDirectory()
 	}
 
 	return info, nil
@@ -116,6 +132,7 @@ func GetVaultInfo(path string) (*VaultInfo, error) {
 //   - File has supported version
 //   - File has minimum required size
 //   - Header fields are within expected ranges
+//   - Header checksum matches (v3+)
 func ValidateVaultFile(path string) error {
 	// Check file exists
 	fileInfo, err := os.Stat(path)
@@ -123,12 +140,6 @@ func ValidateVaultFile(path string) error {
 		return fmt.Errorf("file access error: %w", err)
 	}
 
-	// Check minimum file size (header + some encrypted data)
-	minSize := int64(binary.Size(VaultHeader{}) + 16) // header + minimal ciphertext
-	if fileInfo.Size() < minSize {
-		return fmt.Errorf("file too small to be a valid vault (minimum %d bytes, got %d)", minSize, fileInfo.Size())
-	}
-
 	// Open file and read header
 	file, err := os.Open(path)
 	if err != nil {
@@ -136,25 +147,62 @@ func ValidateVaultFile(path string) error {
 	}
 	defer file.Close()
 
-	var header VaultHeader
-	if err := binary.Read(file, binary.LittleEndian, &header); err != nil {
-		return fmt.Errorf("header read error: %w", err)
+	prefix, err := readHeaderPrefix(file)
+	if err != nil {
+		return fmt.Errorf("file too small to be a valid vault (got %d bytes)", fileInfo.Size())
 	}
 
 	// Validate magic header
-	if string(header.Magic[:]) != VaultMagic {
+	if string(prefix.Magic[:]) != VaultMagic {
 		return fmt.Errorf("invalid file format: not a Flint Vault file (expected magic '%s', got '%s')",
-			VaultMagic, string(header.Magic[:]))
+			VaultMagic, string(prefix.Magic[:]))
 	}
 
 	// Validate version
-	if header.Version < 1 || header.Version > CurrentVaultVersion {
-		return fmt.Errorf("unsupported vault version: %d (supported: 1-%d)", header.Version, CurrentVaultVersion)
+	if prefix.Version < 1 || prefix.Version > CurrentVaultVersion {
+		return fmt.Errorf("unsupported vault version: %d (supported: 1-%d)", prefix.Version, CurrentVaultVersion)
+	}
+
+	// Check minimum file size (header + some encrypted data)
+	minSize := headerSize(prefix.Version) + 16 // header + minimal ciphertext
+	if fileInfo.Size() < minSize {
+		return fmt.Errorf("file too small to be a valid vault (minimum %d bytes, got %d)", minSize, fileInfo.Size())
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("file seek error: %w", err)
+	}
+
+	header, err := readVaultHeader(file)
+	if err != nil {
+		return fmt.Errorf("header read error: %w", err)
+	}
+
+	// Validate key slots and their key derivation parameters (should be reasonable)
+	if header.activeKeySlots() == 0 {
+		return fmt.Errorf("%w: no active key slots", ErrHeaderTampered)
+	}
+	for i := range header.KeySlots {
+		if !header.KeySlots[i].active() {
+			continue
+		}
+		if err := header.KeySlots[i].validate(); err != nil {
+			return fmt.Errorf("key slot %d: %w", i, err)
+		}
+	}
+
+	// The encrypted directory must fit in the file
+	if header.DirectorySize > uint64(fileInfo.Size()-header.encodedSize()) {
+		return fmt.Errorf("%w: directory size %d exceeds file size", ErrHeaderTampered, header.DirectorySize)
 	}
 
-	// Validate iteration count (should be reasonable)
-	if header.Iterations < 10000 || header.Iterations > 10000000 {
-		return fmt.Errorf("suspicious PBKDF2 iteration count: %d (expected: 10,000 - 10,000,000)", header.Iterations)
+	// Detect modified header fields before any key derivation (v3+)
+	if err := header.verifyChecksum(); err != nil {
+		// A header rewrite saves the new header first; the header may be torn by a crash
+		if _, statErr := os.Stat(headerCopyPath(path)); statErr == nil {
+			return fmt.Errorf("%w: header rewrite did not finish (%v)", ErrInterruptedWrite, err)
+		}
+		return err
 	}
 
 	return nil
@@ -17,7 +17,7 @@ func TestIsFlintVault(t *testing.T) {
 
 	// Тест 1: Валидный vault файл
 	vaultPath := filepath.Join(tmpDir, "test.vault")
-	err = CreateVault(vaultPath, "test123")
+	err = CreateVault(vaultPath, Password("test123"))
 	if err != nil {
 		t.Fatalf("Failed to create test vault: %v", err)
 	}
@@ -56,7 +56,7 @@ func TestIsFlintVault(t *testing.T) {
 	fakePath := filepath.Join(tmpDir, "fake.vault")
 	fakeHeader := VaultHeader{
 		Version:       CurrentVaultVersion,
-		Iterations:    PBKDF2Iters,
+		KeySlots:      [MaxKeySlots]KeySlot{{Kind: KeySlotPassword, Iterations: PBKDF2Iters}},
 		DirectorySize: 100,
 	}
 	copy(fakeHeader.Magic[:], "FAKE001") // Неправильный magic
@@ -106,7 +106,7 @@ func TestGetVaultInfo(t *testing.T) {
 
 	// Тест 1: Валидный vault файл
 	vaultPath := filepath.Join(tmpDir, "test.vault")
-	err = CreateVault(vaultPath, "test123")
+	err = CreateVault(vaultPath, Password("test123"))
 	if err != nil {
 		t.Fatalf("Failed to create test vault: %v", err)
 	}
@@ -176,7 +176,7 @@ func TestValidateVaultFile(t *testing.T) {
 
 	// Тест 1: Валидный vault файл
 	vaultPath := filepath.Join(tmpDir, "test.vault")
-	err = CreateVault(vaultPath, "test123")
+	err = CreateVault(vaultPath, Password("test123"))
 	if err != nil {
 		t.Fatalf("Failed to create test vault: %v", err)
 	}
@@ -209,7 +209,7 @@ func TestValidateVaultFile(t *testing.T) {
 	wrongMagicPath := filepath.Join(tmpDir, "wrong_magic.vault")
 	header := VaultHeader{
 		Version:       CurrentVaultVersion,
-		Iterations:    PBKDF2Iters,
+		KeySlots:      [MaxKeySlots]KeySlot{{Kind: KeySlotPassword, Iterations: PBKDF2Iters}},
 		DirectorySize: 100,
 	}
 	copy(header.Magic[:], "WRONG01")
@@ -242,7 +242,7 @@ func TestValidateVaultFile(t *testing.T) {
 	wrongVersionPath := filepath.Join(tmpDir, "wrong_version.vault")
 	header = VaultHeader{
 		Version:       999, // Неподдерживаемая версия
-		Iterations:    PBKDF2Iters,
+		KeySlots:      [MaxKeySlots]KeySlot{{Kind: KeySlotPassword, Iterations: PBKDF2Iters}},
 		DirectorySize: 100,
 	}
 	copy(header.Magic[:], VaultMagic)
@@ -273,7 +273,7 @@ func TestValidateVaultFile(t *testing.T) {
 	suspiciousIterPath := filepath.Join(tmpDir, "suspicious_iter.vault")
 	header = VaultHeader{
 		Version:       CurrentVaultVersion,
-		Iterations:    100, // Слишком мало итераций
+		KeySlots:      [MaxKeySlots]KeySlot{{Kind: KeySlotPassword, Iterations: 100}}, // Слишком мало итераций
 		DirectorySize: 100,
 	}
 	copy(header.Magic[:], VaultMagic)
@@ -310,7 +310,7 @@ func BenchmarkIsFlintVault(b *testing.B) {
 	defer os.RemoveAll(tmpDir)
 
 	vaultPath := filepath.Join(tmpDir, "bench.vault")
-	err = CreateVault(vaultPath, "benchmark123")
+	err = CreateVault(vaultPath, Password("benchmark123"))
 	if err != nil {
 		b.Fatalf("Failed to create vault: %v", err)
 	}
@@ -333,7 +333,7 @@ func BenchmarkGetVaultInfo(b *testing.B) {
 	defer os.RemoveAll(tmpDir)
 
 	vaultPath := filepath.Join(tmpDir, "bench.vault")
-	err = CreateVault(vaultPath, "benchmark123")
+	err = CreateVault(vaultPath, Password("benchmark123"))
 	if err != nil {
 		b.Fatalf("Failed to create vault: %v", err)
 	}
@@ -356,7 +356,7 @@ func BenchmarkValidateVaultFile(b *testing.B) {
 	defer os.RemoveAll(tmpDir)
 
 	vaultPath := filepath.Join(tmpDir, "bench.vault")
-	err = CreateVault(vaultPath, "benchmark123")
+	err = CreateVault(vaultPath, Password("benchmark123"))
 	if err != nil {
 		b.Fatalf("Failed to create vault: %v", err)
 	}
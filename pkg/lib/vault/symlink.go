@@ -0,0 +1,261 @@
+package vault
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ========================
+// SYMBOLIC LINKS
+// ========================
+//
+// By default a symbolic link inside an added tree is stored as its own entry with
+// its target and no payload. Following links instead stores what they point to;
+// loops and dangling links are reported rather than walked or skipped. The source
+// path itself is always followed, as with any other command.
+//
+// Link targets come from the vault directory and are not trusted on extraction:
+// they must be relative and stay inside the output directory, and links are
+// created after all files so nothing is written through a link from the vault.
+
+// SymlinkMode selects how symbolic links inside an added tree are stored
+type SymlinkMode int
+
+const (
+	// SymlinkPreserve stores each link as an entry holding its target (default)
+	SymlinkPreserve SymlinkMode = iota
+	// SymlinkFollow stores the files and directories links point to
+	SymlinkFollow
+)
+
+// AddOptions controls how files and directory trees are added to a vault
+type AddOptions struct {
+	Symlinks    SymlinkMode
+	Compression Compression
+
+	// SnapshotCheck compares the size and modification time of each file after
+	// reading it with those before, and fails files that keep changing with
+	// ErrSourceChanged instead of storing a torn copy
+	SnapshotCheck bool
+
+	// Context cancels the add; the write in progress is undone
+	Context context.Context
+}
+
+// sourceWalkFunc is called for every path of a source tree. For a preserved link
+// info describes the link itself and linkTarget holds its target.
+type sourceWalkFunc func(path string, info os.FileInfo, linkTarget string) error
+
+// walkSourceTree walks root in lexical order like filepath.Walk, handling links
+// according to mode
+func walkSourceTree(root string, mode SymlinkMode, fn sourceWalkFunc) error {
+	info, err := os.Stat(root)
+	if err != nil {
+		return err
+	}
+	return walkSourcePath(root, info, mode, nil, fn)
+}
+
+// walkSourcePath visits path and, for directories, its children. ancestors holds the
+// directories being walked, so a followed link back into one of them is a loop.
+func walkSourcePath(path string, info os.FileInfo, mode SymlinkMode, ancestors []os.FileInfo, fn sourceWalkFunc) error {
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(path)
+		if err != nil {
+			return fmt.Errorf("symlink read error: %w", err)
+		}
+		if mode == SymlinkPreserve {
+			return fn(path, info, target)
+		}
+
+		info, err = os.Stat(path)
+		if err != nil {
+			return fmt.Errorf("dangling symlink %s -> %s: %w", path, target, err)
+		}
+	}
+
+	if !info.IsDir() {
+		return fn(path, info, "")
+	}
+
+	for _, ancestor := range ancestors {
+		if os.SameFile(ancestor, info) {
+			return fmt.Errorf("symlink loop at %s", path)
+		}
+	}
+
+	if err := fn(path, info, ""); err != nil {
+		return err
+	}
+
+	children, err := os.ReadDir(path)
+	if err != nil {
+		return err
+	}
+
+	ancestors = append(ancestors, info)
+	for _, child := range children {
+		childPath := filepath.Join(path, child.Name())
+		childInfo, err := os.Lstat(childPath)
+		if err != nil {
+			return err
+		}
+		if err := walkSourcePath(childPath, childInfo, mode, ancestors, fn); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// isSymlink reports whether info describes a symbolic link
+func isSymlink(info os.FileInfo) bool {
+	return info.Mode()&os.ModeSymlink != 0
+}
+
+// isFile reports whether the entry is a regular file
+func (e FileEntry) isFile() bool {
+	return !e.IsDir && !e.IsSymlink
+}
+
+// hasPayload reports whether the entry has its file data in a single payload
+// (files of v4+ vaults are stored as chunks instead)
+func (e FileEntry) hasPayload() bool {
+	return e.isFile() && len(e.Chunks) == 0
+}
+
+// newSymlinkEntry creates the entry of a preserved link
+func newSymlinkEntry(storePath string, info os.FileInfo, target string) FileEntry {
+	return FileEntry{
+		Path:       storePath,
+		Name:       info.Name(),
+		IsSymlink:  true,
+		LinkTarget: filepath.ToSlash(target),
+		Mode:       uint32(info.Mode()),
+		ModTime:    info.ModTime(),
+	}
+}
+
+// addSymlinkEntry adds a symbolic link entry to the vault; the caller holds the
+// exclusive vault lock
+func (v *Vault) addSymlinkEntry(linkPath string, info os.FileInfo, target, basePath string) error {
+	storePath, err := storePathFor(basePath, linkPath)
+	if err != nil {
+		return err
+	}
+
+	return v.putEntry(newSymlinkEntry(storePath, info, target))
+}
+
+// checkLinkTarget rejects link targets that are absolute or resolve outside the output
+// directory. ".." is only allowed before the first named component, where it climbs
+// through the real directories above the link; after descending, a component may itself
+// be a link, and ".." would no longer mean what it says.
+func checkLinkTarget(entryPath, target string) error {
+	if err := checkRelativePath(target); err != nil {
+		return fmt.Errorf("link %q: %w", entryPath, err)
+	}
+
+	depth := strings.Count(entryPath, "/")
+	descending := false
+	for _, part := range strings.FieldsFunc(target, isPathSeparator) {
+		switch {
+		case part == ".":
+		case part == ".." && !descending:
+			if depth--; depth < 0 {
+				return fmt.Errorf("%w: link %q -> %q points outside the output directory", ErrUnsafePath, entryPath, target)
+			}
+		case part == "..":
+			return fmt.Errorf("%w: link %q -> %q climbs after descending", ErrUnsafePath, entryPath, target)
+		default:
+			descending = true
+		}
+	}
+	return nil
+}
+
+// checkSymlinkAncestors rejects entries that would be written through a link: a link
+// entry among the extracted entries or a link already in the output directory, or a
+// link entry with the entry's own path. A link already at the entry's own path is
+// replaced when the entry is extracted instead (see createOutputFile).
+// checked caches output directories known to contain no links.
+func checkSymlinkAncestors(outputDir string, entry FileEntry, links map[string]bool, checked map[string]bool) error {
+	entryPath := entry.Path
+	if !entry.IsSymlink && links[entryPath] {
+		return fmt.Errorf("%w: %q is also a link", ErrUnsafePath, entryPath)
+	}
+
+	dir := outputDir
+	parts := strings.Split(entryPath, "/")
+	for i, part := range parts[:len(parts)-1] {
+		if links[strings.Join(parts[:i+1], "/")] {
+			return fmt.Errorf("%w: %q is inside a link", ErrUnsafePath, entryPath)
+		}
+
+		dir = filepath.Join(dir, part)
+		if checked[dir] {
+			continue
+		}
+		info, err := os.Lstat(dir)
+		if err == nil && isSymlink(info) {
+			return fmt.Errorf("%w: %q is inside the existing link %s", ErrUnsafePath, entryPath, dir)
+		}
+		checked[dir] = true
+	}
+	return nil
+}
+
+// extractSymlinkEntry creates the link of an entry, replacing a link or file left at
+// its output path by an earlier extraction
+func extractSymlinkEntry(entry FileEntry, outputPath string) error {
+	if err := os.MkdirAll(filepath.Dir(outputPath), 0755); err != nil {
+		return fmt.Errorf("parent directory creation error: %w", err)
+	}
+
+	if info, err := os.Lstat(outputPath); err == nil {
+		if info.IsDir() {
+			return fmt.Errorf("symlink creation error: %s is a directory", outputPath)
+		}
+		if err := os.Remove(outputPath); err != nil {
+			return fmt.Errorf("symlink replace error: %w", err)
+		}
+	}
+
+	if err := os.Symlink(filepath.FromSlash(entry.LinkTarget), outputPath); err != nil {
+		return fmt.Errorf("symlink creation error: %w", err)
+	}
+	return nil
+}
+
+// createOutputFile creates the output file of an entry. Whatever is left at its path
+// by an earlier extraction is removed first, and the file is created exclusively, so
+// it is never written through a link, even one created in the meantime.
+func createOutputFile(outputPath string) (*os.File, error) {
+	if info, err := os.Lstat(outputPath); err == nil && !info.IsDir() {
+		if err := os.Remove(outputPath); err != nil {
+			return nil, fmt.Errorf("output file replace error: %w", err)
+		}
+	}
+
+	file, err := os.OpenFile(outputPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("output file creation error: %w", err)
+	}
+	return file, nil
+}
+
+// extractSymlinks creates the links among entries once all other entries are written
+func extractSymlinks(entries []FileEntry, outputPaths []string) error {
+	for i, entry := range entries {
+		if !entry.IsSymlink {
+			continue
+		}
+		if err := extractSymlinkEntry(entry, outputPaths[i]); err != nil {
+			return fmt.Errorf("file extraction error for %s: %w", entry.Path, err)
+		}
+	}
+	return nil
+}
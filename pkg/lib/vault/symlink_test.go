@@ -0,0 +1,322 @@
+package vault
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// createSymlinkTree создаёт каталог с файлом, ссылками на файл и каталог и внешней ссылкой
+func createSymlinkTree(t *testing.T, dir string) string {
+	t.Helper()
+
+	root := filepath.Join(dir, "tree")
+	if err := os.MkdirAll(filepath.Join(root, "lib", "v1"), 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	createTestFile(t, filepath.Join(root, "lib", "v1"), "lib.so", "library data")
+	for link, target := range map[string]string{
+		"lib/current":     "v1",
+		"lib/current.so":  "v1/lib.so",
+		"lib/v1/root.txt": "../../readme.txt",
+	} {
+		if err := os.Symlink(target, filepath.Join(root, filepath.FromSlash(link))); err != nil {
+			t.Fatalf("Failed to create symlink: %v", err)
+		}
+	}
+	createTestFile(t, root, "readme.txt", testContent)
+	return root
+}
+
+// TestSymlinkPreserve тестирует сохранение и восстановление ссылок
+func TestSymlinkPreserve(t *testing.T) {
+	tmpDir := setupCoreTest(t)
+	defer cleanupCoreTest(t, tmpDir)
+
+	root := createSymlinkTree(t, tmpDir)
+
+	add := map[string]func(vaultPath string) error{
+		"sequential": func(vaultPath string) error {
+			return AddDirectoryToVault(vaultPath, Password(testPassword), root)
+		},
+		"parallel": func(vaultPath string) error {
+			_, err := AddDirectoryToVaultParallel(vaultPath, Password(testPassword), root, DefaultParallelConfig())
+			return err
+		},
+		"append": func(vaultPath string) error {
+			return AppendToVault(vaultPath, root)
+		},
+	}
+
+	for name, addTree := range add {
+		t.Run(name, func(t *testing.T) {
+			vaultPath := filepath.Join(tmpDir, name+".vault")
+			if err := CreateVaultWithKDF(vaultPath, Password(testPassword), testArgon2Params); err != nil {
+				t.Fatalf("CreateVaultWithKDF failed: %v", err)
+			}
+			if err := addTree(vaultPath); err != nil {
+				t.Fatalf("Adding tree failed: %v", err)
+			}
+
+			entries, err := ListVault(vaultPath, Password(testPassword))
+			if err != nil {
+				t.Fatalf("ListVault failed: %v", err)
+			}
+			links := make(map[string]string)
+			for _, entry := range entries {
+				if entry.IsSymlink {
+					links[entry.Path] = entry.LinkTarget
+					if entry.Size != 0 || entry.CompressedSize != 0 {
+						t.Errorf("Link %s must not have a payload", entry.Path)
+					}
+				}
+			}
+			if len(entries) != 8 || len(links) != 3 || links["tree/lib/current"] != "v1" {
+				t.Fatalf("Unexpected entries: %d entries, links %v", len(entries), links)
+			}
+
+			outputDir := filepath.Join(tmpDir, name+"-output")
+			if err := ExtractFromVault(vaultPath, Password(testPassword), outputDir); err != nil {
+				t.Fatalf("ExtractFromVault failed: %v", err)
+			}
+			for link, target := range links {
+				actual, err := os.Readlink(filepath.Join(outputDir, filepath.FromSlash(link)))
+				if err != nil || actual != filepath.FromSlash(target) {
+					t.Errorf("Link %s: expected target %s, got %q (%v)", link, target, actual, err)
+				}
+			}
+			for _, path := range []string{"tree/lib/current/lib.so", "tree/lib/current.so"} {
+				content, err := os.ReadFile(filepath.Join(outputDir, filepath.FromSlash(path)))
+				if err != nil || string(content) != "library data" {
+					t.Errorf("Reading through %s failed: %v", path, err)
+				}
+			}
+
+			// Повторное извлечение заменяет ссылки
+			if err := ExtractFromVault(vaultPath, Password(testPassword), outputDir); err != nil {
+				t.Fatalf("Repeated ExtractFromVault failed: %v", err)
+			}
+		})
+	}
+}
+
+// TestSymlinkFollow тестирует добавление содержимого, на которое указывают ссылки
+func TestSymlinkFollow(t *testing.T) {
+	tmpDir := setupCoreTest(t)
+	defer cleanupCoreTest(t, tmpDir)
+
+	root := createSymlinkTree(t, tmpDir)
+	vaultPath := filepath.Join(tmpDir, "follow.vault")
+	if err := CreateVaultWithKDF(vaultPath, Password(testPassword), testArgon2Params); err != nil {
+		t.Fatalf("CreateVaultWithKDF failed: %v", err)
+	}
+	if err := AddDirectoryToVaultWithOptions(vaultPath, Password(testPassword), root, AddOptions{Symlinks: SymlinkFollow}); err != nil {
+		t.Fatalf("AddDirectoryToVaultWithOptions failed: %v", err)
+	}
+
+	entries, err := ListVault(vaultPath, Password(testPassword))
+	if err != nil {
+		t.Fatalf("ListVault failed: %v", err)
+	}
+	found := make(map[string]FileEntry)
+	for _, entry := range entries {
+		if entry.IsSymlink {
+			t.Errorf("Unexpected link entry %s", entry.Path)
+		}
+		found[entry.Path] = entry
+	}
+	if !found["tree/lib/current"].IsDir || found["tree/lib/current/lib.so"].Size != int64(len("library data")) {
+		t.Errorf("Linked directory was not followed: %v", found)
+	}
+	if found["tree/lib/v1/root.txt"].Size != int64(len(testContent)) {
+		t.Error("Linked file was not followed")
+	}
+
+	// Циклы и битые ссылки являются ошибками
+	loopDir := filepath.Join(tmpDir, "loop")
+	if err := os.MkdirAll(filepath.Join(loopDir, "sub"), 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if err := os.Symlink("..", filepath.Join(loopDir, "sub", "up")); err != nil {
+		t.Fatalf("Failed to create symlink: %v", err)
+	}
+	config := DefaultParallelConfig()
+	config.Symlinks = SymlinkFollow
+	if _, err := AddDirectoryToVaultParallel(vaultPath, Password(testPassword), loopDir, config); err == nil {
+		t.Error("Expected error for symlink loop")
+	}
+
+	danglingDir := filepath.Join(tmpDir, "dangling")
+	if err := os.MkdirAll(danglingDir, 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if err := os.Symlink("missing.txt", filepath.Join(danglingDir, "broken")); err != nil {
+		t.Fatalf("Failed to create symlink: %v", err)
+	}
+	if err := AddDirectoryToVaultWithOptions(vaultPath, Password(testPassword), danglingDir, AddOptions{Symlinks: SymlinkFollow}); err == nil {
+		t.Error("Expected error for dangling symlink")
+	}
+
+	// По умолчанию и цикл, и битая ссылка сохраняются как ссылки
+	if err := AddDirectoryToVault(vaultPath, Password(testPassword), loopDir); err != nil {
+		t.Errorf("AddDirectoryToVault (loop) failed: %v", err)
+	}
+	if err := AddDirectoryToVault(vaultPath, Password(testPassword), danglingDir); err != nil {
+		t.Errorf("AddDirectoryToVault (dangling) failed: %v", err)
+	}
+}
+
+// TestCheckLinkTarget тестирует проверку целей ссылок
+func TestCheckLinkTarget(t *testing.T) {
+	safe := map[string]string{
+		"link":       "file.txt",
+		"a/link":     "../file.txt",
+		"a/b/link":   "../../c/./file.txt",
+		"a/link2":    "./b/c",
+		"a/b/c/link": "../..",
+	}
+	for entryPath, target := range safe {
+		if err := checkLinkTarget(entryPath, target); err != nil {
+			t.Errorf("checkLinkTarget(%q, %q) failed: %v", entryPath, target, err)
+		}
+	}
+
+	unsafe := map[string]string{
+		"link":    "../file.txt",
+		"a/link":  "../../file.txt",
+		"a/link2": "/etc/passwd",
+		"a/link3": "b/../../..",
+		"a/link4": "b/..",
+		"a/link5": `..\..\file.txt`,
+		"a/link6": "C:/Windows",
+		"a/link7": "",
+	}
+	for entryPath, target := range unsafe {
+		if err := checkLinkTarget(entryPath, target); !errors.Is(err, ErrUnsafePath) {
+			t.Errorf("checkLinkTarget(%q, %q): expected ErrUnsafePath, got %v", entryPath, target, err)
+		}
+	}
+}
+
+// TestExtractRejectsUnsafeSymlinks тестирует извлечение ссылок, ведущих за пределы каталога
+func TestExtractRejectsUnsafeSymlinks(t *testing.T) {
+	tests := map[string][]FileEntry{
+		"absolute target": {{Path: "link", IsSymlink: true, LinkTarget: "/etc"}},
+		"escaping target": {{Path: "dir/link", IsSymlink: true, LinkTarget: "../../outside"}},
+		"file inside link": {
+			{Path: "link", IsSymlink: true, LinkTarget: "dir"},
+			{Path: "link/file0.txt"},
+		},
+		"file at link path": {
+			{Path: "link", IsSymlink: true, LinkTarget: "dir"},
+			{Path: "link"},
+		},
+	}
+
+	for name, crafted := range tests {
+		t.Run(name, func(t *testing.T) {
+			tmpDir := setupCoreTest(t)
+			defer cleanupCoreTest(t, tmpDir)
+
+			paths := make([]string, len(crafted))
+			for i := range crafted {
+				paths[i] = crafted[i].Path
+			}
+			vaultPath := createMaliciousVault(t, tmpDir, paths)
+
+			vaultDir, err := loadVaultDirectory(vaultPath, Password(testPassword))
+			if err != nil {
+				t.Fatalf("loadVaultDirectory failed: %v", err)
+			}
+			for i := range crafted {
+				if crafted[i].IsSymlink {
+					vaultDir.Entries[i] = crafted[i]
+				}
+			}
+			if err := updateVaultDirectory(vaultPath, Password(testPassword), *vaultDir); err != nil {
+				t.Fatalf("updateVaultDirectory failed: %v", err)
+			}
+
+			outputDir := filepath.Join(tmpDir, "output")
+			if err := ExtractFromVault(vaultPath, Password(testPassword), outputDir); !errors.Is(err, ErrUnsafePath) {
+				t.Fatalf("ExtractFromVault: expected ErrUnsafePath, got %v", err)
+			}
+			// Выборка по путям берёт одну запись на путь, поэтому совпадающих путей в ней нет
+			if name != "file at link path" {
+				if _, err := ExtractMultipleFilesFromVaultParallel(vaultPath, Password(testPassword), outputDir, paths, DefaultParallelConfig()); !errors.Is(err, ErrUnsafePath) {
+					t.Fatalf("ExtractMultipleFilesFromVaultParallel: expected ErrUnsafePath, got %v", err)
+				}
+			}
+			if _, err := os.Stat(outputDir); !os.IsNotExist(err) {
+				t.Error("Output directory must not be created for a rejected vault")
+			}
+		})
+	}
+}
+
+// TestExtractRejectsExistingSymlinks тестирует запись через ссылку в выходном каталоге
+func TestExtractRejectsExistingSymlinks(t *testing.T) {
+	tmpDir := setupCoreTest(t)
+	defer cleanupCoreTest(t, tmpDir)
+
+	vaultPath := createMaliciousVault(t, tmpDir, []string{"dir/file.txt"})
+
+	outsideDir := filepath.Join(tmpDir, "outside")
+	outputDir := filepath.Join(tmpDir, "output")
+	if err := os.MkdirAll(outsideDir, 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if err := os.Symlink(outsideDir, filepath.Join(outputDir, "dir")); err != nil {
+		t.Fatalf("Failed to create symlink: %v", err)
+	}
+
+	if err := GetFromVault(vaultPath, Password(testPassword), outputDir, []string{"dir/file.txt"}); !errors.Is(err, ErrUnsafePath) {
+		t.Fatalf("GetFromVault: expected ErrUnsafePath, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(outsideDir, "file.txt")); err == nil {
+		t.Error("File was written through an existing symlink")
+	}
+}
+
+// TestExtractReplacesExistingLeafSymlink тестирует извлечение файла на место существующей ссылки
+func TestExtractReplacesExistingLeafSymlink(t *testing.T) {
+	tmpDir := setupCoreTest(t)
+	defer cleanupCoreTest(t, tmpDir)
+
+	vaultPath := createMaliciousVault(t, tmpDir, []string{"file.txt"})
+
+	outsideFile := filepath.Join(tmpDir, "outside.txt")
+	outputDir := filepath.Join(tmpDir, "output")
+	if err := os.WriteFile(outsideFile, []byte("outside"), 0644); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if err := os.Symlink(outsideFile, filepath.Join(outputDir, "file.txt")); err != nil {
+		t.Fatalf("Failed to create symlink: %v", err)
+	}
+
+	if err := ExtractFromVault(vaultPath, Password(testPassword), outputDir); err != nil {
+		t.Fatalf("ExtractFromVault failed: %v", err)
+	}
+	if content := mustReadFile(t, outsideFile); string(content) != "outside" {
+		t.Errorf("File was written through an existing symlink: %q", content)
+	}
+
+	extracted := filepath.Join(outputDir, "file.txt")
+	info, err := os.Lstat(extracted)
+	if err != nil {
+		t.Fatalf("Failed to stat extracted file: %v", err)
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		t.Fatal("Existing symlink was not replaced by the extracted file")
+	}
+	if content := mustReadFile(t, extracted); string(content) != "payload file0.txt" {
+		t.Errorf("Extracted content mismatch: %q", content)
+	}
+}
@@ -31,12 +31,12 @@ func TestCompleteWorkflow(t *testing.T) {
 	vaultPath := filepath.Join(tmpDir, "integration.vault")
 
 	// 1. Создание vault
-	if err := CreateVault(vaultPath, integrationTestPassword); err != nil {
+	if err := CreateVault(vaultPath, Password(integrationTestPassword)); err != nil {
 		t.Fatalf("CreateVault failed: %v", err)
 	}
 
 	// 2. Проверка пустого vault
-	entries, err := ListVault(vaultPath, integrationTestPassword)
+	entries, err := ListVault(vaultPath, Password(integrationTestPassword))
 	if err != nil {
 		t.Fatalf("ListVault failed: %v", err)
 	}
@@ -48,15 +48,15 @@ func TestCompleteWorkflow(t *testing.T) {
 	file1 := createTestFile(t, tmpDir, "document.txt", "Important document content")
 	file2 := createTestFile(t, tmpDir, "config.json", `{"setting": "value"}`)
 
-	if err := AddFileToVault(vaultPath, integrationTestPassword, file1); err != nil {
+	if err := AddFileToVault(vaultPath, Password(integrationTestPassword), file1); err != nil {
 		t.Fatalf("AddFileToVault failed for file1: %v", err)
 	}
-	if err := AddFileToVault(vaultPath, integrationTestPassword, file2); err != nil {
+	if err := AddFileToVault(vaultPath, Password(integrationTestPassword), file2); err != nil {
 		t.Fatalf("AddFileToVault failed for file2: %v", err)
 	}
 
 	// 4. Проверка списка файлов
-	entries, err = ListVault(vaultPath, integrationTestPassword)
+	entries, err = ListVault(vaultPath, Password(integrationTestPassword))
 	if err != nil {
 		t.Fatalf("ListVault failed: %v", err)
 	}
@@ -66,23 +66,23 @@ func TestCompleteWorkflow(t *testing.T) {
 
 	// 5. Селективное извлечение
 	outputDir1 := filepath.Join(tmpDir, "selective_output")
-	if err := GetFromVault(vaultPath, integrationTestPassword, outputDir1, []string{entries[0].Path}); err != nil {
+	if err := GetFromVault(vaultPath, Password(integrationTestPassword), outputDir1, []string{entries[0].Path}); err != nil {
 		t.Fatalf("GetFromVault failed: %v", err)
 	}
 
 	// 6. Полное извлечение
 	outputDir2 := filepath.Join(tmpDir, "full_output")
-	if err := ExtractFromVault(vaultPath, integrationTestPassword, outputDir2); err != nil {
+	if err := ExtractFromVault(vaultPath, Password(integrationTestPassword), outputDir2); err != nil {
 		t.Fatalf("ExtractFromVault failed: %v", err)
 	}
 
 	// 7. Удаление одного файла
-	if err := RemoveFromVault(vaultPath, integrationTestPassword, []string{entries[0].Path}); err != nil {
+	if err := RemoveFromVault(vaultPath, Password(integrationTestPassword), []string{entries[0].Path}); err != nil {
 		t.Fatalf("RemoveFromVault failed: %v", err)
 	}
 
 	// 8. Проверка что файл удалён
-	entries, err = ListVault(vaultPath, integrationTestPassword)
+	entries, err = ListVault(vaultPath, Password(integrationTestPassword))
 	if err != nil {
 		t.Fatalf("ListVault failed: %v", err)
 	}
@@ -105,11 +105,11 @@ func TestPasswordSecurity(t *testing.T) {
 
 	// Тест 1: Создание с сильным паролем
 	strongPassword := "VeryStrongPassword123!@#$%^&*()"
-	if err := CreateVault(vaultPath, strongPassword); err != nil {
+	if err := CreateVault(vaultPath, Password(strongPassword)); err != nil {
 		t.Fatalf("CreateVault failed with strong password: %v", err)
 	}
 
-	if err := AddFileToVault(vaultPath, strongPassword, testFile); err != nil {
+	if err := AddFileToVault(vaultPath, Password(strongPassword), testFile); err != nil {
 		t.Fatalf("AddFileToVault failed: %v", err)
 	}
 
@@ -123,14 +123,14 @@ func TestPasswordSecurity(t *testing.T) {
 	}
 
 	for i, wrongPass := range wrongPasswords {
-		_, err := ListVault(vaultPath, wrongPass)
+		_, err := ListVault(vaultPath, Password(wrongPass))
 		if err == nil {
 			t.Errorf("Test %d: Expected error with wrong password '%s'", i+1, wrongPass)
 		}
 	}
 
 	// Тест 3: Правильный пароль должен работать
-	entries, err := ListVault(vaultPath, strongPassword)
+	entries, err := ListVault(vaultPath, Password(strongPassword))
 	if err != nil {
 		t.Fatalf("ListVault failed with correct password: %v", err)
 	}
@@ -160,7 +160,7 @@ func TestPasswordComplexity(t *testing.T) {
 	for i, test := range testPasswords {
 		vaultPath := filepath.Join(tmpDir, "vault_"+string(rune('a'+i))+".vault")
 
-		err := CreateVault(vaultPath, test.password)
+		err := CreateVault(vaultPath, Password(test.password))
 
 		if test.valid && err != nil {
 			t.Errorf("Test '%s': Expected success but got error: %v", test.name, err)
@@ -186,13 +186,13 @@ func TestLargeFileHandling(t *testing.T) {
 	largeFile := createTestFile(t, tmpDir, "large.txt", largeContent)
 
 	// Создаём vault
-	if err := CreateVault(vaultPath, integrationTestPassword); err != nil {
+	if err := CreateVault(vaultPath, Password(integrationTestPassword)); err != nil {
 		t.Fatalf("CreateVault failed: %v", err)
 	}
 
 	// Измеряем время добавления
 	start := time.Now()
-	if err := AddFileToVault(vaultPath, integrationTestPassword, largeFile); err != nil {
+	if err := AddFileToVault(vaultPath, Password(integrationTestPassword), largeFile); err != nil {
 		t.Fatalf("AddFileToVault failed for large file: %v", err)
 	}
 	addDuration := time.Since(start)
@@ -200,13 +200,13 @@ func TestLargeFileHandling(t *testing.T) {
 	// Измеряем время извлечения
 	outputDir := filepath.Join(tmpDir, "large_output")
 	start = time.Now()
-	if err := ExtractFromVault(vaultPath, integrationTestPassword, outputDir); err != nil {
+	if err := ExtractFromVault(vaultPath, Password(integrationTestPassword), outputDir); err != nil {
 		t.Fatalf("ExtractFromVault failed for large file: %v", err)
 	}
 	extractDuration := time.Since(start)
 
 	// Проверяем целостность
-	entries, err := ListVault(vaultPath, integrationTestPassword)
+	entries, err := ListVault(vaultPath, Password(integrationTestPassword))
 	if err != nil {
 		t.Fatalf("ListVault failed: %v", err)
 	}
@@ -243,7 +243,7 @@ func TestSpecialCharacterFiles(t *testing.T) {
 
 	vaultPath := filepath.Join(tmpDir, "special.vault")
 
-	if err := CreateVault(vaultPath, integrationTestPassword); err != nil {
+	if err := CreateVault(vaultPath, Password(integrationTestPassword)); err != nil {
 		t.Fatalf("CreateVault failed: %v", err)
 	}
 
@@ -262,14 +262,14 @@ func TestSpecialCharacterFiles(t *testing.T) {
 	for _, file := range specialFiles {
 		filePath := createTestFile(t, tmpDir, file.name, file.content)
 
-		if err := AddFileToVault(vaultPath, integrationTestPassword, filePath); err != nil {
+		if err := AddFileToVault(vaultPath, Password(integrationTestPassword), filePath); err != nil {
 			t.Errorf("Failed to add file '%s': %v", file.name, err)
 			continue
 		}
 	}
 
 	// Проверяем что все файлы добавлены
-	entries, err := ListVault(vaultPath, integrationTestPassword)
+	entries, err := ListVault(vaultPath, Password(integrationTestPassword))
 	if err != nil {
 		t.Fatalf("ListVault failed: %v", err)
 	}
@@ -280,7 +280,7 @@ func TestSpecialCharacterFiles(t *testing.T) {
 
 	// Извлекаем и проверяем содержимое
 	outputDir := filepath.Join(tmpDir, "special_output")
-	if err := ExtractFromVault(vaultPath, integrationTestPassword, outputDir); err != nil {
+	if err := ExtractFromVault(vaultPath, Password(integrationTestPassword), outputDir); err != nil {
 		t.Fatalf("ExtractFromVault failed: %v", err)
 	}
 
@@ -300,17 +300,17 @@ func TestEmptyFiles(t *testing.T) {
 	vaultPath := filepath.Join(tmpDir, "empty.vault")
 	emptyFile := createTestFile(t, tmpDir, "empty.txt", "")
 
-	if err := CreateVault(vaultPath, integrationTestPassword); err != nil {
+	if err := CreateVault(vaultPath, Password(integrationTestPassword)); err != nil {
 		t.Fatalf("CreateVault failed: %v", err)
 	}
 
 	// Добавляем пустой файл
-	if err := AddFileToVault(vaultPath, integrationTestPassword, emptyFile); err != nil {
+	if err := AddFileToVault(vaultPath, Password(integrationTestPassword), emptyFile); err != nil {
 		t.Fatalf("AddFileToVault failed for empty file: %v", err)
 	}
 
 	// Проверяем что файл добавлен
-	entries, err := ListVault(vaultPath, integrationTestPassword)
+	entries, err := ListVault(vaultPath, Password(integrationTestPassword))
 	if err != nil {
 		t.Fatalf("ListVault failed: %v", err)
 	}
@@ -325,7 +325,7 @@ func TestEmptyFiles(t *testing.T) {
 
 	// Извлекаем и проверяем
 	outputDir := filepath.Join(tmpDir, "empty_output")
-	if err := ExtractFromVault(vaultPath, integrationTestPassword, outputDir); err != nil {
+	if err := ExtractFromVault(vaultPath, Password(integrationTestPassword), outputDir); err != nil {
 		t.Fatalf("ExtractFromVault failed: %v", err)
 	}
 
@@ -351,7 +351,7 @@ func TestCompressionEfficiency(t *testing.T) {
 
 	vaultPath := filepath.Join(tmpDir, "compression.vault")
 
-	if err := CreateVault(vaultPath, integrationTestPassword); err != nil {
+	if err := CreateVault(vaultPath, Password(integrationTestPassword)); err != nil {
 		t.Fatalf("CreateVault failed: %v", err)
 	}
 
@@ -359,7 +359,7 @@ func TestCompressionEfficiency(t *testing.T) {
 	compressibleContent := strings.Repeat("AAAAAAAAAA", 1000) // 10KB повторяющихся данных
 	compressibleFile := createTestFile(t, tmpDir, "compressible.txt", compressibleContent)
 
-	if err := AddFileToVault(vaultPath, integrationTestPassword, compressibleFile); err != nil {
+	if err := AddFileToVault(vaultPath, Password(integrationTestPassword), compressibleFile); err != nil {
 		t.Fatalf("AddFileToVault failed: %v", err)
 	}
 
@@ -370,12 +370,12 @@ func TestCompressionEfficiency(t *testing.T) {
 	}
 	randomFile := createTestFile(t, tmpDir, "random.txt", randomContent)
 
-	if err := AddFileToVault(vaultPath, integrationTestPassword, randomFile); err != nil {
+	if err := AddFileToVault(vaultPath, Password(integrationTestPassword), randomFile); err != nil {
 		t.Fatalf("AddFileToVault failed: %v", err)
 	}
 
 	// Проверяем результаты сжатия
-	entries, err := ListVault(vaultPath, integrationTestPassword)
+	entries, err := ListVault(vaultPath, Password(integrationTestPassword))
 	if err != nil {
 		t.Fatalf("ListVault failed: %v", err)
 	}
@@ -410,7 +410,7 @@ func TestManySmallFiles(t *testing.T) {
 
 	vaultPath := filepath.Join(tmpDir, "many_files.vault")
 
-	if err := CreateVault(vaultPath, integrationTestPassword); err != nil {
+	if err := CreateVault(vaultPath, Password(integrationTestPassword)); err != nil {
 		t.Fatalf("CreateVault failed: %v", err)
 	}
 
@@ -421,13 +421,13 @@ func TestManySmallFiles(t *testing.T) {
 		content := "Small file content " + string(rune('0'+i%10))
 		filePath := createTestFile(t, tmpDir, fileName, content)
 
-		if err := AddFileToVault(vaultPath, integrationTestPassword, filePath); err != nil {
+		if err := AddFileToVault(vaultPath, Password(integrationTestPassword), filePath); err != nil {
 			t.Fatalf("AddFileToVault failed for file %d: %v", i, err)
 		}
 	}
 
 	// Проверяем что все файлы добавлены
-	entries, err := ListVault(vaultPath, integrationTestPassword)
+	entries, err := ListVault(vaultPath, Password(integrationTestPassword))
 	if err != nil {
 		t.Fatalf("ListVault failed: %v", err)
 	}
@@ -438,7 +438,7 @@ func TestManySmallFiles(t *testing.T) {
 
 	// Извлекаем все файлы
 	outputDir := filepath.Join(tmpDir, "many_output")
-	if err := ExtractFromVault(vaultPath, integrationTestPassword, outputDir); err != nil {
+	if err := ExtractFromVault(vaultPath, Password(integrationTestPassword), outputDir); err != nil {
 		t.Fatalf("ExtractFromVault failed: %v", err)
 	}
 
@@ -469,14 +469,14 @@ func BenchmarkCompleteWorkflow(b *testing.B) {
 		ioutil.WriteFile(testFile, []byte(largeFileContent), 0644)
 
 		// Создаём vault
-		CreateVault(vaultPath, integrationTestPassword)
+		CreateVault(vaultPath, Password(integrationTestPassword))
 
 		// Добавляем файл
-		AddFileToVault(vaultPath, integrationTestPassword, testFile)
+		AddFileToVault(vaultPath, Password(integrationTestPassword), testFile)
 
 		// Извлекаем файл
 		outputDir := filepath.Join(tmpDir, "bench_output_"+string(rune('a'+i)))
-		ExtractFromVault(vaultPath, integrationTestPassword, outputDir)
+		ExtractFromVault(vaultPath, Password(integrationTestPassword), outputDir)
 	}
 }
 
@@ -486,13 +486,13 @@ func BenchmarkMultipleFileOperations(b *testing.B) {
 	defer os.RemoveAll(tmpDir)
 
 	vaultPath := filepath.Join(tmpDir, "bench_multi.vault")
-	CreateVault(vaultPath, integrationTestPassword)
+	CreateVault(vaultPath, Password(integrationTestPassword))
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
 		testFile := filepath.Join(tmpDir, "bench_file_"+string(rune('a'+i%26))+".txt")
 		ioutil.WriteFile(testFile, []byte("Benchmark content "+string(rune('a'+i%26))), 0644)
 
-		AddFileToVault(vaultPath, integrationTestPassword, testFile)
+		AddFileToVault(vaultPath, Password(integrationTestPassword), testFile)
 	}
 }